@@ -0,0 +1,123 @@
+package diskcache
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// Export writes all entries in the cache fs to w as a tarball.
+//
+// When a key prefix is set, only entries under the prefix are exported, and
+// entry names are relative to the prefix.
+func (c *Cache) Export(w io.Writer) error {
+	if !c.life.acquire() {
+		return ErrClosed
+	}
+	defer c.life.release()
+	root := c.root()
+	tw := tar.NewWriter(w)
+	err := afero.Walk(c.fs, root, func(name string, fi fs.FileInfo, err error) error {
+		switch {
+		case err != nil && name == root && errors.Is(err, fs.ErrNotExist):
+			return nil
+		case err != nil:
+			return err
+		case !fi.IsDir() && !fi.Mode().IsRegular():
+			return nil
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, root), "/")
+		if rel == "" || rel == "." {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if fi.IsDir() {
+			hdr.Name += "/"
+			return tw.WriteHeader(hdr)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := c.fs.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Import extracts the tarball read from r into the cache fs, preserving
+// modification times of extracted entries.
+//
+// When a key prefix is set, entries are extracted under the prefix. Entries
+// with absolute names or names outside of the cache fs are rejected.
+func (c *Cache) Import(r io.Reader) error {
+	if !c.life.acquire() {
+		return ErrClosed
+	}
+	defer c.life.release()
+	root := c.root()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil
+		case err != nil:
+			return err
+		}
+		clean := path.Clean(hdr.Name)
+		if path.IsAbs(hdr.Name) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("invalid tar entry name %q", hdr.Name)
+		}
+		name := path.Join(root, clean)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := c.fs.MkdirAll(name, c.dirMode); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := c.fs.MkdirAll(path.Dir(name), c.dirMode); err != nil {
+				return err
+			}
+			f, err := c.fs.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, c.fileMode)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+		if err := c.fs.Chtimes(name, hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+		if c.index != nil && hdr.Typeflag == tar.TypeReg {
+			if err := c.index.update(c.fs, name); err != nil {
+				return err
+			}
+		}
+	}
+}
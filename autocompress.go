@@ -0,0 +1,121 @@
+package diskcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+// codecMagic is the prefix of the codec marker line of entries stored with a
+// marshaler chosen by WithAutoCompression.
+const codecMagic = "DISKCACHE-CODEC "
+
+// codecRule is an auto compression rule.
+type codecRule struct {
+	pattern string
+	g       glob.Glob
+	m       MarshalUnmarshaler
+}
+
+// newCodecRules creates the auto compression rules, ordered from the most to
+// the least specific (longest) content type glob.
+func newCodecRules(rules map[string]MarshalUnmarshaler) ([]codecRule, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("auto compression rules cannot be empty")
+	}
+	var v []codecRule
+	for pattern, m := range rules {
+		if pattern == "" || strings.ContainsAny(pattern, "\r\n") {
+			return nil, fmt.Errorf("invalid auto compression content type %q", pattern)
+		}
+		if _, ok := m.(FlatMarshalUnmarshaler); ok {
+			return nil, fmt.Errorf("auto compression content type %q cannot use a FlatMarshalUnmarshaler", pattern)
+		}
+		g, err := glob.Compile(strings.ToLower(pattern), '/')
+		if err != nil {
+			return nil, err
+		}
+		v = append(v, codecRule{pattern: pattern, g: g, m: m})
+	}
+	sort.Slice(v, func(i, j int) bool {
+		if len(v[i].pattern) != len(v[j].pattern) {
+			return len(v[i].pattern) > len(v[j].pattern)
+		}
+		return v[i].pattern < v[j].pattern
+	})
+	return v, nil
+}
+
+// codecMarshaler returns the marshaler for the response's content type from
+// the auto compression rules. Returns false when no rule matches.
+func (c *Cache) codecMarshaler(res *http.Response) (MarshalUnmarshaler, bool) {
+	typ, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	for _, rule := range c.codecRules {
+		if rule.g.Match(typ) {
+			if rule.m == nil {
+				return nil, true
+			}
+			return codecMarshalUnmarshaler{pattern: rule.pattern, m: rule.m}, true
+		}
+	}
+	return nil, false
+}
+
+// codecUnmarshaler returns the unmarshaler for an entry with the codec marker
+// line in buf.
+func (c *Cache) codecUnmarshaler(buf []byte) MarshalUnmarshaler {
+	line, _, _ := bytes.Cut(buf[len(codecMagic):], []byte("\n"))
+	pattern := string(line)
+	for _, rule := range c.codecRules {
+		if rule.pattern == pattern {
+			return codecMarshalUnmarshaler{pattern: pattern, m: rule.m}
+		}
+	}
+	return codecMarshalUnmarshaler{pattern: pattern}
+}
+
+// codecMarshalUnmarshaler wraps a marshaler, prefixing marshaled entries with
+// a codec marker line identifying the auto compression rule.
+type codecMarshalUnmarshaler struct {
+	pattern string
+	m       MarshalUnmarshaler
+}
+
+// Marshal satisfies the MarshalUnmarshaler interface.
+func (z codecMarshalUnmarshaler) Marshal(w io.Writer, r io.Reader) error {
+	return z.MarshalURL(w, r, "")
+}
+
+// MarshalURL satisfies the URLMarshaler interface.
+func (z codecMarshalUnmarshaler) MarshalURL(w io.Writer, r io.Reader, urlstr string) error {
+	if _, err := io.WriteString(w, codecMagic+z.pattern+"\n"); err != nil {
+		return err
+	}
+	if m, ok := z.m.(URLMarshaler); ok {
+		return m.MarshalURL(w, r, urlstr)
+	}
+	return z.m.Marshal(w, r)
+}
+
+// Unmarshal satisfies the MarshalUnmarshaler interface.
+func (z codecMarshalUnmarshaler) Unmarshal(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	switch {
+	case err != nil:
+		return err
+	case line != codecMagic+z.pattern+"\n":
+		return fmt.Errorf("invalid codec marker %q", strings.TrimSpace(line))
+	case z.m == nil:
+		return fmt.Errorf("no auto compression rule for content type %q", z.pattern)
+	}
+	return z.m.Unmarshal(w, br)
+}
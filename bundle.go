@@ -0,0 +1,144 @@
+package diskcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// bundleDir is the directory for bundle sidecar files.
+const bundleDir = "?bundle"
+
+// bundleName returns the fs name of the bundle sidecar file for the fs name.
+func (c *Cache) bundleName(name string) string {
+	root := c.root()
+	return path.Join(root, bundleDir, strings.TrimPrefix(name, root))
+}
+
+// StoreBundle fetches and stores the main request and the extra requests as
+// a bundle, such as a HTML page and its critical CSS and JavaScript. The
+// extra requests are recorded with the main request's entry, and are loaded
+// together with the main request by LoadBundle. Fresh entries are not
+// refetched. Returns an error, without recording the bundle, when the main
+// response was not stored.
+//
+// Only the method and URL of extra requests are recorded.
+func (c *Cache) StoreBundle(main *http.Request, extra ...*http.Request) error {
+	if !c.life.acquire() {
+		return ErrClosed
+	}
+	defer c.life.release()
+	if err := c.serveDiscard(main); err != nil {
+		return err
+	}
+	// the main response may have been served without being stored
+	z, name, err := c.bundleEntry(main)
+	if err != nil {
+		return err
+	}
+	if _, err := z.fs.Stat(name); err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	for _, req := range extra {
+		if err := c.serveDiscard(req); err != nil {
+			return err
+		}
+		fmt.Fprintf(buf, "%s %s\n", req.Method, req.URL)
+	}
+	sidecar := z.bundleName(name)
+	if err := z.fs.MkdirAll(path.Dir(sidecar), z.dirMode); err != nil {
+		return err
+	}
+	return afero.WriteFile(z.fs, sidecar, buf.Bytes(), z.fileMode)
+}
+
+// serveDiscard serves the request, discarding the response body.
+func (c *Cache) serveDiscard(req *http.Request) error {
+	res, err := c.serve(req)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, res.Body)
+	if cerr := res.Body.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// LoadBundle loads the bundle stored by StoreBundle for the main request,
+// returning the main response followed by the responses for the bundle's
+// extra requests. Stale entries are refetched. Extra requests are created
+// with the main request's context. When the main request does not have a
+// stored bundle, only the main response is returned.
+//
+// The caller is responsible for closing the bodies of all returned
+// responses.
+func (c *Cache) LoadBundle(main *http.Request) ([]*http.Response, error) {
+	if !c.life.acquire() {
+		return nil, ErrClosed
+	}
+	defer c.life.release()
+	z, name, err := c.bundleEntry(main)
+	if err != nil {
+		return nil, err
+	}
+	reqs := []*http.Request{main}
+	buf, err := afero.ReadFile(z.fs, z.bundleName(name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	s := bufio.NewScanner(bytes.NewReader(buf))
+	for s.Scan() {
+		method, urlstr, ok := strings.Cut(s.Text(), " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid bundle line %q", s.Text())
+		}
+		req, err := http.NewRequestWithContext(main.Context(), method, urlstr, nil)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, req)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	var responses []*http.Response
+	for _, req := range reqs {
+		res, err := c.serve(req)
+		if err != nil {
+			for _, res := range responses {
+				res.Body.Close()
+			}
+			return nil, err
+		}
+		responses = append(responses, res)
+	}
+	return responses, nil
+}
+
+// bundleEntry returns the policy cache and fs name of the entry for the main
+// request of a bundle.
+func (c *Cache) bundleEntry(main *http.Request) (*Cache, string, error) {
+	key, p, err := c.Match(main)
+	switch {
+	case err != nil:
+		return nil, "", err
+	case key == "":
+		return nil, "", fmt.Errorf("%w for %s %s", ErrNotMatched, main.Method, redactURL(main.URL))
+	}
+	z := c.policyCache(p)
+	name, err := z.lookup(key)
+	if err != nil {
+		return nil, "", err
+	}
+	return z, name, nil
+}
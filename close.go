@@ -0,0 +1,86 @@
+package diskcache
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrClosed is the closed error, returned for requests made after the cache
+// has been closed.
+var ErrClosed = errors.New("cache closed")
+
+// lifecycle tracks in-flight requests and the closed state of a cache.
+type lifecycle struct {
+	sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+// acquire registers an in-flight request, returning false when closed.
+func (l *lifecycle) acquire() bool {
+	if l == nil {
+		return true
+	}
+	l.RLock()
+	defer l.RUnlock()
+	if l.closed {
+		return false
+	}
+	l.wg.Add(1)
+	return true
+}
+
+// release releases an in-flight request registered with acquire.
+func (l *lifecycle) release() {
+	if l != nil {
+		l.wg.Done()
+	}
+}
+
+// exclusive waits for in-flight requests to finish, and calls f while
+// blocking new requests. Returns ErrClosed when closed.
+func (l *lifecycle) exclusive(f func() error) error {
+	if l == nil {
+		return f()
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	l.wg.Wait()
+	return f()
+}
+
+// close marks the lifecycle closed and waits for in-flight requests to
+// finish, calling f once.
+func (l *lifecycle) close(f func()) {
+	if l == nil {
+		f()
+		return
+	}
+	l.Lock()
+	l.closed = true
+	l.Unlock()
+	l.wg.Wait()
+	l.once.Do(f)
+}
+
+// Close closes the cache, stopping the background refresher, waiting for
+// in-flight requests to finish, and releasing the memory layer. Requests made
+// after the cache is closed return ErrClosed. Close is idempotent and safe to
+// call concurrently with in-flight requests.
+//
+// Response bodies returned prior to Close remain readable, and must still be
+// closed by the caller. The index is rebuilt from the fs by New, and is not
+// persisted.
+func (c *Cache) Close() error {
+	c.refresher.stop()
+	c.life.close(func() {
+		if c.memory != nil {
+			c.memory.clear()
+		}
+	})
+	return nil
+}
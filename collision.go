@@ -0,0 +1,91 @@
+package diskcache
+
+import (
+	"errors"
+	"fmt"
+	"path"
+)
+
+// IndexStrategy is the strategy for handling collisions between a stored
+// entry and a directory of stored entries, such as when /foo is stored, and
+// /foo/bar is later stored (or the reverse). Keys ending in / (or empty keys)
+// always have the matcher's index path (?index by default) appended.
+//
+// There is no strategy for moving a colliding entry under the index path, as
+// the index path is set per matcher, and is not known when storing.
+type IndexStrategy int
+
+// Index strategies.
+const (
+	// IndexError returns ErrKeyCollision when storing an entry that collides
+	// with a stored entry or directory. The default.
+	IndexError IndexStrategy = iota
+	// IndexHash stores entries that collide with a stored entry or directory
+	// under a fallback name derived from a hash of the entry's fs name, in the
+	// ?collision directory, which is used by lookups when the entry is not
+	// found at its own fs name.
+	IndexHash
+)
+
+// collisionDir is the directory for entries stored under a fallback name.
+const collisionDir = "?collision"
+
+// ErrKeyCollision is the key collision error, returned when an entry cannot be
+// stored as its fs name collides with a stored entry or directory.
+var ErrKeyCollision = errors.New("key collision")
+
+// collisionName returns the fallback fs name for the fs name.
+func (c *Cache) collisionName(name string) string {
+	return path.Join(c.root(), collisionDir, c.hasher.Sum([]byte(name)))
+}
+
+// collides determines if the fs name collides with a stored entry or
+// directory, where the fs name is an existing directory, or its closest
+// existing parent is not a directory.
+func (c *Cache) collides(name string) bool {
+	if fi, err := c.fs.Stat(name); err == nil {
+		return fi.IsDir()
+	}
+	for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if fi, err := c.fs.Stat(dir); err == nil {
+			return !fi.IsDir()
+		}
+	}
+	return false
+}
+
+// storeName returns the fs name to store the entry for the key, using the
+// fallback fs name when the fs name collides and collisions are hashed.
+func (c *Cache) storeName(key string) string {
+	name := c.name(key)
+	if c.indexStrategy == IndexHash && c.collides(name) {
+		return c.collisionName(name)
+	}
+	return name
+}
+
+// collisionLookup returns the fallback fs name for the fs name, when
+// collisions are hashed, the fs name is not a stored entry, and the fallback
+// is.
+func (c *Cache) collisionLookup(name string) string {
+	if c.indexStrategy != IndexHash {
+		return name
+	}
+	if fi, err := c.fs.Stat(name); err == nil && fi.Mode().IsRegular() {
+		return name
+	}
+	alt := c.collisionName(name)
+	if fi, err := c.fs.Stat(alt); err == nil && fi.Mode().IsRegular() {
+		return alt
+	}
+	return name
+}
+
+// collisionError wraps the error with ErrKeyCollision when the fs name
+// collides.
+func (c *Cache) collisionError(name string, err error) error {
+	if c.collides(name) {
+		return fmt.Errorf("%w: %s: %w", ErrKeyCollision, name, err)
+	}
+	return err
+}
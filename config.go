@@ -0,0 +1,73 @@
+package diskcache
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// configDir is the directory for config version sidecar files.
+const configDir = "?config"
+
+// configName returns the fs name of the config version sidecar file for the
+// fs name.
+func (c *Cache) configName(name string) string {
+	root := c.root()
+	return path.Join(root, configDir, strings.TrimPrefix(name, root))
+}
+
+// policyVersion returns the hex encoded SHA-256 hash of the cache config
+// version, and the policy's header transformers, body transformers, and
+// marshaler.
+func (c *Cache) policyVersion(p Policy) string {
+	if p.version != "" {
+		return p.version
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "version %s\n", c.configVersion)
+	for _, t := range p.HeaderTransformers {
+		fmt.Fprintf(&sb, "header %T\n", t)
+	}
+	for _, t := range p.BodyTransformers {
+		fmt.Fprintf(&sb, "body %d %s\n", t.TransformPriority(), transformerName(t))
+	}
+	fmt.Fprintf(&sb, "marshaler %T\n", p.MarshalUnmarshaler)
+	return c.hasher.Sum([]byte(sb.String()))
+}
+
+// writeConfig writes the config version sidecar file for the fs name.
+func (c *Cache) writeConfig(name string, p Policy, mode os.FileMode) error {
+	sidecar := c.configName(name)
+	if err := c.fs.MkdirAll(path.Dir(sidecar), c.dirMode); err != nil {
+		return err
+	}
+	return afero.WriteFile(c.fs, sidecar, []byte(c.policyVersion(p)), mode)
+}
+
+// sameConfig returns whether or not the fs name was stored with the policy's
+// config version. Entries without a config version sidecar file never match.
+func (c *Cache) sameConfig(name string, p Policy) bool {
+	buf, err := afero.ReadFile(c.fs, c.configName(name))
+	return err == nil && string(buf) == c.policyVersion(p)
+}
+
+// configMatch returns whether or not the entry for the key was stored with the
+// policy's config version. Always returns true when config versioning is not
+// enabled.
+func (c *Cache) configMatch(key string, p Policy) bool {
+	if !c.configVersioning {
+		return true
+	}
+	name, err := c.lookup(key)
+	return err == nil && c.sameConfig(name, p)
+}
+
+// invalidated returns whether or not the entry for the fs name was stored in
+// a different cache epoch, or with a different config version, when enabled.
+func (c *Cache) invalidated(name string, p Policy) bool {
+	return c.epoch != "" && !c.sameEpoch(name) ||
+		c.configVersioning && !c.sameConfig(name, p)
+}
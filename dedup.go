@@ -0,0 +1,89 @@
+package diskcache
+
+import (
+	"sort"
+)
+
+// DedupReport is the result of analyzing the duplication of response bodies
+// in the cache fs.
+type DedupReport struct {
+	// Count is the number of analyzed entries.
+	Count int
+	// Skipped is the number of entries that could not be loaded.
+	Skipped int
+	// Unique is the number of distinct response bodies.
+	Unique int
+	// LogicalBytes is the total size of all response bodies.
+	LogicalBytes int64
+	// UniqueBytes is the total size of the distinct response bodies, being
+	// the size that would be used were duplicate bodies stored once.
+	UniqueBytes int64
+	// DuplicateBytes is the size used by duplicate response bodies
+	// (LogicalBytes - UniqueBytes).
+	DuplicateBytes int64
+	// Duplicates are the keys of entries with the same non-empty response
+	// body, grouped by body, in order of the most bytes used by duplicates.
+	Duplicates [][]string
+}
+
+// AnalyzeDuplication walks the cache fs, hashing the response body of every
+// entry, and returns a report of the space used by duplicate response bodies.
+// Useful for determining the savings of storing identical bodies once.
+//
+// As with Verify, an entry's body is loaded using the policy of the first of
+// the default policy or the cache's simple matchers that can load the entry.
+// Entries that cannot be loaded are skipped. Response bodies are compared as
+// loaded, after any body transformers were applied when stored.
+func (c *Cache) AnalyzeDuplication() (DedupReport, error) {
+	if !c.life.acquire() {
+		return DedupReport{}, ErrClosed
+	}
+	defer c.life.release()
+	names, err := c.entryNames()
+	if err != nil {
+		return DedupReport{}, err
+	}
+	policies := c.policies()
+	sums, sizes := make([]string, len(names)), make([]int64, len(names))
+	loaded := make([]bool, len(names))
+	_ = c.each(names, func(i int, name string) error {
+		if body, err := c.entryBody(name, policies); err == nil {
+			sums[i], sizes[i], loaded[i] = c.hasher.Sum(body), int64(len(body)), true
+		}
+		return nil
+	})
+	type group struct {
+		size int64
+		keys []string
+	}
+	var report DedupReport
+	var groups []*group
+	bySum := make(map[string]*group)
+	for i, name := range names {
+		report.Count++
+		if !loaded[i] {
+			report.Skipped++
+			continue
+		}
+		report.LogicalBytes += sizes[i]
+		g, ok := bySum[sums[i]]
+		if !ok {
+			g = &group{size: sizes[i]}
+			bySum[sums[i]], groups = g, append(groups, g)
+			report.Unique++
+			report.UniqueBytes += sizes[i]
+		}
+		g.keys = append(g.keys, c.key(name))
+	}
+	report.DuplicateBytes = report.LogicalBytes - report.UniqueBytes
+	// order groups by the bytes used by duplicates
+	sort.SliceStable(groups, func(a, b int) bool {
+		return int64(len(groups[a].keys)-1)*groups[a].size > int64(len(groups[b].keys)-1)*groups[b].size
+	})
+	for _, g := range groups {
+		if g.size != 0 && len(g.keys) > 1 {
+			report.Duplicates = append(report.Duplicates, g.keys)
+		}
+	}
+	return report, nil
+}
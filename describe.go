@@ -0,0 +1,77 @@
+package diskcache
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Describe returns a human-readable description of the cache's effective
+// configuration, listing the cache fs, and each matcher in the order
+// evaluated by Match. For simple matchers, the matcher's method, regexps, key
+// template, and policy are included, with the policy's header and body
+// transformers listed in the order applied, along with the body transformer
+// priorities.
+//
+// Useful for debugging, and for including in bug reports. The output format
+// is not stable.
+func (c *Cache) Describe() string {
+	if c.life.acquire() {
+		defer c.life.release()
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "fs: %T\n", c.fs)
+	if c.keyPrefix != "" {
+		fmt.Fprintf(&sb, "key prefix: %s\n", c.keyPrefix)
+	}
+	for i, m := range c.Matchers() {
+		fmt.Fprintf(&sb, "matcher %d: %T", i, m)
+		if _, ok := m.(*SimpleMatcher); !ok {
+			if s, ok := m.(fmt.Stringer); ok {
+				fmt.Fprintf(&sb, " %s", s)
+			}
+		}
+		if m == Matcher(c.matcher) {
+			sb.WriteString(" (default)")
+		}
+		sb.WriteString("\n")
+		if z, ok := m.(*SimpleMatcher); ok {
+			z.describe(&sb)
+		}
+	}
+	return sb.String()
+}
+
+// describe writes a description of the simple matcher to sb.
+func (m *SimpleMatcher) describe(sb *strings.Builder) {
+	fmt.Fprintf(sb, "  priority: %d\n", m.priority)
+	fmt.Fprintf(sb, "  method: %s\n", m.methodPattern)
+	fmt.Fprintf(sb, "  host: %s\n", m.host)
+	fmt.Fprintf(sb, "  path: %s\n", m.path)
+	fmt.Fprintf(sb, "  key: %s\n", m.key)
+	p := m.policy
+	if p.Label != "" {
+		fmt.Fprintf(sb, "  label: %s\n", p.Label)
+	}
+	fmt.Fprintf(sb, "  ttl: %v\n", p.TTL)
+	if p.ExpireFunc != nil {
+		sb.WriteString("  expire func: set\n")
+	}
+	if p.StaleFunc != nil {
+		sb.WriteString("  stale func: set\n")
+	}
+	for _, t := range p.HeaderTransformers {
+		fmt.Fprintf(sb, "  header transformer: %T\n", t)
+	}
+	for _, t := range p.BodyTransformers {
+		fmt.Fprintf(sb, "  body transformer: %d %s\n", t.TransformPriority(), transformerName(t))
+	}
+	if p.MarshalUnmarshaler != nil {
+		fmt.Fprintf(sb, "  marshaler: %T\n", p.MarshalUnmarshaler)
+	}
+	if p.Validator != nil {
+		fmt.Fprintf(sb, "  validator: %T\n", p.Validator)
+	}
+	if p.Fs != nil {
+		fmt.Fprintf(sb, "  fs: %T\n", p.Fs)
+	}
+}
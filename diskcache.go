@@ -14,19 +14,28 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
+	"log/slog"
+	"mime"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/gobwas/glob"
 	"github.com/spf13/afero"
 	"github.com/yookoala/realpath"
 )
@@ -38,30 +47,189 @@ type Cache struct {
 	fileMode  os.FileMode
 	fs        afero.Fs
 	noDefault bool
+	// modeFunc returns the file mode for the cache file of a response.
+	modeFunc func(*http.Response) os.FileMode
+	// requireFs toggles requiring an explicitly configured fs.
+	requireFs bool
+	// cacheRoot is the root directory used in place of the user's cache
+	// directory.
+	cacheRoot string
+	// keyPrefix is the prefix prepended to keys in the fs.
+	keyPrefix string
+	// shardDepth and shardWidth are the number and width of hash-derived
+	// directories inserted before keys in the fs.
+	shardDepth int
+	shardWidth int
+	// pathMapper maps keys to storage paths.
+	pathMapper func(string) string
+	// hasher is the hasher.
+	hasher Hasher
+	// keyHash is the hash func for hashed keys.
+	keyHash func() hash.Hash
+	// storeRequests toggles storing requests with stored entries.
+	storeRequests bool
+	// storeHeaders are the request headers to store.
+	storeHeaders []string
+	// recordRequests toggles recording requests for stored entries.
+	recordRequests bool
+	// recordHeaders are the request headers to record.
+	recordHeaders []string
+	// ageHeader toggles adding the Age header to loaded responses.
+	ageHeader bool
+	// serveStaleOnError toggles serving stale entries when executing the
+	// request fails.
+	serveStaleOnError bool
+	// configVersioning toggles invalidating entries stored with a different
+	// config version.
+	configVersioning bool
+	// configVersion is the config version.
+	configVersion string
+	// storedTimestamp toggles storing fetch timestamps in sidecar files.
+	storedTimestamp bool
+	// staleWindow is the duration past expiry that stale entries are served
+	// without refetching.
+	staleWindow time.Duration
+	// revalidateTimeout is the timeout for refetching stale entries, after
+	// which the stale entry is served.
+	revalidateTimeout time.Duration
+	// respectCacheControl toggles honoring request cache control directives.
+	respectCacheControl bool
+	// safeMethodsOnly toggles refusing to cache unsafe request methods.
+	safeMethodsOnly bool
+	// preferCached toggles serving the cached entry when a refetch returns a
+	// server error.
+	preferCached bool
+	// preferCachedCodes are the status codes considered server errors.
+	preferCachedCodes []int
+	// aliasResolver resolves the canonical URL for requests prior to
+	// matching.
+	aliasResolver func(*http.Request) *url.URL
+	// hostFromHeader toggles matching on the request's Host header.
+	hostFromHeader bool
+	// normalization is the set of URL normalization rules applied prior to
+	// matching.
+	normalization Normalization
+	// index is the in-memory index of stored entries.
+	index *index
+	// maxIdleAge is the max age since an entry was last read.
+	maxIdleAge time.Duration
+	// fetches is the semaphore limiting concurrent upstream fetches.
+	fetches chan struct{}
+	// readLimit is the maximum response body size read.
+	readLimit int64
+	// limiter is the upstream fetch rate limiter.
+	limiter RateLimiter
+	// replay toggles replay only mode.
+	replay bool
+	// recordDir is the fixture directory for recording all responses.
+	recordDir string
+	// indexStrategy is the index collision strategy.
+	indexStrategy IndexStrategy
+	// versions is the max number of historical versions kept per entry.
+	versions int
+	// fsGen is the fs generation, incremented by SwapFs.
+	fsGen int64
+	// keyDelimiters are the key delimiters set with WithKeyDelimiter.
+	keyDelimiters *keyDelimiters
+	// walkConcurrency is the maximum number of entries processed in parallel
+	// by bulk operations.
+	walkConcurrency int
+	// refresher is the background refresher.
+	refresher *refresher
+	// fetchMiddleware are the middleware wrapping the transport for upstream
+	// fetches.
+	fetchMiddleware []func(http.RoundTripper) http.RoundTripper
+	// lazyBody toggles unmarshaling stored entries as they are read.
+	lazyBody bool
+	// maxTransformMemory is the maximum size of the in-flight body data
+	// buffered by the body transformer chain.
+	maxTransformMemory int64
+	// transformTrace is the body transform trace func.
+	transformTrace func(string, int, int, bool)
+	// contentTypeOverride is the content type override func.
+	contentTypeOverride func(string, string) string
+	// contentTypeHeader toggles rewriting the stored Content-Type header with
+	// the overridden content type.
+	contentTypeHeader bool
+	// injectHit are the headers injected into responses served from the
+	// cache.
+	injectHit http.Header
+	// injectMiss are the headers injected into responses fetched from the
+	// upstream.
+	injectMiss http.Header
+	// basePath is the resolved base path set by WithBasePathFs.
+	basePath string
+	// basePathFs is the fs created by WithBasePathFs.
+	basePathFs afero.Fs
+	// bufferPool is the buffer pool.
+	bufferPool *sync.Pool
+	// epoch is the cache epoch.
+	epoch string
+	// httpcacheFs is the fs of entries stored by httpcache to import.
+	httpcacheFs afero.Fs
+	// lowerCaseKeys toggles lower casing keys prior to mapping to fs names.
+	lowerCaseKeys bool
+	// compressTypes are the content types compressed on the fly when loaded.
+	compressTypes []string
+	// rewriters are the response rewriters.
+	rewriters []ResponseRewriter
+	// policyRefiner is the policy refiner func.
+	policyRefiner func(*http.Response, Policy) Policy
+	// keyFinalizer is the key finalizer func.
+	keyFinalizer func(string, *http.Response) string
+	// codecRules are the auto compression rules.
+	codecRules []codecRule
+	// compressionPassthrough toggles storing already encoded bodies as-is.
+	compressionPassthrough bool
+	// teeStreaming toggles streaming response bodies to the client while
+	// storing.
+	teeStreaming bool
+	// syncWrites toggles syncing stored entries to stable storage.
+	syncWrites bool
+	// skipUnchanged toggles skipping writes of unchanged entries.
+	skipUnchanged bool
+	// memory is the in-memory layer.
+	memory *memory
+	// compressionStats are the compression stats.
+	compressionStats *compressionStats
+	// strictPriorities toggles returning an error for body transformers with
+	// duplicate transform priorities.
+	strictPriorities bool
+	// logger is the debug logger.
+	logger *slog.Logger
+	// cacheEmptyBodies toggles storing responses with empty bodies.
+	cacheEmptyBodies bool
+	// lfHeaders toggles storing header blocks with LF line endings.
+	lfHeaders bool
+	// mirror toggles writing a browsable mirror of stored responses.
+	mirror bool
+	// resumeDownloads toggles resuming interrupted downloads.
+	resumeDownloads bool
+	// failOpen toggles returning fetched responses when storing fails.
+	failOpen bool
+	// extFromContentType toggles appending an extension derived from the
+	// response content type to names in the fs.
+	extFromContentType bool
 	// matchers are the set of url matchers.
 	matchers []Matcher
 	// matcher is default matcher.
 	matcher *SimpleMatcher
+	// life is the cache lifecycle.
+	life *lifecycle
 }
 
 // New creates a new disk cache.
 //
 // By default, the cache path will be <working directory>/cache. Change
-// location using options.
+// location using options, or use WithRequireExplicitFs to disable the default
+// location.
 func New(opts ...Option) (*Cache, error) {
 	m, err := NewSimpleMatcher(
 		`GET`,
 		`^(?P<proto>https?)://(?P<host>[^:]+)(?P<port>:[0-9]+)?$`,
 		`^/?(?P<path>.*)$`,
-		`{{proto}}/{{host}}{{port}}/{{path}}{{query}}`,
-		WithIndexPath("?index"),
-		WithQueryPrefix("_"),
-		WithLongPathHandler(func(key string) string {
-			if len(key) > 128 {
-				return fmt.Sprintf("?long/%x", sha256.Sum256([]byte(key)))
-			}
-			return key
-		}),
+		defaultKey,
+		defaultMatcherOptions()...,
 	)
 	if err != nil {
 		return nil, err
@@ -70,6 +238,7 @@ func New(opts ...Option) (*Cache, error) {
 		dirMode:  0o755,
 		fileMode: 0o644,
 		matcher:  m,
+		life:     new(lifecycle),
 	}
 	for _, o := range opts {
 		if err := o.apply(c); err != nil {
@@ -77,7 +246,10 @@ func New(opts ...Option) (*Cache, error) {
 		}
 	}
 	// set default fs as overlay at <working directory>/cache
-	if c.fs == nil {
+	switch {
+	case c.fs == nil && c.requireFs:
+		return nil, errors.New("no fs configured")
+	case c.fs == nil:
 		dir, err := os.Getwd()
 		if err != nil {
 			return nil, err
@@ -86,63 +258,299 @@ func New(opts ...Option) (*Cache, error) {
 			return nil, err
 		}
 	}
+	// build index
+	if c.index != nil {
+		if err := c.index.scan(c.fs, c.root()); err != nil {
+			return nil, err
+		}
+	}
+	c.applyKeyDelimiters()
+	c.applyHasher()
+	if err := c.checkSharding(); err != nil {
+		return nil, err
+	}
+	if err := c.checkKeyLength(); err != nil {
+		return nil, err
+	}
+	if err := c.sort(); err != nil {
+		return nil, err
+	}
+	// start background refresher
+	if c.refresher != nil {
+		c.refresher.start(c)
+	}
+	return c, nil
+}
+
+// Apply applies the options to the cache, allowing an existing cache to be
+// reconfigured, such as changing the default policy's TTL, or adding
+// matchers. When an option returns an error, options prior to the option
+// will have been applied.
+//
+// Apply is not safe for concurrent use with other methods of the cache.
+// Options that change the fs or storage layout (such as WithFs, WithKeyPrefix,
+// WithSharding, WithHashedKeys, WithPathMapper, or WithIndex) will cause
+// previously stored entries to not be found. Changes to the default policy
+// are not inherited by previously added matchers.
+func (c *Cache) Apply(opts ...Option) error {
+	for _, o := range opts {
+		if err := o.apply(c); err != nil {
+			return err
+		}
+	}
+	c.applyKeyDelimiters()
+	c.applyHasher()
+	if err := c.checkSharding(); err != nil {
+		return err
+	}
+	if err := c.checkKeyLength(); err != nil {
+		return err
+	}
+	return c.sort()
+}
+
+// applyKeyDelimiters applies the key delimiters to the default matcher and
+// simple matchers using the default delimiters.
+func (c *Cache) applyKeyDelimiters() {
+	if c.keyDelimiters == nil {
+		return
+	}
+	for _, v := range append(c.matchers, c.matcher) {
+		if m, ok := v.(*SimpleMatcher); ok {
+			m.applyKeyDelimiters(*c.keyDelimiters)
+		}
+	}
+}
+
+// sort sorts the matchers by priority, and the body transformers of simple
+// matchers by transform priority. Body transformers with the same transform
+// priority retain their registration order. Duplicate transform priorities
+// are logged as a warning, or returned as an error when strict transform
+// priorities are enabled.
+func (c *Cache) sort() error {
+	// ensure matchers are in priority order
+	sort.SliceStable(c.matchers, func(a, b int) bool {
+		return matcherPriority(c.matchers[a]) < matcherPriority(c.matchers[b])
+	})
 	// ensure body transformers are in order.
 	for _, v := range append(c.matchers, c.matcher) {
 		m, ok := v.(*SimpleMatcher)
 		if !ok {
 			continue
 		}
-		sort.Slice(m.policy.BodyTransformers, func(a, b int) bool {
-			return m.policy.BodyTransformers[a].TransformPriority() < m.policy.BodyTransformers[b].TransformPriority()
+		transformers := m.policy.BodyTransformers
+		sort.SliceStable(transformers, func(a, b int) bool {
+			return transformers[a].TransformPriority() < transformers[b].TransformPriority()
 		})
+		for i := 1; i < len(transformers); i++ {
+			if priority := transformers[i].TransformPriority(); priority == transformers[i-1].TransformPriority() {
+				if c.strictPriorities {
+					return fmt.Errorf("body transformers %s and %s have the same transform priority %d", transformerName(transformers[i-1]), transformerName(transformers[i]), priority)
+				}
+				if c.logger != nil {
+					c.logger.Warn("duplicate transform priority", "priority", int(priority), "first", transformerName(transformers[i-1]), "second", transformerName(transformers[i]))
+				}
+			}
+		}
 	}
-	return c, nil
+	return nil
+}
+
+// NewDir creates a new disk cache stored in the directory.
+//
+// See WithBasePathFs.
+func NewDir(dir string, opts ...Option) (*Cache, error) {
+	return New(append([]Option{WithBasePathFs(dir)}, opts...)...)
+}
+
+// NewAppCache creates a new disk cache stored in the user's cache directory
+// for the app. The app cache directory is set after all other options have
+// been applied, allowing WithCacheRoot to be passed.
+//
+// See WithAppCacheDir.
+func NewAppCache(app string, opts ...Option) (*Cache, error) {
+	return New(append(opts[:len(opts):len(opts)], WithAppCacheDir(app))...)
+}
+
+// NewReplayer creates a new disk cache that only replays responses stored in
+// the fs, for use in tests. Entries never expire, requests are never
+// executed, validators are not used, and ErrNotCached is returned for
+// requests without a stored entry.
+func NewReplayer(fs afero.Fs, opts ...Option) (*Cache, error) {
+	return New(append([]Option{WithFs(fs), WithReplay()}, opts...)...)
+}
+
+// Install creates a new disk cache wrapping the current http.DefaultTransport,
+// and sets it as http.DefaultTransport. The returned restore func sets
+// http.DefaultTransport back to its previous value. Intended for use in
+// scripts, command-line tools, and tests.
+//
+// Install mutates global state, and is not safe to call concurrently with
+// other code that reads or sets http.DefaultTransport.
+func Install(opts ...Option) (func(), error) {
+	prev := http.DefaultTransport
+	c, err := New(append([]Option{WithTransport(prev)}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	http.DefaultTransport = c
+	return func() {
+		http.DefaultTransport = prev
+	}, nil
 }
 
 // RoundTrip satisfies the http.RoundTripper interface.
 func (c *Cache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !c.life.acquire() {
+		return nil, ErrClosed
+	}
+	defer c.life.release()
+	return c.serve(req)
+}
+
+// serve serves the request, recording the fixture for the request when
+// recording.
+func (c *Cache) serve(req *http.Request) (*http.Response, error) {
+	if c.recordDir != "" {
+		return c.recordRoundTrip(req)
+	}
+	return c.roundTrip(req)
+}
+
+// roundTrip executes the round trip for the request.
+func (c *Cache) roundTrip(req *http.Request) (*http.Response, error) {
 	// match policy for the request
 	key, p, err := c.Match(req)
 	if err != nil {
 		return nil, err
 	}
+	// honor request cache control directives
+	force, noStore := false, false
+	if c.respectCacheControl && !c.replay {
+		noStore, force = requestCacheControl(req.Header)
+	}
+	// refuse unsafe methods, regardless of the matched policy
+	unsafe := key != "" && c.safeMethodsOnly && !safeMethod(req.Method, p)
 	// no caching policy, pass to regular transport
-	if key == "" {
-		transport := c.transport
-		if transport == nil {
-			transport = http.DefaultTransport
+	if key == "" || noStore || unsafe {
+		switch {
+		case unsafe:
+			c.debug(req.Context(), "unsafe method", "method", req.Method, "url", redactURL(req.URL), "key", key)
+		case noStore:
+			c.debug(req.Context(), "no store", "method", req.Method, "url", redactURL(req.URL), "key", key)
+		default:
+			c.debug(req.Context(), "no match", "method", req.Method, "url", redactURL(req.URL))
+		}
+		if c.replay {
+			return nil, fmt.Errorf("%w: %w for %s %s", ErrNotCached, ErrNotMatched, req.Method, redactURL(req.URL))
+		}
+		return c.fetchTransport().RoundTrip(req)
+	}
+	c.debug(req.Context(), "match", "method", req.Method, "url", redactURL(req.URL), "key", key)
+	if z, ok := ContextPolicy(req.Context()); ok {
+		p = z
+	}
+	if names, ok := SkipTransformers(req.Context()); ok && !c.replay {
+		res, err := c.pristine(key, p, names, req)
+		if err != nil {
+			return nil, err
 		}
-		return transport.RoundTrip(req)
+		return c.inject(res, key, false), nil
 	}
-	force := false
-	for {
+	for count := 0; ; count++ {
 		// fetch
-		stale, mod, res, err := c.Fetch(key, p, req, force)
+		stale, mod, res, err := c.fetch(key, p, req, force)
 		switch {
 		case err != nil:
 			return nil, err
-		case p.Validator == nil:
-			return res, nil
+		case p.Validator == nil, c.replay:
+			return c.inject(res, key, stale || c.replay), nil
 		}
 		// validate response
-		validity, err := p.Validator.Validate(req, res, mod, stale)
+		validity, err := validate(p.Validator, req, res, mod, stale, count)
+		var delay RetryDelay
+		if validity == Retry && errors.As(err, &delay) {
+			err = nil
+		}
 		switch {
 		case err != nil:
+			c.discard(req, key, p, res, stale)
 			return nil, err
 		case validity == Error:
+			c.discard(req, key, p, res, stale)
 			return nil, fmt.Errorf("%T returned no error, but returned Error validity", p.Validator)
 		case validity == Retry:
+			c.discard(req, key, p, res, stale)
 			force = true
+			if err := wait(req.Context(), time.Duration(delay)); err != nil {
+				return nil, err
+			}
 		case validity == Valid:
-			return res, nil
+			return c.inject(res, key, stale), nil
 		default:
+			res.Body.Close()
 			return nil, fmt.Errorf("unable to handle %T validity %d", p.Validator, validity)
 		}
 	}
 }
 
+// discard closes the body of a response that failed validation. When the
+// response was fetched (and not loaded from the cache), the entry stored for
+// the key is evicted, so that invalid responses are not served from the
+// cache.
+func (c *Cache) discard(req *http.Request, key string, p Policy, res *http.Response, hit bool) {
+	res.Body.Close()
+	if hit {
+		return
+	}
+	if err := c.policyCache(p).evictKey(key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		c.debug(req.Context(), "evict error", "key", key, "error", err)
+	}
+}
+
+// inject sets the hit or miss inject headers on the response, replacing any
+// existing values. Occurrences of {{key}} in header values are replaced with
+// the key.
+func (c *Cache) inject(res *http.Response, key string, hit bool) *http.Response {
+	header := c.injectMiss
+	if hit {
+		header = c.injectHit
+	}
+	for k, v := range header {
+		res.Header.Del(k)
+		for _, s := range v {
+			res.Header.Add(k, strings.ReplaceAll(s, "{{key}}", key))
+		}
+	}
+	return res
+}
+
 // Match finds the first matching cache policy for the request.
 func (c *Cache) Match(req *http.Request) (string, Policy, error) {
+	orig := req
+	if c.hostFromHeader && req.Host != "" && req.Host != req.URL.Host {
+		u := *req.URL
+		u.Host = req.Host
+		z := *req
+		z.URL = &u
+		req = &z
+	}
+	if c.aliasResolver != nil {
+		if u := c.aliasResolver(req); u != nil {
+			z := *req
+			z.URL = u
+			req = &z
+		}
+	}
+	if c.normalization != 0 {
+		req = normalizeRequest(req, c.normalization)
+	}
+	// restore request bodies buffered by matchers
+	defer func() {
+		if req != orig {
+			orig.Body, orig.GetBody = req.Body, req.GetBody
+		}
+	}()
 	matchers := c.matchers
 	if !c.noDefault {
 		matchers = append(matchers, c.matcher)
@@ -159,83 +567,516 @@ func (c *Cache) Match(req *http.Request) (string, Policy, error) {
 	return "", Policy{}, nil
 }
 
+// Matchers returns the matchers in the order they are evaluated by Match,
+// including the default matcher (when enabled).
+func (c *Cache) Matchers() []Matcher {
+	matchers := append([]Matcher(nil), c.matchers...)
+	if !c.noDefault {
+		matchers = append(matchers, c.matcher)
+	}
+	return matchers
+}
+
 // Evict forces a cache eviction (deletion) for the key matching the request.
 func (c *Cache) Evict(req *http.Request) error {
-	key, _, err := c.Match(req)
+	if !c.life.acquire() {
+		return ErrClosed
+	}
+	defer c.life.release()
+	key, p, err := c.Match(req)
 	if err != nil {
 		return err
 	}
-	return c.EvictKey(key)
+	if key == "" {
+		return fmt.Errorf("%w for %s %s", ErrNotMatched, req.Method, redactURL(req.URL))
+	}
+	return c.policyCache(p).evictKey(key)
 }
 
-// EvictKey forces a cache eviction (deletion) of the specified key.
+// EvictKey forces a cache eviction (deletion) of the specified key from the
+// cache fs.
 func (c *Cache) EvictKey(key string) error {
-	return c.fs.Remove(key)
+	if !c.life.acquire() {
+		return ErrClosed
+	}
+	defer c.life.release()
+	return c.evictKey(key)
+}
+
+// evictKey evicts the key from the cache fs.
+func (c *Cache) evictKey(key string) error {
+	name, err := c.lookup(key)
+	if err != nil {
+		return err
+	}
+	if err := c.remove(name); err != nil {
+		return err
+	}
+	if c.keyFinalizer != nil {
+		return c.removeFinal(key)
+	}
+	return nil
+}
+
+// Touch updates the last modified time of the entry for the key matching the
+// request to now, making the entry fresh.
+func (c *Cache) Touch(req *http.Request) error {
+	if !c.life.acquire() {
+		return ErrClosed
+	}
+	defer c.life.release()
+	key, p, err := c.Match(req)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return fmt.Errorf("%w for %s %s", ErrNotMatched, req.Method, redactURL(req.URL))
+	}
+	return c.policyCache(p).touchKey(key)
+}
+
+// TouchKey updates the last modified time of the entry for the key in the
+// cache fs to now, making the entry fresh. Returns fs.ErrNotExist when there
+// is no entry for the key.
+func (c *Cache) TouchKey(key string) error {
+	if !c.life.acquire() {
+		return ErrClosed
+	}
+	defer c.life.release()
+	return c.touchKey(key)
+}
+
+// touchKey updates the last modified time of the entry for the key to now.
+func (c *Cache) touchKey(key string) error {
+	if key == "" {
+		return &fs.PathError{Op: "chtimes", Path: key, Err: fs.ErrNotExist}
+	}
+	name, err := c.lookup(key)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := c.fs.Chtimes(name, now, now); err != nil {
+		return err
+	}
+	if err := c.writeTimestamp(name, now, c.fileMode); err != nil {
+		return err
+	}
+	if c.index != nil {
+		return c.index.update(c.fs, name)
+	}
+	return nil
+}
+
+// policyCache returns the cache to use for the policy. When the policy has
+// its own fs, a copy of the cache using the policy's fs is returned. The index
+// and memory layer are not used with a policy's fs.
+func (c *Cache) policyCache(p Policy) *Cache {
+	if p.Fs == nil {
+		return c
+	}
+	z := *c
+	z.fs, z.index, z.memory = p.Fs, nil, nil
+	return &z
+}
+
+// BasePath returns the resolved OS directory of the cache fs, when the cache
+// fs was set by WithBasePathFs, NewDir, NewAppCache, or WithAppCacheDir.
+// Returns false for other fs's, such as afero.MemMapFs.
+func (c *Cache) BasePath() (string, bool) {
+	if c.life.acquire() {
+		defer c.life.release()
+	}
+	if c.basePathFs == nil || c.fs != c.basePathFs {
+		return "", false
+	}
+	return c.basePath, true
+}
+
+// buffers returns the buffer pool.
+func (c *Cache) buffers() *sync.Pool {
+	if c.bufferPool != nil {
+		return c.bufferPool
+	}
+	return defaultBufferPool
+}
+
+// debug logs a debug message when a logger is set.
+func (c *Cache) debug(ctx context.Context, msg string, args ...any) {
+	if c.logger != nil {
+		c.logger.DebugContext(ctx, msg, args...)
+	}
+}
+
+// root returns the fs root for keys.
+func (c *Cache) root() string {
+	if c.keyPrefix == "" {
+		return ""
+	}
+	return strings.TrimSuffix(fixRE.ReplaceAllString(c.keyPrefix, "/"), "/")
+}
+
+// name returns the fs name for the key.
+func (c *Cache) name(key string) string {
+	if c.lowerCaseKeys {
+		key = strings.ToLower(key)
+	}
+	switch {
+	case c.pathMapper != nil:
+		key = strings.TrimPrefix(path.Clean("/"+c.pathMapper(key)), "/")
+	case c.keyHash != nil:
+		key = c.hashName(key)
+	case c.shardDepth != 0:
+		key = path.Join(append(shards(c.hasher.Sum([]byte(key)), c.shardDepth, c.shardWidth), key)...)
+	}
+	if c.keyPrefix == "" {
+		return key
+	}
+	return strings.TrimSuffix(fixRE.ReplaceAllString(c.keyPrefix+"/"+key, "/"), "/")
+}
+
+// lookup returns the fs name of the stored entry for the key. When
+// extensions are derived from content types, the extension recorded for the
+// key is used. Returns the fs name of the key when there is no stored entry.
+func (c *Cache) lookup(key string) (string, error) {
+	if c.keyFinalizer != nil {
+		key = c.finalKey(key)
+	}
+	name := c.name(key)
+	if c.extFromContentType {
+		return c.extLookup(name)
+	}
+	return c.collisionLookup(name), nil
 }
 
-// Fetch retrieves the key from the cache based on the policy TTL. When forced,
-// or if the cached response is stale the request will be executed and the
-// response cached.
+// Fetch retrieves the key from the cache based on the policy TTL and expire
+// func. When forced, or if the cached response is stale the request will be
+// executed and the response cached. The policy is overridden by a policy
+// added to the request's context with WithContextPolicy.
 func (c *Cache) Fetch(key string, p Policy, req *http.Request, force bool) (bool, time.Time, *http.Response, error) {
+	if !c.life.acquire() {
+		return false, time.Time{}, nil, ErrClosed
+	}
+	defer c.life.release()
+	return c.fetch(key, p, req, force)
+}
+
+// fetch retrieves the key from the cache, executing the request when forced
+// or stale.
+func (c *Cache) fetch(key string, p Policy, req *http.Request, force bool) (bool, time.Time, *http.Response, error) {
+	if z, ok := ContextPolicy(req.Context()); ok {
+		p = z
+	}
+	c = c.policyCache(p)
 	// check stale
-	stale, mod, err := c.Stale(req.Context(), key, p.TTL)
+	stale, mod, err := c.stale(req.Context(), key, p)
 	if err != nil {
 		return false, time.Time{}, nil, err
 	}
+	c.debug(req.Context(), "fetch", "key", key, "stale", stale, "mod", mod, "force", force)
+	// serve entries stale within the stale window without refetching
+	staleHit := stale && !force && !c.replay && c.inStaleWindow(req.Context(), key, mod, p)
+	if staleHit {
+		c.debug(req.Context(), "stale window", "key", key, "mod", mod)
+		stale = false
+	}
+	// replay existing entries only
+	if c.replay {
+		if mod.IsZero() {
+			return false, time.Time{}, nil, fmt.Errorf("%w: %s", ErrNotCached, key)
+		}
+		res, err := c.load(key, p, req)
+		if err != nil {
+			return false, time.Time{}, nil, err
+		}
+		return false, mod, res, nil
+	}
+	// import entries stored by httpcache
+	if c.httpcacheFs != nil && mod.IsZero() && !force {
+		ok, mod, res, err := c.importHTTPCache(key, p, req)
+		switch {
+		case err != nil:
+			return false, time.Time{}, nil, err
+		case ok:
+			return true, mod, res, nil
+		}
+	}
 	// exec when stale or forced
 	if stale || force {
-		res, err := c.Exec(key, p, req)
-		if err != nil {
+		// do not overwrite the cached entry with server errors
+		if c.preferCached && !mod.IsZero() {
+			filter := p.ResponseFilter
+			p.ResponseFilter = func(req *http.Request, res *http.Response) bool {
+				if c.serverError(res.StatusCode) {
+					return false
+				}
+				return filter == nil || filter(req, res)
+			}
+		}
+		// bound revalidation of stale entries
+		revalidate, ereq := stale && !force && c.revalidateTimeout != 0 && !mod.IsZero(), req
+		var cancel context.CancelFunc
+		var t *time.Timer
+		if revalidate {
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(req.Context())
+			t, ereq = time.AfterFunc(c.revalidateTimeout, cancel), req.WithContext(ctx)
+		}
+		res, err := c.execute(key, p, ereq)
+		if revalidate {
+			t.Stop()
+			if err != nil {
+				c.debug(req.Context(), "revalidate failed", "key", key, "error", err)
+				cancel()
+			} else {
+				res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+			}
+		}
+		switch {
+		case err == nil && c.preferCached && !mod.IsZero() && c.serverError(res.StatusCode):
+			// serve previously cached entry, falling back to the error response
+			if cached, err := c.load(key, p, req); err == nil {
+				res.Body.Close()
+				cached.Header.Set("Warning", `111 - "Revalidation Failed"`)
+				return true, mod, cached, nil
+			}
+			return false, time.Now(), res, nil
+		case err != nil && (c.serveStaleOnError || revalidate) && !mod.IsZero():
+			// serve previously cached entry
+			res, lerr := c.load(key, p, req)
+			if lerr != nil {
+				return false, time.Time{}, nil, err
+			}
+			res.Header.Set("Warning", `111 - "Revalidation Failed"`)
+			return true, mod, res, nil
+		case err != nil:
 			return false, time.Time{}, nil, err
 		}
-		mod, err := c.Mod(key)
-		if err != nil {
+		mod, err := c.mod(key)
+		switch {
+		case err != nil && errors.Is(err, fs.ErrNotExist):
+			// response was not stored
+			mod = time.Now()
+		case err != nil:
 			return false, time.Time{}, nil, err
 		}
 		return false, mod, res, nil
 	}
-	// load
-	res, err := c.Load(key, p, req)
-	if err != nil {
+	// load, refetching corrupt or removed entries
+	res, err := c.load(key, p, req)
+	switch {
+	case errors.Is(err, ErrTrailingData), errors.Is(err, ErrCorruptEntry):
+		c.debug(req.Context(), "corrupt entry", "key", key, "error", err)
+		return c.fetch(key, p, req, true)
+	case errors.Is(err, errMethodMismatch), errors.Is(err, fs.ErrNotExist):
+		return c.fetch(key, p, req, true)
+	case err != nil:
 		return false, time.Time{}, nil, err
 	}
+	if staleHit {
+		res.Header.Set("Warning", `110 - "Response is Stale"`)
+	}
 	return true, mod, res, nil
 }
 
+// pristine executes the request without applying the named body transformers
+// (or all body transformers, when no names are passed), without storing the
+// response in the cache fs.
+func (c *Cache) pristine(key string, p Policy, names []string, req *http.Request) (*http.Response, error) {
+	c.debug(req.Context(), "skip transformers", "key", key, "names", names)
+	var transformers []BodyTransformer
+	for _, t := range p.BodyTransformers {
+		if len(names) != 0 && !contains(names, transformerName(t)) {
+			transformers = append(transformers, t)
+		}
+	}
+	p.BodyTransformers = transformers
+	// store to a scratch fs
+	z := *c.policyCache(p)
+	z.fs, z.index, z.memory, z.skipUnchanged = afero.NewMemMapFs(), nil, nil, false
+	p.Fs = nil
+	return z.execute(key, p, req)
+}
+
+// serverError returns whether or not the status code is a server error, when
+// preferring cached entries.
+func (c *Cache) serverError(code int) bool {
+	if len(c.preferCachedCodes) == 0 {
+		return 500 <= code && code < 600
+	}
+	return containsInt(c.preferCachedCodes, code)
+}
+
 // Mod returns last modified time of the key.
 func (c *Cache) Mod(key string) (time.Time, error) {
-	fi, err := c.fs.Stat(key)
-	switch {
-	case err != nil:
+	if !c.life.acquire() {
+		return time.Time{}, ErrClosed
+	}
+	defer c.life.release()
+	return c.mod(key)
+}
+
+// mod returns last modified time of the key.
+func (c *Cache) mod(key string) (time.Time, error) {
+	name, err := c.lookup(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return c.nameMod(name)
+}
+
+// nameMod returns the last modified time of the fs name. When storing fetch
+// timestamps, the stored fetch timestamp is preferred.
+func (c *Cache) nameMod(name string) (time.Time, error) {
+	var mod time.Time
+	if c.index != nil {
+		var err error
+		if mod, err = c.indexMod(name); err != nil {
+			return time.Time{}, err
+		}
+	} else {
+		fi, err := c.fs.Stat(name)
+		switch {
+		case err != nil && !errors.Is(err, fs.ErrNotExist) && c.collides(name),
+			err == nil && fi.IsDir():
+			// colliding entries do not exist
+			return time.Time{}, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+		case err != nil:
+			return time.Time{}, err
+		}
+		mod = fi.ModTime()
+	}
+	if c.storedTimestamp {
+		if t, ok := c.readTimestamp(name); ok {
+			return t, nil
+		}
+	}
+	return mod, nil
+}
+
+// indexMod returns the last modified time of the fs name from the index,
+// rescanning the index when due.
+func (c *Cache) indexMod(name string) (time.Time, error) {
+	if err := c.index.refresh(c.fs, c.root()); err != nil {
 		return time.Time{}, err
-	case fi.IsDir():
-		return time.Time{}, fmt.Errorf("fs path %q is a directory", key)
 	}
-	return fi.ModTime(), nil
+	e, ok := c.index.get(name)
+	if !ok {
+		return time.Time{}, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return e.mod, nil
 }
 
 // Stale returns whether or not the key is stale, based on ttl.
 func (c *Cache) Stale(ctx context.Context, key string, ttl time.Duration) (bool, time.Time, error) {
-	mod, err := c.Mod(key)
+	if !c.life.acquire() {
+		return false, time.Time{}, ErrClosed
+	}
+	defer c.life.release()
+	return c.stale(ctx, key, Policy{TTL: ttl})
+}
+
+// stale returns whether or not the key is stale, based on the policy TTL and
+// expire func. When both are set, the earlier expiry is used. When the policy
+// has a stale func, staleness is determined by the stale func instead.
+func (c *Cache) stale(ctx context.Context, key string, p Policy) (bool, time.Time, error) {
+	mod, err := c.mod(key)
 	switch {
 	case err != nil && errors.Is(err, fs.ErrNotExist):
 		return true, mod, nil
 	case err != nil:
 		return false, time.Time{}, err
 	}
+	// entries stored in a different epoch or config version are stale
+	if c.epoch != "" || c.configVersioning {
+		name, err := c.lookup(key)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+		if c.invalidated(name, p) {
+			return true, mod, nil
+		}
+	}
+	stale, err := c.expired(ctx, key, mod, p)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	return stale, mod, nil
+}
+
+// expired returns whether or not an entry for the key last modified at mod is
+// stale, based on the cache policy.
+func (c *Cache) expired(ctx context.Context, key string, mod time.Time, p Policy) (bool, error) {
+	p = c.preflightPolicy(key, p)
+	ttl := policyTTL(ctx, p)
+	if p.StaleFunc != nil {
+		return p.StaleFunc(ctx, key, mod, ttl)
+	}
+	expires := expiry(mod, ttl, p)
+	return !expires.IsZero() && time.Now().After(expires), nil
+}
+
+// policyTTL returns the policy TTL, overridden by the policy schedule TTL and
+// then by TTLs added to the context.
+func policyTTL(ctx context.Context, p Policy) time.Duration {
+	ttl := p.TTL
+	if p.ScheduleTTL != nil {
+		ttl = p.ScheduleTTL(time.Now())
+	}
 	if d, ok := TTL(ctx); ok {
 		ttl = d
 	}
-	return ttl != 0 && time.Now().After(mod.Add(ttl)), mod, nil
+	if d, ok := LabelTTL(ctx, p.Label); ok {
+		ttl = d
+	}
+	return ttl
+}
+
+// expiry returns the expiry time of an entry last modified at mod, based on
+// the ttl and the policy expire func. When both are set, the earlier expiry is
+// used. Returns the zero time when the entry does not expire.
+func expiry(mod time.Time, ttl time.Duration, p Policy) time.Time {
+	var expires time.Time
+	if ttl != 0 {
+		expires = mod.Add(ttl)
+	}
+	if p.ExpireFunc != nil {
+		if t := p.ExpireFunc(mod); !t.IsZero() && (expires.IsZero() || t.Before(expires)) {
+			expires = t
+		}
+	}
+	return expires
+}
+
+// inStaleWindow returns whether or not a stale entry for the key last
+// modified at mod expired within the stale window set by WithServeStaleUpTo.
+func (c *Cache) inStaleWindow(ctx context.Context, key string, mod time.Time, p Policy) bool {
+	if c.staleWindow == 0 || mod.IsZero() || p.StaleFunc != nil {
+		return false
+	}
+	// entries stored in a different epoch or config version are never served
+	if c.epoch != "" || c.configVersioning {
+		name, err := c.lookup(key)
+		if err != nil || c.invalidated(name, p) {
+			return false
+		}
+	}
+	p = c.preflightPolicy(key, p)
+	expires := expiry(mod, policyTTL(ctx, p), p)
+	return !expires.IsZero() && time.Now().Before(expires.Add(c.staleWindow))
 }
 
 // Cached returns whether or not the request is cached. Wraps Match, Stale.
 func (c *Cache) Cached(req *http.Request) (bool, error) {
+	if !c.life.acquire() {
+		return false, ErrClosed
+	}
+	defer c.life.release()
 	key, p, err := c.Match(req)
 	if err != nil {
 		return false, err
 	}
-	stale, _, err := c.Stale(req.Context(), key, p.TTL)
+	stale, _, err := c.policyCache(p).stale(req.Context(), key, p)
 	if err != nil {
 		return false, err
 	}
@@ -244,35 +1085,415 @@ func (c *Cache) Cached(req *http.Request) (bool, error) {
 
 // Load unmarshals and loads the cached response for the key and cache policy.
 func (c *Cache) Load(key string, p Policy, req *http.Request) (*http.Response, error) {
-	f, err := c.fs.OpenFile(key, os.O_RDONLY, 0)
+	if !c.life.acquire() {
+		return nil, ErrClosed
+	}
+	defer c.life.release()
+	return c.load(key, p, req)
+}
+
+// load unmarshals and loads the cached response for the key and cache policy.
+func (c *Cache) load(key string, p Policy, req *http.Request) (*http.Response, error) {
+	c = c.policyCache(p)
+	name, err := c.lookup(key)
 	if err != nil {
 		return nil, err
 	}
-	var r io.Reader = f
-	if p.MarshalUnmarshaler != nil {
-		buf := new(bytes.Buffer)
-		if err := p.MarshalUnmarshaler.Unmarshal(buf, f); err != nil {
+	r, err := c.read(name, p)
+	if err != nil {
+		return nil, err
+	}
+	if c.maxIdleAge != 0 {
+		c.touch(name)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(r), req)
+	switch {
+	case err != nil && errors.Is(err, ErrCorruptEntry):
+		r.Close()
+		return nil, err
+	case err != nil:
+		r.Close()
+		return nil, fmt.Errorf("%w: %s: %w", ErrCorruptEntry, name, err)
+	}
+	res.Body = &fileBody{ReadCloser: res.Body, f: r}
+	// responses stored for HEAD requests do not have a body
+	if res.Header.Get(methodHeader) == "HEAD" && req.Method != "HEAD" {
+		res.Body.Close()
+		return nil, errMethodMismatch
+	}
+	res.Header.Del(methodHeader)
+	if c.ageHeader {
+		mod, err := c.mod(key)
+		if err != nil {
+			res.Body.Close()
 			return nil, err
 		}
-		r = buf
+		res.Header.Set("Age", strconv.Itoa(int(max(0, time.Since(mod)/time.Second))))
 	}
-	return http.ReadResponse(bufio.NewReader(r), req)
+	if c.compressTypes != nil && req.Method != "HEAD" && acceptsGzip(req.Header) {
+		return compressResponse(res, c.compressTypes)
+	}
+	return res, nil
 }
 
-// Exec executes the request, storing the response using the key and cache
+// compressResponse gzip compresses the response body when the response has
+// one of the content types and has not already been encoded.
+func compressResponse(res *http.Response, contentTypes []string) (*http.Response, error) {
+	if res.Header.Get("Content-Encoding") != "" || !matchContentType(contentTypes, res.Header.Get("Content-Type")) {
+		return res, nil
+	}
+	defer res.Body.Close()
+	buf := new(bytes.Buffer)
+	if err := (GzipMarshalUnmarshaler{}).Marshal(buf, res.Body); err != nil {
+		return nil, err
+	}
+	res.Header.Set("Content-Encoding", "gzip")
+	res.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	res.Header.Add("Vary", "Accept-Encoding")
+	res.ContentLength, res.Uncompressed = int64(buf.Len()), false
+	res.Body = io.NopCloser(buf)
+	return res, nil
+}
+
+// unmarshaler returns the unmarshaler for the stored entry read from br. When
+// a policy refiner or auto compression is set, stored entries may have been
+// stored with a different marshaler than the policy's, and entries with a
+// codec marker, and plain, gzip, zlib, and bzip2 entries are detected from the
+// entry's leading bytes. Entries stored as-is by WithCompressionPassthrough
+// are detected from the encoded marker. When formats are registered, entries
+// with a format tag are unmarshaled with the registered format, and the
+// marshaler of untagged entries for policies with a format is detected from
+// the entry's leading bytes.
+func (c *Cache) unmarshaler(br *bufio.Reader, p Policy) MarshalUnmarshaler {
+	detect := c.policyRefiner != nil || c.codecRules != nil || c.compressionPassthrough
+	if hasFormats() {
+		if buf, _ := br.Peek(len(formatMagic)); bytes.Equal(buf, []byte(formatMagic)) {
+			return formatMarshalUnmarshaler{}
+		}
+		if _, ok := p.MarshalUnmarshaler.(formatMarshalUnmarshaler); ok {
+			p.MarshalUnmarshaler, detect = nil, true
+		}
+	}
+	if !detect {
+		return p.MarshalUnmarshaler
+	}
+	buf, _ := br.Peek(512)
+	switch {
+	case c.compressionPassthrough && bytes.HasPrefix(buf, []byte(encodedMagic)):
+		return encodedMarshalUnmarshaler{}
+	case c.codecRules != nil && bytes.HasPrefix(buf, []byte(codecMagic)):
+		return c.codecUnmarshaler(buf)
+	case plainEntryRE.Match(buf):
+		return nil
+	case p.MarshalUnmarshaler == nil && len(buf) > 1 && buf[0] == 0x1f && buf[1] == 0x8b:
+		return GzipMarshalUnmarshaler{}
+	case p.MarshalUnmarshaler == nil && len(buf) > 1 && buf[0] == 0x78 && (int(buf[0])<<8|int(buf[1]))%31 == 0:
+		return ZlibMarshalUnmarshaler{}
+	case p.MarshalUnmarshaler == nil && isBzip2(buf):
+		return Bzip2MarshalUnmarshaler{}
+	}
+	return p.MarshalUnmarshaler
+}
+
+// plainEntryRE matches the start of entries stored without a marshaler.
+var plainEntryRE = regexp.MustCompile(`^(HTTP/1\.[01] [0-9]{3}|[A-Z]+ \S+ HTTP/1\.[01]\r?\n)`)
+
+// headerUnchanged determines if the stored entry for the key has the same
+// status, ETag, and headers as the transformed response header in buf. ETags
+// are compared using the weak comparison function, and must be present.
+func (c *Cache) headerUnchanged(key string, p Policy, buf []byte) bool {
+	name, err := c.lookup(key)
+	if err != nil {
+		return false
+	}
+	r, err := c.read(name, p)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	stored, err := http.ReadResponse(bufio.NewReader(r), nil)
+	if err != nil {
+		return false
+	}
+	defer stored.Body.Close()
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf)), nil)
+	if err != nil {
+		return false
+	}
+	return stored.StatusCode == res.StatusCode &&
+		etagMatch(stored.Header.Get("ETag"), res.Header.Get("ETag")) &&
+		sameHeader(stored.Header, res.Header, "ETag")
+}
+
+// unchanged determines if the stored entry for the fs name is the same
+// response as buf, comparing the status, headers, and body of the unmarshaled
+// entry.
+func (c *Cache) unchanged(name string, p Policy, req *http.Request, buf []byte) bool {
+	r, err := c.read(name, p)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	stored, err := http.ReadResponse(bufio.NewReader(r), req)
+	if err != nil {
+		return false
+	}
+	defer stored.Body.Close()
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf)), req)
+	if err != nil || stored.StatusCode != res.StatusCode || !sameHeader(stored.Header, res.Header) {
+		return false
+	}
+	a, err := io.ReadAll(stored.Body)
+	if err != nil {
+		return false
+	}
+	b, err := io.ReadAll(res.Body)
+	return err == nil && bytes.Equal(a, b)
+}
+
+// read returns a reader for the unmarshaled response stored in the fs name,
+// using the memory layer when enabled. The caller is responsible for closing
+// the returned reader.
+func (c *Cache) read(name string, p Policy) (io.ReadCloser, error) {
+	var mod time.Time
+	if c.memory != nil {
+		var err error
+		if mod, err = c.nameMod(name); err != nil {
+			return nil, err
+		}
+		if buf, ok := c.memory.get(name, mod); ok {
+			return io.NopCloser(bytes.NewReader(buf)), nil
+		}
+	}
+	f, err := c.fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = bufio.NewReader(f)
+	var lazy *lazyBody
+	m := c.unmarshaler(r.(*bufio.Reader), p)
+	switch {
+	case m != nil && c.lazyBody && !c.lfHeaders && c.memory == nil:
+		// unmarshal as the entry is read
+		lazy = newLazyBody(name, m, r, f)
+		r = lazy
+	case m != nil:
+		buf := new(bytes.Buffer)
+		if err := m.Unmarshal(buf, r); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%w: %s: %w", ErrCorruptEntry, name, err)
+		}
+		r = buf
+	}
+	// skip stored request
+	br := bufio.NewReader(r)
+	if _, err := readStoredRequest(br); err != nil {
+		if lazy == nil {
+			f.Close()
+			return nil, fmt.Errorf("%w: %s: %w", ErrCorruptEntry, name, err)
+		}
+		lazy.Close()
+		if errors.Is(err, ErrCorruptEntry) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s: %w", ErrCorruptEntry, name, err)
+	}
+	if !c.lfHeaders && c.memory == nil {
+		// stream plain and lazily unmarshaled entries from the file
+		switch {
+		case lazy != nil:
+			return &fileBody{ReadCloser: io.NopCloser(br), f: lazy}, nil
+		case m == nil:
+			return &fileBody{ReadCloser: io.NopCloser(br), f: f}, nil
+		}
+		f.Close()
+		return io.NopCloser(br), nil
+	}
+	b, err := io.ReadAll(br)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if c.lfHeaders {
+		b = crlfHeader(b)
+	}
+	if c.memory != nil {
+		c.memory.add(name, mod, b)
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+// Exec executes the request, storing the response using the key and cache
 // policy. Applies header and body transformers, before marshaling and the
 // response.
+//
+// Body transformers are not applied to gRPC-Web (application/grpc-web*)
+// responses, as the length-prefixed message framing and the trailers frame
+// encoded in the body must be stored verbatim. Similarly, body transformers
+// are not applied to Server-Sent Events (text/event-stream) responses, to
+// preserve event framing. As the response body is read to EOF, only completed
+// (finite) event streams can be cached. Body transformers are also not applied
+// to responses with a non-identity Content-Encoding (such as gzip), as the
+// encoded bytes would be corrupted. Header transformers and the policy's
+// marshaler/unmarshaler are still applied.
+//
+// When a HEAD response's ETag or Last-Modified validators (and Content-Length,
+// when present) match a stored GET entry for the key, the stored GET entry is
+// refreshed instead of being replaced by the bodiless HEAD response.
 func (c *Cache) Exec(key string, p Policy, req *http.Request) (*http.Response, error) {
+	if !c.life.acquire() {
+		return nil, ErrClosed
+	}
+	defer c.life.release()
+	return c.execute(key, p, req)
+}
+
+// execute executes the request using the policy cache, storing the response
+// using the key and cache policy.
+func (c *Cache) execute(key string, p Policy, req *http.Request) (*http.Response, error) {
+	res, err := c.policyCache(p).exec(key, p, req)
+	if err != nil {
+		return nil, err
+	}
+	res.Header.Del(methodHeader)
+	return res, nil
+}
+
+// fetchTransport returns the transport for upstream fetches, wrapped with the
+// fetch middleware.
+func (c *Cache) fetchTransport() http.RoundTripper {
 	transport := c.transport
 	if transport == nil {
 		transport = http.DefaultTransport
 	}
+	for i := len(c.fetchMiddleware) - 1; i >= 0; i-- {
+		transport = c.fetchMiddleware[i](transport)
+	}
+	return transport
+}
+
+// exec executes the request, storing the response using the key and cache
+// policy.
+func (c *Cache) exec(key string, p Policy, req *http.Request) (*http.Response, error) {
+	transport := c.fetchTransport()
+	// limit concurrent fetches
+	if c.fetches != nil {
+		select {
+		case c.fetches <- struct{}{}:
+			defer func() { <-c.fetches }()
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	// rate limit fetches
+	if c.limiter != nil {
+		if err := c.limiter.Wait(req.Context()); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrRateLimited, err)
+		}
+	}
 	// grab
-	res, err := transport.RoundTrip(req)
+	var res *http.Response
+	var err error
+	if c.resumeDownloads {
+		res, err = c.resumeFetch(transport, key, req)
+	} else {
+		res, err = transport.RoundTrip(req)
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
+	// the response body is closed by the client when tee streaming
+	var teed bool
+	defer func(body io.Closer) {
+		if !teed {
+			body.Close()
+		}
+	}(res.Body)
+	if c.readLimit != 0 {
+		res.Body = &limitBody{ReadCloser: res.Body, n: c.readLimit}
+	}
+	// record the config version of the matched policy, as the stored policy
+	// is changed below
+	if c.configVersioning {
+		p.version = c.policyVersion(p)
+	}
+	if p.preflight && req.Method == "OPTIONS" {
+		p.maxAge = res.Header.Get("Access-Control-Max-Age")
+	}
+	// refine policy for the response
+	if c.policyRefiner != nil {
+		p = c.policyRefiner(res, p)
+	}
+	if m, ok := c.codecMarshaler(res); ok {
+		p.MarshalUnmarshaler = m
+	}
+	// store already encoded bodies as-is
+	if c.compressionPassthrough && p.MarshalUnmarshaler != nil && isEncoded(res.Header) {
+		c.debug(req.Context(), "passthrough", "key", key, "content-encoding", res.Header.Get("Content-Encoding"))
+		p.MarshalUnmarshaler = encodedMarshalUnmarshaler{}
+	}
+	// rewrite response
+	for _, rw := range c.rewriters {
+		z, err := rw.Rewrite(res)
+		switch {
+		case err != nil:
+			return nil, err
+		case z == nil:
+			return nil, fmt.Errorf("%T returned nil response", rw)
+		}
+		if z != res && z.Body != nil {
+			defer z.Body.Close()
+		}
+		res = z
+	}
+	// determine the file mode for the response
+	mode := c.fileMode
+	if c.modeFunc != nil {
+		if m := c.modeFunc(res); m != 0 {
+			mode = m
+		}
+	}
+	// finalize key
+	if c.keyFinalizer != nil {
+		final := c.keyFinalizer(key, res)
+		if err := c.writeFinal(key, final); err != nil {
+			return nil, err
+		}
+		c.debug(req.Context(), "finalize", "key", key, "final", final)
+		key = final
+	}
+	// keep the stored GET entry when a HEAD response's validators match
+	if req.Method == "HEAD" && c.configMatch(key, p) && c.headValidates(key, p, req, res) {
+		c.debug(req.Context(), "head validated", "key", key)
+		if err := c.touchKey(key); err != nil {
+			return nil, err
+		}
+		if c.epoch != "" {
+			name, err := c.lookup(key)
+			if err != nil {
+				return nil, err
+			}
+			if err := c.writeEpoch(name, mode); err != nil {
+				return nil, err
+			}
+		}
+		return c.load(key, p, req)
+	}
+	// pass through responses with uncacheable status codes or content types
+	if len(p.CacheableStatusCodes) != 0 && !containsInt(p.CacheableStatusCodes, res.StatusCode) || !c.storesContentType(p, req, res) {
+		c.debug(req.Context(), "not cacheable", "key", key, "status", res.StatusCode, "content-type", res.Header.Get("Content-Type"))
+		buf, err := io.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		res.Body = io.NopCloser(bytes.NewReader(buf))
+		return res, nil
+	}
+	var body *countBody
+	if c.cacheEmptyBodies {
+		body = &countBody{ReadCloser: res.Body}
+		res.Body = body
+	}
 	// dump
 	buf, err := httputil.DumpResponse(res, false)
 	if err != nil {
@@ -283,63 +1504,658 @@ func (c *Cache) Exec(key string, p Policy, req *http.Request) (*http.Response, e
 	for _, t := range p.HeaderTransformers {
 		buf = t.HeaderTransform(buf)
 	}
-	// apply body transforms
+	// mark responses for HEAD requests, as they do not have a body
+	if req.Method == "HEAD" {
+		buf = addHeader(buf, methodHeader, "HEAD")
+	}
+	// apply body transforms, storing grpc-web and event stream responses
+	// verbatim to preserve message and event framing
+	contentType, bodyTransformers := res.Header.Get("Content-Type"), p.BodyTransformers
+	if c.contentTypeOverride != nil {
+		if typ := c.contentTypeOverride(req.URL.String(), contentType); typ != contentType {
+			c.debug(req.Context(), "content type override", "key", key, "content-type", typ)
+			if c.contentTypeHeader {
+				buf = addHeader(stripContentTypeHeader(buf), "Content-Type", typ)
+			}
+			contentType = typ
+		}
+	}
+	// return the stored entry when unchanged, and stored with the same config
+	if c.skipUnchanged && req.Method != "HEAD" && c.configMatch(key, p) && c.headerUnchanged(key, p, buf) {
+		c.debug(req.Context(), "unchanged", "key", key, "etag", res.Header.Get("ETag"))
+		if err := c.touchKey(key); err != nil {
+			return nil, err
+		}
+		if c.epoch != "" {
+			name, err := c.lookup(key)
+			if err != nil {
+				return nil, err
+			}
+			if err := c.writeEpoch(name, mode); err != nil {
+				return nil, err
+			}
+		}
+		return c.load(key, p, req)
+	}
+	switch {
+	case isVerbatimContentType(contentType):
+		bodyTransformers = nil
+	case len(bodyTransformers) != 0 && isEncoded(res.Header):
+		// transformers cannot process encoded bodies
+		c.debug(req.Context(), "encoded", "key", key, "content-encoding", res.Header.Get("Content-Encoding"))
+		bodyTransformers = nil
+	}
+	// stream directly to disk when there is nothing to apply to the body
+	if len(bodyTransformers) == 0 && p.MarshalUnmarshaler == nil && p.ResponseFilter == nil && p.BodyValidator == nil && p.StorePredicate == nil && !c.extFromContentType && !c.mirror && c.memory == nil {
+		if req.Method != "HEAD" {
+			buf = stripContentLengthHeader(buf)
+			if c.teeStreaming && len(c.rewriters) == 0 {
+				z, err := c.storeTee(key, p, mode, req, contentType, buf, res.Body)
+				if err != nil && c.failOpen {
+					// pass through the upstream body
+					c.debug(req.Context(), "store error", "key", key, "error", err)
+					if z, err = http.ReadResponse(bufio.NewReader(bytes.NewReader(buf)), req); err != nil {
+						return nil, err
+					}
+					z.Body = res.Body
+				}
+				teed = err == nil
+				return z, err
+			}
+		}
+		// buffer the response when failing open, so that it can be returned
+		// when storing fails
+		if !c.failOpen {
+			return c.storeStream(key, p, mode, req, contentType, buf, res.Body)
+		}
+	}
+	// ensure context body transformers see the overridden content type
+	tres := res
+	if contentType != res.Header.Get("Content-Type") {
+		z := *res
+		z.Header = res.Header.Clone()
+		z.Header.Set("Content-Type", contentType)
+		tres = &z
+	}
 	buf, err = transformAndAppend(
 		buf,
 		res.Body,
-		req.URL.String(),
-		res.StatusCode,
-		res.Header.Get("Content-Type"),
+		req,
+		tres,
+		contentType,
 		req.Method != "HEAD",
-		p.BodyTransformers...,
+		c.buffers(),
+		c.maxTransformMemory,
+		c.transformTrace,
+		bodyTransformers...,
 	)
 	if err != nil {
+		c.debug(req.Context(), "transform error", "key", key, "error", err)
 		return nil, err
 	}
-	body := buf
-	// marshal
-	if p.MarshalUnmarshaler != nil {
-		b := new(bytes.Buffer)
-		if err := p.MarshalUnmarshaler.Marshal(b, bytes.NewReader(buf)); err != nil {
-			return nil, err
+	// validate body
+	if p.BodyValidator != nil && req.Method != "HEAD" {
+		var body []byte
+		if i := bytes.Index(buf, crlfcrlf); i != -1 {
+			body = buf[i+4:]
 		}
-		buf = b.Bytes()
-	}
-	// store
-	if len(buf) != 0 {
-		// ensure path exists
-		if err := c.fs.MkdirAll(path.Dir(key), c.dirMode); err != nil {
-			return nil, err
+		if !p.BodyValidator(body, contentType) {
+			c.debug(req.Context(), "invalid body", "key", key)
+			return nil, ErrInvalidBody
 		}
-		// open cache file
-		f, err := c.fs.OpenFile(key, os.O_APPEND|os.O_CREATE|os.O_WRONLY|os.O_TRUNC, c.fileMode)
+	}
+	// filter
+	if p.ResponseFilter != nil {
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf)), req)
 		if err != nil {
 			return nil, err
 		}
-		if _, err := f.Write(buf); err != nil {
-			return nil, err
+		if !p.ResponseFilter(req, res) {
+			return http.ReadResponse(bufio.NewReader(bytes.NewReader(buf)), req)
 		}
-		if err := f.Close(); err != nil {
+	}
+	// store, checking that the upstream body is empty, as body transformers
+	// may not have read it
+	storeEmpty := false
+	if body != nil && body.n == 0 {
+		_, err := io.ReadFull(body, make([]byte, 1))
+		storeEmpty = errors.Is(err, io.EOF)
+	}
+	if err := c.store(key, p, mode, req, contentType, buf, storeEmpty); err != nil {
+		if !c.failOpen || errors.Is(err, ErrMarshal) {
 			return nil, err
 		}
+		c.debug(req.Context(), "store error", "key", key, "error", err)
 	}
 	// read response
-	return http.ReadResponse(bufio.NewReader(bytes.NewReader(body)), req)
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(buf)), req)
+}
+
+// headValidates determines if the HEAD response's validators match the
+// stored GET entry for the key. The ETag and Last-Modified headers of the
+// response must match the stored entry when present, with at least one
+// present, and the Content-Length of the response (when present) must match
+// the length of the stored body.
+func (c *Cache) headValidates(key string, p Policy, req *http.Request, res *http.Response) bool {
+	etag, lastModified := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+	if res.StatusCode != http.StatusOK || etag == "" && lastModified == "" {
+		return false
+	}
+	z := req.Clone(req.Context())
+	z.Method = "GET"
+	z.Header.Del("Accept-Encoding")
+	stored, err := c.load(key, p, z)
+	if err != nil {
+		return false
+	}
+	defer stored.Body.Close()
+	switch {
+	case stored.StatusCode != http.StatusOK,
+		etag != "" && !etagMatch(stored.Header.Get("ETag"), etag),
+		lastModified != "" && stored.Header.Get("Last-Modified") != lastModified:
+		return false
+	}
+	if s := res.Header.Get("Content-Length"); s != "" {
+		n, err := io.Copy(io.Discard, stored.Body)
+		if err != nil || strconv.FormatInt(n, 10) != s {
+			return false
+		}
+	}
+	return true
 }
 
+// storesContentType determines if the response's content type is stored by
+// the policy, applying any content type override.
+func (c *Cache) storesContentType(p Policy, req *http.Request, res *http.Response) bool {
+	if len(p.storeContentTypes) == 0 && len(p.skipContentTypes) == 0 {
+		return true
+	}
+	contentType := res.Header.Get("Content-Type")
+	if c.contentTypeOverride != nil {
+		contentType = c.contentTypeOverride(req.URL.String(), contentType)
+	}
+	typ, _, _ := mime.ParseMediaType(contentType)
+	typ = strings.ToLower(typ)
+	if len(p.storeContentTypes) != 0 && !matchGlobs(p.storeContentTypes, typ) {
+		return false
+	}
+	return !matchGlobs(p.skipContentTypes, typ)
+}
+
+// storeStream stores the response header buf and body using the key and file
+// mode, streaming the body directly to disk. The returned response's body is
+// read from the stored entry.
+func (c *Cache) storeStream(key string, p Policy, mode os.FileMode, req *http.Request, contentType string, buf []byte, body io.Reader) (*http.Response, error) {
+	if c.lfHeaders {
+		buf = lfHeader(buf)
+	}
+	buf, err := c.prependRequest(buf, req)
+	if err != nil {
+		return nil, err
+	}
+	name := c.storeName(key)
+	// open partial cache file
+	f, tmp, err := c.createTemp(name, mode)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		_ = c.fs.Remove(tmp)
+		return nil, err
+	}
+	n, err := io.Copy(f, body)
+	if err != nil {
+		f.Close()
+		_ = c.fs.Remove(tmp)
+		return nil, err
+	}
+	if err := c.sync(f); err != nil {
+		f.Close()
+		_ = c.fs.Remove(tmp)
+		return nil, err
+	}
+	if err := c.replace(tmp, name); err != nil {
+		f.Close()
+		return nil, err
+	}
+	c.debug(req.Context(), "store", "key", key, "name", name, "size", int64(len(buf))+n)
+	if err := c.writeSidecars(name, key, p, mode, req); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if c.compressionStats != nil {
+		c.compressionStats.add(contentType, int64(len(buf))+n, int64(len(buf))+n)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if c.index != nil {
+		if err := c.index.update(c.fs, name); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	// read response, skipping stored request
+	br := bufio.NewReader(f)
+	if _, err := readStoredRequest(br); err != nil {
+		f.Close()
+		return nil, err
+	}
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	res.Body = &fileBody{ReadCloser: res.Body, f: f}
+	return res, nil
+}
+
+// limitBody wraps a response body, returning ErrReadLimit when more than n
+// bytes are read.
+type limitBody struct {
+	io.ReadCloser
+	n int64
+}
+
+// Read satisfies the io.Reader interface.
+func (b *limitBody) Read(p []byte) (int, error) {
+	if b.n < 0 {
+		return 0, ErrReadLimit
+	}
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.n -= int64(n); b.n < 0 {
+		return n, ErrReadLimit
+	}
+	return n, err
+}
+
+// prependRequest prepends the dumped request to buf, when storing requests.
+func (c *Cache) prependRequest(buf []byte, req *http.Request) ([]byte, error) {
+	if !c.storeRequests {
+		return buf, nil
+	}
+	b, err := dumpRequest(req, c.storeHeaders)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, buf...), nil
+}
+
+// writeSidecars writes the key, epoch, timestamp, config, vary, preflight, and
+// recorded request sidecar files for the stored fs name with the file mode,
+// when enabled.
+func (c *Cache) writeSidecars(name, key string, p Policy, mode os.FileMode, req *http.Request) error {
+	if c.keyHash != nil {
+		if err := c.writeKey(name, key, mode); err != nil {
+			return err
+		}
+	}
+	if c.epoch != "" {
+		if err := c.writeEpoch(name, mode); err != nil {
+			return err
+		}
+	}
+	if err := c.writeTimestamp(name, time.Now(), mode); err != nil {
+		return err
+	}
+	if c.configVersioning {
+		if err := c.writeConfig(name, p, mode); err != nil {
+			return err
+		}
+	}
+	if len(p.Vary) != 0 {
+		if err := c.writeVary(name, req, p.Vary, mode); err != nil {
+			return err
+		}
+	}
+	if p.preflight && req.Method == "OPTIONS" {
+		if err := c.writePreflight(name, p.maxAge, mode); err != nil {
+			return err
+		}
+	}
+	if err := c.writeVersion(name, mode); err != nil {
+		return err
+	}
+	if c.recordRequests {
+		return c.recordRequest(name, req, mode)
+	}
+	return nil
+}
+
+// countBody wraps a response body, counting the bytes read.
+type countBody struct {
+	io.ReadCloser
+	n int64
+}
+
+// Read satisfies the io.Reader interface.
+func (b *countBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// cancelBody wraps a response body, canceling the request's context when the
+// body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close satisfies the io.Closer interface.
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// fileBody wraps a response body read from a file, closing the file when the
+// body is closed.
+type fileBody struct {
+	io.ReadCloser
+	f io.Closer
+}
+
+// Close satisfies the io.Closer interface.
+func (b *fileBody) Close() error {
+	err := b.ReadCloser.Close()
+	if ferr := b.f.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// store marshals and stores the response buf using the key, cache policy, and
+// file mode. Empty marshaled responses are only stored when storeEmpty is
+// true.
+func (c *Cache) store(key string, p Policy, mode os.FileMode, req *http.Request, contentType string, buf []byte, storeEmpty bool) error {
+	raw := buf
+	if c.lfHeaders {
+		buf = lfHeader(buf)
+	}
+	if _, ok := p.MarshalUnmarshaler.(FlatMarshalUnmarshaler); !ok {
+		var err error
+		if buf, err = c.prependRequest(buf, req); err != nil {
+			return err
+		}
+	}
+	size := len(buf)
+	// marshal
+	if p.MarshalUnmarshaler != nil {
+		var err error
+		b := getBuffer(c.buffers())
+		defer putBuffer(c.buffers(), b)
+		if m, ok := p.MarshalUnmarshaler.(URLMarshaler); ok {
+			err = m.MarshalURL(b, bytes.NewReader(buf), req.URL.String())
+		} else {
+			err = p.MarshalUnmarshaler.Marshal(b, bytes.NewReader(buf))
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrMarshal, key, err)
+		}
+		buf = b.Bytes()
+	}
+	if len(buf) == 0 && !storeEmpty {
+		return nil
+	}
+	if p.StorePredicate != nil {
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), req)
+		if err != nil {
+			return err
+		}
+		if !p.StorePredicate(key, buf, res) {
+			c.debug(req.Context(), "store predicate", "key", key)
+			return nil
+		}
+	}
+	name := c.storeName(key)
+	ext := extByContentType(contentType)
+	if c.extFromContentType {
+		name = extEntry(c.name(key), ext)
+	}
+	// touch unchanged entries in place of rewriting
+	if c.skipUnchanged {
+		if c.unchanged(name, p, req, raw) {
+			c.debug(req.Context(), "unchanged", "key", key, "name", name)
+			now := time.Now()
+			if err := c.fs.Chtimes(name, now, now); err != nil {
+				return err
+			}
+			if err := c.writeSidecars(name, key, p, mode, req); err != nil {
+				return err
+			}
+			return c.stored(name, raw)
+		}
+	}
+	// previously stored entry, as the content type may differ
+	var prev string
+	if c.extFromContentType {
+		var err error
+		if prev, err = c.lookup(key); err != nil {
+			return err
+		}
+	}
+	// open partial cache file
+	f, tmp, err := c.createTemp(name, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		_ = c.fs.Remove(tmp)
+		return err
+	}
+	if err := c.sync(f); err != nil {
+		f.Close()
+		_ = c.fs.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = c.fs.Remove(tmp)
+		return err
+	}
+	if err := c.replace(tmp, name); err != nil {
+		return err
+	}
+	if c.extFromContentType {
+		if err := c.writeExt(c.name(key), ext, mode); err != nil {
+			return err
+		}
+	}
+	// remove the previously stored entry once replaced
+	if prev != "" && prev != name {
+		if err := c.fs.Remove(prev); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if c.index != nil {
+			c.index.remove(prev)
+		}
+	}
+	c.debug(req.Context(), "store", "key", key, "name", name, "size", len(buf))
+	if err := c.writeSidecars(name, key, p, mode, req); err != nil {
+		return err
+	}
+	if c.mirror {
+		c.writeMirror(req, contentType, raw, mode)
+	}
+	if c.compressionStats != nil {
+		c.compressionStats.add(contentType, int64(size), int64(len(buf)))
+	}
+	return c.stored(name, raw)
+}
+
+// create creates the fs name with the file mode, ensuring its path exists. The
+// path is recreated when removed prior to opening, such as when the cache
+// directory is cleared at runtime.
+func (c *Cache) create(name string, flag int, mode os.FileMode) (afero.File, error) {
+	for i := 0; ; i++ {
+		if err := c.fs.MkdirAll(path.Dir(name), c.dirMode); err != nil {
+			return nil, c.collisionError(name, err)
+		}
+		f, err := c.fs.OpenFile(name, flag|os.O_CREATE, mode)
+		switch {
+		case err != nil && i == 0 && errors.Is(err, fs.ErrNotExist):
+			continue
+		case err != nil:
+			return nil, c.collisionError(name, err)
+		}
+		return f, nil
+	}
+}
+
+// sync commits the file's contents to stable storage when sync writes are
+// enabled. Errors from fs backends that do not support syncing are ignored.
+func (c *Cache) sync(f afero.File) error {
+	if !c.syncWrites {
+		return nil
+	}
+	if err := f.Sync(); err != nil && !errors.Is(err, errors.ErrUnsupported) && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+	return nil
+}
+
+// stored updates the index and memory layer for the stored fs name, using the
+// unmarshaled response raw.
+func (c *Cache) stored(name string, raw []byte) error {
+	if c.index != nil {
+		if err := c.index.update(c.fs, name); err != nil {
+			return err
+		}
+	}
+	if c.memory != nil {
+		mod, err := c.nameMod(name)
+		if err != nil {
+			return err
+		}
+		c.memory.add(name, mod, raw)
+	}
+	return nil
+}
+
+// methodHeader is the header used to mark the request method of stored
+// responses.
+const methodHeader = "X-Diskcache-Method"
+
+// errMethodMismatch is the method mismatch error.
+var errMethodMismatch = errors.New("method mismatch")
+
+// ErrNotCached is the not cached error.
+var ErrNotCached = errors.New("not cached")
+
+// ErrNotMatched is the not matched error, returned when no matcher matches a
+// request that requires a cache policy.
+var ErrNotMatched = errors.New("no matching policy")
+
+// ErrCorruptEntry is the corrupt entry error, returned when a stored entry
+// cannot be unmarshaled or read. Evicting the entry with EvictKey and
+// refetching is typically sufficient to recover.
+var ErrCorruptEntry = errors.New("corrupt entry")
+
+// ErrTransform is the body transform error. Use errors.As with a
+// *TransformError to retrieve the body transformer and response details.
+var ErrTransform = errors.New("transform error")
+
+// ErrMarshal is the marshal error, returned when a response cannot be
+// marshaled for storage.
+var ErrMarshal = errors.New("marshal error")
+
+// ErrReadLimit is the read limit exceeded error.
+var ErrReadLimit = errors.New("read limit exceeded")
+
+// ErrTransformMemory is the transform memory exceeded error.
+var ErrTransformMemory = errors.New("transform memory exceeded")
+
+// ErrRateLimited is the rate limited error.
+var ErrRateLimited = errors.New("rate limited")
+
+// RateLimiter is the interface for upstream fetch rate limiters, such as
+// golang.org/x/time/rate.Limiter.
+type RateLimiter interface {
+	// Wait blocks until a fetch is permitted, returning an error when the
+	// context is done or a fetch cannot be permitted.
+	Wait(context.Context) error
+}
+
+// ErrInvalidBody is the invalid body error.
+var ErrInvalidBody = errors.New("invalid body")
+
+// ErrContentTooShort is the content too short error.
+var ErrContentTooShort = errors.New("content too short")
+
 // Policy is a disk cache policy.
 type Policy struct {
 	// TTL is the time-to-live.
 	TTL time.Duration
+	// ScheduleTTL returns the time-to-live for the passed current time. When
+	// set, it is used in place of TTL, but is overridden by TTLs added to the
+	// context.
+	ScheduleTTL func(now time.Time) time.Duration
+	// ExpireFunc returns the absolute expiry time for an entry last modified
+	// at the passed time. A zero time indicates no expiry.
+	ExpireFunc func(time.Time) time.Time
+	// StaleFunc determines whether or not an existing entry for the key is
+	// stale, based on its last modified time and the effective TTL. When set,
+	// TTL and ExpireFunc are not otherwise used to determine staleness.
+	StaleFunc func(ctx context.Context, key string, mod time.Time, ttl time.Duration) (bool, error)
 	// HeaderTransformers are the set of header transformers.
 	HeaderTransformers []HeaderTransformer
 	// BodyTransformers are the set of body tranformers.
 	BodyTransformers []BodyTransformer
+	// BodyValidator validates the response body after body transformers have
+	// been applied. Responses with invalid bodies are not stored, and
+	// ErrInvalidBody is returned. Not used for HEAD requests.
+	BodyValidator func(body []byte, contentType string) bool
+	// ResponseFilter determines whether or not a response is stored. Called
+	// after header and body transformers have been applied, and with the
+	// response as it would be stored, prior to marshaling. Responses are
+	// returned, but not stored, when the filter returns false.
+	ResponseFilter func(*http.Request, *http.Response) bool
+	// StorePredicate determines whether or not a response is stored, passed
+	// the key, the marshaled bytes about to be written, and the response as
+	// would be stored. Responses are returned, but not stored, when the
+	// predicate returns false. The data must not be retained after the
+	// predicate returns.
+	StorePredicate func(key string, data []byte, res *http.Response) bool
+	// CacheableStatusCodes are the status codes of responses that are stored.
+	// When set, responses with other status codes are returned, but not
+	// stored.
+	CacheableStatusCodes []int
 	// MarshalUnmarshaler is the marshal/unmarshaler responsible for storage on
 	// disk.
 	MarshalUnmarshaler MarshalUnmarshaler
 	// Validator validates responses.
 	Validator Validator
+	// Fs is the fs used for storing responses, overriding the cache fs when
+	// set.
+	Fs afero.Fs
+	// Label is the policy label, used to scope context TTLs added with
+	// WithContextLabelTTL.
+	Label string
+	// Vary are the request headers hashed into the key, recorded in a vary
+	// sidecar file when storing. See WithNormalizedVaryKey.
+	Vary []string
+	// version is the config version of the policy prior to refinement.
+	version string
+	// storeContentTypes are the content type globs of responses that are
+	// stored.
+	storeContentTypes []glob.Glob
+	// skipContentTypes are the content type globs of responses that are not
+	// stored.
+	skipContentTypes []glob.Glob
+	// preflight toggles using the Access-Control-Max-Age of stored preflight
+	// responses as the TTL.
+	preflight bool
+	// maxAge is the Access-Control-Max-Age of a fetched preflight response,
+	// recorded in a preflight sidecar file when storing.
+	maxAge string
+	// bodyKey is whether or not the matched key includes a hash of the
+	// request body.
+	bodyKey bool
 }
 
 // UserCacheDir returns the user's system cache dir, adding paths to the end.
@@ -361,21 +2177,106 @@ func UserCacheDir(paths ...string) (string, error) {
 	return filepath.Join(append([]string{dir}, paths...)...), nil
 }
 
-// contextKey is a context key.
-type contextKey string
-
-// context keys.
-const (
-	ttlKey contextKey = "ttl"
+// Context keys are unexported struct types, so that values added by the
+// package cannot collide with values added under other keys.
+type (
+	// ttlKey is the context key for the ttl.
+	ttlKey struct{}
+	// labelKey is the context key for policy label ttls.
+	labelKey struct{ label string }
+	// policyKey is the context key for the policy.
+	policyKey struct{}
+	// skipKey is the context key for the body transformer names to skip.
+	skipKey struct{}
 )
 
 // WithContextTTL adds the ttl to the context.
 func WithContextTTL(parent context.Context, ttl time.Duration) context.Context {
-	return context.WithValue(parent, ttlKey, ttl)
+	return context.WithValue(parent, ttlKey{}, ttl)
+}
+
+// WithoutContextTTL clears any ttl added to the parent context.
+func WithoutContextTTL(parent context.Context) context.Context {
+	return context.WithValue(parent, ttlKey{}, nil)
 }
 
 // TTL returns the ttl from the context.
 func TTL(ctx context.Context) (time.Duration, bool) {
-	ttl, ok := ctx.Value(ttlKey).(time.Duration)
+	ttl, ok := ctx.Value(ttlKey{}).(time.Duration)
 	return ttl, ok
 }
+
+// HasContextTTL returns whether or not a ttl was added to the context.
+func HasContextTTL(ctx context.Context) bool {
+	_, ok := TTL(ctx)
+	return ok
+}
+
+// WithContextLabelTTL adds the ttl for policies with the label to the context.
+// A label ttl overrides the ttl added with WithContextTTL for policies with
+// the label, and has no effect on other policies.
+//
+// See WithMatcherLabel.
+func WithContextLabelTTL(parent context.Context, label string, ttl time.Duration) context.Context {
+	return context.WithValue(parent, labelKey{label}, ttl)
+}
+
+// WithoutContextLabelTTL clears any ttl for policies with the label added to
+// the parent context.
+func WithoutContextLabelTTL(parent context.Context, label string) context.Context {
+	return context.WithValue(parent, labelKey{label}, nil)
+}
+
+// LabelTTL returns the ttl for policies with the label from the context.
+func LabelTTL(ctx context.Context, label string) (time.Duration, bool) {
+	if label == "" {
+		return 0, false
+	}
+	ttl, ok := ctx.Value(labelKey{label}).(time.Duration)
+	return ttl, ok
+}
+
+// WithContextPolicy adds the policy to the context. When present, the policy
+// fully overrides the policy matched for the request in RoundTrip and Fetch.
+// Use Match to retrieve the matched policy, and modify the needed fields.
+func WithContextPolicy(parent context.Context, p Policy) context.Context {
+	return context.WithValue(parent, policyKey{}, p)
+}
+
+// WithoutContextPolicy clears any policy added to the parent context.
+func WithoutContextPolicy(parent context.Context) context.Context {
+	return context.WithValue(parent, policyKey{}, nil)
+}
+
+// ContextPolicy returns the policy from the context.
+func ContextPolicy(ctx context.Context) (Policy, bool) {
+	p, ok := ctx.Value(policyKey{}).(Policy)
+	return p, ok
+}
+
+// WithContextSkipTransformers adds the body transformer names to skip to the
+// context. When present, RoundTrip fetches a fresh copy of the response from
+// the upstream without applying the named body transformers (or any body
+// transformers, when no names are passed), such as for returning the
+// un-minified original from a debugging endpoint. Names are matched against
+// the body transformer's name, as used with WithTransformTrace.
+//
+// The fetched response is only returned, and is never stored: any stored
+// entry is neither read nor modified. Header transformers and response
+// rewriters are still applied. Has no effect when replaying.
+func WithContextSkipTransformers(parent context.Context, names ...string) context.Context {
+	return context.WithValue(parent, skipKey{}, names)
+}
+
+// WithoutContextSkipTransformers clears any body transformer names to skip
+// added to the parent context.
+func WithoutContextSkipTransformers(parent context.Context) context.Context {
+	return context.WithValue(parent, skipKey{}, nil)
+}
+
+// SkipTransformers returns the body transformer names to skip from the
+// context.
+func SkipTransformers(ctx context.Context) ([]string, bool) {
+	names, ok := ctx.Value(skipKey{}).([]string)
+	return names, ok
+}
@@ -2,19 +2,44 @@ package diskcache
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"io/fs"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
 	"time"
+
+	"github.com/spf13/afero"
 )
 
 func TestWithContextTTL(t *testing.T) {
@@ -62,6 +87,88 @@ func TestWithContextTTL(t *testing.T) {
 	}
 }
 
+func TestWithContextTTLExpiry(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	tests := []struct {
+		ttl time.Duration
+		exp int
+	}{
+		{1 * time.Hour, 1},
+		{1 * time.Hour, 1},
+		{1 * time.Millisecond, 2},
+		{1 * time.Millisecond, 3},
+		{1 * time.Hour, 3},
+	}
+	for i, test := range tests {
+		// ensure the entry is older than the short ttl
+		<-time.After(2 * time.Millisecond)
+		switch v, err := doReq(WithContextTTL(ctx, test.ttl), cl, s.URL); {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case v != test.exp:
+			t.Errorf("test %d expected %d, got: %d", i, test.exp, v)
+		}
+	}
+}
+
+func TestContextKeys(t *testing.T) {
+	type userKey string
+	ctx := context.WithValue(context.Background(), userKey("ttl"), 5*time.Second)
+	if HasContextTTL(ctx) {
+		t.Errorf("expected no context ttl")
+	}
+	ctx = WithContextTTL(ctx, 1*time.Minute)
+	ctx = WithContextLabelTTL(ctx, "a", 2*time.Minute)
+	ctx = WithContextPolicy(ctx, Policy{TTL: 3 * time.Minute})
+	ctx = WithContextSkipTransformers(ctx)
+	if ttl, ok := TTL(ctx); !ok || ttl != 1*time.Minute || !HasContextTTL(ctx) {
+		t.Errorf("expected ttl %v, got: %v %t", 1*time.Minute, ttl, ok)
+	}
+	if ttl, ok := LabelTTL(ctx, "a"); !ok || ttl != 2*time.Minute {
+		t.Errorf("expected label ttl %v, got: %v %t", 2*time.Minute, ttl, ok)
+	}
+	if p, ok := ContextPolicy(ctx); !ok || p.TTL != 3*time.Minute {
+		t.Errorf("expected policy ttl %v, got: %v %t", 3*time.Minute, p.TTL, ok)
+	}
+	if _, ok := SkipTransformers(ctx); !ok {
+		t.Errorf("expected skip transformers")
+	}
+	if v, ok := ctx.Value(userKey("ttl")).(time.Duration); !ok || v != 5*time.Second {
+		t.Errorf("expected user value %v, got: %v %t", 5*time.Second, v, ok)
+	}
+	ctx = WithoutContextTTL(ctx)
+	ctx = WithoutContextLabelTTL(ctx, "a")
+	ctx = WithoutContextPolicy(ctx)
+	ctx = WithoutContextSkipTransformers(ctx)
+	if _, ok := TTL(ctx); ok || HasContextTTL(ctx) {
+		t.Errorf("expected no context ttl")
+	}
+	if _, ok := LabelTTL(ctx, "a"); ok {
+		t.Errorf("expected no label ttl")
+	}
+	if _, ok := ContextPolicy(ctx); ok {
+		t.Errorf("expected no context policy")
+	}
+	if _, ok := SkipTransformers(ctx); ok {
+		t.Errorf("expected no skip transformers")
+	}
+}
+
 func TestWithMethod(t *testing.T) {
 	// set up simple test server for demonstration
 	var count uint64
@@ -112,37 +219,8151 @@ func TestWithMethod(t *testing.T) {
 	}
 }
 
-func doReq(ctx context.Context, cl *http.Client, urlstr string) (int, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", urlstr, nil)
+func TestWithKeyPrefix(t *testing.T) {
+	// set up simple test server for demonstration
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	baseDir := setupDir(t, "test-with-key-prefix")
+	// create disk cache
+	c, err := New(
+		WithBasePathFs(baseDir),
+		WithKeyPrefix("subsys"),
+		WithTTL(1*time.Hour),
+	)
 	if err != nil {
-		return -1, err
+		t.Fatalf("expected no error, got: %v", err)
 	}
-	res, err := cl.Do(req)
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		v, err := doReq(ctx, cl, s.URL+"/a/b")
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case v != 1:
+			t.Errorf("expected %d, got: %d", 1, v)
+		}
+	}
+	req, err := http.NewRequest("GET", s.URL+"/a/b", nil)
 	if err != nil {
-		return -1, err
+		t.Fatalf("expected no error, got: %v", err)
 	}
-	defer res.Body.Close()
-	buf, err := io.ReadAll(res.Body)
+	key, _, err := c.Match(req)
 	if err != nil {
-		return -1, err
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, "subsys", key)); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := c.Evict(req); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, "subsys", key)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist, got: %v", err)
 	}
-	return strconv.Atoi(string(bytes.TrimSpace(buf)))
 }
 
-func setupDir(t *testing.T, name string) string {
-	t.Helper()
-	wd, err := os.Getwd()
+func TestBase64DecoderNoContentType(t *testing.T) {
+	const body = "aGVsbG8gd29ybGQ="
+	// set up simple test server for demonstration
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		// prevent content type sniffing
+		res.Header()["Content-Type"] = nil
+		fmt.Fprint(res, body)
+	}))
+	defer s.Close()
+	baseDir := setupDir(t, "test-base64-decoder-no-content-type")
+	// create disk cache
+	c, err := New(
+		WithBasePathFs(baseDir),
+		WithBase64Decoder("text/plain"),
+		WithTTL(1*time.Hour),
+	)
 	if err != nil {
 		t.Fatalf("expected no error, got: %v", err)
 	}
-	dir := filepath.Join(wd, ".cache", name)
-	switch err := os.RemoveAll(dir); {
-	case errors.Is(err, os.ErrNotExist):
+	cl := &http.Client{
+		Transport: c,
+	}
+	for i := 0; i < 2; i++ {
+		res, err := cl.Get(s.URL)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case res.Header.Get("Content-Type") != "":
+			t.Errorf("expected no content type, got: %q", res.Header.Get("Content-Type"))
+		case string(buf) != body:
+			t.Errorf("expected %q, got: %q", body, string(buf))
+		}
+	}
+	// empty content types applies to all responses
+	w := new(bytes.Buffer)
+	ok, err := Base64Decoder{}.BodyTransform(w, strings.NewReader(body), s.URL, http.StatusOK, "")
+	switch {
 	case err != nil:
 		t.Fatalf("expected no error, got: %v", err)
+	case !ok:
+		t.Errorf("expected ok")
+	case w.String() != "hello world":
+		t.Errorf("expected %q, got: %q", "hello world", w.String())
 	}
-	if err := os.MkdirAll(dir, 0o755); err != nil {
+}
+
+func TestWithWARCStorage(t *testing.T) {
+	// set up simple test server for demonstration
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	baseDir := setupDir(t, "test-with-warc-storage")
+	// create disk cache
+	c, err := New(
+		WithBasePathFs(baseDir),
+		WithWARCStorage(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
 		t.Fatalf("expected no error, got: %v", err)
 	}
-	return dir
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		v, err := doReq(ctx, cl, s.URL)
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case v != 1:
+			t.Errorf("expected %d, got: %d", 1, v)
+		}
+	}
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	key, _, err := c.Match(req)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	buf, err := os.ReadFile(filepath.Join(baseDir, key))
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case !bytes.HasPrefix(buf, []byte("WARC/1.1\r\nWARC-Type: response\r\n")):
+		t.Errorf("expected WARC response record, got:\n%s", string(buf))
+	case !bytes.Contains(buf, []byte("\r\nWARC-Target-URI: "+s.URL+"\r\n")):
+		t.Errorf("expected WARC-Target-URI %s, got:\n%s", s.URL, string(buf))
+	}
+}
+
+func TestGRPCWebPassthrough(t *testing.T) {
+	// data frame followed by trailers frame
+	body := []byte{0x00, 0x00, 0x00, 0x00, 0x03, 'a', 'b', 'c'}
+	trailers := []byte("grpc-status: 0\r\n")
+	body = append(body, 0x80, 0x00, 0x00, 0x00, byte(len(trailers)))
+	body = append(body, trailers...)
+	// set up simple test server for demonstration
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/grpc-web+proto")
+		_, _ = res.Write(body)
+	}))
+	defer s.Close()
+	baseDir := setupDir(t, "test-grpc-web-passthrough")
+	// create disk cache
+	c, err := New(
+		WithBasePathFs(baseDir),
+		WithMinifier(),
+		WithPrefixStripper([]byte(")]}'")),
+		WithGzipCompression(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	for i := 0; i < 2; i++ {
+		res, err := cl.Get(s.URL)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case !bytes.Equal(buf, body):
+			t.Errorf("expected %q, got: %q", body, buf)
+		}
+	}
+}
+
+func TestEventStreamPassthrough(t *testing.T) {
+	events := []string{
+		"event: a\ndata: 1\n\n",
+		": comment\n\n\n",
+		"event: b\ndata:  2 \ndata: 3\nid: 4\n\n",
+	}
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddUint64(&count, 1)
+		res.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			_, _ = io.WriteString(res, event)
+			res.(http.Flusher).Flush()
+		}
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithMinifier(),
+		WithWhitespaceNormalize("text/event-stream"),
+		WithGzipCompression(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	exp := strings.Join(events, "")
+	for i := 0; i < 2; i++ {
+		res, err := cl.Get(s.URL)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case string(buf) != exp:
+			t.Errorf("test %d expected %q, got: %q", i, exp, string(buf))
+		}
+	}
+	if n := atomic.LoadUint64(&count); n != 1 {
+		t.Errorf("expected %d request, got: %d", 1, n)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	// set up simple test server for demonstration
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	// create disk caches
+	var caches []*Cache
+	for _, name := range []string{"test-export", "test-import"} {
+		c, err := New(
+			WithBasePathFs(setupDir(t, name)),
+			WithTTL(1*time.Hour),
+		)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		caches = append(caches, c)
+	}
+	ctx := context.Background()
+	if _, err := doReq(ctx, &http.Client{Transport: caches[0]}, s.URL+"/a/b"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	if err := caches[0].Export(buf); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := caches[1].Import(buf); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	v, err := doReq(ctx, &http.Client{Transport: caches[1]}, s.URL+"/a/b")
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case v != 1:
+		t.Errorf("expected %d, got: %d", 1, v)
+	}
+}
+
+func TestHTMLStripper(t *testing.T) {
+	tests := []struct {
+		t   HTMLStripper
+		s   string
+		exp string
+	}{
+		{
+			HTMLStripper{RemoveScripts: true, RemoveComments: true, RemoveStyles: true},
+			`<html><head><style>p { color: red; }</style><script src="a.js"></script></head><!-- comment --><body><p>hello</p><script>alert("</p>");</script></body></html>`,
+			`<html><head></head><body><p>hello</p></body></html>`,
+		},
+		{
+			HTMLStripper{RemoveEventHandlers: true, RemoveNoscript: true},
+			`<p onclick="alert(1)" class="a">hello</p><noscript><p>no <noscript>script</noscript></p></noscript><!-- comment -->`,
+			`<p class="a">hello</p><!-- comment -->`,
+		},
+		{
+			HTMLStripper{RemoveScripts: true},
+			`<p>unterminated <script>alert(1)`,
+			`<p>unterminated `,
+		},
+	}
+	for i, test := range tests {
+		w := new(bytes.Buffer)
+		ok, err := test.t.BodyTransform(w, strings.NewReader(test.s), "", http.StatusOK, "text/html; charset=utf-8")
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case !ok:
+			t.Errorf("test %d expected ok", i)
+		case w.String() != test.exp:
+			t.Errorf("test %d expected:\n%s\ngot:\n%s", i, test.exp, w.String())
+		}
+	}
+}
+
+func TestURLRewriter(t *testing.T) {
+	base, err := url.Parse("https://example.com/")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cdn := func(u *url.URL) *url.URL {
+		if u.Host == "cdn.example.com" {
+			u.Host = "example.com"
+		}
+		return u
+	}
+	tests := []struct {
+		urlstr      string
+		contentType string
+		s           string
+		exp         string
+	}{
+		{
+			"https://example.com/a/b/index.html",
+			"text/html; charset=utf-8",
+			`<a href="https://example.com/a/c/d.html?q=1#top">d</a><img src='/img/e.png'><a href="f.html">f</a><a href="https://other.com/">o</a>`,
+			`<a href="../c/d.html?q=1#top">d</a><img src="../../img/e.png"><a href="f.html">f</a><a href="https://other.com/">o</a>`,
+		},
+		{
+			"https://example.com/",
+			"text/html",
+			`<style>body { background: url('/a/bg.png') }</style><p style="background: url(//cdn.example.com/b.png)">x</p><a href="/">home</a>`,
+			`<style>body { background: url("a/bg.png") }</style><p style="background: url('b.png')">x</p><a href="./">home</a>`,
+		},
+		{
+			"https://example.com/css/site.css",
+			"text/css",
+			`a { background: url("https://example.com/img/a.png"); } b { background: url(data:image/png;base64,AA==); }`,
+			`a { background: url("../img/a.png"); } b { background: url(data:image/png;base64,AA==); }`,
+		},
+		{
+			"https://example.com/a.js",
+			"application/javascript",
+			`fetch("https://example.com/b")`,
+			`fetch("https://example.com/b")`,
+		},
+		{
+			"https://other.com/index.html",
+			"text/html",
+			`<a href="https://example.com/a">a</a>`,
+			`<a href="https://example.com/a">a</a>`,
+		},
+	}
+	tr := URLRewriter{Base: base, Rules: []func(*url.URL) *url.URL{cdn}}
+	for i, test := range tests {
+		w := new(bytes.Buffer)
+		ok, err := tr.BodyTransform(w, strings.NewReader(test.s), test.urlstr, http.StatusOK, test.contentType)
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case !ok:
+			t.Errorf("test %d expected ok", i)
+		case w.String() != test.exp:
+			t.Errorf("test %d expected:\n%s\ngot:\n%s", i, test.exp, w.String())
+		}
+	}
+	if _, err := New(WithURLRewriter("/no/host")); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestGzipTrailingData(t *testing.T) {
+	z := GzipMarshalUnmarshaler{Level: gzip.DefaultCompression}
+	var streams [][]byte
+	for _, s := range []string{"first", "second"} {
+		buf := new(bytes.Buffer)
+		if err := z.Marshal(buf, strings.NewReader(s)); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		streams = append(streams, buf.Bytes())
+	}
+	tests := []struct {
+		buf []byte
+		exp error
+	}{
+		{streams[0], nil},
+		{append(append([]byte(nil), streams[0]...), streams[1]...), ErrTrailingData},
+		{append(append([]byte(nil), streams[0]...), streams[1][:5]...), ErrTrailingData},
+	}
+	for i, test := range tests {
+		w := new(bytes.Buffer)
+		if err := z.Unmarshal(w, bytes.NewReader(test.buf)); !errors.Is(err, test.exp) {
+			t.Errorf("test %d expected error %v, got: %v", i, test.exp, err)
+		}
+	}
+	// set up simple test server for demonstration
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	baseDir := setupDir(t, "test-gzip-trailing-data")
+	// create disk cache
+	c, err := New(
+		WithBasePathFs(baseDir),
+		WithGzipCompression(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	if _, err := doReq(ctx, cl, s.URL); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// corrupt stored entry
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	key, _, err := c.Match(req)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	f, err := os.OpenFile(filepath.Join(baseDir, key), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := f.Write(streams[1][:5]); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	v, err := doReq(ctx, cl, s.URL)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case v != 2:
+		t.Errorf("expected %d, got: %d", 2, v)
+	}
+}
+
+func TestWithAgeHeader(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(res, "1")
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithAgeHeader(),
+		WithTTL(2*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	name := "http/" + u.Host + "/a"
+	for i, exp := range []string{"", "3600"} {
+		res, err := cl.Get(s.URL + "/a")
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		res.Body.Close()
+		// the age is only added to loaded responses
+		if age := res.Header.Get("Age"); age != exp {
+			t.Errorf("test %d expected age %q, got: %q", i, exp, age)
+		}
+		mod := time.Now().Add(-1 * time.Hour)
+		if err := fs.Chtimes(name, mod, mod); err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+	}
+	// the age is not stored
+	buf, err := afero.ReadFile(fs, name)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if bytes.Contains(buf, []byte("Age:")) {
+		t.Errorf("expected no stored age header, got: %q", buf)
+	}
+}
+
+func TestWithAgeHeaderModError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(res, "1")
+	}))
+	defer s.Close()
+	fs := &statErrFs{openFs: &openFs{Fs: afero.NewMemMapFs()}}
+	c, err := New(
+		WithFs(fs),
+		WithAgeHeader(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	ctx := context.Background()
+	if v, err := doReq(ctx, &http.Client{Transport: c}, s.URL+"/a"); err != nil || v != 1 {
+		t.Fatalf("expected 1, got: %d %v", v, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", s.URL+"/a", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	key, p, err := c.Match(req)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	fs.fail.Store(true)
+	if _, err := c.Load(key, p, req); err == nil || err.Error() != "stat failed" {
+		t.Fatalf("expected stat failed error, got: %v", err)
+	}
+	// the entry is closed when the age cannot be determined
+	if n := atomic.LoadInt64(&fs.open); n != 0 {
+		t.Errorf("expected 0 open files, got: %d", n)
+	}
+}
+
+// statErrFs wraps an openFs, failing stats when set.
+type statErrFs struct {
+	*openFs
+	fail atomic.Bool
+}
+
+func (fs *statErrFs) Stat(name string) (os.FileInfo, error) {
+	if fs.fail.Load() {
+		return nil, errors.New("stat failed")
+	}
+	return fs.openFs.Stat(name)
+}
+
+func TestWithServeStaleOnError(t *testing.T) {
+	// set up simple test server for demonstration
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	baseDir := setupDir(t, "test-with-serve-stale-on-error")
+	// create disk cache
+	var fail atomic.Bool
+	c, err := New(
+		WithBasePathFs(baseDir),
+		WithTransport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if fail.Load() {
+				return nil, errors.New("origin unavailable")
+			}
+			return http.DefaultTransport.RoundTrip(req)
+		})),
+		WithServeStaleOnError(),
+		WithTTL(1*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	if _, err := doReq(ctx, cl, s.URL); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	fail.Store(true)
+	<-time.After(2 * time.Millisecond)
+	v, err := doReq(ctx, cl, s.URL)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case v != 1:
+		t.Errorf("expected %d, got: %d", 1, v)
+	}
+	if _, err := doReq(ctx, cl, s.URL+"/not-cached"); err == nil {
+		t.Errorf("expected error, got: nil")
+	}
+}
+
+func TestWithRevalidateTimeout(t *testing.T) {
+	var count uint64
+	var slow atomic.Bool
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		n := atomic.AddUint64(&count, 1)
+		if slow.Load() {
+			select {
+			case <-time.After(5 * time.Second):
+			case <-req.Context().Done():
+				return
+			}
+		}
+		fmt.Fprintf(res, "%d\n", n)
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithRevalidateTimeout(50*time.Millisecond),
+		WithTTL(1*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	if v, err := doReq(ctx, cl, s.URL); err != nil || v != 1 {
+		t.Fatalf("expected 1, got: %d %v", v, err)
+	}
+	// stale entry is served when the refetch times out
+	slow.Store(true)
+	<-time.After(2 * time.Millisecond)
+	start := time.Now()
+	res, err := cl.Get(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	buf, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case string(buf) != "1\n":
+		t.Errorf("expected %q, got: %q", "1\n", string(buf))
+	case res.Header.Get("Warning") == "":
+		t.Errorf("expected Warning header")
+	case time.Since(start) > 1*time.Second:
+		t.Errorf("expected refetch to time out, took: %v", time.Since(start))
+	}
+	// stale entry is refreshed when the origin is responsive
+	slow.Store(false)
+	if v, err := doReq(ctx, cl, s.URL); err != nil || v != 3 {
+		t.Errorf("expected 3, got: %d %v", v, err)
+	}
+}
+
+func BenchmarkExec(b *testing.B) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	// set up simple test server for demonstration
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = res.Write(body)
+	}))
+	defer s.Close()
+	for _, test := range []struct {
+		name string
+		opts []Option
+	}{
+		{"stream", nil},
+		{"buffered", []Option{
+			WithBodyTransformFunc(TransformPriorityModify, func(w io.Writer, r io.Reader, _ string, _ int, _ string) (bool, error) {
+				_, err := io.Copy(w, r)
+				return err == nil, err
+			}),
+		}},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			baseDir := setupDir(b, "benchmark-exec-"+test.name)
+			// create disk cache
+			c, err := New(append([]Option{WithBasePathFs(baseDir)}, test.opts...)...)
+			if err != nil {
+				b.Fatalf("expected no error, got: %v", err)
+			}
+			req, err := http.NewRequest("GET", s.URL, nil)
+			if err != nil {
+				b.Fatalf("expected no error, got: %v", err)
+			}
+			key, p, err := c.Match(req)
+			if err != nil {
+				b.Fatalf("expected no error, got: %v", err)
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				res, err := c.Exec(key, p, req)
+				if err != nil {
+					b.Fatalf("expected no error, got: %v", err)
+				}
+				if _, err := io.Copy(io.Discard, res.Body); err != nil {
+					b.Fatalf("expected no error, got: %v", err)
+				}
+				res.Body.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	buf := append([]byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n"), bytes.Repeat([]byte("0123456789abcdef"), 1024)...)
+	for _, test := range []struct {
+		name string
+		m    MarshalUnmarshaler
+	}{
+		{"gzip", GzipMarshalUnmarshaler{Level: gzip.DefaultCompression}},
+		{"zlib", ZlibMarshalUnmarshaler{Level: zlib.DefaultCompression}},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			w, r := new(bytes.Buffer), new(bytes.Buffer)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(buf)))
+			for i := 0; i < b.N; i++ {
+				w.Reset()
+				if err := test.m.Marshal(w, bytes.NewReader(buf)); err != nil {
+					b.Fatalf("expected no error, got: %v", err)
+				}
+				r.Reset()
+				if err := test.m.Unmarshal(r, w); err != nil {
+					b.Fatalf("expected no error, got: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkTransformAndAppend(b *testing.B) {
+	header := []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n")
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	var transformers []BodyTransformer
+	for i := 0; i < 3; i++ {
+		transformers = append(transformers, BodyTransformerFunc(func(w io.Writer, r io.Reader, _ string, _ int, _ string) (bool, error) {
+			_, err := io.Copy(w, r)
+			return err == nil, err
+		}))
+	}
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"text/plain"}}}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	for i := 0; i < b.N; i++ {
+		if _, err := transformAndAppend(header, bytes.NewReader(body), req, res, "text/plain", true, defaultBufferPool, 0, nil, transformers...); err != nil {
+			b.Fatalf("expected no error, got: %v", err)
+		}
+	}
+}
+
+func BenchmarkTransformLarge(b *testing.B) {
+	header := []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n")
+	// larger than maxPooledBuffer, so each copy of the body is allocated
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<18)
+	var transformers []BodyTransformer
+	for i := 0; i < 3; i++ {
+		transformers = append(transformers, BodyTransformerFunc(func(w io.Writer, r io.Reader, _ string, _ int, _ string) (bool, error) {
+			_, err := io.Copy(w, r)
+			return err == nil, err
+		}))
+	}
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"text/plain"}}}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	for i := 0; i < b.N; i++ {
+		if _, err := transformAndAppend(header, bytes.NewReader(body), req, res, "text/plain", true, defaultBufferPool, 0, nil, transformers...); err != nil {
+			b.Fatalf("expected no error, got: %v", err)
+		}
+	}
+}
+
+func TestHeadValidatesGet(t *testing.T) {
+	var gets, heads uint64
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("ETag", etag.Load().(string))
+		res.Header().Set("Content-Length", "2")
+		if req.Method == "HEAD" {
+			atomic.AddUint64(&heads, 1)
+			return
+		}
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&gets, 1))
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithMethod("GET", "HEAD"),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	name := "http/" + u.Host + "/a"
+	expire := func() {
+		old := time.Now().Add(-2 * time.Hour)
+		if err := fs.Chtimes(name, old, old); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	doHead := func() {
+		req, err := http.NewRequestWithContext(ctx, "HEAD", s.URL+"/a", nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		res, err := cl.Do(req)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		res.Body.Close()
+		if s, exp := res.Header.Get("ETag"), etag.Load().(string); s != exp {
+			t.Errorf("expected %q, got: %q", exp, s)
+		}
+	}
+	if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != 1 {
+		t.Errorf("expected 1, got: %d %v", v, err)
+	}
+	// head with matching validators refreshes the get entry
+	expire()
+	doHead()
+	if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != 1 {
+		t.Errorf("expected 1, got: %d %v", v, err)
+	}
+	// head with changed validators replaces the get entry
+	etag.Store(`"v2"`)
+	expire()
+	doHead()
+	for i := 0; i < 2; i++ {
+		if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != 2 {
+			t.Errorf("test %d expected 2, got: %d %v", i, v, err)
+		}
+	}
+	if n := atomic.LoadUint64(&heads); n != 2 {
+		t.Errorf("expected 2 heads, got: %d", n)
+	}
+}
+
+func TestMethodMismatch(t *testing.T) {
+	// set up simple test server for demonstration
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "HEAD" {
+			fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+		}
+	}))
+	defer s.Close()
+	baseDir := setupDir(t, "test-method-mismatch")
+	// create disk cache
+	c, err := New(
+		WithBasePathFs(baseDir),
+		WithMethod("GET", "HEAD"),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	doHead := func(urlstr string) {
+		req, err := http.NewRequestWithContext(ctx, "HEAD", urlstr, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		res, err := cl.Do(req)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		res.Body.Close()
+		switch {
+		case res.StatusCode != http.StatusOK:
+			t.Errorf("expected status %d, got: %d", http.StatusOK, res.StatusCode)
+		case res.Header.Get(methodHeader) != "":
+			t.Errorf("expected no %s header, got: %q", methodHeader, res.Header.Get(methodHeader))
+		}
+	}
+	// head after get uses the cached get
+	if _, err := doReq(ctx, cl, s.URL+"/get-head"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	doHead(s.URL + "/get-head")
+	if count != 1 {
+		t.Errorf("expected count == %d, got: %d", 1, count)
+	}
+	// get after head refetches
+	doHead(s.URL + "/head-get")
+	for i := 0; i < 2; i++ {
+		v, err := doReq(ctx, cl, s.URL+"/head-get")
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case v != 2:
+			t.Errorf("expected %d, got: %d", 2, v)
+		}
+	}
+}
+
+func TestWithCompressionStats(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		res.Write(bytes.Repeat([]byte("compress me\n"), 1000))
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithGzipCompression(),
+		WithCompressionStats(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	for _, p := range []string{"/a", "/b", "/a"} {
+		res, err := cl.Get(s.URL + p)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+	stats := c.CompressionStats()
+	stat, ok := stats["text/plain"]
+	switch {
+	case len(stats) != 1 || !ok:
+		t.Fatalf("expected text/plain stats, got: %v", stats)
+	case stat.Count != 2:
+		t.Errorf("expected count %d, got: %d", 2, stat.Count)
+	case stat.Size <= stat.StoredSize:
+		t.Errorf("expected size %d > stored size %d", stat.Size, stat.StoredSize)
+	case stat.Ratio() <= 1:
+		t.Errorf("expected ratio > 1, got: %f", stat.Ratio())
+	}
+}
+
+func TestWithRateLimiter(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	limiter := &quotaLimiter{n: 1}
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithRateLimiter(limiter),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		switch v, err := doReq(ctx, cl, s.URL+"/a"); {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case v != 1:
+			t.Errorf("expected %d, got: %d", 1, v)
+		}
+	}
+	if _, err := doReq(ctx, cl, s.URL+"/b"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("expected ErrRateLimited, got: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("expected count == %d, got: %d", 1, count)
+	}
+}
+
+// quotaLimiter is a rate limiter permitting n fetches.
+type quotaLimiter struct {
+	n int
+}
+
+func (l *quotaLimiter) Wait(context.Context) error {
+	if l.n == 0 {
+		return errors.New("quota exhausted")
+	}
+	l.n--
+	return nil
+}
+
+func TestWithHostFromHeader(t *testing.T) {
+	tests := []struct {
+		opts []Option
+		host string
+		exp  string
+	}{
+		{nil, "example.com", "http/10.0.0.1/path"},
+		{nil, "", "http/10.0.0.1/path"},
+		{[]Option{WithHostFromHeader()}, "example.com", "http/example.com/path"},
+		{[]Option{WithHostFromHeader()}, "", "http/10.0.0.1/path"},
+	}
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			c, err := New(append([]Option{WithFs(afero.NewMemMapFs())}, test.opts...)...)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			req, err := http.NewRequest("GET", "http://10.0.0.1/path", nil)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			req.Host = test.host
+			key, _, err := c.Match(req)
+			switch {
+			case err != nil:
+				t.Fatalf("expected no error, got: %v", err)
+			case key != test.exp:
+				t.Errorf("expected %q, got: %q", test.exp, key)
+			}
+		})
+	}
+}
+
+func TestWithTransformTrace(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain")
+		res.WriteHeader(http.StatusNotFound)
+		res.Write([]byte("not found"))
+	}))
+	defer s.Close()
+	var trace []string
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithBodyTransformFunc(TransformPriorityFirst, func(w io.Writer, r io.Reader, _ string, _ int, _ string) (bool, error) {
+			_, err := io.Copy(w, io.MultiReader(r, strings.NewReader("!")))
+			return true, err
+		}),
+		WithErrorTruncator(),
+		WithTransformTrace(func(name string, before, after int, shortCircuit bool) {
+			trace = append(trace, fmt.Sprintf("%s %d %d %t", name, before, after, shortCircuit))
+		}),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	res, err := cl.Get(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	res.Body.Close()
+	exp := []string{
+		"diskcache.BodyTransformerFunc 9 10 false",
+		"diskcache.Truncator 10 0 true",
+	}
+	if !slices.Equal(trace, exp) {
+		t.Errorf("expected %q, got: %q", exp, trace)
+	}
+}
+
+func TestWithQuerySort(t *testing.T) {
+	tests := []struct {
+		opts []Option
+		exp  string
+	}{
+		{nil, "http/example.com/path_a%3D3%26a%3D1%26b%3D2"},
+		{[]Option{WithQuerySort()}, "http/example.com/path_a%3D1%26a%3D3%26b%3D2"},
+		{[]Option{WithQueryPrefix("_", "a"), WithQuerySort()}, "http/example.com/path_a%3D1%26a%3D3"},
+		{[]Option{WithQuerySort(), WithQueryPrefix("_", "a")}, "http/example.com/path_a%3D1%26a%3D3"},
+	}
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			c, err := New(append([]Option{WithFs(afero.NewMemMapFs())}, test.opts...)...)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			req, err := http.NewRequest("GET", "http://example.com/path?b=2&a=3&a=1", nil)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			key, _, err := c.Match(req)
+			switch {
+			case err != nil:
+				t.Fatalf("expected no error, got: %v", err)
+			case key != test.exp:
+				t.Errorf("expected %q, got: %q", test.exp, key)
+			}
+		})
+	}
+}
+
+func TestWithIgnoreQueryParams(t *testing.T) {
+	var count uint64
+	var mu sync.Mutex
+	var queries []string
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		queries = append(queries, req.URL.RawQuery)
+		mu.Unlock()
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithIgnoreQueryParams("utm_source", "gclid"),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	tests := []struct {
+		query string
+		exp   int
+	}{
+		{"?a=1&utm_source=x", 1},
+		{"?a=1&utm_source=y&gclid=z", 1},
+		{"?a=1", 1},
+		{"?a=2&utm_source=x", 2},
+	}
+	for i, test := range tests {
+		v, err := doReq(ctx, cl, s.URL+test.query)
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case v != test.exp:
+			t.Errorf("test %d expected %d, got: %d", i, test.exp, v)
+		}
+	}
+	// ignored fields are sent upstream
+	if exp := []string{"a=1&utm_source=x", "a=2&utm_source=x"}; !slices.Equal(queries, exp) {
+		t.Errorf("expected %q, got: %q", exp, queries)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithGzipCompression(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	for _, p := range []string{"/a", "/b", "/c"} {
+		if _, err := doReq(ctx, cl, s.URL+p); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	key := "http/" + u.Host + "/b"
+	if err := afero.WriteFile(fs, key, []byte("corrupt"), 0o644); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for i, repair := range []bool{false, true} {
+		report, err := c.Verify(repair)
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case report.Count != 3:
+			t.Errorf("test %d expected count %d, got: %d", i, 3, report.Count)
+		case !slices.Equal(report.Bad, []string{key}):
+			t.Errorf("test %d expected bad %q, got: %q", i, []string{key}, report.Bad)
+		}
+	}
+	report, err := c.Verify(false)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case report.Count != 2 || len(report.Bad) != 0:
+		t.Errorf("expected count 2 and no bad entries, got: %+v", report)
+	}
+}
+
+func TestAnalyzeDuplication(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/c":
+			res.Write([]byte("other"))
+		case "/e":
+		default:
+			res.Write([]byte("duplicate"))
+		}
+	}))
+	defer s.Close()
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithGzipCompression(),
+		WithTTL(1*time.Hour),
+		WithWalkConcurrency(4),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	for _, p := range []string{"/a", "/b", "/c", "/d", "/e", "/f"} {
+		res, err := cl.Get(s.URL + p)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		_, _ = io.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	prefix := "http/" + u.Host
+	if err := afero.WriteFile(fs, prefix+"/f", []byte("corrupt"), 0o644); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	report, err := c.AnalyzeDuplication()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	exp := DedupReport{
+		Count:          6,
+		Skipped:        1,
+		Unique:         3,
+		LogicalBytes:   3*9 + 5,
+		UniqueBytes:    9 + 5,
+		DuplicateBytes: 2 * 9,
+		Duplicates:     [][]string{{prefix + "/a", prefix + "/b", prefix + "/d"}},
+	}
+	if !reflect.DeepEqual(report, exp) {
+		t.Errorf("expected %+v, got: %+v", exp, report)
+	}
+}
+
+func TestWithMaxConcurrentFetches(t *testing.T) {
+	var count, active, peak int64
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt64(&active, 1)
+		defer atomic.AddInt64(&active, -1)
+		for m := atomic.LoadInt64(&peak); n > m && !atomic.CompareAndSwapInt64(&peak, m, n); m = atomic.LoadInt64(&peak) {
+		}
+		if req.URL.Path != "/cached" {
+			<-release
+		}
+		fmt.Fprintf(res, "%d\n", atomic.AddInt64(&count, 1))
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+		WithMaxConcurrentFetches(2),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	if v, err := doReq(ctx, cl, s.URL+"/cached"); err != nil || v != 1 {
+		t.Errorf("expected 1, got: %d %v", v, err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := doReq(ctx, cl, s.URL+"/"+strconv.Itoa(i)); err != nil {
+				t.Errorf("expected no error, got: %v", err)
+			}
+		}(i)
+	}
+	for start := time.Now(); atomic.LoadInt64(&active) < 2; <-time.After(1 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("expected fetches")
+		}
+	}
+	// requests for cached entries are not limited
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if v, err := doReq(ctx, cl, s.URL+"/cached"); err != nil || v != 1 {
+			t.Errorf("expected 1, got: %d %v", v, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected cached request to not be limited")
+	}
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt64(&peak); n != 2 {
+		t.Errorf("expected peak concurrent fetches == 2, got: %d", n)
+	}
+	if n := atomic.LoadInt64(&count); n != 7 {
+		t.Errorf("expected count == 7, got: %d", n)
+	}
+	if _, err := New(WithMaxConcurrentFetches(0)); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestWithReadLimit(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write(bytes.Repeat([]byte("a"), 4096))
+	}))
+	defer s.Close()
+	tests := []struct {
+		limit int64
+		opts  []Option
+		err   error
+	}{
+		{4096, nil, nil},
+		{4095, nil, ErrReadLimit},
+		{4096, []Option{WithGzipCompression()}, nil},
+		{1024, []Option{WithGzipCompression()}, ErrReadLimit},
+	}
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			c, err := New(append([]Option{
+				WithFs(afero.NewMemMapFs()),
+				WithReadLimit(test.limit),
+				WithTTL(1 * time.Hour),
+			}, test.opts...)...)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			cl := &http.Client{
+				Transport: c,
+			}
+			res, err := cl.Get(s.URL)
+			if err == nil {
+				_, err = io.ReadAll(res.Body)
+				res.Body.Close()
+			}
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got: %v", test.err, err)
+			}
+			req, err := http.NewRequest("GET", s.URL, nil)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			switch cached, err := c.Cached(req); {
+			case err != nil:
+				t.Fatalf("expected no error, got: %v", err)
+			case cached != (test.err == nil):
+				t.Errorf("expected cached %t, got: %t", test.err == nil, cached)
+			}
+		})
+	}
+}
+
+func TestWithMaxTransformMemory(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write(bytes.Repeat([]byte("a"), 4096))
+	}))
+	defer s.Close()
+	identity := BodyTransformerFunc(func(w io.Writer, r io.Reader, _ string, _ int, _ string) (bool, error) {
+		_, err := io.Copy(w, r)
+		return err == nil, err
+	})
+	tests := []struct {
+		limit int64
+		n     int
+		err   error
+	}{
+		{4096, 1, nil},
+		{4095, 1, ErrTransformMemory},
+		{8192, 3, nil},
+		{8191, 3, ErrTransformMemory},
+	}
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var transformers []BodyTransformer
+			for j := 0; j < test.n; j++ {
+				transformers = append(transformers, identity)
+			}
+			c, err := New(
+				WithFs(afero.NewMemMapFs()),
+				WithMaxTransformMemory(test.limit),
+				WithBodyTransformers(transformers...),
+				WithTTL(1*time.Hour),
+			)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			cl := &http.Client{
+				Transport: c,
+			}
+			res, err := cl.Get(s.URL)
+			if err == nil {
+				_, err = io.ReadAll(res.Body)
+				res.Body.Close()
+			}
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got: %v", test.err, err)
+			}
+			if test.err != nil && !errors.Is(err, ErrTransform) {
+				t.Errorf("expected error %v, got: %v", ErrTransform, err)
+			}
+			req, err := http.NewRequest("GET", s.URL, nil)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			switch cached, err := c.Cached(req); {
+			case err != nil:
+				t.Fatalf("expected no error, got: %v", err)
+			case cached != (test.err == nil):
+				t.Errorf("expected cached %t, got: %t", test.err == nil, cached)
+			}
+		})
+	}
+}
+
+func TestWithMatcherFs(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cacheFs, matcherFs := afero.NewMemMapFs(), afero.NewMemMapFs()
+	m, err := NewSimpleMatcher(
+		"GET",
+		"^http://"+regexp.QuoteMeta(u.Host)+"$",
+		`^/tier/(?P<path>.*)$`,
+		`tier/{{path}}`,
+		WithMatcherFs(matcherFs),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	c, err := New(
+		WithFs(cacheFs),
+		WithMatchers(m),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		for j, p := range []string{"/tier/a", "/a"} {
+			switch v, err := doReq(ctx, cl, s.URL+p); {
+			case err != nil:
+				t.Fatalf("expected no error, got: %v", err)
+			case v != j+1:
+				t.Errorf("expected %d, got: %d", j+1, v)
+			}
+		}
+	}
+	for _, test := range []struct {
+		fs     afero.Fs
+		name   string
+		exists bool
+	}{
+		{matcherFs, "tier/a", true},
+		{cacheFs, "tier/a", false},
+		{cacheFs, "http/" + u.Host + "/a", true},
+		{matcherFs, "http/" + u.Host + "/a", false},
+	} {
+		if exists, _ := afero.Exists(test.fs, test.name); exists != test.exists {
+			t.Errorf("expected %s exists %t, got: %t", test.name, test.exists, exists)
+		}
+	}
+	req, err := http.NewRequest("GET", s.URL+"/tier/a", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := c.Evict(req); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if exists, _ := afero.Exists(matcherFs, "tier/a"); exists {
+		t.Errorf("expected tier/a to be evicted")
+	}
+}
+
+func TestWithCacheEmptyBodies(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddUint64(&count, 1)
+		switch req.URL.Path {
+		case "/empty":
+			res.WriteHeader(http.StatusNoContent)
+		case "/error":
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write([]byte("error"))
+		}
+	}))
+	defer s.Close()
+	tests := []struct {
+		opts []Option
+		path string
+		exp  uint64
+	}{
+		{nil, "/empty", 2},
+		{[]Option{WithCacheEmptyBodies()}, "/empty", 1},
+		{[]Option{WithCacheEmptyBodies(), WithErrorTruncator()}, "/error", 2},
+	}
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			atomic.StoreUint64(&count, 0)
+			c, err := New(append([]Option{
+				WithFs(afero.NewMemMapFs()),
+				WithFlatStorage(),
+				WithTTL(1 * time.Hour),
+			}, test.opts...)...)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			cl := &http.Client{
+				Transport: c,
+			}
+			for j := 0; j < 2; j++ {
+				res, err := cl.Get(s.URL + test.path)
+				if err != nil {
+					t.Fatalf("expected no error, got: %v", err)
+				}
+				buf, err := io.ReadAll(res.Body)
+				res.Body.Close()
+				switch {
+				case err != nil:
+					t.Fatalf("expected no error, got: %v", err)
+				case len(buf) != 0:
+					t.Errorf("expected empty body, got: %q", string(buf))
+				}
+			}
+			if n := atomic.LoadUint64(&count); n != test.exp {
+				t.Errorf("expected count == %d, got: %d", test.exp, n)
+			}
+		})
+	}
+}
+
+func TestWithPreferCachedOnServerError(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if n := atomic.AddUint64(&count, 1); n > 1 {
+			res.WriteHeader(http.StatusBadGateway)
+		}
+		fmt.Fprintf(res, "%d\n", count)
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithPreferCachedOnServerError(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	if v, err := doReq(ctx, cl, s.URL); err != nil || v != 1 {
+		t.Fatalf("expected 1 and no error, got: %d %v", v, err)
+	}
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	key, p, err := c.Match(req)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		_, _, res, err := c.Fetch(key, p, req, true)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case res.StatusCode != http.StatusOK:
+			t.Errorf("expected status %d, got: %d", http.StatusOK, res.StatusCode)
+		case string(buf) != "1\n":
+			t.Errorf("expected %q, got: %q", "1\n", string(buf))
+		case res.Header.Get("Warning") == "":
+			t.Errorf("expected Warning header")
+		}
+	}
+}
+
+func TestNewDir(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(res, 1)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	root := setupDir(t, "test-new-dir")
+	tests := []struct {
+		f   func() (*Cache, error)
+		dir string
+	}{
+		{func() (*Cache, error) { return NewDir(filepath.Join(root, "dir")) }, filepath.Join(root, "dir")},
+		{func() (*Cache, error) { return NewAppCache("app", WithCacheRoot(root)) }, filepath.Join(root, "app")},
+	}
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			c, err := test.f()
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			cl := &http.Client{
+				Transport: c,
+			}
+			if _, err := doReq(context.Background(), cl, s.URL); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			name := filepath.Join(test.dir, "http", u.Host, "?index")
+			if _, err := os.Stat(name); err != nil {
+				t.Errorf("expected no error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestWithRedactHeaders(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Add("Set-Cookie", "a=secret-1")
+		res.Header().Add("Set-Cookie", "b=secret-2")
+		res.Header().Set("X-Api-Key", "secret-3")
+		res.Header().Set("X-Api-Key-Id", "1")
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithTTL(1*time.Hour),
+		WithRedactHeaders("set-cookie", "X-Api-Key"),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	for i := 0; i < 2; i++ {
+		res, err := cl.Get(s.URL)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if v := res.Header.Values("Set-Cookie"); !slices.Equal(v, []string{"[redacted]", "[redacted]"}) {
+			t.Errorf("test %d expected redacted Set-Cookie values, got: %q", i, v)
+		}
+		if v := res.Header.Get("X-Api-Key"); v != "[redacted]" {
+			t.Errorf("test %d expected redacted X-Api-Key, got: %q", i, v)
+		}
+		if v := res.Header.Get("X-Api-Key-Id"); v != "1" {
+			t.Errorf("test %d expected X-Api-Key-Id 1, got: %q", i, v)
+		}
+	}
+	if n := atomic.LoadUint64(&count); n != 1 {
+		t.Errorf("expected count == 1, got: %d", n)
+	}
+	// redacted values are not stored
+	err = afero.Walk(fs, "", func(name string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		buf, err := afero.ReadFile(fs, name)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(buf, []byte("secret")) {
+			t.Errorf("expected %s to not contain redacted values", name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+}
+
+func TestWithHeaderGzipCompression(t *testing.T) {
+	body := bytes.Repeat([]byte{0, 1, 2, 3, 4, 5, 6, 7}, 128)
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "image/png")
+		res.Header().Set("Content-Security-Policy", strings.Repeat("default-src 'self'; ", 100))
+		res.Write(body)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithHeaderGzipCompression(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	for i := 0; i < 2; i++ {
+		res, err := cl.Get(s.URL + "/image.png")
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case !bytes.Equal(buf, body):
+			t.Errorf("test %d expected body to match", i)
+		case res.Header.Get("Content-Type") != "image/png":
+			t.Errorf("test %d expected content type %q, got: %q", i, "image/png", res.Header.Get("Content-Type"))
+		}
+	}
+	buf, err := afero.ReadFile(fs, "http/"+u.Host+"/image.png")
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case !bytes.HasPrefix(buf, []byte{0x1f, 0x8b}):
+		t.Errorf("expected stored entry to start with gzip header")
+	case !bytes.HasSuffix(buf, body):
+		t.Errorf("expected stored entry to end with uncompressed body")
+	case len(buf) > 2*len(body):
+		t.Errorf("expected compressed header block, got stored size %d", len(buf))
+	}
+}
+
+func TestWithContextPolicy(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(res, "<html>  <body>  <p>  hello  </p>  </body>  </html>")
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithMinifier(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	_, p, err := c.Match(req)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	p.BodyTransformers = nil
+	tests := []struct {
+		ctx context.Context
+		exp string
+	}{
+		{context.Background(), "<p>hello"},
+		{WithContextPolicy(context.Background(), p), "<html>  <body>  <p>  hello  </p>  </body>  </html>"},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequestWithContext(test.ctx, "GET", s.URL, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		res, err := c.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case string(buf) != test.exp:
+			t.Errorf("test %d expected %q, got: %q", i, test.exp, string(buf))
+		}
+		if err := c.Evict(req); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+}
+
+func TestWithRespectRequestCacheControl(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithRespectRequestCacheControl(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	tests := []struct {
+		cacheControl string
+		exp          int
+	}{
+		{"", 1},
+		{"", 1},
+		{"no-cache", 2},
+		{"", 2},
+		{"max-age=0", 3},
+		{"no-store", 4},
+		{"", 3},
+		{"max-age=60", 3},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", s.URL, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if test.cacheControl != "" {
+			req.Header.Set("Cache-Control", test.cacheControl)
+		}
+		res, err := cl.Do(req)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case string(buf) != strconv.Itoa(test.exp)+"\n":
+			t.Errorf("test %d expected %d, got: %q", i, test.exp, string(buf))
+		}
+	}
+}
+
+func TestWithSafeMethodsOnly(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithMethod("GET", "POST", "PUT", "DELETE", "PATCH"),
+		WithBodyKeyForContentTypes("application/json"),
+		WithSafeMethodsOnly(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	tests := []struct {
+		method      string
+		contentType string
+		exp         int
+	}{
+		{"GET", "", 1},
+		{"GET", "", 1},
+		{"DELETE", "", 2},
+		{"DELETE", "", 3},
+		{"PUT", "", 4},
+		{"PUT", "", 5},
+		{"PATCH", "", 6},
+		{"POST", "text/plain", 7},
+		{"POST", "text/plain", 8},
+		{"POST", "application/json", 9},
+		{"POST", "application/json", 9},
+		{"GET", "", 1},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest(test.method, s.URL, strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		res, err := cl.Do(req)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case string(buf) != strconv.Itoa(test.exp)+"\n":
+			t.Errorf("test %d %s expected %d, got: %q", i, test.method, test.exp, string(buf))
+		}
+	}
+	// post requests with a path resembling a body key are not cached
+	for i, exp := range []int{10, 11} {
+		req, err := http.NewRequest("POST", s.URL+"/a%3Fbody=1", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		req.Header.Set("Content-Type", "text/plain")
+		res, err := cl.Do(req)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case string(buf) != strconv.Itoa(exp)+"\n":
+			t.Errorf("test %d expected %d, got: %q", i, exp, string(buf))
+		}
+	}
+}
+
+func TestWithHashedKeys(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithHashedKeys(sha256.New),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	urlstr := s.URL + "/a:b?c=d"
+	for i := 0; i < 2; i++ {
+		switch v, err := doReq(ctx, cl, urlstr); {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case v != 1:
+			t.Errorf("expected %d, got: %d", 1, v)
+		}
+	}
+	req, err := http.NewRequest("GET", urlstr, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	key, _, err := c.Match(req)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+	name := path.Join(sum[0:2], sum[2:4], sum)
+	if exists, _ := afero.Exists(fs, name); !exists {
+		t.Errorf("expected %s to exist", name)
+	}
+	report, err := c.Verify(false)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case report.Count != 1:
+		t.Errorf("expected count %d, got: %d", 1, report.Count)
+	}
+	if got := c.key(name); got != key {
+		t.Errorf("expected key %q, got: %q", key, got)
+	}
+	if err := c.Evict(req); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for _, name := range []string{name, c.keyName(name)} {
+		if exists, _ := afero.Exists(fs, name); exists {
+			t.Errorf("expected %s to be removed", name)
+		}
+	}
+}
+
+func TestWithRecordRequest(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(res, 1)
+	}))
+	defer s.Close()
+	tests := []struct {
+		headers []string
+		exp     http.Header
+	}{
+		{nil, http.Header{"X-Test": {"test"}, "User-Agent": {"agent"}}},
+		{[]string{"authorization"}, http.Header{"Authorization": {"secret"}}},
+	}
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			c, err := New(
+				WithFs(afero.NewMemMapFs()),
+				WithRecordRequest(test.headers...),
+				WithTTL(1*time.Hour),
+			)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			req, err := http.NewRequest("GET", s.URL+"/path?q=v", nil)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			req.Header.Set("Authorization", "secret")
+			req.Header.Set("User-Agent", "agent")
+			req.Header.Set("X-Test", "test")
+			res, err := c.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			res.Body.Close()
+			key, _, err := c.Match(req)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			recorded, err := c.RecordedRequest(key)
+			switch {
+			case err != nil:
+				t.Fatalf("expected no error, got: %v", err)
+			case recorded.Method != "GET" || recorded.RequestURI != "/path?q=v":
+				t.Errorf("expected GET /path?q=v, got: %s %s", recorded.Method, recorded.RequestURI)
+			case recorded.Host != req.URL.Host:
+				t.Errorf("expected host %q, got: %q", req.URL.Host, recorded.Host)
+			case !reflect.DeepEqual(recorded.Header, test.exp):
+				t.Errorf("expected headers %v, got: %v", test.exp, recorded.Header)
+			}
+		})
+	}
+}
+
+func TestTransformError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(res, 1)
+	}))
+	defer s.Close()
+	errTest := errors.New("test error")
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithBodyTransformFunc(TransformPriorityModify, func(io.Writer, io.Reader, string, int, string) (bool, error) {
+			return false, errTest
+		}),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	_, err = c.RoundTrip(req)
+	exp := "diskcache.BodyTransformerFunc: " + s.URL + " (200 text/plain): test error"
+	var terr *TransformError
+	switch {
+	case !errors.Is(err, errTest):
+		t.Fatalf("expected test error, got: %v", err)
+	case !errors.Is(err, ErrTransform):
+		t.Errorf("expected ErrTransform, got: %v", err)
+	case !errors.As(err, &terr):
+		t.Errorf("expected *TransformError, got: %T", err)
+	case terr.Code != http.StatusOK:
+		t.Errorf("expected %d, got: %d", http.StatusOK, terr.Code)
+	case err.Error() != exp:
+		t.Errorf("expected %q, got: %q", exp, err.Error())
+	}
+}
+
+func TestTouch(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(50*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != 1 {
+		t.Errorf("expected 1, got: %d %v", v, err)
+	}
+	req, err := http.NewRequest("GET", s.URL+"/a", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	key, _, err := c.Match(req)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// touching keeps the entry fresh
+	for i, touch := range []func() error{
+		func() error { return c.Touch(req) },
+		func() error { return c.TouchKey(key) },
+	} {
+		<-time.After(30 * time.Millisecond)
+		if err := touch(); err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		<-time.After(30 * time.Millisecond)
+		if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != 1 {
+			t.Errorf("test %d expected 1, got: %d %v", i, v, err)
+		}
+	}
+	<-time.After(60 * time.Millisecond)
+	if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != 2 {
+		t.Errorf("expected 2, got: %d %v", v, err)
+	}
+	// no entry
+	if err := c.TouchKey(key + "/b"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got: %v", err)
+	}
+	// not matched
+	post, err := http.NewRequest("POST", s.URL+"/a", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := c.Touch(post); !errors.Is(err, ErrNotMatched) {
+		t.Errorf("expected ErrNotMatched, got: %v", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(res, 1)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithTTL(1*time.Hour),
+		WithGzipCompression(),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// not matched
+	req, err := http.NewRequest("POST", s.URL, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := c.Evict(req); !errors.Is(err, ErrNotMatched) {
+		t.Errorf("expected ErrNotMatched, got: %v", err)
+	}
+	// corrupt entry
+	key := "http/" + u.Host + "/a"
+	if err := afero.WriteFile(fs, key, []byte("garbage"), 0o644); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if req, err = http.NewRequest("GET", s.URL+"/a", nil); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := c.Load(key, Policy{MarshalUnmarshaler: GzipMarshalUnmarshaler{}}, req); !errors.Is(err, ErrCorruptEntry) {
+		t.Errorf("expected ErrCorruptEntry, got: %v", err)
+	}
+	// marshal
+	errTest := errors.New("test error")
+	if _, err := c.Exec(key, Policy{MarshalUnmarshaler: errMarshaler{errTest}}, req); !errors.Is(err, ErrMarshal) || !errors.Is(err, errTest) {
+		t.Errorf("expected ErrMarshal, got: %v", err)
+	}
+}
+
+// errMarshaler is a marshaler that returns an error.
+type errMarshaler struct {
+	err error
+}
+
+func (m errMarshaler) Marshal(io.Writer, io.Reader) error {
+	return m.err
+}
+
+func (m errMarshaler) Unmarshal(io.Writer, io.Reader) error {
+	return m.err
+}
+
+func TestWithCacheableStatusCodes(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddUint64(&count, 1)
+		switch req.URL.Path {
+		case "/missing":
+			res.WriteHeader(http.StatusNotFound)
+		case "/error":
+			res.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintln(res, req.URL.Path)
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithCacheableStatusCodes(http.StatusOK, http.StatusNotFound),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	tests := []struct {
+		path string
+		code int
+		exp  uint64
+	}{
+		{"/", http.StatusOK, 1},
+		{"/missing", http.StatusNotFound, 1},
+		{"/error", http.StatusInternalServerError, 2},
+	}
+	for _, test := range tests {
+		atomic.StoreUint64(&count, 0)
+		for i := 0; i < 2; i++ {
+			res, err := cl.Get(s.URL + test.path)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			buf, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			switch {
+			case err != nil:
+				t.Fatalf("expected no error, got: %v", err)
+			case res.StatusCode != test.code:
+				t.Errorf("expected status %d, got: %d", test.code, res.StatusCode)
+			case string(buf) != test.path+"\n":
+				t.Errorf("expected %q, got: %q", test.path+"\n", string(buf))
+			}
+		}
+		if n := atomic.LoadUint64(&count); n != test.exp {
+			t.Errorf("%s expected count == %d, got: %d", test.path, test.exp, n)
+		}
+	}
+}
+
+func TestWithLFHeaders(t *testing.T) {
+	body := "a\r\n\r\nb\n"
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddUint64(&count, 1)
+		res.Header().Set("Content-Type", "text/plain")
+		res.Header().Set("X-Test", "test")
+		fmt.Fprint(res, body)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	tests := []struct {
+		opts   []Option
+		header string
+		stored func([]byte) (string, string, error)
+	}{
+		{nil, "test", func(buf []byte) (string, string, error) {
+			header, body, _ := bytes.Cut(buf, lflf)
+			return string(header), string(body), nil
+		}},
+		{[]Option{WithHeaderGzipCompression()}, "test", func(buf []byte) (string, string, error) {
+			br := bytes.NewReader(buf)
+			r, err := gzip.NewReader(br)
+			if err != nil {
+				return "", "", err
+			}
+			r.Multistream(false)
+			header, err := io.ReadAll(r)
+			if err != nil {
+				return "", "", err
+			}
+			body, err := io.ReadAll(br)
+			return strings.TrimSuffix(string(header), "\n\n"), string(body), err
+		}},
+		{[]Option{WithFlatStorage()}, "", func(buf []byte) (string, string, error) {
+			return "", string(buf), nil
+		}},
+		{[]Option{WithFlatStorage(), WithFlatKeepHeaders("X-Test")}, "test", nil},
+	}
+	for i, test := range tests {
+		fs := afero.NewMemMapFs()
+		c, err := New(append([]Option{WithFs(fs), WithTTL(1 * time.Hour), WithLFHeaders()}, test.opts...)...)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		cl := &http.Client{
+			Transport: c,
+		}
+		atomic.StoreUint64(&count, 0)
+		for j := 0; j < 2; j++ {
+			res, err := cl.Get(s.URL + "/a")
+			if err != nil {
+				t.Fatalf("test %d.%d expected no error, got: %v", i, j, err)
+			}
+			buf, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			switch {
+			case err != nil:
+				t.Fatalf("test %d.%d expected no error, got: %v", i, j, err)
+			case string(buf) != body:
+				t.Errorf("test %d.%d expected body %q, got: %q", i, j, body, string(buf))
+			case j == 1 && res.Header.Get("X-Test") != test.header:
+				t.Errorf("test %d.%d expected header %q, got: %q", i, j, test.header, res.Header.Get("X-Test"))
+			}
+		}
+		if n := atomic.LoadUint64(&count); n != 1 {
+			t.Errorf("test %d expected 1 request, got: %d", i, n)
+		}
+		if test.stored == nil {
+			continue
+		}
+		buf, err := afero.ReadFile(fs, "http/"+u.Host+"/a")
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		header, stored, err := test.stored(buf)
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case strings.Contains(header, "\r"):
+			t.Errorf("test %d expected header block with LF line endings, got: %q", i, header)
+		case test.header != "" && !strings.Contains(header, "\nX-Test: test"):
+			t.Errorf("test %d expected stored header block, got: %q", i, header)
+		case stored != body:
+			t.Errorf("test %d expected stored body %q, got: %q", i, body, stored)
+		}
+	}
+}
+
+func TestWithPathMapper(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithPathMapper(func(key string) string {
+			return "bucket/" + strings.ReplaceAll(key, "/", "_")
+		}),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		switch v, err := doReq(ctx, cl, s.URL+"/a/b"); {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case v != 1:
+			t.Errorf("expected %d, got: %d", 1, v)
+		}
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	name := "bucket/http_" + u.Host + "_a_b"
+	if exists, _ := afero.Exists(fs, name); !exists {
+		t.Errorf("expected %s to exist", name)
+	}
+	req, err := http.NewRequest("GET", s.URL+"/a/b", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := c.Evict(req); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if exists, _ := afero.Exists(fs, name); exists {
+		t.Errorf("expected %s to be evicted", name)
+	}
+}
+
+func TestWithStoreRequest(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	tests := []struct {
+		opts []Option
+	}{
+		{nil},
+		{[]Option{WithGzipCompression()}},
+		{[]Option{WithLFHeaders()}},
+		{[]Option{WithWARCStorage()}},
+	}
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			atomic.StoreUint64(&count, 0)
+			c, err := New(append([]Option{
+				WithFs(afero.NewMemMapFs()),
+				WithStoreRequest(),
+				WithTTL(1 * time.Hour),
+			}, test.opts...)...)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			cl := &http.Client{
+				Transport: c,
+			}
+			ctx := context.Background()
+			for j := 0; j < 2; j++ {
+				switch v, err := doReq(ctx, cl, s.URL+"/path"); {
+				case err != nil:
+					t.Fatalf("expected no error, got: %v", err)
+				case v != 1:
+					t.Errorf("expected %d, got: %d", 1, v)
+				}
+			}
+			req, err := http.NewRequest("GET", s.URL+"/path", nil)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			key, p, err := c.Match(req)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			stored, err := c.LoadRequest(key, p)
+			switch {
+			case err != nil:
+				t.Fatalf("expected no error, got: %v", err)
+			case stored.Method != "GET" || stored.RequestURI != "/path":
+				t.Errorf("expected GET /path, got: %s %s", stored.Method, stored.RequestURI)
+			}
+			if report, err := c.Verify(false); err != nil || len(report.Bad) != 0 {
+				t.Errorf("expected no bad entries, got: %+v %v", report, err)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	for i, exp := range []int{1, 1} {
+		if v, err := doReq(ctx, cl, s.URL); err != nil || v != exp {
+			t.Fatalf("test %d expected %d and no error, got: %d %v", i, exp, v, err)
+		}
+	}
+	if err := c.Apply(WithTTL(1 * time.Nanosecond)); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	<-time.After(2 * time.Millisecond)
+	if v, err := doReq(ctx, cl, s.URL); err != nil || v != 2 {
+		t.Fatalf("expected %d and no error, got: %d %v", 2, v, err)
+	}
+	if err := c.Apply(WithMatcherPriority(1)); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestWithValidJSON(t *testing.T) {
+	var count uint64
+	var invalid atomic.Bool
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		typ := "application/json; charset=utf-8"
+		if req.URL.Path == "/text" {
+			typ = "text/plain"
+		}
+		res.Header().Set("Content-Type", typ)
+		n := atomic.AddUint64(&count, 1)
+		if invalid.Load() {
+			fmt.Fprintf(res, "{%d", n)
+			return
+		}
+		fmt.Fprintf(res, "%d", n)
+	}))
+	defer s.Close()
+	for _, stale := range []bool{false, true} {
+		atomic.StoreUint64(&count, 0)
+		invalid.Store(false)
+		opts := []Option{
+			WithFs(afero.NewMemMapFs()),
+			WithTTL(1 * time.Millisecond),
+			WithValidJSON(),
+		}
+		if stale {
+			opts = append(opts, WithServeStaleOnError())
+		}
+		c, err := New(opts...)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		get := func(urlpath string) (string, error) {
+			res, err := (&http.Client{Transport: c}).Get(s.URL + urlpath)
+			if err != nil {
+				return "", err
+			}
+			defer res.Body.Close()
+			buf, err := io.ReadAll(res.Body)
+			return string(buf), err
+		}
+		if v, err := get("/json"); err != nil || v != "1" {
+			t.Errorf("stale %t expected 1, got: %q %v", stale, v, err)
+		}
+		invalid.Store(true)
+		<-time.After(2 * time.Millisecond)
+		switch v, err := get("/json"); {
+		case stale && (err != nil || v != "1"):
+			t.Errorf("stale %t expected previously cached 1, got: %q %v", stale, v, err)
+		case !stale && !errors.Is(err, ErrInvalidBody):
+			t.Errorf("stale %t expected ErrInvalidBody, got: %v", stale, err)
+		}
+		// invalid bodies are not stored
+		if _, err := get("/new"); !errors.Is(err, ErrInvalidBody) {
+			t.Errorf("stale %t expected ErrInvalidBody, got: %v", stale, err)
+		}
+		req, err := http.NewRequest("GET", s.URL+"/new", nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		switch ok, err := c.Cached(req); {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case ok:
+			t.Errorf("stale %t expected invalid body to not be cached", stale)
+		}
+		// other content is not validated
+		if v, err := get("/text"); err != nil || v != "{4" {
+			t.Errorf("stale %t expected {4, got: %q %v", stale, v, err)
+		}
+	}
+}
+
+func TestNDJSONMinifier(t *testing.T) {
+	tests := []struct {
+		t           NDJSONMinifier
+		contentType string
+		s           string
+		exp         string
+		err         bool
+	}{
+		{NDJSONMinifier{Minify: true}, "application/x-ndjson", "{ \"a\": 1 }\n\n[1, 2]\r\n\"s\"", "{\"a\":1}\n[1,2]\n\"s\"\n", false},
+		{NDJSONMinifier{}, "application/jsonl; charset=utf-8", "{ \"a\": 1 }\n", "{ \"a\": 1 }\n", false},
+		{NDJSONMinifier{Minify: true, DropInvalid: true}, "application/x-ndjson", "{\"a\": 1}\n{bad\n2\n", "{\"a\":1}\n2\n", false},
+		{NDJSONMinifier{Minify: true}, "application/x-ndjson", "{\"a\": 1}\n{bad\n2\n", "", true},
+		{NDJSONMinifier{Minify: true}, "application/json", "{ \"a\": 1 }\n", "{ \"a\": 1 }\n", false},
+	}
+	for i, test := range tests {
+		w := new(bytes.Buffer)
+		ok, err := test.t.BodyTransform(w, strings.NewReader(test.s), "", http.StatusOK, test.contentType)
+		switch {
+		case test.err && !errors.Is(err, ErrInvalidBody):
+			t.Errorf("test %d expected ErrInvalidBody, got: %v", i, err)
+		case test.err:
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case !ok:
+			t.Errorf("test %d expected ok", i)
+		case w.String() != test.exp:
+			t.Errorf("test %d expected %q, got: %q", i, test.exp, w.String())
+		}
+	}
+}
+
+func TestWithNDJSON(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/invalid":
+			res.Header().Set("Content-Type", "application/x-ndjson")
+			_, _ = io.WriteString(res, "{\"a\": 1}\n{bad\n")
+		case "/json":
+			res.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(res, "{ \"a\": 1 }")
+		default:
+			res.Header().Set("Content-Type", "application/x-ndjson")
+			_, _ = io.WriteString(res, "{ \"a\": 1 }\n[1, 2]\n")
+		}
+	}))
+	defer s.Close()
+	// the ndjson and minifier priorities do not conflict
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+		WithNDJSON(),
+		WithMinifier(),
+		WithStrictTransformPriorities(),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	tests := []struct {
+		path string
+		exp  string
+		err  bool
+	}{
+		{"/ndjson", "{\"a\":1}\n[1,2]\n", false},
+		{"/json", "{\"a\":1}", false},
+		{"/invalid", "", true},
+	}
+	for i, test := range tests {
+		res, err := cl.Get(s.URL + test.path)
+		switch {
+		case test.err && !errors.Is(err, ErrInvalidBody):
+			t.Errorf("test %d expected ErrInvalidBody, got: %v", i, err)
+			continue
+		case test.err:
+			continue
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case string(buf) != test.exp:
+			t.Errorf("test %d expected %q, got: %q", i, test.exp, string(buf))
+		}
+	}
+}
+
+func TestWithJSONCanonical(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/ld":
+			res.Header().Set("Content-Type", "application/ld+json")
+		case "/charset":
+			res.Header().Set("Content-Type", "application/json; charset=utf-8")
+		case "/text":
+			res.Header().Set("Content-Type", "text/plain")
+		default:
+			res.Header().Set("Content-Type", "application/json")
+		}
+		if req.URL.Path == "/invalid" {
+			_, _ = io.WriteString(res, `{"b": 1,`)
+			return
+		}
+		_, _ = io.WriteString(res, `{"b": 1, "a": [2, 1], "c": "<&>"}`)
+	}))
+	defer s.Close()
+	const canonical, original = `{"a":[2,1],"b":1,"c":"<&>"}`, `{"b": 1, "a": [2, 1], "c": "<&>"}`
+	tests := []struct {
+		contentTypes []string
+		path         string
+		exp          string
+	}{
+		{nil, "/json", canonical},
+		{nil, "/charset", canonical},
+		{nil, "/ld", original},
+		{nil, "/text", original},
+		{nil, "/invalid", `{"b": 1,`},
+		{[]string{"application/ld+json"}, "/ld", canonical},
+		{[]string{"application/ld+json"}, "/json", original},
+	}
+	for i, test := range tests {
+		c, err := New(
+			WithFs(afero.NewMemMapFs()),
+			WithTTL(1*time.Hour),
+			WithJSONCanonical(test.contentTypes...),
+		)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		res, err := (&http.Client{Transport: c}).Get(s.URL + test.path)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case string(buf) != test.exp:
+			t.Errorf("test %d expected %q, got: %q", i, test.exp, string(buf))
+		}
+	}
+}
+
+func TestWhitespaceNormalizer(t *testing.T) {
+	tests := []struct {
+		contentType string
+		s           string
+		exp         string
+	}{
+		{"text/plain", "  a  \t b  \r\n\r\n\n\nc\t\n", "a b\n\nc\n"},
+		{"text/csv; charset=utf-8", "a, b ,c\n\n\n1,2,3", "a, b ,c\n\n1,2,3"},
+		{"text/plain", strings.Repeat("a ", 4096) + "\n", strings.TrimSuffix(strings.Repeat("a ", 4096), " ") + "\n"},
+		{"text/html", "  a  \n\n\n", "  a  \n\n\n"},
+	}
+	tr := WhitespaceNormalizer{ContentTypes: []string{"text/plain", "text/csv"}}
+	for i, test := range tests {
+		w := new(bytes.Buffer)
+		ok, err := tr.BodyTransform(w, strings.NewReader(test.s), "", http.StatusOK, test.contentType)
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case !ok:
+			t.Errorf("test %d expected ok", i)
+		case w.String() != test.exp:
+			t.Errorf("test %d expected %q, got: %q", i, test.exp, w.String())
+		}
+	}
+}
+
+func TestWithMemoryLayer(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithMemoryLayer(1),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	if _, err := doReq(ctx, cl, s.URL+"/a"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// modify the stored entry, preserving the last modified time
+	name := "http/" + u.Host + "/a"
+	mod, err := c.Mod("http/" + u.Host + "/a")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	buf := "HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\n10\n"
+	if err := afero.WriteFile(fs, name, []byte(buf), 0o644); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := fs.Chtimes(name, mod, mod); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != 1 {
+		t.Errorf("expected %d from memory, got: %d %v", 1, v, err)
+	}
+	// changed last modified time invalidates
+	mod = mod.Add(1 * time.Second)
+	if err := fs.Chtimes(name, mod, mod); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != 10 {
+		t.Errorf("expected %d from fs, got: %d %v", 10, v, err)
+	}
+	// eviction removes
+	req, err := http.NewRequest("GET", s.URL+"/a", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := c.Evict(req); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, ok := c.memory.get(name, mod); ok {
+		t.Errorf("expected memory entry to be removed")
+	}
+	// least recently used entries are removed
+	for _, p := range []string{"/b", "/c"} {
+		if _, err := doReq(ctx, cl, s.URL+p); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	if n := c.memory.ll.Len(); n != 1 {
+		t.Errorf("expected %d memory entries, got: %d", 1, n)
+	}
+}
+
+func TestWithPathBlacklist(t *testing.T) {
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithPathBlacklist("/admin/**", "/logout", "/*.php"),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	tests := []struct {
+		path    string
+		matched bool
+	}{
+		{"/", true},
+		{"/admin", true},
+		{"/admin/", false},
+		{"/admin/users/1", false},
+		{"/logout", false},
+		{"/logout/now", true},
+		{"/index.php", false},
+		{"/a/index.php", true},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "http://example.com"+test.path, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		key, _, err := c.Match(req)
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case (key != "") != test.matched:
+			t.Errorf("%s expected matched %t, got key: %q", test.path, test.matched, key)
+		}
+	}
+	if _, err := New(WithFs(afero.NewMemMapFs()), WithPathBlacklist("/[")); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestWithResponseFilter(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/private" {
+			res.Header().Set("X-Private", "1")
+		}
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithResponseFilter(func(req *http.Request, res *http.Response) bool {
+			if req == nil || res.Request == nil {
+				t.Errorf("expected request to be passed to filter")
+			}
+			return res.Header.Get("X-Private") == ""
+		}),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	tests := []struct {
+		path   string
+		expect []int
+	}{
+		{"/public", []int{1, 1}},
+		{"/private", []int{2, 3}},
+	}
+	for i, test := range tests {
+		for j, exp := range test.expect {
+			switch v, err := doReq(ctx, cl, s.URL+test.path); {
+			case err != nil:
+				t.Fatalf("test %d expected no error, got: %v", i, err)
+			case v != exp:
+				t.Errorf("test %d request %d expected %d, got: %d", i, j, exp, v)
+			}
+		}
+	}
+	// filtered responses are not stored
+	req, err := http.NewRequest("GET", s.URL+"/private", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	switch ok, err := c.Cached(req); {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case ok:
+		t.Errorf("expected filtered response to not be cached")
+	}
+}
+
+func TestWithStorePredicate(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d %s\n", atomic.AddUint64(&count, 1), strings.Repeat("a", 100))
+	}))
+	defer s.Close()
+	for _, test := range []struct {
+		max int
+		exp uint64
+	}{
+		{1024, 1},
+		{64, 2},
+	} {
+		atomic.StoreUint64(&count, 0)
+		c, err := New(
+			WithFs(afero.NewMemMapFs()),
+			WithGzipCompression(),
+			WithStorePredicate(func(key string, data []byte, res *http.Response) bool {
+				return res.StatusCode == http.StatusOK && len(data) < test.max
+			}),
+			WithTTL(1*time.Hour),
+		)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		cl := &http.Client{
+			Transport: c,
+		}
+		for i := 0; i < 2; i++ {
+			res, err := cl.Get(s.URL)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+		if n := atomic.LoadUint64(&count); n != test.exp {
+			t.Errorf("max %d expected count == %d, got: %d", test.max, test.exp, n)
+		}
+	}
+}
+
+func TestWithSkipUnchangedWrites(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("ETag", `"v1"`)
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithSkipUnchangedWrites(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	ctx := context.Background()
+	if _, err := doReq(ctx, &http.Client{Transport: c}, s.URL+"/a"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	req, err := http.NewRequest("GET", s.URL+"/a", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	key, p, err := c.Match(req)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	prev, err := c.Mod(key)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	// refetch with the same etag keeps the stored body
+	_, mod, res, err := c.Fetch(key, p, req, true)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer res.Body.Close()
+	buf, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if s := string(buf); s != "1\n" {
+		t.Errorf("expected %q, got: %q", "1\n", s)
+	}
+	if !mod.After(prev) {
+		t.Errorf("expected mod %v to be after %v", mod, prev)
+	}
+	if n := atomic.LoadUint64(&count); n != 2 {
+		t.Errorf("expected %d requests, got: %d", 2, n)
+	}
+}
+
+func TestETagMatch(t *testing.T) {
+	tests := []struct {
+		a, b string
+		exp  bool
+	}{
+		{`"v1"`, `"v1"`, true},
+		{`W/"v1"`, `"v1"`, true},
+		{`"v1"`, `W/"v1"`, true},
+		{`W/"v1"`, `W/"v1"`, true},
+		{`"v1"`, `"v2"`, false},
+		{`W/"v1"`, `W/"v2"`, false},
+		{`W/"v1"`, `"W/v1"`, false},
+		{``, ``, false},
+		{`W/`, `W/`, false},
+	}
+	for i, test := range tests {
+		if b := etagMatch(test.a, test.b); b != test.exp {
+			t.Errorf("test %d expected %t for %s and %s, got: %t", i, test.exp, test.a, test.b, b)
+		}
+	}
+}
+
+func TestWithSkipUnchangedWritesWeakETag(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		n := atomic.AddUint64(&count, 1)
+		switch n {
+		case 1:
+			res.Header().Set("ETag", `"v1"`)
+		case 2:
+			res.Header().Set("ETag", `W/"v1"`)
+		default:
+			res.Header().Set("ETag", `W/"v2"`)
+		}
+		fmt.Fprintf(res, "%d\n", n)
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithSkipUnchangedWrites(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	req, err := http.NewRequest("GET", s.URL+"/a", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	key, p, err := c.Match(req)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for i, exp := range []string{"1\n", "1\n", "3\n"} {
+		_, _, res, err := c.Fetch(key, p, req, true)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if s := string(buf); s != exp {
+			t.Errorf("test %d expected %q, got: %q", i, exp, s)
+		}
+	}
+}
+
+func TestWithSkipUnchangedWritesHeaders(t *testing.T) {
+	var count uint64
+	var etag, cacheControl, body atomic.Value
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		n := atomic.AddUint64(&count, 1)
+		if v := etag.Load().(string); v != "" {
+			res.Header().Set("ETag", v)
+		}
+		res.Header().Set("Cache-Control", cacheControl.Load().(string))
+		res.Header().Set("Date", time.Unix(int64(n), 0).UTC().Format(http.TimeFormat))
+		_, _ = io.WriteString(res, body.Load().(string))
+	}))
+	defer s.Close()
+	tests := []struct {
+		etag         string
+		cacheControl string
+		body         string
+		writes       int64
+		exp          string
+	}{
+		{`"v1"`, "max-age=1", "a\n", 1, "a\n"},
+		// same etag and headers
+		{`"v1"`, "max-age=1", "b\n", 1, "a\n"},
+		// same etag, changed headers
+		{`"v1"`, "max-age=2", "c\n", 2, "c\n"},
+		// no etag, same response with a different date (only compared
+		// when buffered)
+		{"", "max-age=2", "c\n", 3, "c\n"},
+		{"", "max-age=2", "c\n", 3, "c\n"},
+		// no etag, changed body
+		{"", "max-age=2", "d\n", 4, "d\n"},
+	}
+	for _, opts := range [][]Option{nil, {WithGzipCompression()}} {
+		atomic.StoreUint64(&count, 0)
+		fs := &renameFs{Fs: afero.NewMemMapFs()}
+		c, err := New(append([]Option{
+			WithFs(fs),
+			WithSkipUnchangedWrites(),
+			WithTTL(1 * time.Hour),
+		}, opts...)...)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		req, err := http.NewRequest("GET", s.URL+"/a", nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		key, p, err := c.Match(req)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		for i, test := range tests {
+			if test.etag == "" && opts == nil {
+				break
+			}
+			etag.Store(test.etag)
+			cacheControl.Store(test.cacheControl)
+			body.Store(test.body)
+			_, _, res, err := c.Fetch(key, p, req, true)
+			if err != nil {
+				t.Fatalf("test %d expected no error, got: %v", i, err)
+			}
+			buf, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			switch {
+			case err != nil:
+				t.Fatalf("test %d expected no error, got: %v", i, err)
+			case string(buf) != test.exp:
+				t.Errorf("test %d expected %q, got: %q", i, test.exp, string(buf))
+			case res.Header.Get("Cache-Control") != test.cacheControl:
+				t.Errorf("test %d expected Cache-Control %q, got: %q", i, test.cacheControl, res.Header.Get("Cache-Control"))
+			}
+			if n := fs.renames.Load(); n != test.writes {
+				t.Errorf("test %d expected %d writes, got: %d", i, test.writes, n)
+			}
+		}
+	}
+}
+
+// renameFs is a fs that counts entries renamed into place.
+type renameFs struct {
+	afero.Fs
+	renames atomic.Int64
+}
+
+func (fs *renameFs) Rename(oldname, newname string) error {
+	if !strings.Contains(newname, "?") {
+		fs.renames.Add(1)
+	}
+	return fs.Fs.Rename(oldname, newname)
+}
+
+func TestInstall(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	prev := http.DefaultTransport
+	restore, err := Install(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, ok := http.DefaultTransport.(*Cache); !ok {
+		t.Fatalf("expected *Cache, got: %T", http.DefaultTransport)
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if v, err := doReq(ctx, &http.Client{}, s.URL); err != nil || v != 1 {
+			t.Errorf("test %d expected %d, got: %d %v", i, 1, v, err)
+		}
+	}
+	restore()
+	if http.DefaultTransport != prev {
+		t.Errorf("expected http.DefaultTransport to be restored")
+	}
+}
+
+func TestWithRequireExplicitFs(t *testing.T) {
+	if _, err := New(WithRequireExplicitFs()); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if _, err := New(WithRequireExplicitFs(), WithTTL(1*time.Hour)); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	for i, opts := range [][]Option{
+		{WithRequireExplicitFs(), WithFs(afero.NewMemMapFs())},
+		{WithFs(afero.NewMemMapFs()), WithRequireExplicitFs()},
+	} {
+		if _, err := New(opts...); err != nil {
+			t.Errorf("test %d expected no error, got: %v", i, err)
+		}
+	}
+}
+
+func TestWithProxy(t *testing.T) {
+	var count uint64
+	var mu sync.Mutex
+	var urls []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		urls = append(urls, req.URL.String())
+		mu.Unlock()
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer proxy.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithProxy(proxy.URL),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if v, err := doReq(ctx, cl, "http://example.invalid/a"); err != nil || v != 1 {
+			t.Errorf("test %d expected 1, got: %d %v", i, v, err)
+		}
+	}
+	if exp := []string{"http://example.invalid/a"}; !slices.Equal(urls, exp) {
+		t.Errorf("expected proxied urls %q, got: %q", exp, urls)
+	}
+	if _, err := New(WithProxy("http://[::1")); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestWithInsecureSkipVerify(t *testing.T) {
+	var count uint64
+	s := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	ctx := context.Background()
+	c, err := New(WithFs(afero.NewMemMapFs()), WithTTL(1*time.Hour))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := doReq(ctx, &http.Client{Transport: c}, s.URL); err == nil {
+		t.Errorf("expected certificate error, got nil")
+	}
+	c, err = New(
+		WithFs(afero.NewMemMapFs()),
+		WithInsecureSkipVerify(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if v, err := doReq(ctx, &http.Client{Transport: c}, s.URL); err != nil || v != 1 {
+			t.Errorf("test %d expected 1, got: %d %v", i, v, err)
+		}
+	}
+}
+
+func TestWithDialTimeout(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(res, "1")
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithDialTimeout(5*time.Second),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	switch transport, ok := c.transport.(*http.Transport); {
+	case !ok:
+		t.Fatalf("expected *http.Transport, got: %T", c.transport)
+	case transport == http.DefaultTransport:
+		t.Errorf("expected a copy of http.DefaultTransport")
+	case transport.DialContext == nil:
+		t.Errorf("expected dial context to be set")
+	}
+	if v, err := doReq(context.Background(), &http.Client{Transport: c}, s.URL); err != nil || v != 1 {
+		t.Errorf("expected 1, got: %d %v", v, err)
+	}
+	// transports other than *http.Transport cannot be modified
+	transport := roundTripperFunc(http.DefaultTransport.RoundTrip)
+	if _, err := New(WithTransport(transport), WithDialTimeout(5*time.Second)); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestHTTPTransportOptionsAfterInstall(t *testing.T) {
+	restore, err := Install(WithFs(afero.NewMemMapFs()))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer restore()
+	for i, opt := range []Option{
+		WithProxy("http://127.0.0.1:1"),
+		WithInsecureSkipVerify(),
+		WithDialTimeout(5 * time.Second),
+	} {
+		if _, err := New(WithFs(afero.NewMemMapFs()), opt); err == nil {
+			t.Errorf("test %d expected error, got nil", i)
+		}
+	}
+}
+
+func TestWithContentTypeOverride(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = res.Write([]byte("  a  b  \n\n\n"))
+	}))
+	defer s.Close()
+	override := func(urlstr, got string) string {
+		if strings.HasSuffix(urlstr, ".txt") && got == "application/octet-stream" {
+			return "text/plain"
+		}
+		return got
+	}
+	for i, rewrite := range []bool{false, true} {
+		c, err := New(
+			WithFs(afero.NewMemMapFs()),
+			WithContentTypeOverride(override, rewrite),
+			WithWhitespaceNormalize(),
+		)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		cl := &http.Client{
+			Transport: c,
+		}
+		for _, test := range []struct {
+			path        string
+			exp         string
+			contentType string
+		}{
+			{"/a.txt", "a b\n\n", "text/plain"},
+			{"/a.bin", "  a  b  \n\n\n", "application/octet-stream"},
+		} {
+			res, err := cl.Get(s.URL + test.path)
+			if err != nil {
+				t.Fatalf("test %d expected no error, got: %v", i, err)
+			}
+			buf, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatalf("test %d expected no error, got: %v", i, err)
+			}
+			if s := string(buf); s != test.exp {
+				t.Errorf("test %d expected %q, got: %q", i, test.exp, s)
+			}
+			exp := test.contentType
+			if !rewrite {
+				exp = "application/octet-stream"
+			}
+			if typ := res.Header.Get("Content-Type"); typ != exp {
+				t.Errorf("test %d expected %q, got: %q", i, exp, typ)
+			}
+		}
+	}
+}
+
+func TestTransformPriorityOrder(t *testing.T) {
+	appender := func(s string) func(io.Writer, io.Reader, string, int, string) (bool, error) {
+		return func(w io.Writer, r io.Reader, _ string, _ int, _ string) (bool, error) {
+			if _, err := io.Copy(w, r); err != nil {
+				return false, err
+			}
+			_, err := io.WriteString(w, s)
+			return err == nil, err
+		}
+	}
+	var opts []Option
+	for _, s := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		opts = append(opts, WithBodyTransformFunc(TransformPriorityModify, appender(s)))
+	}
+	opts = append(opts, WithBodyTransformFunc(TransformPriorityDecode, appender("0")))
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	defer s.Close()
+	c, err := New(append(opts, WithFs(afero.NewMemMapFs()))...)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	res, err := (&http.Client{Transport: c}).Get(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer res.Body.Close()
+	buf, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if exp, s := "0abcdefgh", string(buf); s != exp {
+		t.Errorf("expected %q, got: %q", exp, s)
+	}
+	// strict
+	if _, err := New(append(opts, WithStrictTransformPriorities())...); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestWithBodyTransformFunc(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddUint64(&count, 1)
+		res.Header().Set("Content-Type", "text/plain")
+		res.WriteHeader(http.StatusCreated)
+		fmt.Fprint(res, "a")
+	}))
+	defer s.Close()
+	var args []string
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+		WithBodyTransformFunc(TransformPriorityDecode, func(w io.Writer, r io.Reader, urlstr string, code int, contentType string) (bool, error) {
+			args = append(args, fmt.Sprintf("%s %d %s", urlstr, code, contentType))
+			buf, err := io.ReadAll(r)
+			if err != nil {
+				return false, err
+			}
+			_, err = w.Write(bytes.ToUpper(buf))
+			return err == nil, err
+		}),
+		// returning false stops lower priority transformers
+		WithBodyTransformFunc(TransformPriorityModify, func(w io.Writer, r io.Reader, _ string, _ int, _ string) (bool, error) {
+			if _, err := io.Copy(w, r); err != nil {
+				return false, err
+			}
+			_, err := io.WriteString(w, "b")
+			return false, err
+		}),
+		WithBodyTransformFunc(TransformPriorityLast, func(w io.Writer, r io.Reader, _ string, _ int, _ string) (bool, error) {
+			if _, err := io.Copy(w, r); err != nil {
+				return false, err
+			}
+			_, err := io.WriteString(w, "c")
+			return err == nil, err
+		}),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	for i := 0; i < 2; i++ {
+		res, err := cl.Get(s.URL + "/x")
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case string(buf) != "Ab":
+			t.Errorf("test %d expected %q, got: %q", i, "Ab", string(buf))
+		}
+	}
+	if n := atomic.LoadUint64(&count); n != 1 {
+		t.Errorf("expected 1 request, got: %d", n)
+	}
+	if exp := []string{s.URL + "/x 201 text/plain"}; !slices.Equal(args, exp) {
+		t.Errorf("expected %q, got: %q", exp, args)
+	}
+	if p := BodyTransformerFunc(nil).TransformPriority(); p != TransformPriorityModify {
+		t.Errorf("expected %d, got: %d", TransformPriorityModify, p)
+	}
+}
+
+func TestWithImageOptimizer(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	pngBuf, jpegBuf := new(bytes.Buffer), new(bytes.Buffer)
+	if err := png.Encode(pngBuf, img); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := jpeg.Encode(jpegBuf, img, nil); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// png with a header exceeding the pixel bound
+	bomb := bytes.Clone(pngBuf.Bytes())
+	binary.BigEndian.PutUint32(bomb[16:], 1<<16)
+	binary.BigEndian.PutUint32(bomb[20:], 1<<16)
+	binary.BigEndian.PutUint32(bomb[29:], crc32.ChecksumIEEE(bomb[12:29]))
+	bodies := map[string][]byte{
+		"/a.png":   pngBuf.Bytes(),
+		"/a.jpg":   jpegBuf.Bytes(),
+		"/bomb":    bomb,
+		"/invalid": []byte("not an image"),
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/a.jpg":
+			res.Header().Set("Content-Type", "image/jpeg")
+		default:
+			res.Header().Set("Content-Type", "image/png")
+		}
+		_, _ = res.Write(bodies[req.URL.Path])
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithImageOptimizer(10, 0),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	tests := []struct {
+		path   string
+		format string
+	}{
+		{"/a.png", "png"},
+		{"/a.jpg", "jpeg"},
+		{"/bomb", ""},
+		{"/invalid", ""},
+	}
+	for i, test := range tests {
+		res, err := cl.Get(s.URL + test.path)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if test.format == "" {
+			// passed through unmodified
+			if !bytes.Equal(buf, bodies[test.path]) {
+				t.Errorf("test %d expected unmodified body", i)
+			}
+			continue
+		}
+		cfg, typ, err := image.DecodeConfig(bytes.NewReader(buf))
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case typ != test.format:
+			t.Errorf("test %d expected format %q, got: %q", i, test.format, typ)
+		case cfg.Width != 10 || cfg.Height != 5:
+			t.Errorf("test %d expected 10x5, got: %dx%d", i, cfg.Width, cfg.Height)
+		}
+	}
+}
+
+func TestWithBodyKeyForContentTypes(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		buf, _ := io.ReadAll(req.Body)
+		fmt.Fprintf(res, "%d %s\n", atomic.AddUint64(&count, 1), buf)
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithMethod("POST"),
+		WithBodyKeyForContentTypes("application/json"),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	tests := []struct {
+		contentType string
+		body        string
+		exp         string
+	}{
+		{"application/json", `{"a":1}`, `1 {"a":1}`},
+		{"application/json", `{"a":2}`, `2 {"a":2}`},
+		{"application/json; charset=utf-8", `{"a":1}`, `1 {"a":1}`},
+		{"text/plain", "a", "3 a"},
+		{"text/plain", "b", "3 a"},
+	}
+	for i, test := range tests {
+		res, err := cl.Post(s.URL, test.contentType, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if s := strings.TrimSpace(string(buf)); s != test.exp {
+			t.Errorf("test %d expected %q, got: %q", i, test.exp, s)
+		}
+	}
+}
+
+func TestWithInjectHeaders(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("X-Cache", "upstream")
+		_, _ = res.Write([]byte("a\n"))
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+		WithInjectHeaders(
+			http.Header{"X-Cache": {"HIT"}, "X-Cache-Key": {"{{key}}"}},
+			http.Header{"X-Cache": {"MISS"}},
+		),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	for i, exp := range []string{"MISS", "HIT"} {
+		res, err := cl.Get(s.URL + "/a")
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		res.Body.Close()
+		if v := res.Header.Get("X-Cache"); v != exp {
+			t.Errorf("test %d expected %q, got: %q", i, exp, v)
+		}
+		expKey := ""
+		if exp == "HIT" {
+			expKey = "http/" + u.Host + "/a"
+		}
+		if v := res.Header.Get("X-Cache-Key"); v != expKey {
+			t.Errorf("test %d expected %q, got: %q", i, expKey, v)
+		}
+	}
+}
+
+func TestRemovedBaseDir(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	dir := filepath.Join(t.TempDir(), "cache")
+	c, err := NewDir(dir, WithTTL(1*time.Hour))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	for i, exp := range []int{1, 1, 2, 2} {
+		if i == 2 {
+			if err := os.RemoveAll(dir); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+		}
+		if v, err := doReq(ctx, cl, s.URL+"/a/b/c"); err != nil || v != exp {
+			t.Errorf("test %d expected %d, got: %d %v", i, exp, v, err)
+		}
+	}
+	// removed after checking staleness
+	c, err = NewDir(dir, WithStaleFunc(func(_ context.Context, _ string, mod time.Time, _ time.Duration) (bool, error) {
+		if mod.IsZero() {
+			return true, nil
+		}
+		return false, os.RemoveAll(dir)
+	}))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v, err := doReq(ctx, &http.Client{Transport: c}, s.URL+"/a/b/c"); err != nil || v != 3 {
+		t.Errorf("expected %d, got: %d %v", 3, v, err)
+	}
+}
+
+func TestWithSyncWrites(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		_, _ = res.Write([]byte("a\n"))
+	}))
+	defer s.Close()
+	tests := []struct {
+		opts []Option
+		err  error
+	}{
+		{nil, nil},
+		{[]Option{WithMinifier()}, nil},
+		{nil, syscall.EINVAL},
+		{[]Option{WithMinifier()}, errors.ErrUnsupported},
+	}
+	for i, test := range tests {
+		fs := &syncFs{Fs: afero.NewMemMapFs(), err: test.err}
+		c, err := New(append(test.opts, WithFs(fs), WithSyncWrites())...)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		res, err := (&http.Client{Transport: c}).Get(s.URL)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		res.Body.Close()
+		if n := atomic.LoadInt64(&fs.n); n != 1 {
+			t.Errorf("test %d expected %d sync, got: %d", i, 1, n)
+		}
+	}
+}
+
+// syncFs is a fs that counts file syncs.
+type syncFs struct {
+	afero.Fs
+	err error
+	n   int64
+}
+
+func (fs *syncFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return syncFile{File: f, fs: fs}, nil
+}
+
+// syncFile is a file that counts syncs.
+type syncFile struct {
+	afero.File
+	fs *syncFs
+}
+
+func (f syncFile) Sync() error {
+	atomic.AddInt64(&f.fs.n, 1)
+	if f.fs.err != nil {
+		return f.fs.err
+	}
+	return f.File.Sync()
+}
+
+func TestWithWalkConcurrency(t *testing.T) {
+	fs := &openFs{Fs: afero.NewMemMapFs()}
+	c, err := New(
+		WithFs(fs),
+		WithWalkConcurrency(4),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		buf := []byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na")
+		if i%10 == 0 {
+			buf = []byte("bad")
+		}
+		if err := afero.WriteFile(fs, fmt.Sprintf("e/%03d", i), buf, 0o644); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	report, err := c.Verify(false)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if report.Count != 200 || len(report.Bad) != 20 {
+		t.Errorf("expected 200 entries and 20 bad, got: %d %d", report.Count, len(report.Bad))
+	}
+	if err := c.Export(io.Discard); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if n := atomic.LoadInt64(&fs.open); n != 0 {
+		t.Errorf("expected no open files, got: %d", n)
+	}
+	if n := atomic.LoadInt64(&fs.max); n > 4 {
+		t.Errorf("expected at most 4 open files, got: %d", n)
+	}
+	if _, err := New(WithWalkConcurrency(0)); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+// openFs is a fs that counts open files.
+type openFs struct {
+	afero.Fs
+	open int64
+	max  int64
+}
+
+func (fs *openFs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *openFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	n := atomic.AddInt64(&fs.open, 1)
+	for m := atomic.LoadInt64(&fs.max); n > m && !atomic.CompareAndSwapInt64(&fs.max, m, n); m = atomic.LoadInt64(&fs.max) {
+	}
+	return &openFile{File: f, fs: fs}, nil
+}
+
+// openFile is a file that decrements the open file count when closed.
+type openFile struct {
+	afero.File
+	fs     *openFs
+	closed int32
+}
+
+func (f *openFile) Close() error {
+	if atomic.CompareAndSwapInt32(&f.closed, 0, 1) {
+		atomic.AddInt64(&f.fs.open, -1)
+	}
+	return f.File.Close()
+}
+
+func TestWithLazyBody(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write(body)
+	}))
+	defer s.Close()
+	fs := &openFs{Fs: afero.NewMemMapFs()}
+	c, err := New(
+		WithFs(fs),
+		WithGzipCompression(),
+		WithLazyBody(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	res, err := cl.Get(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	_, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	req := httptest.NewRequest("GET", s.URL, nil)
+	key, p, err := c.Match(req)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// partially read
+	res, err = c.Load(key, p, req)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(res.Body, buf); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if n := atomic.LoadInt64(&fs.open); n != 1 {
+		t.Errorf("expected %d open files, got: %d", 1, n)
+	}
+	if err := res.Body.Close(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if n := atomic.LoadInt64(&fs.open); n != 0 {
+		t.Errorf("expected %d open files, got: %d", 0, n)
+	}
+	// fully read
+	res, err = c.Load(key, p, req)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	buf, err = io.ReadAll(res.Body)
+	res.Body.Close()
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case !bytes.Equal(buf, body):
+		t.Errorf("expected body of %d bytes, got: %d", len(body), len(buf))
+	}
+	// truncated entries are corrupt when read
+	name, err := c.lookup(key)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	stored, err := afero.ReadFile(fs, name)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := afero.WriteFile(fs, name, stored[:len(stored)-16], 0o644); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if res, err = c.Load(key, p, req); err == nil {
+		_, err = io.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	if !errors.Is(err, ErrCorruptEntry) {
+		t.Errorf("expected error %v, got: %v", ErrCorruptEntry, err)
+	}
+	if n := atomic.LoadInt64(&fs.open); n != 0 {
+		t.Errorf("expected %d open files, got: %d", 0, n)
+	}
+}
+
+func TestWithPolicyRefiner(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, ".png") {
+			res.Header().Set("Content-Type", "image/png")
+		} else {
+			res.Header().Set("Content-Type", "text/plain")
+		}
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithTTL(1*time.Hour),
+		WithPolicyRefiner(func(res *http.Response, p Policy) Policy {
+			if strings.HasPrefix(res.Header.Get("Content-Type"), "text/") {
+				p.MarshalUnmarshaler = GzipMarshalUnmarshaler{}
+			}
+			return p
+		}),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	tests := []struct {
+		path string
+		exp  int
+		gzip bool
+	}{
+		{"/a.txt", 1, true},
+		{"/b.png", 2, false},
+		{"/a.txt", 1, true},
+		{"/b.png", 2, false},
+	}
+	for i, test := range tests {
+		if v, err := doReq(ctx, cl, s.URL+test.path); err != nil || v != test.exp {
+			t.Errorf("test %d expected %d, got: %d %v", i, test.exp, v, err)
+		}
+		buf, err := afero.ReadFile(fs, "http/"+u.Host+test.path)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if gzip := bytes.HasPrefix(buf, []byte{0x1f, 0x8b}); gzip != test.gzip {
+			t.Errorf("test %d expected gzip %t, got: %t", i, test.gzip, gzip)
+		}
+	}
+}
+
+func TestWithOnTheFlyCompression(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, ".png") {
+			res.Header().Set("Content-Type", "image/png")
+		} else {
+			res.Header().Set("Content-Type", "text/plain")
+		}
+		_, _ = res.Write([]byte(strings.Repeat("a", 1024)))
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+		WithOnTheFlyCompression(),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		exp            string
+	}{
+		{"/a.txt", "", ""},
+		{"/a.txt", "gzip, deflate", "gzip"},
+		{"/a.txt", "deflate", ""},
+		{"/a.txt", "gzip;q=0", ""},
+		{"/b.png", "gzip", ""},
+		{"/b.png", "gzip", ""},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", s.URL+test.path, nil)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		res, err := c.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		defer res.Body.Close()
+		if v := res.Header.Get("Content-Encoding"); v != test.exp {
+			t.Errorf("test %d expected %q, got: %q", i, test.exp, v)
+		}
+		var r io.Reader = res.Body
+		if test.exp == "gzip" {
+			if r, err = gzip.NewReader(res.Body); err != nil {
+				t.Fatalf("test %d expected no error, got: %v", i, err)
+			}
+		}
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if exp := strings.Repeat("a", 1024); string(buf) != exp {
+			t.Errorf("test %d expected body %q, got: %q", i, exp, string(buf))
+		}
+	}
+}
+
+func TestWithContextLabelTTL(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+		WithMatchers(
+			MatchHostPath(u.Hostname(), "/api/**", WithTTL(1*time.Hour), WithMatcherLabel("api")),
+		),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	for _, urlstr := range []string{s.URL + "/api/a", s.URL + "/b"} {
+		if _, err := doReq(ctx, cl, urlstr); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	ctx = WithContextLabelTTL(ctx, "api", 1*time.Nanosecond)
+	tests := []struct {
+		urlstr string
+		exp    int
+	}{
+		{s.URL + "/api/a", 3},
+		{s.URL + "/b", 2},
+		{s.URL + "/api/a", 4},
+		{s.URL + "/b", 2},
+	}
+	for i, test := range tests {
+		if v, err := doReq(ctx, cl, test.urlstr); err != nil || v != test.exp {
+			t.Errorf("test %d expected %d, got: %d %v", i, test.exp, v, err)
+		}
+	}
+}
+
+func TestWithLowerCaseKeys(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithTTL(1*time.Hour),
+		WithLowerCaseKeys(),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	for i, path := range []string{"/Path", "/path", "/PATH"} {
+		if v, err := doReq(ctx, cl, s.URL+path); err != nil || v != 1 {
+			t.Errorf("test %d expected %d, got: %d %v", i, 1, v, err)
+		}
+	}
+	if _, err := fs.Stat("http/" + u.Host + "/path"); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
+
+func TestWithHTTPCacheImport(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+		res.(http.Flusher).Flush()
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// store entries as httpcache does
+	legacy := afero.NewMemMapFs()
+	now := time.Now().Truncate(time.Second)
+	mods := map[string]time.Time{
+		"/a": now.Add(-10 * time.Minute),
+		"/b": now.Add(-70 * time.Minute),
+	}
+	for _, path := range []string{"/a", "/b"} {
+		res, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		buf, err := httputil.DumpResponse(res, true)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		name := fmt.Sprintf("%x", md5.Sum([]byte(s.URL+path)))
+		if err := afero.WriteFile(legacy, name, buf, 0o644); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := legacy.Chtimes(name, mods[path], mods[path]); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(30*time.Minute),
+		WithHTTPCacheImport(legacy),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	tests := []struct {
+		path string
+		exp  int
+	}{
+		{"/a", 1},
+		{"/a", 1},
+		{"/b", 3},
+		{"/c", 4},
+	}
+	for i, test := range tests {
+		if v, err := doReq(ctx, cl, s.URL+test.path); err != nil || v != test.exp {
+			t.Errorf("test %d expected %d, got: %d %v", i, test.exp, v, err)
+		}
+	}
+	mod, err := c.Mod("http/" + u.Host + "/a")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if !mod.Equal(mods["/a"]) {
+		t.Errorf("expected last modified %v, got: %v", mods["/a"], mod)
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewDir(dir)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	exp, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	switch s, ok := c.BasePath(); {
+	case !ok:
+		t.Errorf("expected ok")
+	case s != exp:
+		t.Errorf("expected %q, got: %q", exp, s)
+	}
+	c, err = New(WithBasePathFs(dir), WithFs(afero.NewMemMapFs()))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if s, ok := c.BasePath(); ok {
+		t.Errorf("expected not ok, got: %q", s)
+	}
+}
+
+func TestSizeGated(t *testing.T) {
+	upper := BodyTransformerFunc(func(w io.Writer, r io.Reader, _ string, _ int, _ string) (bool, error) {
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			return false, err
+		}
+		_, err = w.Write(bytes.ToUpper(buf))
+		return false, err
+	})
+	tests := []struct {
+		min, max int64
+		s        string
+		exp      string
+		ok       bool
+	}{
+		{2, 4, "a", "a", true},
+		{2, 4, "ab", "AB", false},
+		{2, 4, "abcd", "ABCD", false},
+		{2, 4, "abcde", "abcde", true},
+		{2, 0, strings.Repeat("a", 4096), strings.Repeat("A", 4096), false},
+		{0, 2, "", "", false},
+	}
+	for i, test := range tests {
+		tr := SizeGated(upper, test.min, test.max)
+		w := new(bytes.Buffer)
+		ok, err := tr.BodyTransform(w, strings.NewReader(test.s), "", http.StatusOK, "text/plain")
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case ok != test.ok:
+			t.Errorf("test %d expected %t, got: %t", i, test.ok, ok)
+		case w.String() != test.exp:
+			t.Errorf("test %d expected %q, got: %q", i, test.exp, w.String())
+		}
+	}
+}
+
+func TestWithResponseRewriter(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(res, "a")
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+		WithCacheableStatusCodes(http.StatusOK),
+		WithResponseRewriter(func(res *http.Response) (*http.Response, error) {
+			buf, err := io.ReadAll(res.Body)
+			if err != nil {
+				return nil, err
+			}
+			z := *res
+			z.StatusCode, z.Status = http.StatusOK, "200 OK"
+			z.Header = res.Header.Clone()
+			z.Header.Set("X-Body-Length", strconv.Itoa(len(buf)))
+			z.Body, z.ContentLength = io.NopCloser(bytes.NewReader(bytes.ToUpper(buf))), -1
+			return &z, nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	for i := 0; i < 2; i++ {
+		res, err := cl.Get(s.URL)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case res.StatusCode != http.StatusOK:
+			t.Errorf("test %d expected %d, got: %d", i, http.StatusOK, res.StatusCode)
+		case res.Header.Get("X-Body-Length") != "2":
+			t.Errorf("test %d expected %q, got: %q", i, "2", res.Header.Get("X-Body-Length"))
+		case string(buf) != "A\n":
+			t.Errorf("test %d expected %q, got: %q", i, "A\n", string(buf))
+		}
+	}
+	cached, err := c.Cached(httptest.NewRequest("GET", s.URL, nil))
+	if err != nil || !cached {
+		t.Errorf("expected cached, got: %t %v", cached, err)
+	}
+	// rewriters returning a nil response error
+	c, err = New(
+		WithFs(afero.NewMemMapFs()),
+		WithResponseRewriter(func(*http.Response) (*http.Response, error) {
+			return nil, nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := (&http.Client{Transport: c}).Get(s.URL); err == nil || !strings.Contains(err.Error(), "diskcache.ResponseRewriterFunc returned nil response") {
+		t.Errorf("expected nil response error, got: %v", err)
+	}
+}
+
+func TestWithCacheEpoch(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	fs := afero.NewMemMapFs()
+	ctx := context.Background()
+	tests := []struct {
+		epoch string
+		exp   int
+	}{
+		{"", 1},
+		{"v1", 2},
+		{"v1", 2},
+		{"v2", 3},
+		{"v2", 3},
+		{"v1", 4},
+	}
+	for i, test := range tests {
+		opts := []Option{WithFs(fs), WithTTL(1 * time.Hour)}
+		if test.epoch != "" {
+			opts = append(opts, WithCacheEpoch(test.epoch))
+		}
+		c, err := New(opts...)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if v, err := doReq(ctx, &http.Client{Transport: c}, s.URL); err != nil || v != test.exp {
+			t.Errorf("test %d expected %d, got: %d %v", i, test.exp, v, err)
+		}
+	}
+}
+
+func TestCorruptEntry(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	ctx := context.Background()
+	for i, opts := range [][]Option{nil, {WithGzipCompression()}} {
+		fs := afero.NewMemMapFs()
+		c, err := New(append(opts, WithFs(fs), WithTTL(1*time.Hour))...)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		cl := &http.Client{
+			Transport: c,
+		}
+		name := "http/" + u.Host + "/a"
+		for _, buf := range []string{"garbage", "HTTP/1.1 200 OK\r\nContent-"} {
+			if err := afero.WriteFile(fs, name, []byte(buf), 0o644); err != nil {
+				t.Fatalf("test %d expected no error, got: %v", i, err)
+			}
+			exp := int(atomic.LoadUint64(&count)) + 1
+			if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != exp {
+				t.Errorf("test %d expected %d, got: %d %v", i, exp, v, err)
+			}
+			// repaired
+			if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != exp {
+				t.Errorf("test %d expected %d, got: %d %v", i, exp, v, err)
+			}
+		}
+	}
+}
+
+func TestContextBodyTransformer(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(res, "secret")
+	}))
+	defer s.Close()
+	type ctxKey struct{}
+	redact := func(ctx context.Context, w io.Writer, r io.Reader, req *http.Request, res *http.Response) (bool, error) {
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			return false, err
+		}
+		if req.Header.Get("X-Redact") == "1" && ctx.Value(ctxKey{}) == "yes" && res.StatusCode == http.StatusOK {
+			buf = bytes.ReplaceAll(buf, []byte("secret"), []byte("******"))
+		}
+		_, err = w.Write(buf)
+		return err == nil, err
+	}
+	for i, opt := range []Option{
+		WithBodyTransformContextFunc(TransformPriorityModify, redact),
+		WithBodyTransformers(SizeGated(ContextBodyTransformerFunc(redact), 0, 0)),
+	} {
+		c, err := New(WithFs(afero.NewMemMapFs()), opt)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		req, err := http.NewRequestWithContext(context.WithValue(context.Background(), ctxKey{}, "yes"), "GET", s.URL, nil)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		req.Header.Set("X-Redact", "1")
+		res, err := c.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case string(buf) != "******\n":
+			t.Errorf("test %d expected %q, got: %q", i, "******\n", string(buf))
+		}
+	}
+}
+
+func TestStoreBundle(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%s %d\n", req.URL.Path, atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	fs := afero.NewMemMapFs()
+	c, err := New(WithFs(fs), WithTTL(1*time.Hour))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	ctx := context.Background()
+	var reqs []*http.Request
+	for _, p := range []string{"/", "/a.css", "/b.js"} {
+		req, err := http.NewRequestWithContext(ctx, "GET", s.URL+p, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		reqs = append(reqs, req)
+	}
+	if err := c.StoreBundle(reqs[0], reqs[1:]...); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if n := atomic.LoadUint64(&count); n != 3 {
+		t.Fatalf("expected 3 requests, got: %d", n)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", s.URL, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	responses, err := c.LoadBundle(req)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	exp := []string{"/ 1\n", "/a.css 2\n", "/b.js 3\n"}
+	if len(responses) != len(exp) {
+		t.Fatalf("expected %d responses, got: %d", len(exp), len(responses))
+	}
+	for i, res := range responses {
+		buf, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		res.Body.Close()
+		if s := string(buf); s != exp[i] {
+			t.Errorf("test %d expected %q, got: %q", i, exp[i], s)
+		}
+	}
+	if n := atomic.LoadUint64(&count); n != 3 {
+		t.Errorf("expected 3 requests, got: %d", n)
+	}
+	if err := c.Evict(req); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	responses, err = c.LoadBundle(req)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for _, res := range responses {
+		res.Body.Close()
+	}
+	if len(responses) != 1 {
+		t.Errorf("expected 1 response after evict, got: %d", len(responses))
+	}
+}
+
+func TestStoreBundleNotStored(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%s %d\n", req.URL.Path, atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	afs := afero.NewMemMapFs()
+	c, err := New(WithFs(afs), WithTTL(1*time.Hour), WithStorePredicate(func(_ string, data []byte, _ *http.Response) bool {
+		return !bytes.Contains(data, []byte("/ "))
+	}))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	ctx := context.Background()
+	var reqs []*http.Request
+	for _, p := range []string{"/", "/a.css"} {
+		req, err := http.NewRequestWithContext(ctx, "GET", s.URL+p, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		reqs = append(reqs, req)
+	}
+	if err := c.StoreBundle(reqs[0], reqs[1:]...); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist, got: %v", err)
+	}
+	if n := atomic.LoadUint64(&count); n != 1 {
+		t.Errorf("expected 1 request, got: %d", n)
+	}
+	if err := afero.Walk(afs, "/", func(name string, _ fs.FileInfo, err error) error {
+		if err == nil && strings.Contains(name, bundleDir) {
+			t.Errorf("expected no bundle sidecar, got: %s", name)
+		}
+		return err
+	}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+}
+
+func TestWithNormalizedVaryKey(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	c, err := New(WithFs(afero.NewMemMapFs()), WithTTL(1*time.Hour), WithNormalizedVaryKey("accept-language", "Accept"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	tests := []struct {
+		lang string
+		exp  int
+	}{
+		{"en", 1},
+		{"de", 2},
+		{"en", 1},
+		{"", 3},
+		{"de", 2},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequestWithContext(ctx, "GET", s.URL, nil)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if test.lang != "" {
+			req.Header.Set("Accept-Language", test.lang)
+		}
+		res, err := cl.Do(req)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if v := strings.TrimSpace(string(buf)); v != strconv.Itoa(test.exp) {
+			t.Errorf("test %d expected %d, got: %s", i, test.exp, v)
+		}
+		key, _, err := c.Match(req)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		h, err := c.VaryValues(key)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if v := h.Get("Accept-Language"); v != test.lang {
+			t.Errorf("test %d expected %q, got: %q", i, test.lang, v)
+		}
+	}
+	if _, err := New(WithNormalizedVaryKey()); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestClose(t *testing.T) {
+	started, done := make(chan struct{}), make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-done
+		fmt.Fprintln(res, "1")
+	}))
+	defer s.Close()
+	c, err := New(WithFs(afero.NewMemMapFs()), WithTTL(1*time.Hour), WithMemoryLayer(10))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	errc := make(chan error, 1)
+	go func() {
+		v, err := doReq(ctx, cl, s.URL)
+		if err == nil && v != 1 {
+			err = fmt.Errorf("expected 1, got: %d", v)
+		}
+		errc <- err
+	}()
+	<-started
+	closed := make(chan error, 2)
+	for range 2 {
+		go func() {
+			closed <- c.Close()
+		}()
+	}
+	select {
+	case <-closed:
+		t.Fatalf("expected close to wait for in-flight request")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(done)
+	if err := <-errc; err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	for range 2 {
+		if err := <-closed; err != nil {
+			t.Errorf("expected no error, got: %v", err)
+		}
+	}
+	if _, err := doReq(ctx, cl, s.URL); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
+
+func TestWithServeStaleUpTo(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	fs := afero.NewMemMapFs()
+	c, err := New(WithFs(fs), WithTTL(1*time.Hour), WithServeStaleUpTo(1*time.Hour))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	req, err := http.NewRequest("GET", s.URL+"/a", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	key, _, err := c.Match(req)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	tests := []struct {
+		age     time.Duration
+		exp     string
+		warning string
+	}{
+		{0, "1\n", ""},
+		{30 * time.Minute, "1\n", ""},
+		{90 * time.Minute, "1\n", `110 - "Response is Stale"`},
+		{3 * time.Hour, "2\n", ""},
+		{0, "2\n", ""},
+	}
+	for i, test := range tests {
+		if test.age != 0 {
+			mod := time.Now().Add(-test.age)
+			if err := fs.Chtimes(c.name(key), mod, mod); err != nil {
+				t.Fatalf("test %d expected no error, got: %v", i, err)
+			}
+		}
+		res, err := c.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if s := string(buf); s != test.exp {
+			t.Errorf("test %d expected %q, got: %q", i, test.exp, s)
+		}
+		if s := res.Header.Get("Warning"); s != test.warning {
+			t.Errorf("test %d expected warning %q, got: %q", i, test.warning, s)
+		}
+		if test.age == 90*time.Minute {
+			if stale, _, err := c.Stale(context.Background(), key, 1*time.Hour); err != nil || !stale {
+				t.Errorf("test %d expected stale, got: %t %v", i, stale, err)
+			}
+		}
+	}
+	if _, err := New(WithServeStaleUpTo(-1)); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestNewSimpleMatcherKeyTokens(t *testing.T) {
+	tests := []struct {
+		host, path, key string
+		err             bool
+	}{
+		{`^(?P<proto>https?)://(?P<host>[^:]+)(?P<port>:[0-9]+)?$`, `^/?(?P<path>.*)$`, defaultKey, false},
+		{`^(?P<proto>https?)://(?P<host>[^:]+)$`, `^/?(?P<path>.*)$`, `{{method}}/{{host}}/{{path}}{{query}}`, false},
+		{`^(?P<proto>https?)://(?P<host>[^:]+)$`, `^/?(?P<path>.*)$`, defaultKey, true},
+		{`^https?://[^:]+$`, `^/?(?P<path>.*)$`, `{{path}}/{{}}`, true},
+		{`^https?://[^:]+$`, `^/?.*$`, `static`, false},
+	}
+	for i, test := range tests {
+		_, err := NewSimpleMatcher("GET", test.host, test.path, test.key)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("test %d expected error, got nil", i)
+		case !test.err && err != nil:
+			t.Errorf("test %d expected no error, got: %v", i, err)
+		}
+	}
+}
+
+func TestWithFragmentInKey(t *testing.T) {
+	c, err := New(WithFs(afero.NewMemMapFs()), WithFragmentInKey())
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	tests := []struct {
+		urlstr string
+		exp    string
+	}{
+		{"https://example.com/app", "https/example.com/app"},
+		{"https://example.com/app#", "https/example.com/app"},
+		{"https://example.com/app#/a/b?c=d", "https/example.com/app#%2Fa%2Fb%3Fc%3Dd"},
+		{"https://example.com/app?q=1#top", "https/example.com/app_q%3D1#top"},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", test.urlstr, nil)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		key, _, err := c.Match(req)
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case key != test.exp:
+			t.Errorf("test %d expected %q, got: %q", i, test.exp, key)
+		}
+	}
+	m, err := NewSimpleMatcher("GET", `^https?://(?P<host>.+)$`, `^/(?P<path>.*)$`, `{{host}}/{{fragment}}/{{path}}`, WithFragmentInKey())
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	req, err := http.NewRequest("GET", "https://example.com/app#top", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if key, _, err := m.Match(req); err != nil || key != "example.com/#top/app" {
+		t.Errorf("expected %q, got: %q %v", "example.com/#top/app", key, err)
+	}
+}
+
+func TestMatcherPriority(t *testing.T) {
+	low := Match("GET", `^https?://example\.com$`, `^/(?P<path>.*)$`, `low/{{path}}`, WithMatcherPriority(10))
+	high := Match("GET", `^https?://example\.com$`, `^/(?P<path>.*)$`, `high/{{path}}`, WithMatcherPriority(-1))
+	mid := Match("GET", `^https?://example\.com$`, `^/(?P<path>.*)$`, `mid/{{path}}`)
+	custom := priorityMatcher{Match("GET", `^https?://example\.com$`, `^/(?P<path>a)$`, `custom/{{path}}`), 5}
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithMatchers(low, custom, mid, high),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// matchers are evaluated in priority order, followed by the default matcher
+	matchers := c.Matchers()
+	if len(matchers) != 5 {
+		t.Fatalf("expected 5 matchers, got: %d", len(matchers))
+	}
+	for i, exp := range []Matcher{high, mid, custom, low} {
+		if matchers[i] != exp {
+			t.Errorf("matcher %d expected %v, got: %v", i, exp, matchers[i])
+		}
+	}
+	req, err := http.NewRequest("GET", "https://example.com/a", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if key, _, err := c.Match(req); err != nil || key != "high/a" {
+		t.Errorf("expected %q, got: %q %v", "high/a", key, err)
+	}
+	// default matcher is excluded when disabled
+	if c, err = New(WithFs(afero.NewMemMapFs()), WithNoDefault(), WithMatchers(low, high)); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if matchers := c.Matchers(); len(matchers) != 2 || matchers[0] != high || matchers[1] != low {
+		t.Errorf("expected [high low], got: %v", matchers)
+	}
+	// only valid for simple matchers
+	if _, err := New(WithMatcherPriority(1)); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+// priorityMatcher wraps a matcher with a priority.
+type priorityMatcher struct {
+	Matcher
+	priority int
+}
+
+func (m priorityMatcher) MatcherPriority() int {
+	return m.priority
+}
+
+func TestMatchHost(t *testing.T) {
+	host := MatchHost("example.com")
+	glob := MatchHostPath("example.com", "/a/*.js", WithTTL(1*time.Hour))
+	index := MatchHost("example.com", WithIndexPath("!index"))
+	tests := []struct {
+		m      Matcher
+		method string
+		url    string
+		exp    string
+		ttl    time.Duration
+	}{
+		{host, "GET", "https://example.com/a/b.js", "https/example.com/a/b.js", 0},
+		{host, "GET", "http://example.com:8080/", "http/example.com:8080/?index", 0},
+		{host, "GET", "https://other.com/a/b.js", "", 0},
+		{host, "GET", "https://sub.example.com/a/b.js", "", 0},
+		{host, "POST", "https://example.com/a/b.js", "", 0},
+		{glob, "GET", "https://example.com/a/b.js", "https/example.com/a/b.js", 1 * time.Hour},
+		{glob, "GET", "https://example.com/a/b/c.js", "", 0},
+		{glob, "GET", "https://example.com/a/b.css", "", 0},
+		{glob, "GET", "https://other.com/a/b.js", "", 0},
+		{index, "GET", "http://example.com:8080/", "http/example.com:8080/!index", 0},
+		{index, "GET", "https://example.com/a/", "https/example.com/a/!index", 0},
+	}
+	for i, test := range tests {
+		key, p, err := test.m.Match(httptest.NewRequest(test.method, test.url, nil))
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case key != test.exp:
+			t.Errorf("test %d expected %q, got: %q", i, test.exp, key)
+		case key != "" && p.TTL != test.ttl:
+			t.Errorf("test %d expected ttl %v, got: %v", i, test.ttl, p.TTL)
+		}
+	}
+}
+
+func TestSimpleMatcherString(t *testing.T) {
+	m, err := NewSimpleMatcher(
+		"GET",
+		`^https://(?P<host>example\.com)$`,
+		`^/(?P<path>.*)$`,
+		`{{host}}/{{path}}`,
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	exp := `method=GET host=^https://(?P<host>example\.com)$ path=^/(?P<path>.*)$ key={{host}}/{{path}}`
+	if s := m.String(); s != exp {
+		t.Errorf("expected %q, got: %q", exp, s)
+	}
+	if err := WithMethod("GET", "HEAD").apply(m); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if s := fmt.Sprint(m); !strings.HasPrefix(s, "method={GET,HEAD} ") {
+		t.Errorf("expected method {GET,HEAD}, got: %q", s)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	m, err := NewSimpleMatcher(
+		"GET",
+		`^https://(?P<host>example\.com)$`,
+		`^/(?P<path>.*)$`,
+		`{{host}}/{{path}}`,
+		WithTTL(2*time.Hour),
+		WithMatcherLabel("example"),
+		WithMinifier(),
+		WithHTMLStrip(true, true, true),
+		WithGzipCompression(),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	c, err := New(WithFs(afero.NewMemMapFs()), WithMatchers(m), WithMethod("GET", "HEAD"), WithTTL(1*time.Hour))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	s := c.Describe()
+	for i, exp := range []string{
+		"fs: *afero.MemMapFs\n",
+		"matcher 0: *diskcache.SimpleMatcher\n",
+		"  key: {{host}}/{{path}}\n",
+		"  label: example\n",
+		"  ttl: 2h0m0s\n",
+		"  body transformer: 60 diskcache.HTMLStripper\n  body transformer: 80 diskcache.Minifier\n",
+		"  marshaler: diskcache.GzipMarshalUnmarshaler\n",
+		"matcher 1: *diskcache.SimpleMatcher (default)\n",
+		"  method: {GET,HEAD}\n",
+		"  ttl: 1h0m0s\n",
+	} {
+		if !strings.Contains(s, exp) {
+			t.Errorf("test %d expected description to contain %q, got:\n%s", i, exp, s)
+		}
+	}
+}
+
+func TestBzip2MarshalUnmarshaler(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	// bzip2 compressed response, produced externally
+	entry, err := hex.DecodeString("425a683931415926535977dec07600000e5f8000124003f030084cc40022e5d46020004889a1a8323ca3469e50c81aa7a9934d18269ea030d05ca326429eba0d821c3e286860cb375685d0561cd3d5d802517b017963cac2a10d7b84205ca2c1e05dc914e14241df7b01d8")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for i, opts := range [][]Option{
+		{WithMarshalUnmarshaler(Bzip2MarshalUnmarshaler{Marshaler: GzipMarshalUnmarshaler{Level: gzip.DefaultCompression}})},
+		{WithMarshalUnmarshaler(Bzip2MarshalUnmarshaler{})},
+		{WithPolicyRefiner(func(_ *http.Response, p Policy) Policy { return p })},
+	} {
+		fs := afero.NewMemMapFs()
+		c, err := New(append(opts, WithFs(fs), WithTTL(1*time.Hour))...)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		cl := &http.Client{
+			Transport: c,
+		}
+		if err := afero.WriteFile(fs, "http/"+u.Host+"/a", entry, 0o644); err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		ctx := context.Background()
+		res, err := cl.Get(s.URL + "/a")
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil || string(buf) != "external\n" {
+			t.Errorf("test %d expected %q, got: %q %v", i, "external\n", buf, err)
+		}
+		// entries written by the cache are stored with the marshaler
+		exp := int(atomic.LoadUint64(&count)) + 1
+		for j := 0; j < 2; j++ {
+			if v, err := doReq(ctx, cl, s.URL+"/b"); err != nil || v != exp {
+				t.Errorf("test %d,%d expected %d, got: %d %v", i, j, exp, v, err)
+			}
+		}
+	}
+}
+
+func TestWithStoredTimestamp(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	fs := afero.NewMemMapFs()
+	c, err := New(WithFs(fs), WithTTL(1*time.Hour), WithStoredTimestamp())
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	name := "http/" + u.Host + "/a"
+	tests := []struct {
+		mtime time.Duration
+		exp   int
+	}{
+		{0, 1},
+		// rewritten mtime is ignored
+		{-2 * time.Hour, 1},
+		{-3 * time.Hour, 1},
+	}
+	for i, test := range tests {
+		if test.mtime != 0 {
+			mtime := time.Now().Add(test.mtime)
+			if err := fs.Chtimes(name, mtime, mtime); err != nil {
+				t.Fatalf("test %d expected no error, got: %v", i, err)
+			}
+		}
+		if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != test.exp {
+			t.Errorf("test %d expected %d, got: %d %v", i, test.exp, v, err)
+		}
+	}
+	// stale stored timestamp is used over a fresh mtime
+	ts := time.Now().Add(-2 * time.Hour)
+	if err := afero.WriteFile(fs, "?timestamp/"+name, []byte(ts.Format(time.RFC3339Nano)), 0o644); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	key := "http/" + u.Host + "/a"
+	if mod, err := c.Mod(key); err != nil || !mod.Equal(ts) {
+		t.Errorf("expected mod %v, got: %v %v", ts, mod, err)
+	}
+	if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != 2 {
+		t.Errorf("expected 2, got: %d %v", v, err)
+	}
+	// entries without a stored timestamp fall back to the mtime
+	if err := afero.WriteFile(fs, "http/"+u.Host+"/b", []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\n0\n"), 0o644); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v, err := doReq(ctx, cl, s.URL+"/b"); err != nil || v != 0 {
+		t.Errorf("expected 0, got: %d %v", v, err)
+	}
+	mtime := time.Now().Add(-2 * time.Hour)
+	if err := fs.Chtimes("http/"+u.Host+"/b", mtime, mtime); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v, err := doReq(ctx, cl, s.URL+"/b"); err != nil || v != 3 {
+		t.Errorf("expected 3, got: %d %v", v, err)
+	}
+}
+
+func TestWithAutoCompression(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/a.txt":
+			res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		case "/a.json":
+			res.Header().Set("Content-Type", "application/json")
+		case "/a.png":
+			res.Header().Set("Content-Type", "image/png")
+		default:
+			res.Header().Set("Content-Type", "application/octet-stream")
+		}
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	fs := afero.NewMemMapFs()
+	rules := map[string]MarshalUnmarshaler{
+		"text/*":           GzipMarshalUnmarshaler{Level: gzip.DefaultCompression},
+		"application/json": ZlibMarshalUnmarshaler{Level: zlib.DefaultCompression},
+		"image/*":          nil,
+	}
+	c, err := New(WithFs(fs), WithTTL(1*time.Hour), WithAutoCompression(rules))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	tests := []struct {
+		path   string
+		prefix []byte
+	}{
+		{"/a.txt", append([]byte("DISKCACHE-CODEC text/*\n"), 0x1f, 0x8b)},
+		{"/a.json", append([]byte("DISKCACHE-CODEC application/json\n"), 0x78)},
+		{"/a.png", []byte("HTTP/1.1 200 OK\r\n")},
+		{"/a.bin", []byte("HTTP/1.1 200 OK\r\n")},
+	}
+	for i, test := range tests {
+		for j := 0; j < 2; j++ {
+			if v, err := doReq(ctx, cl, s.URL+test.path); err != nil || v != i+1 {
+				t.Errorf("test %d,%d expected %d, got: %d %v", i, j, i+1, v, err)
+			}
+		}
+		buf, err := afero.ReadFile(fs, "http/"+u.Host+test.path)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if !bytes.HasPrefix(buf, test.prefix) {
+			t.Errorf("test %d expected prefix %q, got: %q", i, test.prefix, buf[:min(len(buf), 40)])
+		}
+	}
+	// entries with a removed rule are refetched
+	delete(rules, "text/*")
+	c, err = New(WithFs(fs), WithTTL(1*time.Hour), WithAutoCompression(rules))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v, err := doReq(ctx, &http.Client{Transport: c}, s.URL+"/a.txt"); err != nil || v != 5 {
+		t.Errorf("expected 5, got: %d %v", v, err)
+	}
+	if _, err := New(WithAutoCompression(map[string]MarshalUnmarshaler{"text/*": FlatMarshalUnmarshaler{}})); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestWithCompressionPassthrough(t *testing.T) {
+	var count uint64
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, _ = w.Write(bytes.Repeat([]byte("compressed\n"), 100))
+	_ = w.Close()
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		n := atomic.AddUint64(&count, 1)
+		res.Header().Set("Content-Type", "text/plain")
+		if req.URL.Path == "/a.gz" {
+			res.Header().Set("Content-Encoding", "gzip")
+			_, _ = res.Write(gz.Bytes())
+			return
+		}
+		fmt.Fprintf(res, "%d\n", n)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithTTL(1*time.Hour),
+		WithGzipCompression(),
+		WithCompressionPassthrough(),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", s.URL+"/a.gz", nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, err := cl.Do(req)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case res.Header.Get("Content-Encoding") != "gzip":
+			t.Errorf("test %d expected gzip content encoding, got: %q", i, res.Header.Get("Content-Encoding"))
+		case !bytes.Equal(buf, gz.Bytes()):
+			t.Errorf("test %d expected gzip body, got: %q", i, buf)
+		}
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if v, err := doReq(ctx, cl, s.URL+"/a.txt"); err != nil || v != 2 {
+			t.Errorf("test %d expected 2, got: %d %v", i, v, err)
+		}
+	}
+	if n := atomic.LoadUint64(&count); n != 2 {
+		t.Errorf("expected 2 fetches, got: %d", n)
+	}
+	tests := []struct {
+		path   string
+		prefix []byte
+	}{
+		{"/a.gz", []byte(encodedMagic + "HTTP/1.1 200 OK\r\n")},
+		{"/a.txt", []byte{0x1f, 0x8b}},
+	}
+	for i, test := range tests {
+		buf, err := afero.ReadFile(fs, "http/"+u.Host+test.path)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if !bytes.HasPrefix(buf, test.prefix) {
+			t.Errorf("test %d expected prefix %q, got: %q", i, test.prefix, buf[:min(len(buf), 40)])
+		}
+	}
+}
+
+// registerTestFormats registers the test entry formats.
+var registerTestFormats sync.Once
+
+func TestWithFormat(t *testing.T) {
+	registerTestFormats.Do(func() {
+		RegisterFormat(0xf1, ZlibMarshalUnmarshaler{Level: zlib.DefaultCompression})
+		RegisterFormat(0xf2, GzipMarshalUnmarshaler{Level: gzip.DefaultCompression})
+	})
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	fs := afero.NewMemMapFs()
+	ctx := context.Background()
+	// store an untagged entry
+	c, err := New(WithFs(fs), WithTTL(1*time.Hour), WithGzipCompression())
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v, err := doReq(ctx, &http.Client{Transport: c}, s.URL+"/legacy"); err != nil || v != 1 {
+		t.Fatalf("expected 1, got: %d %v", v, err)
+	}
+	tests := []struct {
+		tag    byte
+		path   string
+		exp    int
+		prefix []byte
+	}{
+		{0xf1, "/legacy", 1, []byte{0x1f, 0x8b}},
+		{0xf1, "/a", 2, append([]byte("DISKCACHE-FORMAT f1\n"), 0x78)},
+		{0xf2, "/a", 2, append([]byte("DISKCACHE-FORMAT f1\n"), 0x78)},
+		{0xf2, "/b", 3, append([]byte("DISKCACHE-FORMAT f2\n"), 0x1f, 0x8b)},
+	}
+	for i, test := range tests {
+		c, err := New(WithFs(fs), WithTTL(1*time.Hour), WithFormat(test.tag))
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if v, err := doReq(ctx, &http.Client{Transport: c}, s.URL+test.path); err != nil || v != test.exp {
+			t.Errorf("test %d expected %d, got: %d %v", i, test.exp, v, err)
+		}
+		buf, err := afero.ReadFile(fs, "http/"+u.Host+test.path)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if !bytes.HasPrefix(buf, test.prefix) {
+			t.Errorf("test %d expected prefix %q, got: %q", i, test.prefix, buf[:min(len(buf), 40)])
+		}
+	}
+	// entries with unregistered formats are refetched
+	if err := afero.WriteFile(fs, "http/"+u.Host+"/a", []byte("DISKCACHE-FORMAT ee\n"), 0o644); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v, err := doReq(ctx, &http.Client{Transport: c}, s.URL+"/a"); err != nil || v != 4 {
+		t.Errorf("expected 4, got: %d %v", v, err)
+	}
+	if _, err := New(WithFormat(0xee)); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected panic")
+			}
+		}()
+		RegisterFormat(0xf1, GzipMarshalUnmarshaler{})
+	}()
+}
+
+func TestWithConfigVersion(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(res, "<p>%d</p>\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	fs := afero.NewMemMapFs()
+	tests := []struct {
+		opts []Option
+		exp  uint64
+	}{
+		{nil, 1},
+		{[]Option{WithConfigVersion("")}, 2},
+		{[]Option{WithConfigVersion("")}, 2},
+		{[]Option{WithConfigVersion(""), WithMinifier()}, 3},
+		{[]Option{WithConfigVersion(""), WithMinifier()}, 3},
+		{[]Option{WithConfigVersion("v2"), WithMinifier()}, 4},
+		// refined policies use the matched policy's config version
+		{[]Option{WithConfigVersion("v2"), WithMinifier(), WithPolicyRefiner(func(_ *http.Response, p Policy) Policy {
+			p.MarshalUnmarshaler = GzipMarshalUnmarshaler{}
+			return p
+		})}, 4},
+		// auto compressed entries use the matched policy's config version
+		{[]Option{WithConfigVersion("v3"), WithAutoCompression(map[string]MarshalUnmarshaler{"text/*": GzipMarshalUnmarshaler{}})}, 5},
+		{[]Option{WithConfigVersion("v3"), WithAutoCompression(map[string]MarshalUnmarshaler{"text/*": GzipMarshalUnmarshaler{}})}, 5},
+	}
+	for i, test := range tests {
+		c, err := New(append(test.opts, WithFs(fs), WithTTL(1*time.Hour))...)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		res, err := (&http.Client{Transport: c}).Get(s.URL)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		res.Body.Close()
+		if n := atomic.LoadUint64(&count); n != test.exp {
+			t.Errorf("test %d expected %d requests, got: %d", i, test.exp, n)
+		}
+	}
+}
+
+func TestWithContextSkipTransformers(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddUint64(&count, 1)
+		res.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(res, "<p>  a  </p>\n<!-- b -->\n")
+	}))
+	defer s.Close()
+	c, err := New(WithFs(afero.NewMemMapFs()), WithTTL(1*time.Hour), WithHTMLStrip(false, true, false), WithMinifier())
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	tests := []struct {
+		ctx   context.Context
+		exp   string
+		count uint64
+	}{
+		{context.Background(), "<p>a", 1},
+		{WithContextSkipTransformers(context.Background()), "<p>  a  </p>\n<!-- b -->\n", 2},
+		{WithContextSkipTransformers(context.Background(), "diskcache.Minifier"), "<p>  a  </p>\n\n", 3},
+		{context.Background(), "<p>a", 3},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequestWithContext(test.ctx, "GET", s.URL, nil)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		res, err := cl.Do(req)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if s := string(buf); s != test.exp {
+			t.Errorf("test %d expected %q, got: %q", i, test.exp, s)
+		}
+		if n := atomic.LoadUint64(&count); n != test.count {
+			t.Errorf("test %d expected %d requests, got: %d", i, test.count, n)
+		}
+	}
+}
+
+func TestWithKeyFinalizer(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain")
+		res.Header().Set("X-Canonical", "/canonical")
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithTTL(1*time.Hour),
+		WithKeyFinalizer(func(key string, res *http.Response) string {
+			if v := res.Header.Get("X-Canonical"); v != "" {
+				return "http/" + res.Request.URL.Host + v
+			}
+			return key
+		}),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	tests := []struct {
+		path string
+		exp  int
+	}{
+		{"/a", 1},
+		{"/b", 2},
+		{"/a", 2},
+		{"/b", 2},
+	}
+	for i, test := range tests {
+		if v, err := doReq(ctx, cl, s.URL+test.path); err != nil || v != test.exp {
+			t.Errorf("test %d expected %d, got: %d %v", i, test.exp, v, err)
+		}
+	}
+	if _, err := fs.Stat("http/" + u.Host + "/canonical"); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if _, err := fs.Stat("http/" + u.Host + "/a"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got: %v", err)
+	}
+	if _, err := c.Mod("http/" + u.Host + "/a"); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if err := c.EvictKey("http/" + u.Host + "/a"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := c.Mod("http/" + u.Host + "/b"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got: %v", err)
+	}
+	if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != 3 {
+		t.Errorf("expected 3, got: %d %v", v, err)
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Set-Cookie", "session=secret-cookie")
+		fmt.Fprintln(res, "1")
+	}))
+	defer s.Close()
+	buf := new(bytes.Buffer)
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+		WithLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	u, err := url.Parse(s.URL + "/a?token=secret-query")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	u.User = url.UserPassword("user", "secret-password")
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer secret-header")
+	cl := &http.Client{
+		Transport: c,
+	}
+	for i := 0; i < 2; i++ {
+		res, err := cl.Do(req)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+	key, _, err := c.Match(req)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := c.EvictKey(key); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	out := buf.String()
+	// logged urls do not include user info or query strings
+	for _, msg := range []string{"msg=match", "msg=fetch", "msg=store", "msg=evict", "url=" + s.URL + "/a "} {
+		if !strings.Contains(out, msg) {
+			t.Errorf("expected %q to be logged, got:\n%s", msg, out)
+		}
+	}
+	for _, secret := range []string{"secret-password", "secret-header", "secret-cookie"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("expected %q to not be logged, got:\n%s", secret, out)
+		}
+	}
+}
+
+func TestWithRecordAll(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithTTL(1*time.Hour),
+		WithRecordAll("fixtures"),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	post := func(cl *http.Client, body string) (int, error) {
+		res, err := cl.Post(s.URL+"/post", "text/plain", strings.NewReader(body))
+		if err != nil {
+			return -1, err
+		}
+		defer res.Body.Close()
+		buf, err := io.ReadAll(res.Body)
+		if err != nil {
+			return -1, err
+		}
+		return strconv.Atoi(string(bytes.TrimSpace(buf)))
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	if v, err := doReq(ctx, cl, s.URL+"/a?b=2&a=1"); err != nil || v != 1 {
+		t.Errorf("expected 1, got: %d %v", v, err)
+	}
+	if v, err := post(cl, "a"); err != nil || v != 2 {
+		t.Errorf("expected 2, got: %d %v", v, err)
+	}
+	if v, err := post(cl, "b"); err != nil || v != 3 {
+		t.Errorf("expected 3, got: %d %v", v, err)
+	}
+	if _, err := fs.Stat("fixtures/post"); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	// fixtures are not entries
+	report, err := c.Verify(false)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case report.Count != 1:
+		t.Errorf("expected 1 entry, got: %d", report.Count)
+	}
+	s.Close()
+	r, err := NewFixtureReplayer(fs, "fixtures")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl = &http.Client{
+		Transport: r,
+	}
+	if v, err := doReq(ctx, cl, s.URL+"/a?a=1&b=2"); err != nil || v != 1 {
+		t.Errorf("expected 1, got: %d %v", v, err)
+	}
+	if v, err := post(cl, "b"); err != nil || v != 3 {
+		t.Errorf("expected 3, got: %d %v", v, err)
+	}
+	if v, err := post(cl, "a"); err != nil || v != 2 {
+		t.Errorf("expected 2, got: %d %v", v, err)
+	}
+	if _, err := post(cl, "c"); !errors.Is(err, ErrNotCached) {
+		t.Errorf("expected ErrNotCached, got: %v", err)
+	}
+}
+
+func TestWithTeeStreaming(t *testing.T) {
+	var count uint64
+	wait := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(res, "%d", atomic.AddUint64(&count, 1))
+		res.(http.Flusher).Flush()
+		if req.URL.Path == "/wait" {
+			<-wait
+		}
+		fmt.Fprintln(res)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithTTL(1*time.Hour),
+		WithTeeStreaming(),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	// client receives bytes before the response has completed
+	res, err := cl.Get(s.URL + "/wait")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(res.Body, b); err != nil || string(b) != "1" {
+		t.Errorf("expected 1, got: %q %v", b, err)
+	}
+	if _, err := fs.Stat("http/" + u.Host + "/wait"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got: %v", err)
+	}
+	close(wait)
+	if _, err := io.ReadAll(res.Body); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := res.Body.Close(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v, err := doReq(ctx, cl, s.URL+"/wait"); err != nil || v != 1 {
+		t.Errorf("expected 1, got: %d %v", v, err)
+	}
+	// partial reads are not committed
+	res, err = cl.Get(s.URL + "/partial")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := io.ReadFull(res.Body, b); err != nil || string(b) != "2" {
+		t.Errorf("expected 2, got: %q %v", b, err)
+	}
+	if err := res.Body.Close(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := fs.Stat("http/" + u.Host + "/partial"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got: %v", err)
+	}
+	if _, err := fs.Stat("?tee/http/" + u.Host + "/partial"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got: %v", err)
+	}
+	for i, exp := range []int{3, 3} {
+		if v, err := doReq(ctx, cl, s.URL+"/partial"); err != nil || v != exp {
+			t.Errorf("test %d expected %d, got: %d %v", i, exp, v, err)
+		}
+	}
+}
+
+func TestWithStoreContentTypes(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch path.Ext(req.URL.Path) {
+		case ".txt":
+			res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		case ".json":
+			res.Header().Set("Content-Type", "Application/JSON")
+		case ".csv":
+			res.Header().Set("Content-Type", "text/csv")
+		case ".png":
+			res.Header().Set("Content-Type", "image/png")
+		}
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+		WithStoreContentTypes("text/*", "application/json"),
+		WithSkipContentTypes("text/csv"),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	tests := []struct {
+		path string
+		exp  int
+	}{
+		{"/a.txt", 1},
+		{"/a.txt", 1},
+		{"/b.json", 2},
+		{"/b.json", 2},
+		{"/c.png", 3},
+		{"/c.png", 4},
+		{"/d.csv", 5},
+		{"/d.csv", 6},
+		{"/e", 7},
+		{"/e", 7},
+	}
+	for i, test := range tests {
+		if v, err := doReq(ctx, cl, s.URL+test.path); err != nil || v != test.exp {
+			t.Errorf("test %d expected %d, got: %d %v", i, test.exp, v, err)
+		}
+	}
+	if _, err := New(WithStoreContentTypes()); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, err := New(WithSkipContentTypes("[")); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != 1 {
+		t.Errorf("expected 1, got: %d %v", v, err)
+	}
+	req, err := http.NewRequest("GET", s.URL+"/a", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := c.Refresh(ctx, req); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != 2 {
+		t.Errorf("expected 2, got: %d %v", v, err)
+	}
+	post, err := http.NewRequest("POST", s.URL+"/a", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := c.Refresh(ctx, post); !errors.Is(err, ErrNotMatched) {
+		t.Errorf("expected ErrNotMatched, got: %v", err)
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := c.Refresh(canceled, req); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := c.Refresh(ctx, req); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got: %v", err)
+	}
+}
+
+func TestWithBackgroundRefresh(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	req, err := http.NewRequest("GET", s.URL+"/a", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+		WithBackgroundRefresh(5*time.Millisecond, req),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadUint64(&count) < 3; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected at least 3 refreshes, got: %d", atomic.LoadUint64(&count))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	n := atomic.LoadUint64(&count)
+	time.Sleep(25 * time.Millisecond)
+	if v := atomic.LoadUint64(&count); v != n {
+		t.Errorf("expected %d, got: %d", n, v)
+	}
+	if _, err := New(WithBackgroundRefresh(0, req)); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, err := New(WithBackgroundRefresh(time.Second)); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestFS(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+		WithGzipCompression(),
+		WithRecordRequest(),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	for i, p := range []string{"/a/b.txt", "/a/c.txt"} {
+		if v, err := doReq(ctx, cl, s.URL+p); err != nil || v != i+1 {
+			t.Errorf("test %d expected %d, got: %d %v", i, i+1, v, err)
+		}
+	}
+	fsys := c.FS()
+	buf, err := fs.ReadFile(fsys, "http/"+u.Host+"/a/c.txt")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if s, exp := string(buf), "2\n"; s != exp {
+		t.Errorf("expected %q, got: %q", exp, s)
+	}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if s, exp := strings.Join(names, ","), "http"; s != exp {
+		t.Errorf("expected %q, got: %q", exp, s)
+	}
+	if err := fstest.TestFS(fsys, "http/"+u.Host+"/a/b.txt", "http/"+u.Host+"/a/c.txt"); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if _, err := fs.ReadDir(fsys, "?request"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got: %v", err)
+	}
+	if _, err := fsys.Open("http/" + u.Host + "/a/d.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got: %v", err)
+	}
+	if _, err := fsys.Open("/http"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("expected fs.ErrInvalid, got: %v", err)
+	}
+	// serve with http.FileServer
+	w := httptest.NewRecorder()
+	http.FileServer(http.FS(fsys)).ServeHTTP(w, httptest.NewRequest("GET", "/http/"+u.Host+"/a/b.txt", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d, got: %d", http.StatusOK, w.Code)
+	}
+	if s, exp := w.Body.String(), "1\n"; s != exp {
+		t.Errorf("expected %q, got: %q", exp, s)
+	}
+}
+
+func TestWithURLNormalization(t *testing.T) {
+	tests := []struct {
+		rules []Normalization
+		a, b  string
+		same  bool
+	}{
+		{nil, "HTTP://Example.COM/a", "http://example.com/a", true},
+		{nil, "http://example.com:80/a", "http://example.com/a", true},
+		{nil, "https://example.com:443/a", "https://example.com/a", true},
+		{nil, "http://example.com:8080/a", "http://example.com/a", false},
+		{nil, "http://example.com/a/./b/../c", "http://example.com/a/c", true},
+		{nil, "http://example.com/%7Ea", "http://example.com/~a", true},
+		{nil, "http://example.com/a?q=%7e", "http://example.com/a?q=~", true},
+		{nil, "http://example.com/a?q=a%2fb", "http://example.com/a?q=a%2Fb", true},
+		{nil, "http://example.com/a/", "http://example.com/a", false},
+		{[]Normalization{NormalizeTrailingSlash}, "http://example.com/a/", "http://example.com/a", true},
+		{[]Normalization{NormalizeTrailingSlash}, "HTTP://Example.COM/a", "http://example.com/a", false},
+	}
+	for i, test := range tests {
+		c, err := New(
+			WithFs(afero.NewMemMapFs()),
+			WithURLNormalization(test.rules...),
+		)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		var keys []string
+		for _, urlstr := range []string{test.a, test.b} {
+			req, err := http.NewRequest("GET", urlstr, nil)
+			if err != nil {
+				t.Fatalf("test %d expected no error, got: %v", i, err)
+			}
+			key, _, err := c.Match(req)
+			if err != nil {
+				t.Fatalf("test %d expected no error, got: %v", i, err)
+			}
+			keys = append(keys, key)
+		}
+		if same := keys[0] == keys[1]; same != test.same {
+			t.Errorf("test %d expected same == %t, got: %q %q", i, test.same, keys[0], keys[1])
+		}
+	}
+	// query parameter order is only changed with NormalizeQueryOrder
+	for i, test := range []struct {
+		n   Normalization
+		q   string
+		exp string
+	}{
+		{NormalizeDefault, "b=%7e&a=a%2fb&b=1", "b=~&a=a%2Fb&b=1"},
+		{NormalizeDefault, "b=1&a&c=%zz", "b=1&a&c=%zz"},
+		{NormalizeDefault | NormalizeQueryOrder, "b=%7e&a=a%2fb&b=1", "a=a%2Fb&b=~&b=1"},
+		{NormalizeQueryOrder, "b=2&a=1&b=1", "a=1&b=2&b=1"},
+	} {
+		u := normalizeURL(&url.URL{Scheme: "http", Host: "example.com", Path: "/", RawQuery: test.q}, test.n)
+		if u.RawQuery != test.exp {
+			t.Errorf("test %d expected %q, got: %q", i, test.exp, u.RawQuery)
+		}
+	}
+	// requests are executed using the original url
+	var path atomic.Value
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		path.Store(req.URL.RequestURI())
+		fmt.Fprintln(res, "1")
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithURLNormalization(),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := doReq(context.Background(), &http.Client{Transport: c}, s.URL+"/a/../b?q=%7e"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v, _ := path.Load().(string); v != "/a/../b?q=%7e" {
+		t.Errorf("expected original url, got: %q", v)
+	}
+}
+
+func TestWithAliasResolver(t *testing.T) {
+	var count uint64
+	var paths []string
+	var mu sync.Mutex
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		paths = append(paths, req.URL.Path)
+		mu.Unlock()
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+		WithURLNormalization(),
+		WithAliasResolver(func(req *http.Request) *url.URL {
+			if !strings.HasPrefix(req.URL.Path, "/old/") {
+				return nil
+			}
+			u := *req.URL
+			u.Host, u.Path = strings.ToUpper(u.Host), "/new/"+strings.TrimPrefix(u.Path, "/old/")
+			return &u
+		}),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	tests := []struct {
+		path string
+		exp  int
+	}{
+		{"/new/a", 1},
+		{"/old/a", 1},
+		{"/old/b", 2},
+		{"/new/b", 2},
+		{"/other", 3},
+	}
+	for i, test := range tests {
+		if v, err := doReq(ctx, cl, s.URL+test.path); err != nil || v != test.exp {
+			t.Errorf("test %d expected %d, got: %d %v", i, test.exp, v, err)
+		}
+	}
+	// requests are executed using the original url
+	if exp := []string{"/new/a", "/old/b", "/other"}; !slices.Equal(paths, exp) {
+		t.Errorf("expected %v, got: %v", exp, paths)
+	}
+}
+
+func TestRequestSignature(t *testing.T) {
+	newReq := func(method, urlstr, body string, headers ...string) *http.Request {
+		var r io.Reader
+		if body != "" {
+			r = strings.NewReader(body)
+		}
+		req, err := http.NewRequest(method, urlstr, r)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Add(headers[i], headers[i+1])
+		}
+		return req
+	}
+	sig := func(req *http.Request, headers []string, includeBody bool) string {
+		s, err := RequestSignature(req, headers, includeBody)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		return s
+	}
+	headers := []string{"accept", "X-Token"}
+	a := sig(newReq("GET", "http://example.com/a?b=2&a=1", "", "Accept", "text/html", "X-Token", "t"), headers, true)
+	tests := []struct {
+		req         *http.Request
+		headers     []string
+		includeBody bool
+		same        bool
+	}{
+		{newReq("GET", "HTTP://Example.com:80/a?a=1&b=2#frag", "", "X-Token", " t ", "Accept", "text/html", "User-Agent", "x"), []string{"x-token", "Accept", "ACCEPT"}, true, true},
+		{newReq("GET", "http://example.com/a?a=1&b=2", "", "Accept", "text/html", "X-Token", "u"), headers, true, false},
+		{newReq("GET", "http://example.com/a?a=1&b=3", "", "Accept", "text/html", "X-Token", "t"), headers, true, false},
+		{newReq("GET", "http://example.com/a?a=1&b=2", "", "Accept", "text/html"), headers, true, false},
+		{newReq("HEAD", "http://example.com/a?a=1&b=2", "", "Accept", "text/html", "X-Token", "t"), headers, true, false},
+		{newReq("GET", "http://example.com/a?a=1&b=2", "body", "Accept", "text/html", "X-Token", "t"), headers, true, false},
+	}
+	for i, test := range tests {
+		if s := sig(test.req, test.headers, test.includeBody); (s == a) != test.same {
+			t.Errorf("test %d expected same %t, got: %s %s", i, test.same, s, a)
+		}
+	}
+	// body is only included when includeBody is true
+	if sig(newReq("POST", "http://example.com/", "a"), nil, false) != sig(newReq("POST", "http://example.com/", "b"), nil, false) {
+		t.Errorf("expected same signature")
+	}
+	// body is restored
+	req := newReq("POST", "http://example.com/", "body")
+	if sig(req, nil, true) != sig(req, nil, true) {
+		t.Errorf("expected same signature")
+	}
+	if buf, err := io.ReadAll(req.Body); err != nil || string(buf) != "body" {
+		t.Errorf("expected %q, got: %q %v", "body", buf, err)
+	}
+}
+
+func TestWithSignatureKey(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+		WithSignatureKey(false, "Accept"),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	tests := []struct {
+		accept string
+		exp    int
+	}{
+		{"text/html", 1},
+		{"application/json", 2},
+		{"text/html", 1},
+		{"", 3},
+		{"application/json", 2},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", s.URL+"/a", nil)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		res, err := cl.Do(req)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if v, err := strconv.Atoi(strings.TrimSpace(string(buf))); err != nil || v != test.exp {
+			t.Errorf("test %d expected %d, got: %d %v", i, test.exp, v, err)
+		}
+		key, _, err := c.Match(req)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if !strings.Contains(key, "/a?sig=") {
+			t.Errorf("test %d expected signature key, got: %q", i, key)
+		}
+	}
+}
+
+func TestEncodedBodyTransformers(t *testing.T) {
+	const html = "<html>\n  <body>\n    <p>a</p>\n  </body>\n</html>\n"
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/html")
+		if req.URL.Path == "/identity" {
+			res.Header().Set("Content-Encoding", "identity")
+			_, _ = res.Write([]byte(html))
+			return
+		}
+		res.Header().Set("Content-Encoding", "gzip")
+		w := gzip.NewWriter(res)
+		_, _ = w.Write([]byte(html))
+		_ = w.Close()
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+		WithMinifier(),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	get := func(urlstr string) []byte {
+		req, err := http.NewRequest("GET", urlstr, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, err := cl.Do(req)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer res.Body.Close()
+		buf, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		return buf
+	}
+	for i := 0; i < 2; i++ {
+		r, err := gzip.NewReader(bytes.NewReader(get(s.URL + "/gzip")))
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if s := string(buf); s != html {
+			t.Errorf("test %d expected %q, got: %q", i, html, s)
+		}
+	}
+	if s := string(get(s.URL + "/identity")); s == html || !strings.Contains(s, "<p>a") {
+		t.Errorf("expected minified body, got: %q", s)
+	}
+}
+
+func TestWithKeyDelimiter(t *testing.T) {
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithMatchers(
+			MatchHost("example.com"),
+			MatchHost("custom.com", WithIndexPath("!index")),
+		),
+		WithKeyDelimiter("@index", "@long/", "~"),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	long := strings.Repeat("a", 200)
+	tests := []struct {
+		urlstr string
+		exp    string
+	}{
+		{"http://example.com/", "http/example.com/@index"},
+		{"http://example.com/a?b=1", "http/example.com/a~b%3D1"},
+		{"http://example.com/" + long, fmt.Sprintf("@long/%x", sha256.Sum256([]byte("http/example.com/"+long)))},
+		{"http://custom.com/", "http/custom.com/!index"},
+		{"http://custom.com/a?b=1", "http/custom.com/a~b%3D1"},
+		{"https://other.com/", "https/other.com/@index"},
+		{"https://other.com/?b=1", "https/other.com/~b%3D1"},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", test.urlstr, nil)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		key, _, err := c.Match(req)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if key != test.exp {
+			t.Errorf("test %d expected %q, got: %q", i, test.exp, key)
+		}
+	}
+	if _, err := New(WithFs(afero.NewMemMapFs()), WithKeyDelimiter("", "@long/", "~")); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestWithIndex(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	ctx := context.Background()
+	fs := &scanFs{Fs: afero.NewMemMapFs(), block: make(chan struct{})}
+	c, err := New(
+		WithFs(fs),
+		WithTTL(1*time.Hour),
+		WithIndex(1*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != 1 {
+		t.Errorf("expected 1, got: %d %v", v, err)
+	}
+	<-time.After(2 * time.Millisecond)
+	// block the rescan triggered by the next lookup
+	fs.blocked.Store(true)
+	done := make(chan int, 2)
+	do := func() {
+		v, err := doReq(ctx, cl, s.URL+"/a")
+		if err != nil {
+			t.Errorf("expected no error, got: %v", err)
+		}
+		done <- v
+	}
+	go do()
+	for start := time.Now(); fs.opened.Load() == 0; <-time.After(1 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("expected rescan")
+		}
+	}
+	// lookups during the rescan use the existing index
+	go do()
+	select {
+	case v := <-done:
+		if v != 1 {
+			t.Errorf("expected 1, got: %d", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected lookup to not wait for rescan")
+	}
+	fs.blocked.Store(false)
+	close(fs.block)
+	if v := <-done; v != 1 {
+		t.Errorf("expected 1, got: %d", v)
+	}
+	if n := fs.opened.Load(); n != 1 {
+		t.Errorf("expected 1 rescan, got: %d", n)
+	}
+}
+
+// scanFs is a fs that blocks opening directories while blocked, such as when
+// walking the fs.
+type scanFs struct {
+	afero.Fs
+	block   chan struct{}
+	blocked atomic.Bool
+	opened  atomic.Int64
+}
+
+func (fs *scanFs) Open(name string) (afero.File, error) {
+	if fi, err := fs.Fs.Stat(name); err == nil && fi.IsDir() && fs.blocked.Load() {
+		fs.opened.Add(1)
+		<-fs.block
+	}
+	return fs.Fs.Open(name)
+}
+
+func TestSwapFs(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	ctx := context.Background()
+	fs1, fs2 := afero.NewMemMapFs(), afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs1),
+		WithTTL(1*time.Hour),
+		WithIndex(0),
+		WithMemoryLayer(10),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != 1 {
+		t.Errorf("expected 1, got: %d %v", v, err)
+	}
+	// build staging cache
+	staging, err := New(
+		WithFs(fs2),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v, err := doReq(ctx, &http.Client{Transport: staging}, s.URL+"/a"); err != nil || v != 2 {
+		t.Errorf("expected 2, got: %d %v", v, err)
+	}
+	if err := c.SwapFs(fs2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != 2 {
+		t.Errorf("expected 2, got: %d %v", v, err)
+	}
+	// swap concurrently with requests
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || (v != 1 && v != 2) {
+					t.Errorf("expected 1 or 2, got: %d %v", v, err)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		fs := fs1
+		if i%2 == 1 {
+			fs = fs2
+		}
+		if err := c.SwapFs(fs); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	wg.Wait()
+	if err := c.SwapFs(nil); err == nil {
+		t.Errorf("expected error")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := c.SwapFs(fs1); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got: %v", err)
+	}
+}
+
+func TestSwapFsMethods(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(res, "1")
+	}))
+	defer s.Close()
+	ctx := context.Background()
+	fs1, fs2 := afero.NewMemMapFs(), afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs1),
+		WithTTL(1*time.Hour),
+		WithVersioning(2),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", s.URL+"/a", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	key, _, err := c.Match(req)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v, err := doReq(ctx, &http.Client{Transport: c}, s.URL+"/a"); err != nil || v != 1 {
+		t.Errorf("expected 1, got: %d %v", v, err)
+	}
+	// call methods concurrently with swaps
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				_, _ = c.Mod(key)
+				_, _, _ = c.Stale(ctx, key, 1*time.Hour)
+				_, _ = c.Cached(req)
+				_, _ = c.Versions(key)
+				_, _ = c.VaryValues(key)
+				_, _ = c.Verify(false)
+				_, _ = fs.ReadFile(c.FS(), key)
+				_, _ = c.BasePath()
+				_ = c.Describe()
+				_ = c.TouchKey(key)
+				if j%5 == 0 {
+					_ = c.EvictKey(key)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		z := fs1
+		if i%2 == 1 {
+			z = fs2
+		}
+		if err := c.SwapFs(z); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	wg.Wait()
+	if err := c.Close(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := c.Mod(key); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got: %v", err)
+	}
+	if _, err := fs.ReadFile(c.FS(), key); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got: %v", err)
+	}
+}
+
+func TestWithVersioning(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Nanosecond),
+		WithVersioning(2),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	for i := 1; i <= 3; i++ {
+		if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != i {
+			t.Errorf("test %d expected %d, got: %d %v", i, i, v, err)
+		}
+	}
+	key := "http/" + u.Host + "/a"
+	versions, err := c.Versions(key)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("expected 2 versions, got: %d", len(versions))
+	}
+	load := func(at time.Time) (int, error) {
+		res, err := c.LoadVersion(key, at)
+		if err != nil {
+			return -1, err
+		}
+		defer res.Body.Close()
+		buf, err := io.ReadAll(res.Body)
+		if err != nil {
+			return -1, err
+		}
+		return strconv.Atoi(string(bytes.TrimSpace(buf)))
+	}
+	tests := []struct {
+		at  time.Time
+		exp int
+	}{
+		{time.Now(), 3},
+		{versions[1], 3},
+		{versions[1].Add(-1), 2},
+		{versions[0], 2},
+	}
+	for i, test := range tests {
+		if v, err := load(test.at); err != nil || v != test.exp {
+			t.Errorf("test %d expected %d, got: %d %v", i, test.exp, v, err)
+		}
+	}
+	if _, err := load(versions[0].Add(-1)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got: %v", err)
+	}
+	if err := c.EvictKey(key); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if versions, err := c.Versions(key); err != nil || len(versions) != 0 {
+		t.Errorf("expected no versions, got: %v %v", versions, err)
+	}
+}
+
+func TestWithIndexStrategy(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	ctx := context.Background()
+	// error strategy (the default) returns a collision error
+	c, err := New(
+		WithBasePathFs(setupDir(t, "test-index-strategy-error")),
+		WithTTL(1*time.Hour),
+		WithIndexStrategy(IndexError),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	if v, err := doReq(ctx, cl, s.URL+"/foo"); err != nil || v != 1 {
+		t.Errorf("expected 1, got: %d %v", v, err)
+	}
+	if _, err := doReq(ctx, cl, s.URL+"/foo/bar"); !errors.Is(err, ErrKeyCollision) {
+		t.Errorf("expected ErrKeyCollision, got: %v", err)
+	}
+	// hash strategy stores colliding entries under a fallback name
+	c, err = New(
+		WithBasePathFs(setupDir(t, "test-index-strategy-hash")),
+		WithTTL(1*time.Hour),
+		WithIndexStrategy(IndexHash),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl = &http.Client{
+		Transport: c,
+	}
+	tests := []struct {
+		path string
+		exp  int
+	}{
+		{"/foo", 3},
+		{"/foo/bar", 4},
+		{"/foo", 3},
+		{"/foo/bar", 4},
+		{"/a/b", 5},
+		{"/a", 6},
+		{"/a/b", 5},
+		{"/a", 6},
+	}
+	for i, test := range tests {
+		if v, err := doReq(ctx, cl, s.URL+test.path); err != nil || v != test.exp {
+			t.Errorf("test %d expected %d, got: %d %v", i, test.exp, v, err)
+		}
+	}
+	if _, err := New(WithIndexStrategy(IndexStrategy(10))); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestWithMaxKeyLength(t *testing.T) {
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithMaxKeyLength(100, 30),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	a, b := strings.Repeat("a", 120), strings.Repeat("a", 119)+"b"
+	tests := []struct {
+		urlstr string
+		exp    string
+	}{
+		{"http://example.com/short", "http/example.com/short"},
+		{"http://example.com/" + a, fmt.Sprintf("http/example.com/aaaaaaaaaaaaa~%x", sha256.Sum256([]byte("http/example.com/"+a)))},
+		{"http://example.com/" + b, fmt.Sprintf("http/example.com/aaaaaaaaaaaaa~%x", sha256.Sum256([]byte("http/example.com/"+b)))},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", test.urlstr, nil)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		key, _, err := c.Match(req)
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case key != test.exp:
+			t.Errorf("test %d expected %q, got: %q", i, test.exp, key)
+		case len(key) > 100:
+			t.Errorf("test %d expected key length <= 100, got: %d", i, len(key))
+		}
+	}
+	if _, err := New(WithMaxKeyLength(64, 0)); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, err := New(WithMaxKeyLength(100, -1)); err == nil {
+		t.Errorf("expected error")
+	}
+	// the prefix is shortened to fit the hash
+	for i, test := range []struct {
+		opts []Option
+		n    int
+		err  bool
+	}{
+		{[]Option{WithHasher(md5.New), WithMaxKeyLength(40, 30)}, 40, false},
+		{[]Option{WithMaxKeyLength(70, 30)}, 70, false},
+		{[]Option{WithMaxKeyLength(200, 100), WithHasher(sha512.New)}, 200, false},
+		{[]Option{WithMaxKeyLength(100, 30), WithHasher(sha512.New)}, 0, true},
+		{[]Option{WithMatchers(Match("GET", `^https?://(?P<host>.+)$`, `^/(?P<path>.*)$`, `{{host}}/{{path}}`, WithMaxKeyLength(100, 30))), WithHasher(sha512.New)}, 0, true},
+	} {
+		c, err := New(append([]Option{WithFs(afero.NewMemMapFs())}, test.opts...)...)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("test %d expected error", i)
+			continue
+		case test.err:
+			continue
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		req, err := http.NewRequest("GET", "http://example.com/"+a, nil)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		switch key, _, err := c.Match(req); {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case len(key) > test.n || !strings.HasPrefix(key, "http/"):
+			t.Errorf("test %d expected key with length <= %d, got: %q", i, test.n, key)
+		}
+	}
+	// the budget is checked when changing the hasher
+	if err := c.Apply(WithHasher(sha512.New)); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestWithExpireAt(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	expires := time.Now().Add(50 * time.Millisecond)
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+		WithExpireAt(expires),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	// cached until the expiry time, regardless of the ttl
+	for i := 0; i < 2; i++ {
+		switch v, err := doReq(ctx, cl, s.URL); {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case v != 1:
+			t.Errorf("expected %d, got: %d", 1, v)
+		}
+	}
+	<-time.After(time.Until(expires) + 5*time.Millisecond)
+	// entries stored after the expiry time use the ttl
+	for i := 0; i < 2; i++ {
+		switch v, err := doReq(ctx, cl, s.URL); {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case v != 2:
+			t.Errorf("expected %d, got: %d", 2, v)
+		}
+	}
+}
+
+func TestWithExpireFunc(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	tests := []struct {
+		ttl    time.Duration
+		f      func(time.Time) time.Time
+		expect []int
+	}{
+		// expire func earlier than the ttl
+		{1 * time.Hour, func(mod time.Time) time.Time { return mod.Add(1 * time.Millisecond) }, []int{1, 2, 3}},
+		// ttl earlier than the expire func
+		{1 * time.Millisecond, func(mod time.Time) time.Time { return mod.Add(1 * time.Hour) }, []int{1, 2, 3}},
+		// zero time does not expire
+		{0, func(time.Time) time.Time { return time.Time{} }, []int{1, 1, 1}},
+		// zero time uses the ttl
+		{1 * time.Millisecond, func(time.Time) time.Time { return time.Time{} }, []int{1, 2, 3}},
+	}
+	for i, test := range tests {
+		atomic.StoreUint64(&count, 0)
+		c, err := New(
+			WithFs(afero.NewMemMapFs()),
+			WithTTL(test.ttl),
+			WithExpireFunc(test.f),
+		)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		cl := &http.Client{
+			Transport: c,
+		}
+		for j, exp := range test.expect {
+			<-time.After(2 * time.Millisecond)
+			switch v, err := doReq(context.Background(), cl, s.URL); {
+			case err != nil:
+				t.Fatalf("test %d expected no error, got: %v", i, err)
+			case v != exp:
+				t.Errorf("test %d request %d expected %d, got: %d", i, j, exp, v)
+			}
+		}
+	}
+}
+
+func TestWithStaleFunc(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	errStale := errors.New("stale failed")
+	var stale, fail atomic.Bool
+	var last atomic.Int64
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+		WithStaleFunc(func(_ context.Context, _ string, _ time.Time, ttl time.Duration) (bool, error) {
+			last.Store(int64(ttl))
+			if fail.Load() {
+				return false, errStale
+			}
+			return stale.Load(), nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	tests := []struct {
+		ttl   time.Duration
+		stale bool
+		fail  bool
+		exp   int
+	}{
+		{0, false, false, 1},
+		// fresh by ttl, stale by func
+		{0, true, false, 2},
+		// stale by ttl, fresh by func
+		{1 * time.Nanosecond, false, false, 2},
+		{0, false, false, 2},
+		{0, false, true, 2},
+	}
+	for i, test := range tests {
+		stale.Store(test.stale)
+		fail.Store(test.fail)
+		cctx, ttl := ctx, 1*time.Hour
+		if test.ttl != 0 {
+			cctx, ttl = WithContextTTL(ctx, test.ttl), test.ttl
+		}
+		v, err := doReq(cctx, cl, s.URL+"/a")
+		switch {
+		case test.fail && !errors.Is(err, errStale):
+			t.Errorf("test %d expected error %v, got: %v", i, errStale, err)
+		case test.fail:
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case v != test.exp:
+			t.Errorf("test %d expected %d, got: %d", i, test.exp, v)
+		}
+		if i != 0 && time.Duration(last.Load()) != ttl {
+			t.Errorf("test %d expected ttl %v, got: %v", i, ttl, time.Duration(last.Load()))
+		}
+	}
+	// errors are not refetched
+	if n := atomic.LoadUint64(&count); n != 2 {
+		t.Errorf("expected 2 requests, got: %d", n)
+	}
+}
+
+func TestWithScheduleTTL(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	// busy simulates the current time being within business hours
+	var busy atomic.Bool
+	busy.Store(true)
+	start := time.Now()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Millisecond),
+		WithScheduleTTL(func(now time.Time) time.Duration {
+			if now.Before(start) {
+				t.Errorf("expected schedule to be passed the current time, got: %v", now)
+			}
+			if busy.Load() {
+				return 365 * 24 * time.Hour
+			}
+			return 1 * time.Millisecond
+		}),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	// schedule ttl takes precedence over the static ttl
+	for i := 0; i < 3; i++ {
+		<-time.After(2 * time.Millisecond)
+		v, err := doReq(ctx, cl, s.URL)
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case v != 1:
+			t.Errorf("expected %d, got: %d", 1, v)
+		}
+	}
+	// context ttl takes precedence over the schedule ttl
+	<-time.After(2 * time.Millisecond)
+	switch v, err := doReq(WithContextTTL(ctx, 1*time.Millisecond), cl, s.URL); {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case v != 2:
+		t.Errorf("expected %d, got: %d", 2, v)
+	}
+	// outside business hours, the entry is always refetched
+	busy.Store(false)
+	for i := 3; i < 5; i++ {
+		<-time.After(2 * time.Millisecond)
+		v, err := doReq(ctx, cl, s.URL)
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case v != i:
+			t.Errorf("expected %d, got: %d", i, v)
+		}
+	}
+}
+
+func TestWithExtensionFromContentType(t *testing.T) {
+	var count uint64
+	var typ atomic.Value
+	typ.Store("application/json")
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", typ.Load().(string))
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithExtensionFromContentType(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	tests := []struct {
+		typ   string
+		force bool
+		exp   int
+		ext   string
+	}{
+		{"application/json", false, 1, ".json"},
+		{"application/json", false, 1, ".json"},
+		{"application/json", true, 2, ".json"},
+		{"text/html", true, 3, ".html"},
+		{"text/html", false, 3, ".html"},
+	}
+	for i, test := range tests {
+		typ.Store(test.typ)
+		cctx := ctx
+		if test.force {
+			cctx = WithContextTTL(ctx, 1*time.Nanosecond)
+		}
+		switch v, err := doReq(cctx, cl, s.URL+"/a"); {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case v != test.exp:
+			t.Errorf("test %d expected %d, got: %d", i, test.exp, v)
+		}
+		// only the most recently stored entry remains
+		var names []string
+		err := afero.Walk(fs, "", func(name string, fi os.FileInfo, err error) error {
+			switch {
+			case err != nil:
+				return err
+			case fi.Mode().IsRegular() && !strings.Contains(name, "?"):
+				names = append(names, name)
+			}
+			return nil
+		})
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case len(names) != 1 || !strings.HasSuffix(names[0], test.ext):
+			t.Errorf("test %d expected one entry with extension %s, got: %v", i, test.ext, names)
+		}
+	}
+}
+
+func TestWithExtensionFromContentTypeCollision(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		typ := "application/x-diskcache-unknown"
+		if req.URL.Path == "/data" {
+			typ = "text/html"
+		}
+		res.Header().Set("Content-Type", typ)
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithExtensionFromContentType(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	tests := []struct {
+		path  string
+		force bool
+		exp   int
+	}{
+		{"/data.x", false, 1},
+		{"/data", false, 2},
+		{"/data.html", false, 3},
+		{"/data.x", false, 1},
+		{"/data", false, 2},
+		{"/data.html", false, 3},
+		{"/data", true, 4},
+		{"/data.html", true, 5},
+		{"/data.x", false, 1},
+		{"/data", false, 4},
+		{"/data.html", false, 5},
+	}
+	for i, test := range tests {
+		cctx := ctx
+		if test.force {
+			cctx = WithContextTTL(ctx, 1*time.Nanosecond)
+		}
+		switch v, err := doReq(cctx, cl, s.URL+test.path); {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case v != test.exp:
+			t.Errorf("test %d expected %d, got: %d", i, test.exp, v)
+		}
+	}
+	var names []string
+	err = afero.Walk(fs, "", func(name string, fi os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case fi.Mode().IsRegular() && !strings.Contains(name, "?"):
+			names = append(names, path.Base(name))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if exp := []string{"data.html~", "data.x~", "data~.html"}; !slices.Equal(names, exp) {
+		t.Errorf("expected %v, got: %v", exp, names)
+	}
+}
+
+func TestWithHasher(t *testing.T) {
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithHasher(md5.New),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	req := httptest.NewRequest("GET", "https://example.com/"+strings.Repeat("a", 200), nil)
+	key, _, err := c.Match(req)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if exp := "?long/" + Hasher(md5.New).Sum([]byte("https/example.com/"+strings.Repeat("a", 200))); key != exp {
+		t.Errorf("expected %q, got: %q", exp, key)
+	}
+	// default hasher is sha256
+	if s, exp := Hasher(nil).Sum([]byte("key")), Hasher(sha256.New).Sum([]byte("key")); s != exp {
+		t.Errorf("expected %q, got: %q", exp, s)
+	}
+	// sharding is bounded by the hash length
+	if _, err := New(WithHasher(md5.New), WithSharding(5, 7)); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if _, err := New(WithSharding(5, 7)); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if _, err := New(WithHasher(nil)); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestWithSharding(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithSharding(2, 3),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != 1 {
+			t.Errorf("test %d expected 1, got: %d %v", i, v, err)
+		}
+	}
+	key := "http/" + u.Host + "/a"
+	h := Hasher(nil).Sum([]byte(key))
+	if _, err := fs.Stat(path.Join(h[0:3], h[3:6], key)); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if _, err := fs.Stat(key); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got: %v", err)
+	}
+	for i, opt := range []Option{
+		WithSharding(-1, 2),
+		WithSharding(2, 0),
+	} {
+		if _, err := New(opt); err == nil {
+			t.Errorf("test %d expected error, got nil", i)
+		}
+	}
+}
+
+func TestWithErrorPlaceholder(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddUint64(&count, 1)
+		res.Header().Set("Content-Type", "text/plain")
+		if req.URL.Path == "/error" {
+			res.WriteHeader(http.StatusNotFound)
+			res.Write([]byte("not found"))
+			return
+		}
+		res.Write([]byte("ok"))
+	}))
+	defer s.Close()
+	const placeholder = `{"cached_error":true}`
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithErrorPlaceholder([]byte(placeholder), "application/json"),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	tests := []struct {
+		path        string
+		code        int
+		contentType string
+		body        string
+	}{
+		{"/error", http.StatusNotFound, "application/json", placeholder},
+		{"/error", http.StatusNotFound, "application/json", placeholder},
+		{"/ok", http.StatusOK, "text/plain", "ok"},
+	}
+	for i, test := range tests {
+		res, err := cl.Get(s.URL + test.path)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case res.StatusCode != test.code:
+			t.Errorf("test %d expected status %d, got: %d", i, test.code, res.StatusCode)
+		case res.Header.Get("Content-Type") != test.contentType:
+			t.Errorf("test %d expected content type %q, got: %q", i, test.contentType, res.Header.Get("Content-Type"))
+		case string(body) != test.body:
+			t.Errorf("test %d expected body %q, got: %q", i, test.body, string(body))
+		}
+	}
+	if count != 2 {
+		t.Errorf("expected count %d, got: %d", 2, count)
+	}
+}
+
+func TestWithFlatKeepHeaders(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddUint64(&count, 1)
+		res.Header().Set("Content-Type", "text/html; charset=utf-8")
+		res.Header().Set("X-Foo", "bar")
+		res.Write([]byte("<p>hello</p>"))
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithFlatGzipCompression(),
+		WithFlatKeepHeaders("content-type", "Content-Length"),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	for i := 0; i < 2; i++ {
+		res, err := cl.Get(s.URL)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case string(buf) != "<p>hello</p>":
+			t.Errorf("expected body %q, got: %q", "<p>hello</p>", string(buf))
+		case i == 0:
+			// the first response is returned as fetched
+		case res.Header.Get("Content-Type") != "text/html; charset=utf-8":
+			t.Errorf("expected content type %q, got: %q", "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+		case res.ContentLength != 12:
+			t.Errorf("expected content length %d, got: %d", 12, res.ContentLength)
+		case res.Header.Get("X-Foo") != "":
+			t.Errorf("expected no X-Foo header, got: %q", res.Header.Get("X-Foo"))
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected count %d, got: %d", 1, count)
+	}
+	if _, err := New(WithFlatKeepHeaders("Content-Type")); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestImportFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.json": `{"a":1}`,
+		"b":      "<!DOCTYPE html><html><body>b</body></html>",
+	}
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	var count uint64
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+		WithTransport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			atomic.AddUint64(&count, 1)
+			return nil, errors.New("unexpected fetch")
+		})),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	reqA := httptest.NewRequest("GET", "https://example.com/a", nil)
+	reqB := httptest.NewRequest("GET", "https://example.com/b", nil)
+	if err := c.ImportFiles(map[string]*http.Request{
+		filepath.Join(dir, "a.json"): reqA,
+		filepath.Join(dir, "b"):      reqB,
+	}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	tests := []struct {
+		url         string
+		contentType string
+		body        string
+	}{
+		{"https://example.com/a", "application/json", files["a.json"]},
+		{"https://example.com/b", "text/html; charset=utf-8", files["b"]},
+	}
+	for i, test := range tests {
+		res, err := cl.Get(test.url)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case res.Header.Get("Content-Type") != test.contentType:
+			t.Errorf("test %d expected content type %q, got: %q", i, test.contentType, res.Header.Get("Content-Type"))
+		case string(buf) != test.body:
+			t.Errorf("test %d expected body %q, got: %q", i, test.body, string(buf))
+		}
+	}
+	if count != 0 {
+		t.Errorf("expected count %d, got: %d", 0, count)
+	}
+	if err := c.ImportFiles(map[string]*http.Request{filepath.Join(dir, "missing"): reqA}); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected error %v, got: %v", fs.ErrNotExist, err)
+	}
+}
+
+func TestImportFilesSwapFs(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "a.json")
+	if err := os.WriteFile(name, []byte(`{"a":1}`), 0o644); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	m := blockMatcher{
+		Matcher: Match("GET", `^https://example\.com$`, `^/(?P<path>.*)$`, `{{path}}`),
+		once:    new(sync.Once),
+		entered: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithTTL(1*time.Hour),
+		WithMatchers(m),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	imported := make(chan error, 1)
+	go func() {
+		imported <- c.ImportFiles(map[string]*http.Request{
+			name: httptest.NewRequest("GET", "https://example.com/a", nil),
+		})
+	}()
+	// swap while the import is in-flight
+	<-m.entered
+	swapped := make(chan error, 1)
+	go func() {
+		swapped <- c.SwapFs(afero.NewMemMapFs())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(m.release)
+	for _, ch := range []chan error{imported, swapped} {
+		select {
+		case err := <-ch:
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected import and swap to complete")
+		}
+	}
+}
+
+// blockMatcher wraps a matcher, blocking the first match until released.
+type blockMatcher struct {
+	Matcher
+	once    *sync.Once
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (m blockMatcher) Match(req *http.Request) (string, Policy, error) {
+	m.once.Do(func() {
+		close(m.entered)
+		<-m.release
+	})
+	return m.Matcher.Match(req)
+}
+
+func TestWithFetchMiddleware(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	var mu sync.Mutex
+	var calls []string
+	middleware := func(name string) func(http.RoundTripper) http.RoundTripper {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				mu.Lock()
+				calls = append(calls, name)
+				mu.Unlock()
+				return next.RoundTrip(req)
+			})
+		}
+	}
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithFetchMiddleware(middleware("a"), middleware("b")),
+		WithFetchMiddleware(middleware("c")),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		v, err := doReq(ctx, cl, s.URL)
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case v != 1:
+			t.Errorf("expected %d, got: %d", 1, v)
+		}
+	}
+	if exp := []string{"a", "b", "c"}; !slices.Equal(calls, exp) {
+		t.Errorf("expected %q, got: %q", exp, calls)
+	}
+}
+
+func TestWithPreflight(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddUint64(&count, 1)
+		// the max age of responses to other requests is ignored
+		res.Header().Set("Access-Control-Max-Age", req.URL.Query().Get("max"))
+		if req.Method == "OPTIONS" {
+			res.Header().Set("Access-Control-Allow-Origin", req.Header.Get("Origin"))
+			res.WriteHeader(http.StatusNoContent)
+			return
+		}
+		res.Write([]byte("get"))
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithQueryPrefix("_"),
+		WithPreflight(),
+		WithTTL(1*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	tests := []struct {
+		method  string
+		query   string
+		headers map[string]string
+		exp     uint64
+	}{
+		{"OPTIONS", "?max=3600", map[string]string{"Origin": "https://a.example", "Access-Control-Request-Method": "PUT", "Access-Control-Request-Headers": "X-A, Content-Type"}, 1},
+		{"OPTIONS", "?max=3600", map[string]string{"Origin": "https://a.example", "Access-Control-Request-Method": "put", "Access-Control-Request-Headers": "content-type,x-a"}, 1},
+		{"OPTIONS", "?max=3600", map[string]string{"Origin": "https://a.example", "Access-Control-Request-Method": "DELETE"}, 2},
+		{"OPTIONS", "?max=3600", map[string]string{"Origin": "https://b.example", "Access-Control-Request-Method": "DELETE"}, 3},
+		{"OPTIONS", "?max=3600", map[string]string{"Origin": "https://a.example", "Access-Control-Request-Method": "DELETE"}, 3},
+		{"GET", "?max=3600", nil, 4},
+		{"GET", "?max=3600", nil, 5},
+		{"OPTIONS", "?max=0", map[string]string{"Origin": "https://a.example", "Access-Control-Request-Method": "PUT"}, 6},
+		{"OPTIONS", "?max=0", map[string]string{"Origin": "https://a.example", "Access-Control-Request-Method": "PUT"}, 7},
+	}
+	for i, test := range tests {
+		// expire entries using the policy ttl
+		<-time.After(2 * time.Millisecond)
+		req, err := http.NewRequest(test.method, s.URL+test.query, nil)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+		res, err := cl.Do(req)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		_, _ = io.ReadAll(res.Body)
+		res.Body.Close()
+		if n := atomic.LoadUint64(&count); n != test.exp {
+			t.Errorf("test %d expected count %d, got: %d", i, test.exp, n)
+		}
+	}
+}
+
+func TestWithMirrorLayout(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/missing":
+			http.NotFound(res, req)
+		case strings.HasPrefix(req.URL.Path, "/data"), strings.HasSuffix(req.URL.Path, ".json"):
+			res.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(res, `{"path":%q}`, req.URL.Path)
+		default:
+			res.Header().Set("Content-Type", "text/html")
+			fmt.Fprintf(res, "<p>%s</p>", req.URL.RequestURI())
+		}
+	}))
+	defer s.Close()
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithGzipCompression(),
+		WithMirrorLayout(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	for _, p := range []string{"/", "/a/b.json", "/data", "/dir/", "/page?x=1", "/missing"} {
+		res, err := cl.Get(s.URL + p)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		_, _ = io.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	tests := []struct {
+		name string
+		exp  string
+	}{
+		{"index.html", "<p>/</p>"},
+		{"a/b.json", `{"path":"/a/b.json"}`},
+		{"data.json", `{"path":"/data"}`},
+		{"dir/index.html", "<p>/dir/</p>"},
+		{"page?x=1.html", "<p>/page?x=1</p>"},
+	}
+	for _, test := range tests {
+		buf, err := afero.ReadFile(fs, path.Join(mirrorDir, u.Host, test.name))
+		switch {
+		case err != nil:
+			t.Errorf("%s expected no error, got: %v", test.name, err)
+		case string(buf) != test.exp:
+			t.Errorf("%s expected %q, got: %q", test.name, test.exp, string(buf))
+		}
+	}
+	if _, err := fs.Stat(path.Join(mirrorDir, u.Host, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected error %v, got: %v", os.ErrNotExist, err)
+	}
+	// mirror is not walked
+	report, err := c.Verify(false)
+	switch {
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	case report.Count != 6 || len(report.Bad) != 0:
+		t.Errorf("expected count 6 and no bad entries, got: %+v", report)
+	}
+}
+
+func TestMirrorNameTraversal(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(res, "<p>outside</p>")
+	}))
+	defer s.Close()
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithMirrorLayout(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	res, err := (&http.Client{Transport: c}).Get(s.URL + "/p?x=/../../../../outside")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	_, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	base := path.Join(mirrorDir, u.Host)
+	err = afero.Walk(fs, "", func(name string, fi os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case fi.Mode().IsRegular() && !strings.HasPrefix(name, "http/") && !strings.HasPrefix(name, base+"/"):
+			t.Errorf("expected mirror copy in %s, got: %s", base, name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	tests := []struct {
+		urlstr string
+		exp    string
+		ok     bool
+	}{
+		{"http://example.com/p?x=/../../../../outside", "?mirror/example.com/p?x=%2F..%2F..%2F..%2F..%2Foutside", true},
+		{"http://example.com/../../a.html", "?mirror/example.com/a.html", true},
+		{"http://../a.html", "", false},
+		{"http://./a.html", "", false},
+		{"/a.html", "", false},
+	}
+	for i, test := range tests {
+		u, err := url.Parse(test.urlstr)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		switch name, ok := c.mirrorName(u, "text/html"); {
+		case ok != test.ok:
+			t.Errorf("test %d expected ok %t, got: %t (%s)", i, test.ok, ok, name)
+		case name != test.exp:
+			t.Errorf("test %d expected %q, got: %q", i, test.exp, name)
+		}
+	}
+}
+
+func TestWithResumableDownloads(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	var count uint64
+	var ranges []string
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddUint64(&count, 1)
+		ranges = append(ranges, req.Header.Get("Range"))
+		res.Header().Set("ETag", `"v1"`)
+		http.ServeContent(res, req, "data.bin", time.Time{}, bytes.NewReader(body))
+	}))
+	defer s.Close()
+	// interrupt the first download after 1000 bytes
+	var interrupt atomic.Bool
+	interrupt.Store(true)
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		res, err := http.DefaultTransport.RoundTrip(req)
+		if err == nil && interrupt.Swap(false) {
+			res.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(io.LimitReader(res.Body, 1000), iotest.ErrReader(io.ErrUnexpectedEOF)), res.Body}
+		}
+		return res, err
+	})
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithTransport(transport),
+		WithResumableDownloads(),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	if res, err := cl.Get(s.URL + "/data.bin"); err == nil {
+		_, err = io.ReadAll(res.Body)
+		res.Body.Close()
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		res, err := cl.Get(s.URL + "/data.bin")
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		buf, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case !bytes.Equal(buf, body):
+			t.Errorf("test %d expected body of length %d, got: %d", i, len(body), len(buf))
+		}
+	}
+	if n := atomic.LoadUint64(&count); n != 2 {
+		t.Errorf("expected 2 fetches, got: %d", n)
+	}
+	if exp := []string{"", "bytes=1000-"}; !slices.Equal(ranges, exp) {
+		t.Errorf("expected ranges %q, got: %q", exp, ranges)
+	}
+	// ensure the partial download was removed
+	err = afero.Walk(fs, "", func(name string, fi os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case fi.Mode().IsRegular() && (strings.Contains(name, resumeDir) || strings.Contains(name, teeDir)):
+			t.Errorf("expected no partial downloads, got: %s", name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+}
+
+func TestWithMinContentLength(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		n := atomic.AddUint64(&count, 1)
+		switch {
+		case req.URL.Path == "/other":
+			res.Header().Set("Content-Type", "application/octet-stream")
+		case req.URL.Path == "/flaky" && n%3 == 0:
+			// chunked, without a content length
+			res.(http.Flusher).Flush()
+			fmt.Fprintf(res, "%d\n%s", n, strings.Repeat(" ", 100))
+			return
+		}
+		fmt.Fprintf(res, "%d\n", n)
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithMinContentLength(100, "text/plain"),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	// refetched until the body is long enough
+	for i := 0; i < 2; i++ {
+		if v, err := doReq(ctx, cl, s.URL+"/flaky"); err != nil || v != 3 {
+			t.Errorf("test %d expected 3, got: %d %v", i, v, err)
+		}
+	}
+	// short responses of other content types are not refetched
+	if v, err := doReq(ctx, cl, s.URL+"/other"); err != nil || v != 4 {
+		t.Errorf("expected 4, got: %d %v", v, err)
+	}
+	// always short
+	atomic.StoreUint64(&count, 0)
+	if _, err := doReq(ctx, cl, s.URL+"/short"); !errors.Is(err, ErrContentTooShort) {
+		t.Errorf("expected ErrContentTooShort, got: %v", err)
+	}
+	if n := atomic.LoadUint64(&count); n != 4 {
+		t.Errorf("expected 4 fetches, got: %d", n)
+	}
+	cached, err := c.Cached(httptest.NewRequest("GET", s.URL+"/short", nil))
+	if err != nil || cached {
+		t.Errorf("expected not cached, got: %t %v", cached, err)
+	}
+}
+
+func TestWithModeFunc(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, ".json") {
+			res.Header().Set("Content-Type", "application/json")
+		}
+		fmt.Fprintln(res, "1")
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	ctx := context.Background()
+	for i, opts := range [][]Option{
+		nil,
+		{WithTeeStreaming()},
+	} {
+		fs := afero.NewMemMapFs()
+		c, err := New(append(
+			opts,
+			WithFs(fs),
+			WithMode(0o755, 0o644),
+			WithModeFunc(func(res *http.Response) os.FileMode {
+				if res.Header.Get("Content-Type") == "application/json" {
+					return 0o600
+				}
+				return 0
+			}),
+			WithStoredTimestamp(),
+			WithTTL(1*time.Hour),
+		)...)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		cl := &http.Client{
+			Transport: c,
+		}
+		tests := []struct {
+			path string
+			exp  os.FileMode
+		}{
+			{"/a.json", 0o600},
+			{"/a.html", 0o644},
+		}
+		for j, test := range tests {
+			if _, err := doReq(ctx, cl, s.URL+test.path); err != nil {
+				t.Fatalf("test %d %d expected no error, got: %v", i, j, err)
+			}
+			// the entry and its sidecar files use the mode
+			for _, name := range []string{"http/" + u.Host + test.path, "?timestamp/http/" + u.Host + test.path} {
+				fi, err := fs.Stat(name)
+				switch {
+				case err != nil:
+					t.Fatalf("test %d %d expected no error, got: %v", i, j, err)
+				case fi.Mode().Perm() != test.exp:
+					t.Errorf("test %d %d expected %s mode %v, got: %v", i, j, name, test.exp, fi.Mode().Perm())
+				}
+			}
+		}
+	}
+}
+
+func TestSimpleValidator(t *testing.T) {
+	var counts []int
+	fail := errors.New("fail")
+	v := NewSimpleValidator(func(_ *http.Request, res *http.Response, _ time.Time, _ bool, count int) (Validity, error) {
+		counts = append(counts, count)
+		switch res.StatusCode {
+		case http.StatusInternalServerError:
+			return Error, fail
+		case http.StatusTooManyRequests:
+			return Retry, RetryDelay(1 * time.Second)
+		}
+		return Valid, nil
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	tests := []struct {
+		status   int
+		validity Validity
+		err      error
+	}{
+		{http.StatusOK, Valid, nil},
+		{http.StatusInternalServerError, Error, fail},
+		{http.StatusTooManyRequests, Retry, RetryDelay(1 * time.Second)},
+		{http.StatusOK, Valid, nil},
+	}
+	for i, test := range tests {
+		validity, err := v.Validate(req, &http.Response{StatusCode: test.status}, time.Now(), false)
+		switch {
+		case !errors.Is(err, test.err):
+			t.Errorf("test %d expected error %v, got: %v", i, test.err, err)
+		case validity != test.validity:
+			t.Errorf("test %d expected validity %d, got: %d", i, test.validity, validity)
+		}
+	}
+	// errors do not increment the count
+	if exp := []int{0, 1, 1, 2}; !slices.Equal(counts, exp) {
+		t.Errorf("expected counts %v, got: %v", exp, counts)
+	}
+	v.Reset()
+	if _, err := v.Validate(req, &http.Response{StatusCode: http.StatusOK}, time.Now(), false); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if exp := []int{0, 1, 1, 2, 0}; !slices.Equal(counts, exp) {
+		t.Errorf("expected counts %v, got: %v", exp, counts)
+	}
+}
+
+func TestNewRequestValidator(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	var mu sync.Mutex
+	var counts []int
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithValidator(NewRequestValidator(func(_ *http.Request, _ *http.Response, _ time.Time, _ bool, count int) (Validity, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			counts = append(counts, count)
+			if count < 2 {
+				return Retry, nil
+			}
+			return Valid, nil
+		})),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	// the count is the attempt for each request, with the first attempt of
+	// the second request loaded from the cache
+	for i, exp := range []int{3, 5} {
+		if v, err := doReq(ctx, cl, s.URL); err != nil || v != exp {
+			t.Errorf("test %d expected %d, got: %d %v", i, exp, v, err)
+		}
+	}
+	if exp := []int{0, 1, 2, 0, 1, 2}; !slices.Equal(counts, exp) {
+		t.Errorf("expected counts %v, got: %v", exp, counts)
+	}
+}
+
+func TestWithRetryAfter(t *testing.T) {
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		counts[req.URL.Path]++
+		n := counts[req.URL.Path]
+		mu.Unlock()
+		switch {
+		case req.URL.Path == "/seconds" && n == 1:
+			res.Header().Set("Retry-After", "1")
+			res.WriteHeader(http.StatusTooManyRequests)
+		case req.URL.Path == "/date" && n == 1:
+			res.Header().Set("Retry-After", time.Now().Add(1*time.Second).UTC().Format(http.TimeFormat))
+			res.WriteHeader(http.StatusServiceUnavailable)
+		case req.URL.Path == "/unavailable":
+			res.WriteHeader(http.StatusServiceUnavailable)
+		case req.URL.Path == "/limited":
+			res.Header().Set("Retry-After", "0")
+			res.WriteHeader(http.StatusTooManyRequests)
+		case req.URL.Path == "/cancel":
+			res.Header().Set("Retry-After", "60")
+			res.WriteHeader(http.StatusTooManyRequests)
+		}
+		fmt.Fprintf(res, "%d\n", n)
+	}))
+	defer s.Close()
+	c, err := New(
+		WithFs(afero.NewMemMapFs()),
+		WithRetryAfter(2),
+		WithTTL(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	tests := []struct {
+		path  string
+		exp   int
+		delay time.Duration
+	}{
+		{"/seconds", 2, 1 * time.Second},
+		{"/date", 2, 0},
+		{"/unavailable", 1, 0},
+		{"/limited", 3, 0},
+	}
+	for i, test := range tests {
+		start := time.Now()
+		v, err := doReq(ctx, cl, s.URL+test.path)
+		switch {
+		case err != nil:
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		case v != test.exp:
+			t.Errorf("test %d expected %d, got: %d", i, test.exp, v)
+		case time.Since(start) < test.delay:
+			t.Errorf("test %d expected delay of at least %v, got: %v", i, test.delay, time.Since(start))
+		}
+	}
+	// the exhausted 429 response is cached, and is not retried
+	if v, err := doReq(ctx, cl, s.URL+"/limited"); err != nil || v != 3 {
+		t.Errorf("expected 3, got: %d %v", v, err)
+	}
+	mu.Lock()
+	n := counts["/limited"]
+	mu.Unlock()
+	if n != 3 {
+		t.Errorf("expected 3 fetches, got: %d", n)
+	}
+	// waiting stops when the context is done
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := doReq(ctx, cl, s.URL+"/cancel"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got: %v", err)
+	}
+	parseTests := []struct {
+		value string
+		exp   time.Duration
+		ok    bool
+	}{
+		{"120", 120 * time.Second, true},
+		{" 0 ", 0, true},
+		{"-1", 0, false},
+		{"Wed, 21 Oct 2015 07:28:30 GMT", 30 * time.Second, true},
+		{"Wed, 21 Oct 2015 07:27:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	now := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	for i, test := range parseTests {
+		switch d, ok := parseRetryAfter(test.value, now); {
+		case ok != test.ok:
+			t.Errorf("test %d expected ok %t, got: %t", i, test.ok, ok)
+		case d != test.exp:
+			t.Errorf("test %d expected %v, got: %v", i, test.exp, d)
+		}
+	}
+}
+
+func TestEvictIdle(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	fs := afero.NewMemMapFs()
+	c, err := New(
+		WithFs(fs),
+		WithTTL(24*time.Hour),
+		WithMaxIdleAge(1*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cl := &http.Client{
+		Transport: c,
+	}
+	ctx := context.Background()
+	reqs := make(map[string]*http.Request)
+	old := time.Now().Add(-2 * time.Hour)
+	for _, urlpath := range []string{"/a", "/b", "/c"} {
+		if _, err := doReq(ctx, cl, s.URL+urlpath); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		req, err := http.NewRequest("GET", s.URL+urlpath, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		reqs[urlpath] = req
+		if urlpath == "/c" {
+			continue
+		}
+		// age the entry
+		key, _, err := c.Match(req)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := fs.Chtimes(c.storeName(key), old, old); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	// read /a, updating its last read time
+	if v, err := doReq(ctx, cl, s.URL+"/a"); err != nil || v != 1 {
+		t.Errorf("expected 1, got: %d %v", v, err)
+	}
+	if err := c.EvictIdle(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for urlpath, exp := range map[string]bool{"/a": true, "/b": false, "/c": true} {
+		switch ok, err := c.Cached(reqs[urlpath]); {
+		case err != nil:
+			t.Fatalf("expected no error, got: %v", err)
+		case ok != exp:
+			t.Errorf("%s expected cached == %t, got: %t", urlpath, exp, ok)
+		}
+	}
+	// max idle age is required
+	c, err = New(WithFs(fs))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := c.EvictIdle(); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestWithFailOpen(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "%d\n", atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	fs := afero.NewReadOnlyFs(afero.NewMemMapFs())
+	ctx := context.Background()
+	c, err := New(WithFs(fs), WithTTL(1*time.Hour))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := doReq(ctx, &http.Client{Transport: c}, s.URL); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"stream", nil},
+		{"gzip", []Option{WithGzipCompression()}},
+		{"tee", []Option{WithTeeStreaming()}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(append([]Option{WithFs(fs), WithTTL(1 * time.Hour), WithFailOpen()}, test.opts...)...)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			cl := &http.Client{
+				Transport: c,
+			}
+			for i := 0; i < 2; i++ {
+				exp := int(atomic.LoadUint64(&count)) + 1
+				if v, err := doReq(ctx, cl, s.URL); err != nil || v != exp {
+					t.Errorf("test %d expected %d, got: %d %v", i, exp, v, err)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentRoundTrip(t *testing.T) {
+	var count uint64
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/html")
+		res.Header().Set("ETag", `"`+req.URL.Path+`"`)
+		fmt.Fprintf(res, "<p>%s %d</p>", req.URL.Path, atomic.AddUint64(&count, 1))
+	}))
+	defer s.Close()
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"default", nil},
+		{"gzip", []Option{WithGzipCompression(), WithMinifier()}},
+		{"memory", []Option{WithMemoryLayer(4), WithAgeHeader()}},
+		{"index", []Option{WithIndex(0), WithMaxIdleAge(1 * time.Hour), WithCacheEpoch("a")}},
+		{"hashed", []Option{WithHashedKeys(sha256.New), WithStoreRequest(), WithConfigVersion("a")}},
+		{"lazy", []Option{WithGzipCompression(), WithLazyBody(), WithSkipUnchangedWrites()}},
+		{"tee", []Option{WithTeeStreaming(), WithVersioning(2)}},
+		{"validator", []Option{WithRetryStatusCode(1, http.StatusOK), WithCompressionStats(), WithExtensionFromContentType()}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(append([]Option{
+				WithFs(afero.NewMemMapFs()),
+				WithTTL(1 * time.Millisecond),
+			}, test.opts...)...)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			defer c.Close()
+			cl := &http.Client{
+				Transport: c,
+			}
+			var wg sync.WaitGroup
+			for i := 0; i < 16; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 25; j++ {
+						p := "/" + strconv.Itoa((i+j)%4)
+						res, err := cl.Get(s.URL + p)
+						if err != nil {
+							t.Errorf("expected no error, got: %v", err)
+							return
+						}
+						buf, err := io.ReadAll(res.Body)
+						res.Body.Close()
+						switch {
+						case err != nil:
+							t.Errorf("expected no error, got: %v", err)
+							return
+						case !strings.HasPrefix(string(buf), "<p>"+p+" "):
+							t.Errorf("expected body for %s, got: %q", p, string(buf))
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func doReq(ctx context.Context, cl *http.Client, urlstr string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", urlstr, nil)
+	if err != nil {
+		return -1, err
+	}
+	res, err := cl.Do(req)
+	if err != nil {
+		return -1, err
+	}
+	defer res.Body.Close()
+	buf, err := io.ReadAll(res.Body)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(string(bytes.TrimSpace(buf)))
+}
+
+func setupDir(t testing.TB, name string) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	dir := filepath.Join(wd, ".cache", name)
+	switch err := os.RemoveAll(dir); {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	return dir
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
 }
@@ -0,0 +1,34 @@
+package diskcache
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// epochDir is the directory for epoch sidecar files.
+const epochDir = "?epoch"
+
+// epochName returns the fs name of the epoch sidecar file for the fs name.
+func (c *Cache) epochName(name string) string {
+	root := c.root()
+	return path.Join(root, epochDir, strings.TrimPrefix(name, root))
+}
+
+// writeEpoch writes the epoch sidecar file for the fs name.
+func (c *Cache) writeEpoch(name string, mode os.FileMode) error {
+	sidecar := c.epochName(name)
+	if err := c.fs.MkdirAll(path.Dir(sidecar), c.dirMode); err != nil {
+		return err
+	}
+	return afero.WriteFile(c.fs, sidecar, []byte(c.epoch), mode)
+}
+
+// sameEpoch returns whether or not the fs name was stored with the cache
+// epoch. Entries without an epoch sidecar file are never in the cache epoch.
+func (c *Cache) sameEpoch(name string) bool {
+	buf, err := afero.ReadFile(c.fs, c.epochName(name))
+	return err == nil && string(buf) == c.epoch
+}
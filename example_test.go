@@ -2,7 +2,9 @@ package diskcache_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -10,6 +12,7 @@ import (
 	"time"
 
 	"github.com/kenshaw/diskcache"
+	"github.com/spf13/afero"
 )
 
 // Example demonstrates setting up a simple diskcache for use with a
@@ -70,3 +73,34 @@ func Example() {
 	//
 	// <!doctype html><html lang=en><body attribute=value><p>hello ken!<div>something</div><a href=//example.com/full/path>a link!</a>
 }
+
+// ExampleNewReplayer demonstrates replaying stored responses in tests.
+func ExampleNewReplayer() {
+	// store response in an in-memory fs
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "https/example.com/hello", []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nhello world\n"), 0o644); err != nil {
+		log.Fatal(err)
+	}
+	// create replayer
+	d, err := diskcache.NewReplayer(fs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cl := &http.Client{Transport: d}
+	for _, urlstr := range []string{"https://example.com/hello", "https://example.com/missing"} {
+		res, err := cl.Get(urlstr)
+		if err != nil {
+			fmt.Println("error:", errors.Is(err, diskcache.ErrNotCached))
+			continue
+		}
+		defer res.Body.Close()
+		buf, err := io.ReadAll(res.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(res.Status, ": ", string(buf))
+	}
+	// Output:
+	// 200 OK: hello world
+	// error: true
+}
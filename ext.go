@@ -0,0 +1,72 @@
+package diskcache
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// extDir is the directory for content type extension sidecar files.
+const extDir = "?ext"
+
+// extMarker is the marker appended to the fs name of a key, followed by the
+// extension derived from the content type, for entries stored with
+// WithExtensionFromContentType. As the marker is always appended, keys that
+// differ only by an extension (such as data and data.html) are never stored
+// with the same fs name.
+const extMarker = "~"
+
+// extName returns the fs name of the extension sidecar file for the fs name of
+// a key.
+func (c *Cache) extName(name string) string {
+	root := c.root()
+	return path.Join(root, extDir, strings.TrimPrefix(name, root))
+}
+
+// extEntry returns the fs name of the stored entry for the fs name of a key
+// and the extension.
+func extEntry(name, ext string) string {
+	return name + extMarker + ext
+}
+
+// extBase returns the fs name of the key for the fs name of a stored entry,
+// removing the marker and the extension.
+func extBase(name string) string {
+	if i := strings.LastIndex(name, extMarker); i != -1 {
+		if ext := name[i+len(extMarker):]; ext == "" || isExt(ext) {
+			return name[:i]
+		}
+	}
+	return name
+}
+
+// writeExt writes the extension sidecar file for the fs name of a key,
+// recording the extension of the stored entry.
+func (c *Cache) writeExt(name, ext string, mode os.FileMode) error {
+	sidecar := c.extName(name)
+	if err := c.fs.MkdirAll(path.Dir(sidecar), c.dirMode); err != nil {
+		return err
+	}
+	return afero.WriteFile(c.fs, sidecar, []byte(ext), mode)
+}
+
+// extLookup returns the fs name of the stored entry for the fs name of a key,
+// using the extension recorded in the extension sidecar file. Returns the fs
+// name of the entry without an extension when there is no recorded
+// extension.
+func (c *Cache) extLookup(name string) (string, error) {
+	buf, err := afero.ReadFile(c.fs, c.extName(name))
+	switch {
+	case err != nil && errors.Is(err, fs.ErrNotExist):
+		return extEntry(name, ""), nil
+	case err != nil:
+		return "", err
+	case !isExt(string(buf)):
+		return extEntry(name, ""), nil
+	}
+	return extEntry(name, string(buf)), nil
+}
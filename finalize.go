@@ -0,0 +1,46 @@
+package diskcache
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// finalDir is the directory for final key sidecar files.
+const finalDir = "?final"
+
+// finalName returns the fs name of the final key sidecar file for the fs
+// name.
+func (c *Cache) finalName(name string) string {
+	root := c.root()
+	return path.Join(root, finalDir, strings.TrimPrefix(name, root))
+}
+
+// writeFinal writes the final key sidecar file for the key.
+func (c *Cache) writeFinal(key, final string) error {
+	sidecar := c.finalName(c.name(key))
+	if err := c.fs.MkdirAll(path.Dir(sidecar), c.dirMode); err != nil {
+		return err
+	}
+	return afero.WriteFile(c.fs, sidecar, []byte(final), c.fileMode)
+}
+
+// finalKey returns the final key recorded for the key, or the key when there
+// is no recorded final key.
+func (c *Cache) finalKey(key string) string {
+	if buf, err := afero.ReadFile(c.fs, c.finalName(c.name(key))); err == nil && len(buf) != 0 {
+		return string(buf)
+	}
+	return key
+}
+
+// removeFinal removes the final key sidecar file for the key.
+func (c *Cache) removeFinal(key string) error {
+	if err := c.fs.Remove(c.finalName(c.name(key))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package diskcache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// formatMagic is the prefix of the format tag line of entries stored with a
+// registered format.
+const formatMagic = "DISKCACHE-FORMAT "
+
+// formats are the registered entry formats.
+var formats struct {
+	sync.RWMutex
+	m map[byte]MarshalUnmarshaler
+}
+
+// RegisterFormat registers the marshaler/unmarshaler as the entry format for
+// the tag. Entries stored with a registered format (see WithFormat) are
+// prefixed with a short format tag line, and are loaded with the format
+// registered for the tag, regardless of the policy's marshaler, allowing
+// entries of different formats to coexist in the same cache.
+//
+// Panics when the tag has already been registered, or when the
+// marshaler/unmarshaler is nil or a FlatMarshalUnmarshaler.
+func RegisterFormat(tag byte, mu MarshalUnmarshaler) {
+	formats.Lock()
+	defer formats.Unlock()
+	switch _, flat := mu.(FlatMarshalUnmarshaler); {
+	case mu == nil:
+		panic("diskcache: RegisterFormat marshaler/unmarshaler is nil")
+	case flat:
+		panic("diskcache: RegisterFormat cannot use a FlatMarshalUnmarshaler")
+	}
+	if _, ok := formats.m[tag]; ok {
+		panic(fmt.Sprintf("diskcache: RegisterFormat called twice for tag %#02x", tag))
+	}
+	if formats.m == nil {
+		formats.m = make(map[byte]MarshalUnmarshaler)
+	}
+	formats.m[tag] = mu
+}
+
+// hasFormats returns whether or not any formats have been registered.
+func hasFormats() bool {
+	formats.RLock()
+	defer formats.RUnlock()
+	return len(formats.m) != 0
+}
+
+// lookupFormat returns the format registered for the tag.
+func lookupFormat(tag byte) (MarshalUnmarshaler, bool) {
+	formats.RLock()
+	defer formats.RUnlock()
+	m, ok := formats.m[tag]
+	return m, ok
+}
+
+// formatMarshalUnmarshaler marshals entries with the format registered for
+// the tag, prefixed with the format tag line, and unmarshals entries with the
+// format registered for the entry's format tag.
+type formatMarshalUnmarshaler struct {
+	tag byte
+}
+
+// Marshal satisfies the MarshalUnmarshaler interface.
+func (z formatMarshalUnmarshaler) Marshal(w io.Writer, r io.Reader) error {
+	return z.MarshalURL(w, r, "")
+}
+
+// MarshalURL satisfies the URLMarshaler interface.
+func (z formatMarshalUnmarshaler) MarshalURL(w io.Writer, r io.Reader, urlstr string) error {
+	m, ok := lookupFormat(z.tag)
+	if !ok {
+		return fmt.Errorf("format %#02x not registered", z.tag)
+	}
+	if _, err := fmt.Fprintf(w, "%s%02x\n", formatMagic, z.tag); err != nil {
+		return err
+	}
+	if m, ok := m.(URLMarshaler); ok {
+		return m.MarshalURL(w, r, urlstr)
+	}
+	return m.Marshal(w, r)
+}
+
+// Unmarshal satisfies the MarshalUnmarshaler interface.
+func (z formatMarshalUnmarshaler) Unmarshal(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, formatMagic) {
+		return fmt.Errorf("invalid format tag %q", strings.TrimSpace(line))
+	}
+	tag, err := strconv.ParseUint(strings.TrimSpace(line[len(formatMagic):]), 16, 8)
+	if err != nil {
+		return fmt.Errorf("invalid format tag %q", strings.TrimSpace(line))
+	}
+	m, ok := lookupFormat(byte(tag))
+	if !ok {
+		return fmt.Errorf("format %#02x not registered", tag)
+	}
+	return m.Unmarshal(w, br)
+}
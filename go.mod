@@ -6,10 +6,8 @@ require (
 	github.com/gobwas/glob v0.2.3
 	github.com/spf13/afero v1.11.0
 	github.com/tdewolff/minify/v2 v2.21.1
+	github.com/tdewolff/parse/v2 v2.7.19
 	github.com/yookoala/realpath v1.0.0
 )
 
-require (
-	github.com/tdewolff/parse/v2 v2.7.19 // indirect
-	golang.org/x/text v0.19.0 // indirect
-)
+require golang.org/x/text v0.19.0 // indirect
@@ -0,0 +1,41 @@
+package diskcache
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+)
+
+// Hasher is a hash func used for hashing by the disk cache, such as for long
+// path keys, shards, fallback names, body and vary keys, signature keys, and
+// config versions. A nil Hasher uses SHA-256.
+//
+// See WithHasher.
+type Hasher func() hash.Hash
+
+// Sum returns the hex encoded hash of buf.
+func (h Hasher) Sum(buf []byte) string {
+	if h == nil {
+		return fmt.Sprintf("%x", sha256.Sum256(buf))
+	}
+	z := h()
+	_, _ = z.Write(buf)
+	return fmt.Sprintf("%x", z.Sum(nil))
+}
+
+// hexLen returns the length of the hex encoded hash.
+func (h Hasher) hexLen() int {
+	if h == nil {
+		return 2 * sha256.Size
+	}
+	return 2 * h().Size()
+}
+
+// applyHasher sets the hasher of the default matcher and simple matchers.
+func (c *Cache) applyHasher() {
+	for _, v := range append(c.matchers, c.matcher) {
+		if m, ok := v.(*SimpleMatcher); ok {
+			m.hasher = c.hasher
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package diskcache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+// httpcacheName returns the fs name of the entry stored for the request by
+// github.com/gregjones/httpcache's diskcache, which names entries using the
+// hex encoded MD5 hash of the request's httpcache key.
+func httpcacheName(req *http.Request) string {
+	key := req.URL.String()
+	if req.Method != "GET" {
+		key = req.Method + " " + key
+	}
+	return fmt.Sprintf("%x", md5.Sum([]byte(key)))
+}
+
+// importHTTPCache imports the entry stored by httpcache for the request,
+// storing the entry using the key and cache policy, and preserving the
+// entry's last modified time. Returns false when there is no entry, or when
+// the entry is stale.
+func (c *Cache) importHTTPCache(key string, p Policy, req *http.Request) (bool, time.Time, *http.Response, error) {
+	name := httpcacheName(req)
+	fi, err := c.httpcacheFs.Stat(name)
+	switch {
+	case err != nil && errors.Is(err, fs.ErrNotExist):
+		return false, time.Time{}, nil, nil
+	case err != nil:
+		return false, time.Time{}, nil, err
+	}
+	mod := fi.ModTime()
+	switch stale, err := c.expired(req.Context(), key, mod, p); {
+	case err != nil:
+		return false, time.Time{}, nil, err
+	case stale:
+		return false, time.Time{}, nil, nil
+	}
+	f, err := c.httpcacheFs.Open(name)
+	if err != nil {
+		return false, time.Time{}, nil, err
+	}
+	res, err := http.ReadResponse(bufio.NewReader(f), req)
+	if err != nil {
+		f.Close()
+		return false, time.Time{}, nil, err
+	}
+	res.Body = &fileBody{ReadCloser: res.Body, f: f}
+	// store as if fetched
+	z := *c
+	z.transport, z.limiter, z.fetchMiddleware = entryTransport{res}, nil, nil
+	if res, err = z.exec(key, p, req); err != nil {
+		return false, time.Time{}, nil, err
+	}
+	c.debug(req.Context(), "import", "key", key, "name", name)
+	// read the body, as the stored entry's last modified time may be updated
+	// when its file is closed
+	buf, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return false, time.Time{}, nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(buf))
+	// preserve last modified time
+	if stored, err := c.lookup(key); err == nil {
+		switch err := c.fs.Chtimes(stored, mod, mod); {
+		case err == nil:
+			if err := c.writeTimestamp(stored, mod, c.fileMode); err != nil {
+				return false, time.Time{}, nil, err
+			}
+		case !errors.Is(err, fs.ErrNotExist):
+			return false, time.Time{}, nil, err
+		}
+	}
+	return true, mod, res, nil
+}
+
+// entryTransport is a transport that returns a stored response.
+type entryTransport struct {
+	res *http.Response
+}
+
+// RoundTrip satisfies the http.RoundTripper interface.
+func (t entryTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return t.res, nil
+}
@@ -0,0 +1,124 @@
+package diskcache
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// atimeDir is the directory for last read sidecar files.
+const atimeDir = "?atime"
+
+// atimeName returns the fs name of the last read sidecar file for the fs
+// name.
+func (c *Cache) atimeName(name string) string {
+	root := c.root()
+	return path.Join(root, atimeDir, strings.TrimPrefix(name, root))
+}
+
+// sidecarDir returns whether or not the fs name is a sidecar file directory.
+func (c *Cache) sidecarDir(name string) bool {
+	root := c.root()
+	switch name {
+	case path.Join(root, atimeDir), path.Join(root, keysDir), path.Join(root, requestDir),
+		path.Join(root, epochDir), path.Join(root, bundleDir), path.Join(root, varyDir),
+		path.Join(root, timestampDir), path.Join(root, configDir), path.Join(root, finalDir),
+		path.Join(root, teeDir), path.Join(root, versionDir), path.Join(root, mirrorDir),
+		path.Join(root, resumeDir), path.Join(root, preflightDir), path.Join(root, extDir):
+		return true
+	}
+	// fixtures recorded with WithRecordAll are not entries
+	return c.recordDir != "" && name == c.recordDir
+}
+
+// touch updates the last read time of the fs name. Errors are ignored, as
+// tracking the last read time is best-effort.
+func (c *Cache) touch(name string) {
+	now, atime := time.Now(), c.atimeName(name)
+	if err := c.fs.Chtimes(atime, now, now); err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err := c.fs.MkdirAll(path.Dir(atime), c.dirMode); err != nil {
+		return
+	}
+	if f, err := c.fs.OpenFile(atime, os.O_CREATE|os.O_WRONLY, c.fileMode); err == nil {
+		_ = f.Close()
+	}
+}
+
+// EvictIdle evicts (deletes) all entries that have not been read within the
+// max idle age set by WithMaxIdleAge. Entries that have never been read are
+// evicted when they have not been modified within the max idle age.
+func (c *Cache) EvictIdle() error {
+	if !c.life.acquire() {
+		return ErrClosed
+	}
+	defer c.life.release()
+	if c.maxIdleAge == 0 {
+		return errors.New("max idle age not set")
+	}
+	root := c.root()
+	var names []string
+	err := afero.Walk(c.fs, root, func(name string, fi fs.FileInfo, err error) error {
+		switch {
+		case err != nil && name == root && errors.Is(err, fs.ErrNotExist):
+			return nil
+		case err != nil:
+			return err
+		case fi.IsDir() && c.sidecarDir(name):
+			return fs.SkipDir
+		case !fi.Mode().IsRegular():
+			return nil
+		}
+		last := fi.ModTime()
+		if ai, err := c.fs.Stat(c.atimeName(name)); err == nil && ai.ModTime().After(last) {
+			last = ai.ModTime()
+		}
+		if time.Since(last) > c.maxIdleAge {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.each(names, func(_ int, name string) error {
+		return c.remove(name)
+	})
+}
+
+// remove removes the fs name and its sidecar files.
+func (c *Cache) remove(name string) error {
+	if c.index != nil {
+		defer c.index.remove(name)
+	}
+	if c.memory != nil {
+		c.memory.remove(name)
+	}
+	if err := c.fs.Remove(name); err != nil {
+		return err
+	}
+	c.debug(context.Background(), "evict", "name", name)
+	if err := c.fs.Remove(c.atimeName(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	sidecars := []string{c.keyName(name), c.requestName(name), c.epochName(name), c.bundleName(name), c.varyName(name), c.timestampName(name), c.configName(name), c.finalName(name), c.preflightName(name)}
+	if c.extFromContentType {
+		sidecars = append(sidecars, c.extName(extBase(name)))
+	}
+	for _, sidecar := range sidecars {
+		if err := c.fs.Remove(sidecar); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if c.versions != 0 {
+		return c.fs.RemoveAll(c.versionName(name))
+	}
+	return nil
+}
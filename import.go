@@ -0,0 +1,88 @@
+package diskcache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+)
+
+// ImportFiles stores the contents of each of the files as a 200 OK response
+// to the file's request, under the key and policy matched for the request, as
+// if fetched. Files are read from the OS filesystem, and imported in name
+// order. Header and body transformers and the policy's marshaler/unmarshaler
+// are applied the same as with Exec, and the upstream transport is not used.
+//
+// The Content-Type of each response is inferred from the file's extension,
+// falling back to detecting the content type of the file's contents.
+//
+// Useful for seeding a cache with previously fetched files, such as the
+// output of curl.
+func (c *Cache) ImportFiles(files map[string]*http.Request) error {
+	if !c.life.acquire() {
+		return ErrClosed
+	}
+	defer c.life.release()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if err := c.importFile(name, files[name]); err != nil {
+			return fmt.Errorf("import %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// importFile stores the contents of the file as the response to the request.
+func (c *Cache) importFile(name string, req *http.Request) error {
+	key, p, err := c.Match(req)
+	switch {
+	case err != nil:
+		return err
+	case key == "":
+		return fmt.Errorf("%w: %s %s", ErrNotMatched, req.Method, redactURL(req.URL))
+	}
+	if z, ok := ContextPolicy(req.Context()); ok {
+		p = z
+	}
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(buf)
+	}
+	res := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":   {contentType},
+			"Content-Length": {strconv.Itoa(len(buf))},
+		},
+		Body:          io.NopCloser(bytes.NewReader(buf)),
+		ContentLength: int64(len(buf)),
+		Request:       req,
+	}
+	// store as if fetched
+	z := *c
+	z.transport, z.limiter, z.fetchMiddleware = entryTransport{res}, nil, nil
+	if res, err = z.execute(key, p, req); err != nil {
+		return err
+	}
+	c.debug(req.Context(), "import", "key", key, "name", name)
+	defer res.Body.Close()
+	_, err = io.Copy(io.Discard, res.Body)
+	return err
+}
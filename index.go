@@ -0,0 +1,101 @@
+package diskcache
+
+import (
+	"errors"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// index is a concurrency-safe in-memory index of the fs names and last
+// modified times of stored entries.
+type index struct {
+	sync.RWMutex
+	// rescan is the interval after which the fs is rescanned.
+	rescan time.Duration
+	// scanning is held while the index is being rescanned.
+	scanning sync.Mutex
+	// scanned is the time of the last scan.
+	scanned time.Time
+	// entries are the indexed entries.
+	entries map[string]indexEntry
+}
+
+// indexEntry is an index entry.
+type indexEntry struct {
+	mod  time.Time
+	size int64
+}
+
+// scan rebuilds the index by walking the fs from root.
+func (idx *index) scan(fsys afero.Fs, root string) error {
+	entries := make(map[string]indexEntry)
+	err := afero.Walk(fsys, root, func(name string, fi fs.FileInfo, err error) error {
+		switch {
+		case err != nil && name == root && errors.Is(err, fs.ErrNotExist):
+			return nil
+		case err != nil:
+			return err
+		case fi.Mode().IsRegular():
+			entries[name] = indexEntry{mod: fi.ModTime(), size: fi.Size()}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	idx.Lock()
+	defer idx.Unlock()
+	idx.entries, idx.scanned = entries, time.Now()
+	return nil
+}
+
+// refresh rescans the index when due. Only a single rescan is run at a time,
+// with lookups made during a rescan using the existing index.
+func (idx *index) refresh(fsys afero.Fs, root string) error {
+	if !idx.stale() || !idx.scanning.TryLock() {
+		return nil
+	}
+	defer idx.scanning.Unlock()
+	// rescanned prior to acquiring
+	if !idx.stale() {
+		return nil
+	}
+	return idx.scan(fsys, root)
+}
+
+// stale determines if the index is due to be rescanned.
+func (idx *index) stale() bool {
+	idx.RLock()
+	defer idx.RUnlock()
+	return idx.rescan != 0 && time.Now().After(idx.scanned.Add(idx.rescan))
+}
+
+// get retrieves the index entry for the fs name.
+func (idx *index) get(name string) (indexEntry, bool) {
+	idx.RLock()
+	defer idx.RUnlock()
+	e, ok := idx.entries[name]
+	return e, ok
+}
+
+// update updates the index entry for the fs name from the fs.
+func (idx *index) update(fsys afero.Fs, name string) error {
+	fi, err := fsys.Stat(name)
+	if err != nil {
+		return err
+	}
+	idx.Lock()
+	defer idx.Unlock()
+	idx.entries[name] = indexEntry{mod: fi.ModTime(), size: fi.Size()}
+	return nil
+}
+
+// remove removes the index entry for the fs name.
+func (idx *index) remove(name string) {
+	idx.Lock()
+	defer idx.Unlock()
+	delete(idx.entries, name)
+}
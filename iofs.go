@@ -0,0 +1,201 @@
+package diskcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// FS returns a read-only fs.FS view of the cache, such as for serving stored
+// entries with http.FileServer. Names are keys, and opening a key yields the
+// unmarshaled response body of the stored entry (not the stored bytes, or the
+// response headers). Directories list the stored entries and directories of
+// the cache's fs, excluding sidecar file directories.
+//
+// Entries are unmarshaled using the default policy's MarshalUnmarshaler, as
+// the matched policy for a key is not known. Opened bodies are buffered in
+// memory, so that the returned files are seekable.
+func (c *Cache) FS() fs.FS {
+	return cacheFS{c: c}
+}
+
+// cacheFS is a read-only fs.FS view of a cache.
+type cacheFS struct {
+	c *Cache
+}
+
+// Open satisfies the fs.FS interface.
+func (z cacheFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if !z.c.life.acquire() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: ErrClosed}
+	}
+	defer z.c.life.release()
+	fname, err := z.c.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if fname == "" {
+		fname = "."
+	}
+	fi, err := z.c.fs.Stat(fname)
+	switch {
+	case err != nil:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	case fi.IsDir() && z.c.sidecarDir(fname):
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case fi.IsDir():
+		f, err := afero.NewIOFS(z.c.fs).Open(fname)
+		if err != nil {
+			return nil, err
+		}
+		d, ok := f.(fs.ReadDirFile)
+		if !ok {
+			f.Close()
+			return nil, &fs.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+		}
+		return &cacheDir{ReadDirFile: d, c: z.c, name: fname}, nil
+	}
+	f, err := z.c.openEntry(fname, path.Base(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return f, nil
+}
+
+// openEntry opens the stored entry of the fs name, unmarshaling the response
+// body.
+func (c *Cache) openEntry(fname, name string) (*cacheFile, error) {
+	r, err := c.read(fname, c.matcher.policy)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	res, err := http.ReadResponse(bufio.NewReader(r), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrCorruptEntry, fname, err)
+	}
+	defer res.Body.Close()
+	buf, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	mod, err := c.nameMod(fname)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheFile{
+		Reader: bytes.NewReader(buf),
+		info: cacheFileInfo{
+			name: name,
+			size: int64(len(buf)),
+			mod:  mod,
+		},
+	}, nil
+}
+
+// cacheFile is an opened entry of a cache fs.
+type cacheFile struct {
+	*bytes.Reader
+	info cacheFileInfo
+}
+
+// Stat satisfies the fs.File interface.
+func (f *cacheFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// Close satisfies the fs.File interface.
+func (f *cacheFile) Close() error {
+	return nil
+}
+
+// cacheFileInfo is the file info of an opened entry of a cache fs.
+type cacheFileInfo struct {
+	name string
+	size int64
+	mod  time.Time
+}
+
+// Name satisfies the fs.FileInfo interface.
+func (fi cacheFileInfo) Name() string { return fi.name }
+
+// Size satisfies the fs.FileInfo interface.
+func (fi cacheFileInfo) Size() int64 { return fi.size }
+
+// Mode satisfies the fs.FileInfo interface.
+func (fi cacheFileInfo) Mode() fs.FileMode { return 0o444 }
+
+// ModTime satisfies the fs.FileInfo interface.
+func (fi cacheFileInfo) ModTime() time.Time { return fi.mod }
+
+// IsDir satisfies the fs.FileInfo interface.
+func (fi cacheFileInfo) IsDir() bool { return false }
+
+// Sys satisfies the fs.FileInfo interface.
+func (fi cacheFileInfo) Sys() any { return nil }
+
+// cacheDir is an opened directory of a cache fs.
+type cacheDir struct {
+	fs.ReadDirFile
+	c    *Cache
+	name string
+}
+
+// ReadDir satisfies the fs.ReadDirFile interface, excluding sidecar file
+// directories. The info of entries is the same as the info of the opened
+// entries.
+func (d *cacheDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	for {
+		entries, err := d.ReadDirFile.ReadDir(n)
+		v := entries[:0]
+		for _, e := range entries {
+			switch {
+			case e.IsDir() && d.c.sidecarDir(path.Join(d.name, e.Name())):
+				continue
+			case e.Type().IsRegular():
+				e = cacheDirEntry{DirEntry: e, c: d.c, fname: path.Join(d.name, e.Name())}
+			}
+			v = append(v, e)
+		}
+		// read more when all entries were excluded
+		if n > 0 && len(v) == 0 && len(entries) != 0 && err == nil {
+			continue
+		}
+		return v, err
+	}
+}
+
+// cacheDirEntry is a stored entry listed in a directory of a cache fs.
+type cacheDirEntry struct {
+	fs.DirEntry
+	c     *Cache
+	fname string
+}
+
+// Type satisfies the fs.DirEntry interface.
+func (e cacheDirEntry) Type() fs.FileMode { return 0 }
+
+// Info satisfies the fs.DirEntry interface, returning the info of the opened
+// entry.
+func (e cacheDirEntry) Info() (fs.FileInfo, error) {
+	if !e.c.life.acquire() {
+		return nil, &fs.PathError{Op: "stat", Path: e.Name(), Err: ErrClosed}
+	}
+	defer e.c.life.release()
+	f, err := e.c.openEntry(e.fname, e.Name())
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: e.Name(), Err: err}
+	}
+	return f.info, nil
+}
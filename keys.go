@@ -0,0 +1,100 @@
+package diskcache
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// keysDir is the directory for key sidecar files, used with hashed keys. As
+// hashed names are hex encoded, the directory does not collide with stored
+// entries.
+const keysDir = "_keys"
+
+// hashName returns the hashed fs path for the key, sharded using the shard
+// depth and width, or 2 levels of 2 characters when sharding is not set.
+func (c *Cache) hashName(key string) string {
+	h := c.keyHash()
+	_, _ = h.Write([]byte(key))
+	sum := fmt.Sprintf("%x", h.Sum(nil))
+	depth, width := c.shardDepth, c.shardWidth
+	if depth == 0 {
+		depth, width = 2, 2
+	}
+	return path.Join(append(shards(sum, depth, width), sum)...)
+}
+
+// checkSharding checks that the sharding depth and width do not exceed the
+// length of the hex encoded hash.
+func (c *Cache) checkSharding() error {
+	if n := c.hasher.hexLen(); c.shardDepth*c.shardWidth > n {
+		return fmt.Errorf("sharding depth %d and width %d exceeds hash length %d", c.shardDepth, c.shardWidth, n)
+	}
+	return nil
+}
+
+// checkKeyLength checks that the max key length of the default matcher and
+// simple matchers set with WithMaxKeyLength can hold the hex encoded hash.
+func (c *Cache) checkKeyLength() error {
+	n := c.hasher.hexLen()
+	for _, v := range append(c.matchers, c.matcher) {
+		if m, ok := v.(*SimpleMatcher); ok && m.maxKeyLength != 0 && m.maxKeyLength < n+1 {
+			return fmt.Errorf("max key length %d cannot hold hash length %d", m.maxKeyLength, n)
+		}
+	}
+	return nil
+}
+
+// shards returns depth shards of width characters from the start of s.
+func shards(s string, depth, width int) []string {
+	v := make([]string, 0, depth+1)
+	for i := 0; i < depth && (i+1)*width <= len(s); i++ {
+		v = append(v, s[i*width:(i+1)*width])
+	}
+	return v
+}
+
+// keyName returns the fs name of the key sidecar file for the fs name.
+func (c *Cache) keyName(name string) string {
+	root := c.root()
+	return path.Join(root, keysDir, strings.TrimPrefix(name, root))
+}
+
+// writeKey writes the key sidecar file for the fs name.
+func (c *Cache) writeKey(name, key string, mode os.FileMode) error {
+	sidecar := c.keyName(name)
+	if err := c.fs.MkdirAll(path.Dir(sidecar), c.dirMode); err != nil {
+		return err
+	}
+	return afero.WriteFile(c.fs, sidecar, []byte(key), mode)
+}
+
+// key returns the key for the fs name. Returns the storage path relative to
+// the root when using a path mapper.
+func (c *Cache) key(name string) string {
+	if c.keyHash != nil {
+		if buf, err := afero.ReadFile(c.fs, c.keyName(name)); err == nil {
+			return string(buf)
+		}
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(name, c.root()), "/")
+	if c.pathMapper != nil {
+		return key
+	}
+	depth := c.shardDepth
+	if c.keyHash != nil && depth == 0 {
+		depth = 2
+	}
+	for i := 0; i < depth; i++ {
+		if j := strings.IndexByte(key, '/'); j != -1 {
+			key = key[j+1:]
+		}
+	}
+	if c.extFromContentType {
+		key = extBase(key)
+	}
+	return key
+}
@@ -0,0 +1,39 @@
+package diskcache
+
+import (
+	"fmt"
+	"io"
+)
+
+// lazyBody is a reader that unmarshals a stored entry on demand, as the
+// entry is read.
+type lazyBody struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// newLazyBody creates a lazy body, unmarshaling the entry read from r using
+// the unmarshaler. The file f is closed once unmarshaling finishes, or when
+// the lazy body is closed.
+func newLazyBody(name string, m MarshalUnmarshaler, r io.Reader, f io.Closer) *lazyBody {
+	pr, pw := io.Pipe()
+	b := &lazyBody{PipeReader: pr, done: make(chan struct{})}
+	go func() {
+		defer close(b.done)
+		err := m.Unmarshal(pw, r)
+		f.Close()
+		if err != nil {
+			err = fmt.Errorf("%w: %s: %w", ErrCorruptEntry, name, err)
+		}
+		pw.CloseWithError(err)
+	}()
+	return b
+}
+
+// Close satisfies the io.Closer interface, stopping the unmarshaling of the
+// entry, and waiting for the file to be closed.
+func (b *lazyBody) Close() error {
+	err := b.PipeReader.Close()
+	<-b.done
+	return err
+}
@@ -1,19 +1,34 @@
 package diskcache
 
 import (
+	"bufio"
 	"bytes"
-	"compress/gzip"
-	"compress/zlib"
+	"compress/bzip2"
+	"crypto/rand"
 	"errors"
+	"fmt"
 	"io"
+	"net/textproto"
+	"strconv"
+	"time"
 )
 
+// ErrTrailingData is the trailing data error.
+var ErrTrailingData = errors.New("trailing data")
+
 // MarshalUnmarshaler is the shared interface for marshaling/unmarshaling.
 type MarshalUnmarshaler interface {
 	Marshal(w io.Writer, r io.Reader) error
 	Unmarshal(w io.Writer, r io.Reader) error
 }
 
+// URLMarshaler is the interface for marshalers that make use of the request
+// URL when marshaling. When a policy's MarshalUnmarshaler satisfies this
+// interface, MarshalURL is used in place of Marshal.
+type URLMarshaler interface {
+	MarshalURL(w io.Writer, r io.Reader, urlstr string) error
+}
+
 // GzipMarshalUnmarshaler is a gzip mashaler/unmarshaler.
 type GzipMarshalUnmarshaler struct {
 	// Level is the compression level.
@@ -22,7 +37,7 @@ type GzipMarshalUnmarshaler struct {
 
 // Marshal satisfies the MarshalUnmarshaler interface.
 func (z GzipMarshalUnmarshaler) Marshal(w io.Writer, r io.Reader) error {
-	wr, err := gzip.NewWriterLevel(w, z.Level)
+	wr, err := getGzipWriter(w, z.Level)
 	if err != nil {
 		return err
 	}
@@ -32,19 +47,81 @@ func (z GzipMarshalUnmarshaler) Marshal(w io.Writer, r io.Reader) error {
 	if err := wr.Flush(); err != nil {
 		return err
 	}
-	return wr.Close()
+	if err := wr.Close(); err != nil {
+		return err
+	}
+	putGzipWriter(wr, z.Level)
+	return nil
 }
 
 // Unmarshal satisfies the MarshalUnmarshaler interface.
+//
+// Returns ErrTrailingData when there is any data following the first gzip
+// stream, such as from a partial write.
 func (z GzipMarshalUnmarshaler) Unmarshal(w io.Writer, r io.Reader) error {
-	rd, err := gzip.NewReader(r)
+	br := bufio.NewReader(r)
+	rd, err := getGzipReader(br)
+	if err != nil {
+		return err
+	}
+	rd.Multistream(false)
+	if _, err := io.Copy(w, rd); err != nil {
+		return err
+	}
+	if err := rd.Close(); err != nil {
+		return err
+	}
+	putGzipReader(rd)
+	if _, err := br.ReadByte(); !errors.Is(err, io.EOF) {
+		return ErrTrailingData
+	}
+	return nil
+}
+
+// HeaderGzipMarshalUnmarshaler is a gzip marshaler/unmarshaler that only
+// compresses the header block, storing the body uncompressed following the
+// compressed header block. Useful for responses with large header blocks and
+// incompressible bodies, such as images.
+type HeaderGzipMarshalUnmarshaler struct {
+	// Level is the compression level.
+	Level int
+}
+
+// Marshal satisfies the MarshalUnmarshaler interface.
+func (z HeaderGzipMarshalUnmarshaler) Marshal(w io.Writer, r io.Reader) error {
+	b := new(bytes.Buffer)
+	if _, err := io.Copy(b, r); err != nil {
+		return err
+	}
+	buf := b.Bytes()
+	i, n := headerBoundary(buf)
+	if i == -1 {
+		return errors.New("unable to find header/body boundary")
+	}
+	if err := (GzipMarshalUnmarshaler{Level: z.Level}).Marshal(w, bytes.NewReader(buf[:i+n])); err != nil {
+		return err
+	}
+	_, err := w.Write(buf[i+n:])
+	return err
+}
+
+// Unmarshal satisfies the MarshalUnmarshaler interface.
+func (z HeaderGzipMarshalUnmarshaler) Unmarshal(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	rd, err := getGzipReader(br)
 	if err != nil {
 		return err
 	}
+	rd.Multistream(false)
 	if _, err := io.Copy(w, rd); err != nil {
 		return err
 	}
-	return rd.Close()
+	if err := rd.Close(); err != nil {
+		return err
+	}
+	putGzipReader(rd)
+	_, err = io.Copy(w, br)
+	return err
 }
 
 // ZlibMarshalUnmarshaler is a zlib mashaler/unmarshaler.
@@ -57,7 +134,7 @@ type ZlibMarshalUnmarshaler struct {
 
 // Marshal satisfies the MarshalUnmarshaler interface.
 func (z ZlibMarshalUnmarshaler) Marshal(w io.Writer, r io.Reader) error {
-	wr, err := zlib.NewWriterLevelDict(w, z.Level, z.Dict)
+	wr, err := getZlibWriter(w, z.Level, z.Dict)
 	if err != nil {
 		return err
 	}
@@ -67,19 +144,82 @@ func (z ZlibMarshalUnmarshaler) Marshal(w io.Writer, r io.Reader) error {
 	if err := wr.Flush(); err != nil {
 		return err
 	}
-	return wr.Close()
+	if err := wr.Close(); err != nil {
+		return err
+	}
+	putZlibWriter(wr, z.Level, z.Dict)
+	return nil
 }
 
 // Unmarshal satisfies the MarshalUnmarshaler interface.
 func (z ZlibMarshalUnmarshaler) Unmarshal(w io.Writer, r io.Reader) error {
-	rd, err := zlib.NewReaderDict(r, z.Dict)
+	rd, err := getZlibReader(r, z.Dict)
 	if err != nil {
 		return err
 	}
 	if _, err := io.Copy(w, rd); err != nil {
 		return err
 	}
-	return rd.Close()
+	if err := rd.Close(); err != nil {
+		return err
+	}
+	putZlibReader(rd, z.Dict)
+	return nil
+}
+
+// Bzip2MarshalUnmarshaler is a read-only bzip2 unmarshaler, for loading
+// entries compressed with bzip2 by external tools. As the standard library
+// does not provide a bzip2 compressor, entries are marshaled with Marshaler
+// (or stored uncompressed when Marshaler is nil), and entries that are not
+// bzip2 compressed are unmarshaled with Marshaler. This allows caches with a
+// mix of externally produced bzip2 entries and entries written by the cache
+// to be loaded.
+//
+// Example:
+//
+//	WithMarshalUnmarshaler(Bzip2MarshalUnmarshaler{
+//		Marshaler: GzipMarshalUnmarshaler{Level: gzip.DefaultCompression},
+//	})
+type Bzip2MarshalUnmarshaler struct {
+	// Marshaler is the marshaler/unmarshaler used for writing entries, and
+	// for reading entries that are not bzip2 compressed.
+	Marshaler MarshalUnmarshaler
+}
+
+// Marshal satisfies the MarshalUnmarshaler interface.
+func (z Bzip2MarshalUnmarshaler) Marshal(w io.Writer, r io.Reader) error {
+	if z.Marshaler == nil {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	return z.Marshaler.Marshal(w, r)
+}
+
+// MarshalURL satisfies the URLMarshaler interface.
+func (z Bzip2MarshalUnmarshaler) MarshalURL(w io.Writer, r io.Reader, urlstr string) error {
+	if m, ok := z.Marshaler.(URLMarshaler); ok {
+		return m.MarshalURL(w, r, urlstr)
+	}
+	return z.Marshal(w, r)
+}
+
+// Unmarshal satisfies the MarshalUnmarshaler interface.
+func (z Bzip2MarshalUnmarshaler) Unmarshal(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	if buf, _ := br.Peek(4); isBzip2(buf) {
+		_, err := io.Copy(w, bzip2.NewReader(br))
+		return err
+	}
+	if z.Marshaler == nil {
+		_, err := io.Copy(w, br)
+		return err
+	}
+	return z.Marshaler.Unmarshal(w, br)
+}
+
+// isBzip2 returns whether or not buf starts with the bzip2 stream magic.
+func isBzip2(buf []byte) bool {
+	return len(buf) > 3 && buf[0] == 'B' && buf[1] == 'Z' && buf[2] == 'h' && '1' <= buf[3] && buf[3] <= '9'
 }
 
 // FlatMarshalUnmarshaler is a flat file marshaler/unmarshaler, dropping
@@ -88,6 +228,12 @@ type FlatMarshalUnmarshaler struct {
 	// Chain is an additional MarshalUnmarshaler that the data can be sent to
 	// prior to storage on disk, but after the header has been stripped.
 	Chain MarshalUnmarshaler
+	// Headers are the names of the response headers to keep, which are
+	// stored in a minimal header block prior to the body, and restored when
+	// unmarshaling. A kept Content-Length is set to the length of the stored
+	// body. Entries stored with a different set of kept headers cannot be
+	// unmarshaled.
+	Headers []string
 }
 
 // Marshal satisfies the MarshalUnmarshaler interface.
@@ -97,15 +243,54 @@ func (z FlatMarshalUnmarshaler) Marshal(w io.Writer, r io.Reader) error {
 		return err
 	}
 	buf := b.Bytes()
-	i := bytes.Index(buf, crlfcrlf)
+	i, n := headerBoundary(buf)
 	if i == -1 {
 		return errors.New("unable to find header/body boundary")
 	}
+	body := buf[i+n:]
+	if len(z.Headers) != 0 {
+		var err error
+		if body, err = z.keepHeaders(buf[:i+n], body); err != nil {
+			return err
+		}
+	}
 	if z.Chain == nil {
-		_, err := w.Write(buf[i+4:])
+		_, err := w.Write(body)
 		return err
 	}
-	return z.Chain.Marshal(w, bytes.NewReader(buf[i+4:]))
+	return z.Chain.Marshal(w, bytes.NewReader(body))
+}
+
+// keepHeaders returns the body prefixed with the header block of the kept
+// headers from the header buf. Returns the body when the body is empty and
+// none of the kept headers are present.
+func (z FlatMarshalUnmarshaler) keepHeaders(header, body []byte) ([]byte, error) {
+	tr := textproto.NewReader(bufio.NewReader(bytes.NewReader(header)))
+	if _, err := tr.ReadLine(); err != nil {
+		return nil, err
+	}
+	h, err := tr.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	b := new(bytes.Buffer)
+	for _, k := range z.Headers {
+		k = textproto.CanonicalMIMEHeaderKey(k)
+		switch v := h.Values(k); {
+		case k == "Content-Length":
+			fmt.Fprintf(b, "%s: %d\r\n", k, len(body))
+		case len(v) != 0:
+			for _, s := range v {
+				fmt.Fprintf(b, "%s: %s\r\n", k, s)
+			}
+		}
+	}
+	if b.Len() == 0 && len(body) == 0 {
+		return body, nil
+	}
+	b.Write(crlf)
+	b.Write(body)
+	return b.Bytes(), nil
 }
 
 // Unmarshal satisfies the MarshalUnmarshaler interface.
@@ -117,9 +302,95 @@ func (z FlatMarshalUnmarshaler) Unmarshal(w io.Writer, r io.Reader) error {
 		}
 		r = b
 	}
-	if _, err := w.Write(httpHeader); err != nil {
+	if len(z.Headers) == 0 {
+		if _, err := w.Write(httpHeader); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, r)
+		return err
+	}
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	// restore the kept header block
+	header := httpHeader
+	if len(buf) != 0 {
+		i := len(crlf)
+		if !bytes.HasPrefix(buf, crlf) {
+			if i = bytes.Index(buf, crlfcrlf); i == -1 {
+				return errors.New("unable to find kept header/body boundary")
+			}
+			i += len(crlfcrlf)
+		}
+		header, buf = append(append([]byte{}, httpHeader[:len(httpHeader)-len(crlf)]...), buf[:i]...), buf[i:]
+	}
+	if _, err := w.Write(header); err != nil {
 		return err
 	}
-	_, err := io.Copy(w, r)
+	_, err = w.Write(buf)
+	return err
+}
+
+// WARCMarshalUnmarshaler is a WARC marshaler/unmarshaler, storing responses
+// as WARC response records.
+//
+// See: https://iipc.github.io/warc-specifications/
+type WARCMarshalUnmarshaler struct{}
+
+// Marshal satisfies the MarshalUnmarshaler interface.
+func (z WARCMarshalUnmarshaler) Marshal(w io.Writer, r io.Reader) error {
+	return z.MarshalURL(w, r, "")
+}
+
+// MarshalURL satisfies the URLMarshaler interface.
+func (z WARCMarshalUnmarshaler) MarshalURL(w io.Writer, r io.Reader, urlstr string) error {
+	b := new(bytes.Buffer)
+	if _, err := io.Copy(b, r); err != nil {
+		return err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	id[6], id[8] = (id[6]&0x0f)|0x40, (id[8]&0x3f)|0x80
+	buf := new(bytes.Buffer)
+	buf.WriteString("WARC/1.1\r\n")
+	buf.WriteString("WARC-Type: response\r\n")
+	fmt.Fprintf(buf, "WARC-Record-ID: <urn:uuid:%x-%x-%x-%x-%x>\r\n", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+	fmt.Fprintf(buf, "WARC-Date: %s\r\n", time.Now().UTC().Format(time.RFC3339))
+	if urlstr != "" {
+		fmt.Fprintf(buf, "WARC-Target-URI: %s\r\n", urlstr)
+	}
+	buf.WriteString("Content-Type: application/http;msgtype=response\r\n")
+	fmt.Fprintf(buf, "Content-Length: %d\r\n\r\n", b.Len())
+	buf.Write(b.Bytes())
+	buf.Write(crlfcrlf)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Unmarshal satisfies the MarshalUnmarshaler interface.
+func (z WARCMarshalUnmarshaler) Unmarshal(w io.Writer, r io.Reader) error {
+	rd := textproto.NewReader(bufio.NewReader(r))
+	version, err := rd.ReadLine()
+	switch {
+	case err != nil:
+		return err
+	case version != "WARC/1.1" && version != "WARC/1.0":
+		return fmt.Errorf("invalid WARC version %q", version)
+	}
+	header, err := rd.ReadMIMEHeader()
+	if err != nil {
+		return err
+	}
+	if typ := header.Get("WARC-Type"); typ != "response" {
+		return fmt.Errorf("invalid WARC-Type %q", typ)
+	}
+	n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid WARC Content-Length: %w", err)
+	}
+	_, err = io.CopyN(w, rd.R, n)
 	return err
 }
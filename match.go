@@ -1,39 +1,74 @@
 package diskcache
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/gobwas/glob"
 )
 
 // Matcher is the shared interface for retrivieving a disk cache policy for
-// requests.
+// requests. Matchers may optionally satisfy fmt.Stringer, which is used to
+// identify the matcher in Cache.Describe.
 type Matcher interface {
 	// Match matches the passed request, returning the key and ttl.
 	Match(*http.Request) (string, Policy, error)
 }
 
+// PriorityMatcher is the interface for matchers with an explicit priority.
+// Matchers are evaluated in priority order (lowest first), with ties broken
+// by registration order. Matchers not satisfying this interface have a
+// priority of 0.
+type PriorityMatcher interface {
+	Matcher
+	// MatcherPriority returns the matcher's priority.
+	MatcherPriority() int
+}
+
 // SimpleMatcher handles matching caching policies to requests.
 type SimpleMatcher struct {
+	priority        int
+	methodPattern   string
 	method          glob.Glob
 	host            *regexp.Regexp
 	hostSubexps     []string
 	path            *regexp.Regexp
 	pathSubexps     []string
+	pathBlacklist   []glob.Glob
 	key             string
 	indexPath       string
 	longPathHandler func(string) string
+	maxKeyLength    int
 	queryEncoder    func(url.Values) string
+	querySort       bool
+	ignoreQuery     []string
+	bodyKeyTypes    []string
+	varyHeaders     []string
+	signature       bool
+	sigHeaders      []string
+	sigBody         bool
+	preflight       bool
+	defaultIndex    bool
+	defaultQuery    bool
+	defaultLong     bool
+	hasher          Hasher
 	policy          Policy
 }
 
 // NewSimpleMatcher creates a simple matcher for the provided method, host and
 // path regular expressions, substitution key string, and other options.
 //
+// Each {{name}} token in the key must be a named subexpression of the host or
+// path regular expression, or one of the built-in {{method}}, {{query}}, or
+// {{fragment}} tokens, otherwise an error is returned.
+//
 // Example:
 //
 //	m, err := NewSimpleMatcher(
@@ -66,13 +101,17 @@ func NewSimpleMatcher(method, host, path, key string, opts ...Option) (*SimpleMa
 	if err != nil {
 		return nil, err
 	}
+	if err := checkKeyTokens(key, hostRE.SubexpNames(), pathRE.SubexpNames()); err != nil {
+		return nil, err
+	}
 	m := &SimpleMatcher{
-		method:      methodGlob,
-		host:        hostRE,
-		hostSubexps: hostRE.SubexpNames(),
-		path:        pathRE,
-		pathSubexps: pathRE.SubexpNames(),
-		key:         key,
+		methodPattern: method,
+		method:        methodGlob,
+		host:          hostRE,
+		hostSubexps:   hostRE.SubexpNames(),
+		path:          pathRE,
+		pathSubexps:   pathRE.SubexpNames(),
+		key:           key,
 	}
 	for _, o := range opts {
 		if err := o.apply(m); err != nil {
@@ -82,6 +121,145 @@ func NewSimpleMatcher(method, host, path, key string, opts ...Option) (*SimpleMa
 	return m, nil
 }
 
+// keyTokenRE matches key template tokens.
+var keyTokenRE = regexp.MustCompile(`\{\{([^{}]*)\}\}`)
+
+// checkKeyTokens checks that all tokens in the key template are a built-in
+// token ({{method}}, {{query}}, or {{fragment}}) or a named subexpression of
+// the host or path regexps.
+func checkKeyTokens(key string, hostSubexps, pathSubexps []string) error {
+	for _, m := range keyTokenRE.FindAllStringSubmatch(key, -1) {
+		switch name := m[1]; {
+		case name == "method", name == "query", name == "fragment",
+			name != "" && (slices.Contains(hostSubexps, name) || slices.Contains(pathSubexps, name)):
+		default:
+			return fmt.Errorf("key %q token {{%s}} is not a named subexpression of the host or path regexp", key, name)
+		}
+	}
+	return nil
+}
+
+// defaultKey is the default key template.
+const defaultKey = `{{proto}}/{{host}}{{port}}/{{path}}{{query}}`
+
+// keyDelimiters are the index path, long path, and query prefix markers used
+// in keys.
+type keyDelimiters struct {
+	index string
+	long  string
+	query string
+}
+
+// defaultKeyDelimiters are the default key delimiters.
+var defaultKeyDelimiters = keyDelimiters{
+	index: "?index",
+	long:  "?long/",
+	query: "_",
+}
+
+// defaultMatcherOptions returns the default simple matcher options.
+func defaultMatcherOptions() []Option {
+	d := defaultKeyDelimiters
+	return []Option{
+		WithIndexPath(d.index),
+		WithQueryPrefix(d.query),
+		withLongPathMarker(d.long),
+		withDefaultKeyDelimiters(),
+	}
+}
+
+// withDefaultKeyDelimiters is a simple matcher option to mark the matcher's
+// index path, query encoder, and long path handler as the defaults, which are
+// replaced by the cache's key delimiters set with WithKeyDelimiter.
+func withDefaultKeyDelimiters() Option {
+	return option{
+		matcher: func(m *SimpleMatcher) error {
+			m.defaultIndex, m.defaultQuery, m.defaultLong = true, true, true
+			return nil
+		},
+	}
+}
+
+// withLongPathMarker is a simple matcher option to set the long path handler
+// to the matcher's default long path handler using the long path marker.
+func withLongPathMarker(marker string) Option {
+	return option{
+		matcher: func(m *SimpleMatcher) error {
+			m.longPathHandler = m.longPath(marker)
+			return nil
+		},
+	}
+}
+
+// longPath returns a long path handler that replaces keys longer than 128
+// characters with the hex encoded hash of the key, prefixed with the long
+// path marker.
+func (m *SimpleMatcher) longPath(marker string) func(string) string {
+	return func(key string) string {
+		if len(key) > 128 {
+			return marker + m.hasher.Sum([]byte(key))
+		}
+		return key
+	}
+}
+
+// applyKeyDelimiters replaces the matcher's default index path, query
+// encoder, and long path handler using the key delimiters.
+func (m *SimpleMatcher) applyKeyDelimiters(d keyDelimiters) {
+	if m.defaultIndex {
+		m.indexPath = d.index
+	}
+	if m.defaultQuery {
+		m.queryEncoder = queryPrefixEncoder(d.query)
+	}
+	if m.defaultLong {
+		m.longPathHandler = m.longPath(d.long)
+	}
+}
+
+// MatchHost creates a simple matcher for GET requests to the exact host (on
+// any port), using the same key template and options as the default matcher.
+// Additional options are applied after the default options.
+func MatchHost(host string, opts ...Option) Matcher {
+	return MatchHostPath(host, "**", opts...)
+}
+
+// MatchHostPath creates a simple matcher for GET requests to the exact host
+// (on any port) and paths matching the path glob, using the same key template
+// and options as the default matcher. Additional options are applied after
+// the default options.
+//
+// In the path glob, * matches any characters except /, ** matches any
+// characters, and ? matches any single character except /.
+func MatchHostPath(host, pathGlob string, opts ...Option) Matcher {
+	return Match(
+		`GET`,
+		`^(?P<proto>https?)://(?P<host>`+regexp.QuoteMeta(host)+`)(?P<port>:[0-9]+)?$`,
+		`^/?(?P<path>`+globToRegexp(strings.TrimPrefix(pathGlob, "/"))+`)$`,
+		defaultKey,
+		append(defaultMatcherOptions(), opts...)...,
+	)
+}
+
+// globToRegexp converts a path glob to a regexp.
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return sb.String()
+}
+
 // Match creates a simple matcher for the provided method, host and path
 // regular expressions, and substitution key string. Wraps NewSimpleMatcher.
 func Match(method, host, path, key string, opts ...Option) Matcher {
@@ -103,11 +281,16 @@ func (m *SimpleMatcher) Match(req *http.Request) (string, Policy, error) {
 	if h == nil {
 		return "", Policy{}, nil
 	}
+	for _, g := range m.pathBlacklist {
+		if g.Match(req.URL.Path) {
+			return "", Policy{}, nil
+		}
+	}
 	p := m.path.FindStringSubmatch(req.URL.Path)
 	if p == nil {
 		return "", Policy{}, nil
 	}
-	pairs := []string{"{{method}}", strings.ToLower(req.Method)}
+	pairs := []string{"{{method}}", strings.ToLower(req.Method), "{{fragment}}", fragmentKey(req.URL)}
 	for i := 1; i < len(m.hostSubexps); i++ {
 		if m.hostSubexps[i] == "" {
 			continue
@@ -121,17 +304,123 @@ func (m *SimpleMatcher) Match(req *http.Request) (string, Policy, error) {
 		pairs = append(pairs, "{{"+m.pathSubexps[i]+"}}", p[i])
 	}
 	if m.queryEncoder != nil {
-		pairs = append(pairs, "{{query}}", m.queryEncoder(req.URL.Query()))
+		v := req.URL.Query()
+		for _, k := range m.ignoreQuery {
+			delete(v, k)
+		}
+		if m.querySort {
+			for _, values := range v {
+				slices.Sort(values)
+			}
+		}
+		pairs = append(pairs, "{{query}}", m.queryEncoder(v))
 	}
 	key := strings.NewReplacer(pairs...).Replace(m.key)
 	if key == "" || strings.HasSuffix(key, "/") {
 		key += m.indexPath
 	}
 	key = strings.TrimSuffix(fixRE.ReplaceAllString(key, "/"), "/")
+	policy := m.policy
+	if len(m.bodyKeyTypes) != 0 {
+		hash, err := bodyHash(m.hasher, req, m.bodyKeyTypes)
+		if err != nil {
+			return "", Policy{}, err
+		}
+		if hash != "" {
+			key, policy.bodyKey = key+"?body="+hash, true
+		}
+	}
+	if len(m.varyHeaders) != 0 {
+		key += "?vary=" + varyHash(m.hasher, req, m.varyHeaders)
+	}
+	if m.preflight && req.Method == "OPTIONS" {
+		key += "?preflight=" + preflightKey(m.hasher, req)
+	}
+	if m.signature {
+		sig, err := requestSignature(m.hasher, req, m.sigHeaders, m.sigBody)
+		if err != nil {
+			return "", Policy{}, err
+		}
+		key += "?sig=" + sig
+	}
 	if m.longPathHandler != nil {
 		key = m.longPathHandler(key)
 	}
-	return key, m.policy, nil
+	return key, policy, nil
+}
+
+// fragmentKey returns the key for the URL fragment, or an empty string when
+// the URL has no fragment.
+func fragmentKey(u *url.URL) string {
+	if u.Fragment == "" {
+		return ""
+	}
+	return "#" + url.QueryEscape(u.Fragment)
+}
+
+// bodyHash returns the hex encoded hash of the request body when the request's
+// media type is one of the content types. The request body is buffered and
+// restored when read.
+func bodyHash(h Hasher, req *http.Request, contentTypes []string) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return "", nil
+	}
+	typ, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || !containsFold(contentTypes, typ) {
+		return "", nil
+	}
+	return hashBody(h, req)
+}
+
+// hashBody returns the hex encoded hash of the request body. The request body
+// is buffered and restored when read.
+func hashBody(h Hasher, req *http.Request) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return "", nil
+	}
+	var buf []byte
+	var err error
+	if req.GetBody != nil {
+		r, err := req.GetBody()
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		if buf, err = io.ReadAll(r); err != nil {
+			return "", err
+		}
+	} else {
+		if buf, err = io.ReadAll(req.Body); err != nil {
+			return "", err
+		}
+		if err := req.Body.Close(); err != nil {
+			return "", err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(buf))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(buf)), nil
+		}
+	}
+	return h.Sum(buf), nil
+}
+
+// String satisfies the fmt.Stringer interface, summarizing the matcher's
+// method glob, host and path regexps, and key template.
+func (m *SimpleMatcher) String() string {
+	return fmt.Sprintf("method=%s host=%s path=%s key=%s", m.methodPattern, m.host, m.path, m.key)
+}
+
+// MatcherPriority satisfies the PriorityMatcher interface.
+func (m *SimpleMatcher) MatcherPriority() int {
+	return m.priority
+}
+
+// matcherPriority returns the priority of the matcher.
+func matcherPriority(m Matcher) int {
+	if z, ok := m.(PriorityMatcher); ok {
+		return z.MatcherPriority()
+	}
+	return 0
 }
 
 // apply satisfies the Option interface.
@@ -142,8 +431,35 @@ func (m *SimpleMatcher) apply(v interface{}) error {
 			if m.policy.TTL == 0 {
 				m.policy.TTL = z.matcher.policy.TTL
 			}
+			if m.policy.ScheduleTTL == nil {
+				m.policy.ScheduleTTL = z.matcher.policy.ScheduleTTL
+			}
+			if m.policy.ExpireFunc == nil {
+				m.policy.ExpireFunc = z.matcher.policy.ExpireFunc
+			}
 			m.policy.HeaderTransformers = append(z.matcher.policy.HeaderTransformers, m.policy.HeaderTransformers...)
 			m.policy.BodyTransformers = append(z.matcher.policy.BodyTransformers, m.policy.BodyTransformers...)
+			if m.policy.StaleFunc == nil {
+				m.policy.StaleFunc = z.matcher.policy.StaleFunc
+			}
+			if m.policy.BodyValidator == nil {
+				m.policy.BodyValidator = z.matcher.policy.BodyValidator
+			}
+			if m.policy.ResponseFilter == nil {
+				m.policy.ResponseFilter = z.matcher.policy.ResponseFilter
+			}
+			if m.policy.StorePredicate == nil {
+				m.policy.StorePredicate = z.matcher.policy.StorePredicate
+			}
+			if m.policy.CacheableStatusCodes == nil {
+				m.policy.CacheableStatusCodes = z.matcher.policy.CacheableStatusCodes
+			}
+			if m.policy.storeContentTypes == nil {
+				m.policy.storeContentTypes = z.matcher.policy.storeContentTypes
+			}
+			if m.policy.skipContentTypes == nil {
+				m.policy.skipContentTypes = z.matcher.policy.skipContentTypes
+			}
 			if m.policy.MarshalUnmarshaler == nil {
 				m.policy.MarshalUnmarshaler = z.matcher.policy.MarshalUnmarshaler
 			}
@@ -0,0 +1,86 @@
+package diskcache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// memory is a bounded in-memory LRU of loaded responses, keyed by fs name.
+type memory struct {
+	sync.Mutex
+	max     int
+	ll      *list.List
+	entries map[string]*list.Element
+}
+
+// memoryEntry is a memory entry.
+type memoryEntry struct {
+	name string
+	mod  time.Time
+	buf  []byte
+}
+
+// newMemory creates a new memory layer holding at most max entries.
+func newMemory(max int) *memory {
+	return &memory{
+		max:     max,
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the response bytes for the fs name, when the entry's last
+// modified time matches mod. Entries with a different last modified time are
+// removed.
+func (m *memory) get(name string, mod time.Time) ([]byte, bool) {
+	m.Lock()
+	defer m.Unlock()
+	el, ok := m.entries[name]
+	switch {
+	case !ok:
+		return nil, false
+	case !el.Value.(*memoryEntry).mod.Equal(mod):
+		m.ll.Remove(el)
+		delete(m.entries, name)
+		return nil, false
+	}
+	m.ll.MoveToFront(el)
+	return el.Value.(*memoryEntry).buf, true
+}
+
+// add adds the response bytes for the fs name, evicting the least recently
+// used entry when full.
+func (m *memory) add(name string, mod time.Time, buf []byte) {
+	m.Lock()
+	defer m.Unlock()
+	if el, ok := m.entries[name]; ok {
+		el.Value = &memoryEntry{name: name, mod: mod, buf: buf}
+		m.ll.MoveToFront(el)
+		return
+	}
+	m.entries[name] = m.ll.PushFront(&memoryEntry{name: name, mod: mod, buf: buf})
+	for m.ll.Len() > m.max {
+		el := m.ll.Back()
+		m.ll.Remove(el)
+		delete(m.entries, el.Value.(*memoryEntry).name)
+	}
+}
+
+// remove removes the fs name.
+func (m *memory) remove(name string) {
+	m.Lock()
+	defer m.Unlock()
+	if el, ok := m.entries[name]; ok {
+		m.ll.Remove(el)
+		delete(m.entries, name)
+	}
+}
+
+// clear removes all entries.
+func (m *memory) clear() {
+	m.Lock()
+	defer m.Unlock()
+	m.ll.Init()
+	clear(m.entries)
+}
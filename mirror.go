@@ -0,0 +1,64 @@
+package diskcache
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// mirrorDir is the directory for the browsable mirror of stored responses.
+const mirrorDir = "?mirror"
+
+// mirrorName returns the fs name of the mirror copy of the response for the
+// URL, made of the host and the path, with index.html for directories, and an
+// extension derived from the content type when the path does not have an
+// extension. The query is escaped into the last path element. Returns false
+// when the name would not be contained in the host's mirror directory.
+func (c *Cache) mirrorName(u *url.URL, contentType string) (string, bool) {
+	p := u.Path
+	if p == "" || strings.HasSuffix(p, "/") {
+		p += "index.html"
+	}
+	p = path.Clean("/" + p)
+	if u.RawQuery != "" {
+		p += "?" + strings.ReplaceAll(u.RawQuery, "/", "%2F")
+	}
+	if !isExt(path.Ext(p)) {
+		p += extByContentType(contentType)
+	}
+	dir, host := path.Join(c.root(), mirrorDir), strings.ToLower(u.Host)
+	base := path.Join(dir, host)
+	name := path.Join(base, p)
+	if path.Dir(base) != dir || !strings.HasPrefix(name, base+"/") {
+		return "", false
+	}
+	return name, true
+}
+
+// writeMirror writes the body of the successful GET response raw to the
+// mirror. Errors are ignored, as the mirror is best-effort.
+func (c *Cache) writeMirror(req *http.Request, contentType string, raw []byte, mode os.FileMode) {
+	if req.Method != "GET" || statusCode(raw) != http.StatusOK {
+		return
+	}
+	i, n := headerBoundary(raw)
+	if i == -1 {
+		return
+	}
+	name, ok := c.mirrorName(req.URL, contentType)
+	if !ok {
+		c.debug(req.Context(), "mirror error", "url", redactURL(req.URL), "error", "invalid mirror name")
+		return
+	}
+	if err := c.fs.MkdirAll(path.Dir(name), c.dirMode); err != nil {
+		c.debug(req.Context(), "mirror error", "name", name, "error", err)
+		return
+	}
+	if err := afero.WriteFile(c.fs, name, raw[i+n:], mode); err != nil {
+		c.debug(req.Context(), "mirror error", "name", name, "error", err)
+	}
+}
@@ -0,0 +1,104 @@
+package diskcache
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Normalization is a set of URL normalization rules.
+type Normalization uint
+
+// URL normalization rules.
+const (
+	// NormalizeCase lower cases the URL scheme and host.
+	NormalizeCase Normalization = 1 << iota
+	// NormalizeDefaultPort removes the default port for the URL scheme (:80
+	// for http, and :443 for https).
+	NormalizeDefaultPort
+	// NormalizeDotSegments resolves and removes . and .. path segments.
+	NormalizeDotSegments
+	// NormalizePercentEncoding decodes percent-encoded unreserved characters,
+	// upper cases the hex digits of percent-encoded characters, and
+	// canonically encodes the query parameters, retaining their order.
+	NormalizePercentEncoding
+	// NormalizeTrailingSlash removes trailing slashes from non-root paths.
+	NormalizeTrailingSlash
+	// NormalizeQueryOrder canonically encodes the query, sorting the query
+	// parameters by key. Parameters with the same key retain their order.
+	NormalizeQueryOrder
+)
+
+// NormalizeDefault is the default set of URL normalization rules.
+const NormalizeDefault = NormalizeCase | NormalizeDefaultPort | NormalizeDotSegments | NormalizePercentEncoding
+
+// normalizeURL returns a normalized copy of the URL.
+func normalizeURL(u *url.URL, n Normalization) *url.URL {
+	z := *u
+	if n&NormalizeCase != 0 {
+		z.Scheme, z.Host = strings.ToLower(z.Scheme), strings.ToLower(z.Host)
+	}
+	if n&NormalizeDefaultPort != 0 {
+		switch {
+		case z.Scheme == "http" && strings.HasSuffix(z.Host, ":80"):
+			z.Host = strings.TrimSuffix(z.Host, ":80")
+		case z.Scheme == "https" && strings.HasSuffix(z.Host, ":443"):
+			z.Host = strings.TrimSuffix(z.Host, ":443")
+		}
+	}
+	if n&NormalizeDotSegments != 0 && z.Path != "" {
+		p := path.Clean("/" + z.Path)
+		if strings.HasSuffix(z.Path, "/") && p != "/" {
+			p += "/"
+		}
+		z.Path, z.RawPath = p, ""
+	}
+	if n&NormalizePercentEncoding != 0 {
+		z.RawPath, z.RawQuery = "", normalizeQuery(z.RawQuery)
+	}
+	if n&NormalizeQueryOrder != 0 {
+		if q, err := url.ParseQuery(z.RawQuery); err == nil {
+			z.RawQuery = q.Encode()
+		}
+	}
+	if n&NormalizeTrailingSlash != 0 && len(z.Path) > 1 {
+		z.Path, z.RawPath = strings.TrimRight(z.Path, "/"), ""
+		if z.Path == "" {
+			z.Path = "/"
+		}
+	}
+	return &z
+}
+
+// normalizeQuery canonically encodes the keys and values of the raw query,
+// retaining their order. Parameters that cannot be decoded are left as-is.
+func normalizeQuery(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	params := strings.Split(raw, "&")
+	for i, param := range params {
+		k, v, ok := strings.Cut(param, "=")
+		k, err := url.QueryUnescape(k)
+		if err != nil {
+			continue
+		}
+		if v, err = url.QueryUnescape(v); err != nil {
+			continue
+		}
+		params[i] = url.QueryEscape(k)
+		if ok {
+			params[i] += "=" + url.QueryEscape(v)
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// normalizeRequest returns a shallow copy of the request with a normalized
+// URL.
+func normalizeRequest(req *http.Request, n Normalization) *http.Request {
+	z := *req
+	z.URL = normalizeURL(req.URL, n)
+	return &z
+}
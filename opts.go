@@ -3,15 +3,27 @@ package diskcache
 import (
 	"compress/gzip"
 	"compress/zlib"
+	"context"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"io/fs"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gobwas/glob"
 	"github.com/spf13/afero"
@@ -48,7 +60,8 @@ func WithMethod(method ...string) Option {
 		},
 		matcher: func(m *SimpleMatcher) error {
 			var err error
-			m.method, err = glob.Compile("{"+strings.Join(method, ",")+"}", ',')
+			m.methodPattern = "{" + strings.Join(method, ",") + "}"
+			m.method, err = glob.Compile(m.methodPattern, ',')
 			return err
 		},
 	}
@@ -64,6 +77,149 @@ func WithTransport(transport http.RoundTripper) Option {
 	}
 }
 
+// WithFetchMiddleware is a disk cache option to add middleware that wraps the
+// transport used for upstream fetches, such as for retries, circuit breaking,
+// or refreshing credentials. Middleware is only used when a request is
+// fetched (including unmatched requests passed to the transport), and not
+// when a request is served from the cache.
+//
+// Middleware is applied in the order added, with the first added being the
+// outermost, and wraps the transport set by WithTransport (or
+// http.DefaultTransport).
+func WithFetchMiddleware(middleware ...func(http.RoundTripper) http.RoundTripper) Option {
+	return option{
+		cache: func(c *Cache) error {
+			for _, f := range middleware {
+				if f == nil {
+					return errors.New("fetch middleware cannot be nil")
+				}
+			}
+			c.fetchMiddleware = append(c.fetchMiddleware, middleware...)
+			return nil
+		},
+	}
+}
+
+// WithProxy is a disk cache option to set the proxy used by the underlying
+// HTTP transport.
+//
+// Modifies a copy of the transport set by WithTransport when it is a
+// *http.Transport, otherwise a copy of http.DefaultTransport.
+func WithProxy(urlstr string) Option {
+	return withHTTPTransport(func(t *http.Transport) error {
+		u, err := url.Parse(urlstr)
+		if err != nil {
+			return err
+		}
+		t.Proxy = http.ProxyURL(u)
+		return nil
+	})
+}
+
+// WithInsecureSkipVerify is a disk cache option to disable TLS certificate
+// verification by the underlying HTTP transport.
+//
+// See WithProxy for how the underlying HTTP transport is modified.
+func WithInsecureSkipVerify() Option {
+	return withHTTPTransport(func(t *http.Transport) error {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = new(tls.Config)
+		}
+		t.TLSClientConfig.InsecureSkipVerify = true
+		return nil
+	})
+}
+
+// WithDialTimeout is a disk cache option to set the dial timeout used by the
+// underlying HTTP transport.
+//
+// See WithProxy for how the underlying HTTP transport is modified.
+func WithDialTimeout(timeout time.Duration) Option {
+	return withHTTPTransport(func(t *http.Transport) error {
+		t.DialContext = (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		return nil
+	})
+}
+
+// withHTTPTransport is a disk cache option that modifies a copy of the
+// underlying HTTP transport.
+func withHTTPTransport(f func(*http.Transport) error) Option {
+	return option{
+		cache: func(c *Cache) error {
+			var t *http.Transport
+			switch z := c.transport.(type) {
+			case nil:
+				dt, ok := http.DefaultTransport.(*http.Transport)
+				if !ok {
+					return fmt.Errorf("transport %T is not a *http.Transport", http.DefaultTransport)
+				}
+				t = dt.Clone()
+			case *http.Transport:
+				t = z.Clone()
+			default:
+				return fmt.Errorf("transport %T is not a *http.Transport", c.transport)
+			}
+			if err := f(t); err != nil {
+				return err
+			}
+			c.transport = t
+			return nil
+		},
+	}
+}
+
+// WithMaxConcurrentFetches is a disk cache option to limit the number of
+// concurrent requests executed by the underlying HTTP transport. Requests
+// for cached entries are not limited.
+//
+// A fetch is held until the response body has been read and stored.
+func WithMaxConcurrentFetches(n int) Option {
+	return option{
+		cache: func(c *Cache) error {
+			if n < 1 {
+				return fmt.Errorf("invalid max concurrent fetches %d", n)
+			}
+			c.fetches = make(chan struct{}, n)
+			return nil
+		},
+	}
+}
+
+// WithReadLimit is a disk cache option to set the maximum number of response
+// body bytes read from the upstream. Requests for responses with bodies
+// exceeding the limit fail with ErrReadLimit, and the response is not stored.
+//
+// Useful as a safety limit when caching responses from untrusted origins.
+func WithReadLimit(n int64) Option {
+	return option{
+		cache: func(c *Cache) error {
+			if n <= 0 {
+				return fmt.Errorf("invalid read limit %d", n)
+			}
+			c.readLimit = n
+			return nil
+		},
+	}
+}
+
+// WithRateLimiter is a disk cache option to set a rate limiter that is
+// consulted before every upstream fetch. When the limiter's Wait returns an
+// error, the error is wrapped with ErrRateLimited.
+//
+// Combine with WithServeStaleOnError to serve stale responses when the limit
+// has been exhausted.
+func WithRateLimiter(limiter RateLimiter) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.limiter = limiter
+			return nil
+		},
+	}
+}
+
 // WithMode is a disk cache option to set the file mode used when creating
 // files and directories on disk.
 func WithMode(dirMode, fileMode os.FileMode) Option {
@@ -75,6 +231,19 @@ func WithMode(dirMode, fileMode os.FileMode) Option {
 	}
 }
 
+// WithModeFunc is a disk cache option to set a func returning the file mode
+// used when creating the cache file (and its sidecar files) for a fetched
+// response, such as a stricter mode for responses with certain content types.
+// The file mode set by WithMode is used when the func returns 0.
+func WithModeFunc(f func(res *http.Response) os.FileMode) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.modeFunc = f
+			return nil
+		},
+	}
+}
+
 // WithFs is a disk cache option to set the afero fs used.
 //
 // See: https://github.com/spf13/afero
@@ -111,6 +280,19 @@ func WithBasePathFs(basePath string) Option {
 				return err
 			}
 			c.fs = afero.NewBasePathFs(afero.NewOsFs(), basePath)
+			c.basePath, c.basePathFs = basePath, c.fs
+			return nil
+		},
+	}
+}
+
+// WithRequireExplicitFs is a disk cache option that causes New to return an
+// error when no fs has been configured, instead of defaulting to
+// <working directory>/cache.
+func WithRequireExplicitFs() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.requireFs = true
 			return nil
 		},
 	}
@@ -119,10 +301,14 @@ func WithBasePathFs(basePath string) Option {
 // WithAppCacheDir is a disk cache option to set the afero fs used locked to
 // the user's cache directory joined with the app name and any passed paths.
 //
-// The afero base fs directory will typically be $HOME/.cache/<app>/paths...
+// The afero base fs directory will typically be $HOME/.cache/<app>/paths...,
+// or <root>/<app>/paths... when a root has been set with WithCacheRoot.
 func WithAppCacheDir(app string, paths ...string) Option {
 	return option{
 		cache: func(c *Cache) error {
+			if c.cacheRoot != "" {
+				return WithBasePathFs(filepath.Join(append([]string{c.cacheRoot, app}, paths...)...)).apply(c)
+			}
 			dir, err := UserCacheDir(append([]string{app}, paths...)...)
 			if err != nil {
 				return err
@@ -132,29 +318,1035 @@ func WithAppCacheDir(app string, paths ...string) Option {
 	}
 }
 
-// WithMatchers is a disk cache option to set matchers.
-func WithMatchers(matchers ...Matcher) Option {
+// WithCacheRoot is a disk cache option to set the root directory used by
+// WithAppCacheDir in place of the user's cache directory. Useful in
+// environments where the user's cache directory is not set or not writable.
+//
+// Must be passed prior to WithAppCacheDir.
+func WithCacheRoot(root string) Option {
 	return option{
 		cache: func(c *Cache) error {
-			c.matchers = matchers
+			c.cacheRoot = root
 			return nil
 		},
 	}
 }
 
-// WithDefaultMatcher is a disk cache option to set the default matcher.
-func WithDefaultMatcher(method, host, path, key string, opts ...Option) Option {
+// WithKeyPrefix is a disk cache option to set a prefix prepended to all keys
+// prior to storage in the fs. Useful for namespacing multiple caches sharing
+// the same fs.
+//
+// The prefix is joined to keys with a "/", so that all entries for the
+// prefix can be cleared by removing the prefix directory.
+func WithKeyPrefix(prefix string) Option {
 	return option{
 		cache: func(c *Cache) error {
-			m, err := NewSimpleMatcher(method, host, path, key, opts...)
-			if err != nil {
-				return err
+			c.keyPrefix = prefix
+			return nil
+		},
+	}
+}
+
+// WithSharding is a disk cache option to insert depth hash-derived
+// directories, each width hex characters long, before keys in the fs. Useful
+// for spreading large numbers of entries across directories.
+//
+// The shard directories are derived from the hash of the full key (ie, after
+// any long path handling), and are inserted after any key prefix. The depth
+// and width cannot exceed the length of the hex encoded hash. For
+// example, with a depth of 2 and width of 2, the key http/example.com/?index
+// would be stored as ab/cd/http/example.com/?index.
+func WithSharding(depth, width int) Option {
+	return option{
+		cache: func(c *Cache) error {
+			switch {
+			case depth < 0, width < 0:
+				return fmt.Errorf("invalid sharding depth %d or width %d", depth, width)
+			case depth != 0 && width == 0:
+				return errors.New("sharding width must be greater than 0")
 			}
-			x := &Cache{noDefault: true}
-			if err := m.apply(x); err != nil {
+			c.shardDepth, c.shardWidth = depth, width
+			return nil
+		},
+	}
+}
+
+// WithPathMapper is a disk cache option to set a func that maps keys to
+// storage paths in the fs, allowing an arbitrary storage layout. The mapping
+// must be deterministic, and mapped paths are cleaned to remain within the
+// fs. When set, WithSharding and WithHashedKeys are not
+// used. The key prefix is still applied to the mapped path.
+//
+// As keys cannot be recovered from mapped paths, Verify reports storage paths
+// relative to the key prefix in place of keys.
+func WithPathMapper(mapper func(key string) string) Option {
+	return option{
+		cache: func(c *Cache) error {
+			if mapper == nil {
+				return errors.New("path mapper cannot be nil")
+			}
+			c.pathMapper = mapper
+			return nil
+		},
+	}
+}
+
+// WithHashedKeys is a disk cache option to store entries using the hex encoded
+// hash of their key as the fs name, sharded into directories using the
+// sharding depth and width set with WithSharding, or 2 levels of 2 characters
+// when not set. Avoids path length limits and problematic characters on some
+// filesystems. The original key is stored in a sidecar file.
+func WithHashedKeys(h func() hash.Hash) Option {
+	return option{
+		cache: func(c *Cache) error {
+			if h == nil {
+				return errors.New("hash func cannot be nil")
+			}
+			c.keyHash = h
+			return nil
+		},
+	}
+}
+
+// WithHasher is a disk cache option to set the hash func used for hashing by
+// the disk cache, such as for long path keys, shard directories, fallback
+// names, body and vary keys, signature keys, and config versions. Defaults to
+// SHA-256.
+//
+// Changing the hasher changes the resulting keys and fs names, causing
+// previously stored entries with hashed keys or names to not be found, and
+// invalidates entries stored with config versioning. WithHashedKeys uses its
+// own hash func, and RequestSignature and the fixture names of WithRecordAll
+// always use SHA-256.
+func WithHasher(h func() hash.Hash) Option {
+	return option{
+		cache: func(c *Cache) error {
+			if h == nil {
+				return errors.New("hasher cannot be nil")
+			}
+			c.hasher = h
+			return nil
+		},
+	}
+}
+
+// WithStoreRequest is a disk cache option to store the request line and
+// headers of the request in each stored entry, prior to the response. Stored
+// requests are skipped when loading responses, and can be retrieved with
+// Cache.LoadRequest. Not used with WithFlatStorage.
+//
+// The passed headers are handled the same as with WithRecordRequest.
+func WithStoreRequest(headers ...string) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.storeRequests, c.storeHeaders = true, headers
+			return nil
+		},
+	}
+}
+
+// WithRecordRequest is a disk cache option to record the request line and
+// headers of the request for each stored entry in a sidecar file. Useful for
+// diagnosing matcher and key issues.
+//
+// When headers are passed, only the passed headers are recorded. Otherwise,
+// all headers other than sensitive headers (Authorization, Cookie,
+// Proxy-Authorization, X-Api-Key) are recorded. Sensitive headers are only
+// recorded when explicitly passed.
+//
+// See Cache.RecordedRequest.
+func WithRecordRequest(headers ...string) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.recordRequests, c.recordHeaders = true, headers
+			return nil
+		},
+	}
+}
+
+// WithAgeHeader is a disk cache option to add an Age header to responses
+// loaded from the cache, based on the last modified time of the cached entry.
+//
+// The Age header is not stored on disk.
+func WithAgeHeader() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.ageHeader = true
+			return nil
+		},
+	}
+}
+
+// WithServeStaleOnError is a disk cache option to serve the previously cached
+// entry when executing the request for a stale entry fails, such as during an
+// origin outage. Served entries have a "Warning: 111" header added.
+//
+// Only applies when a cached entry exists.
+func WithServeStaleOnError() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.serveStaleOnError = true
+			return nil
+		},
+	}
+}
+
+// WithServeStaleUpTo is a disk cache option to serve entries that became stale
+// less than window ago as cache hits without refetching, such as for rate
+// limited origins. Entries stale for longer than the window are refetched
+// normally. Served stale entries have a "Warning: 110" header added.
+//
+// An entry's expiry is determined first by the policy's TTL and expire func
+// (including TTLs added to the context), and the window is then applied past
+// that expiry. The window does not apply to policies with a stale func, to
+// forced fetches, or to entries stored in a different cache epoch. Stale and
+// Cached continue to report entries within the window as stale.
+func WithServeStaleUpTo(window time.Duration) Option {
+	return option{
+		cache: func(c *Cache) error {
+			if window < 0 {
+				return errors.New("stale window cannot be negative")
+			}
+			c.staleWindow = window
+			return nil
+		},
+	}
+}
+
+// WithRevalidateTimeout is a disk cache option to bound the time spent
+// refetching stale entries. When refetching a stale entry takes longer than
+// the timeout, or fails, the refetch is canceled and the stale entry is
+// served instead, with a "Warning: 111" header added, bounding tail latency
+// while still refreshing entries when the origin is responsive. Stale entries
+// are refetched again on the next request.
+//
+// Failed refetches of stale entries are served as with WithServeStaleOnError.
+// Entries within the window set by WithServeStaleUpTo are served without
+// refetching, and the timeout applies past the window. The timeout does not
+// apply to forced fetches (such as for validator retries or requests with
+// no-cache directives), to entries not yet cached, or to background refreshes.
+func WithRevalidateTimeout(d time.Duration) Option {
+	return option{
+		cache: func(c *Cache) error {
+			if d < 0 {
+				return errors.New("revalidate timeout cannot be negative")
+			}
+			c.revalidateTimeout = d
+			return nil
+		},
+	}
+}
+
+// WithCacheEmptyBodies is a disk cache option to store responses with empty
+// bodies, such as 204 No Content responses, when the marshaled response is
+// empty, as is the case with WithFlatStorage. By default, empty marshaled
+// responses are not stored.
+//
+// Only responses with an empty body from the upstream are stored. Responses
+// with bodies emptied by body transformers (such as truncators) are still not
+// stored.
+func WithCacheEmptyBodies() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.cacheEmptyBodies = true
+			return nil
+		},
+	}
+}
+
+// WithRespectRequestCacheControl is a disk cache option to honor the
+// Cache-Control directives of requests. Requests with no-cache or max-age=0
+// are revalidated (refetched), and requests with no-store bypass the cache.
+func WithRespectRequestCacheControl() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.respectCacheControl = true
+			return nil
+		},
+	}
+}
+
+// WithSafeMethodsOnly is a disk cache option to refuse caching requests with
+// unsafe methods, even when matched, passing them directly to the transport.
+// Only GET, HEAD, and OPTIONS requests, and POST requests keyed by their body
+// by a simple matcher (see WithBodyKeyForContentTypes), are cached. Requests
+// with other methods, such as PUT, DELETE, or PATCH, are never cached, even
+// when allowed by WithMethod.
+//
+// Guards against a misconfigured matcher caching mutating requests.
+func WithSafeMethodsOnly() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.safeMethodsOnly = true
+			return nil
+		},
+	}
+}
+
+// WithPreferCachedOnServerError is a disk cache option to serve the
+// previously cached entry when refetching a stale or forced entry returns a
+// server error, instead of the error response. The cached entry is not
+// overwritten, and a Warning header is added to the served response. When no
+// status codes are passed, all 5xx status codes are considered server errors.
+//
+// Entries refetched due to a validator's Retry are handled the same way.
+func WithPreferCachedOnServerError(codes ...int) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.preferCached, c.preferCachedCodes = true, codes
+			return nil
+		},
+	}
+}
+
+// WithLFHeaders is a disk cache option to store response header blocks with
+// LF line endings instead of CRLF line endings. Header blocks are converted
+// back to CRLF line endings when loaded.
+//
+// Note: changes the format of entries stored on disk.
+func WithLFHeaders() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.lfHeaders = true
+			return nil
+		},
+	}
+}
+
+// WithExtensionFromContentType is a disk cache option to append a file
+// extension derived from the response content type (such as .html or .json)
+// to entries stored in the fs. Useful when inspecting cached entries by hand.
+//
+// As the content type is not known until the response has been retrieved,
+// the extension is recorded in a sidecar file, which is read on every lookup.
+// Entries are stored with a ~ marker before the extension (for example,
+// data~.json), so that keys differing only by an extension (for example,
+// /data and /data.json) do not collide.
+func WithExtensionFromContentType() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.extFromContentType = true
+			return nil
+		},
+	}
+}
+
+// WithMirrorLayout is a disk cache option to additionally write the body of
+// stored successful GET responses to a browsable, wget-style mirror in the
+// ?mirror directory of the cache fs, such as ?mirror/example.com/index.html
+// for https://example.com/. The mirror path is made of the request URL's host
+// and path, with index.html for directories, the query (when present), and an
+// extension derived from the response content type when the path does not
+// have an extension.
+//
+// The mirror supplements the normal cache layout, which is still used for
+// loading entries. Mirror copies are written on a best-effort basis, are not
+// removed when entries are evicted, and are not included in FS, Verify, or
+// similar walks of the cache fs. Remove the ?mirror directory to clear the
+// mirror.
+func WithMirrorLayout() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.mirror = true
+			return nil
+		},
+	}
+}
+
+// WithResumableDownloads is a disk cache option to resume interrupted
+// downloads of GET responses, such as for very large resources. The body of
+// a fetched response is recorded to a partial download in the ?resume
+// directory of the cache fs as it is read, and when the download is
+// interrupted (the upstream connection fails, or the body is closed before
+// being fully read), the next fetch of the entry requests only the remainder
+// of the body with a Range request, assembling the full body from the partial
+// download and the range response. The partial download is removed once the
+// body has been fully read.
+//
+// Only 200 responses with a strong ETag or a Last-Modified header are resumed,
+// which is sent as If-Range, so a changed resource is refetched in full.
+// Responses transparently decompressed by the transport cannot be resumed.
+func WithResumableDownloads() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.resumeDownloads = true
+			return nil
+		},
+	}
+}
+
+// WithFailOpen is a disk cache option to return the fetched response when
+// storing the response fails due to a fs error, such as when the cache fs is
+// full or not writable, rather than failing the request. Store errors are
+// logged as debug messages (see WithLogger), and the response is not cached.
+// Marshal errors are still returned.
+//
+// When failing open, responses without body transformers or a marshaler are
+// buffered in memory before being stored, rather than streamed directly to
+// disk. Tee streamed responses (see WithTeeStreaming) are passed through
+// uncached when the partial cache file cannot be created.
+//
+// By default, store errors are returned.
+func WithFailOpen() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.failOpen = true
+			return nil
+		},
+	}
+}
+
+// WithURLNormalization is a disk cache option to normalize request URLs prior
+// to matching, so that equivalent URLs map to the same key. Uses
+// NormalizeDefault when no rules are passed.
+//
+// Only the URL used for matching is normalized, requests are executed using
+// the original URL.
+func WithURLNormalization(rules ...Normalization) Option {
+	n := NormalizeDefault
+	if len(rules) != 0 {
+		n = 0
+		for _, rule := range rules {
+			n |= rule
+		}
+	}
+	return option{
+		cache: func(c *Cache) error {
+			c.normalization = n
+			return nil
+		},
+	}
+}
+
+// WithIndex is a disk cache option to maintain an in-memory index of stored
+// entries and their last modified times, avoiding a fs stat when checking
+// staleness. The index is built by walking the fs when the cache is created,
+// and is updated when entries are stored or evicted.
+//
+// Changes made to the fs outside of the cache are not reflected in the index
+// until it is rescanned. When rescan is non-zero, the index is rescanned on
+// the first lookup after the rescan interval has elapsed, with other lookups
+// made during the rescan using the existing index.
+func WithIndex(rescan time.Duration) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.index = &index{rescan: rescan}
+			return nil
+		},
+	}
+}
+
+// WithMaxIdleAge is a disk cache option to track the last time entries were
+// read, so that entries not read within the max idle age can be evicted with
+// EvictIdle.
+//
+// As many filesystems do not track access times, last read times are tracked
+// (best-effort) using sidecar files in the ?atime directory of the fs.
+func WithMaxIdleAge(maxIdleAge time.Duration) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.maxIdleAge = maxIdleAge
+			return nil
+		},
+	}
+}
+
+// WithHostFromHeader is a disk cache option to match requests using the
+// request's Host header (see http.Request.Host), falling back to the URL host
+// when not set. Useful when requests are routed to backends by address, such
+// as behind a proxy or CDN.
+//
+// Only the host used for matching is changed, requests are executed using the
+// original URL.
+func WithHostFromHeader() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.hostFromHeader = true
+			return nil
+		},
+	}
+}
+
+// WithAliasResolver is a disk cache option to set a func that resolves the
+// canonical URL for a request prior to matching, so that aliased URLs share
+// the same key. When the func returns nil, the request URL is used.
+//
+// Only the URL used for matching is resolved, requests are executed using
+// the original URL. The resolved URL is normalized when used with
+// WithURLNormalization.
+func WithAliasResolver(resolver func(*http.Request) *url.URL) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.aliasResolver = resolver
+			return nil
+		},
+	}
+}
+
+// WithStrictTransformPriorities is a disk cache option to return an error
+// when a matcher's body transformers have duplicate transform priorities.
+// Without it, duplicate transform priorities are logged as a warning, and the
+// body transformers are applied in registration order.
+func WithStrictTransformPriorities() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.strictPriorities = true
+			return nil
+		},
+	}
+}
+
+// WithLogger is a disk cache option to set a logger for debug messages, such
+// as when requests are matched, entries are stale, or entries are stored or
+// evicted.
+//
+// Header values are never logged, and logged request URLs do not include user
+// info or query strings.
+func WithLogger(logger *slog.Logger) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.logger = logger
+			return nil
+		},
+	}
+}
+
+// WithReplay is a disk cache option to only replay stored responses. Entries
+// never expire, requests are never executed, and ErrNotCached is returned for
+// requests without a stored entry.
+//
+// See NewReplayer.
+func WithReplay() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.replay = true
+			return nil
+		},
+	}
+}
+
+// WithRecordAll is a disk cache option to record every response returned by
+// the cache, including responses for requests not matched by any matcher,
+// as fixtures in the directory of the fs. Fixtures are keyed by the request
+// method, host, and a hash of the request URL (with sorted query parameters)
+// and body, and are recorded independently of normal caching: matched
+// requests are still stored and loaded using their matched key and policy.
+//
+// Recorded fixtures can be replayed with NewFixtureReplayer.
+func WithRecordAll(dir string) Option {
+	return option{
+		cache: func(c *Cache) error {
+			dir = strings.Trim(path.Clean("/"+dir), "/")
+			if dir == "" {
+				return errors.New("record all directory cannot be empty")
+			}
+			c.recordDir = dir
+			return nil
+		},
+	}
+}
+
+// WithContentTypeOverride is a disk cache option to set a func that
+// overrides the content type of responses, such as for origins that send an
+// incorrect or missing Content-Type. The func is passed the request URL and
+// the received content type, and returns the content type passed to body
+// transformers. When rewriteHeader is true, the stored Content-Type header is
+// also replaced with the returned content type.
+func WithContentTypeOverride(f func(urlstr, got string) string, rewriteHeader bool) Option {
+	return option{
+		cache: func(c *Cache) error {
+			if f == nil {
+				return errors.New("content type override func cannot be nil")
+			}
+			c.contentTypeOverride, c.contentTypeHeader = f, rewriteHeader
+			return nil
+		},
+	}
+}
+
+// WithInjectHeaders is a disk cache option to set headers injected into
+// responses for matched requests, such as X-Cache for tracing. The onHit
+// headers are injected into responses served from the cache, and the onMiss
+// headers into responses fetched from the upstream. Injected headers replace
+// any existing response headers with the same name, and are not stored.
+// Occurrences of {{key}} in header values are replaced with the cache key.
+//
+// Example:
+//
+//	diskcache.WithInjectHeaders(
+//		http.Header{"X-Cache": {"HIT"}, "X-Cache-Key": {"{{key}}"}},
+//		http.Header{"X-Cache": {"MISS"}, "X-Cache-Key": {"{{key}}"}},
+//	)
+func WithInjectHeaders(onHit, onMiss http.Header) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.injectHit, c.injectMiss = onHit.Clone(), onMiss.Clone()
+			return nil
+		},
+	}
+}
+
+// WithCacheEpoch is a disk cache option to set the cache epoch, such as a
+// deploy version. The epoch is recorded with each stored entry, and entries
+// stored with a different (or no) epoch are stale. Changing the epoch
+// invalidates all entries without removing them, allowing entries to be
+// reused when the epoch is reverted, such as on rollback.
+func WithCacheEpoch(epoch string) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.epoch = epoch
+			return nil
+		},
+	}
+}
+
+// WithResponseRewriters is a disk cache option to add response rewriters,
+// applied in order to fetched responses prior to any header or body
+// transformers, and prior to determining whether the response status code is
+// cacheable.
+func WithResponseRewriters(rewriters ...ResponseRewriter) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.rewriters = append(c.rewriters, rewriters...)
+			return nil
+		},
+	}
+}
+
+// WithResponseRewriter is a disk cache option to add a response rewriter
+// func.
+//
+// See WithResponseRewriters.
+func WithResponseRewriter(f func(*http.Response) (*http.Response, error)) Option {
+	return WithResponseRewriters(ResponseRewriterFunc(f))
+}
+
+// WithBufferPool is a disk cache option to set the pool of *bytes.Buffer used
+// when transforming and storing responses, allowing a pool to be shared with
+// other subsystems. Buffers retrieved from the pool are always reset prior to
+// use, and the pool's New func may be nil. A package level pool is used by
+// default.
+func WithBufferPool(pool *sync.Pool) Option {
+	return option{
+		cache: func(c *Cache) error {
+			if pool == nil {
+				return errors.New("buffer pool cannot be nil")
+			}
+			c.bufferPool = pool
+			return nil
+		},
+	}
+}
+
+// WithHTTPCacheImport is a disk cache option to import entries stored in the
+// fs by github.com/gregjones/httpcache's diskcache, allowing an existing
+// httpcache disk cache to be used when migrating. When the cache does not
+// have an entry for a request, and the httpcache fs has a fresh entry for the
+// request, the entry is stored in the cache as if it had been fetched, and
+// retains its last modified time. Entries are only read from the httpcache
+// fs, and are never written to it.
+func WithHTTPCacheImport(fs afero.Fs) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.httpcacheFs = fs
+			return nil
+		},
+	}
+}
+
+// WithLowerCaseKeys is a disk cache option to lower case keys prior to
+// mapping keys to fs names.
+//
+// Keys are case sensitive, but on case-insensitive file systems (such as the
+// defaults for macOS and Windows), keys differing only by case, such as
+// http/example.com/Path and http/example.com/path, map to the same file, and
+// overwrite each other. Lower casing keys makes the behavior consistent
+// across platforms, with keys differing only by case always sharing the same
+// entry.
+func WithLowerCaseKeys() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.lowerCaseKeys = true
+			return nil
+		},
+	}
+}
+
+// WithOnTheFlyCompression is a disk cache option to gzip compress responses
+// loaded from the cache when the request's Accept-Encoding accepts gzip,
+// allowing entries to be stored uncompressed (and readable) on disk while
+// still saving network bandwidth. Responses that already have a
+// Content-Encoding are never compressed.
+//
+// Only responses with one of the content types are compressed, or when no
+// content types are passed, common text content types. Content types that are
+// already compressed, such as image/png, should not be included.
+func WithOnTheFlyCompression(contentTypes ...string) Option {
+	return option{
+		cache: func(c *Cache) error {
+			if len(contentTypes) == 0 {
+				contentTypes = []string{
+					"application/javascript",
+					"application/json",
+					"application/xml",
+					"image/svg+xml",
+					"text/css",
+					"text/csv",
+					"text/html",
+					"text/javascript",
+					"text/plain",
+					"text/xml",
+				}
+			}
+			c.compressTypes = contentTypes
+			return nil
+		},
+	}
+}
+
+// WithPolicyRefiner is a disk cache option to set a func that refines the
+// matched cache policy for a fetched response, such as to compress text
+// responses but store images raw. The func is called immediately after the
+// response has been fetched, prior to applying any of the policy's header or
+// body transformers, and should not read the response body. The refined
+// policy's Fs and Validator are ignored.
+//
+// When loading stored entries, the matched policy's MarshalUnmarshaler is
+// used, except for entries stored uncompressed, or compressed with gzip,
+// zlib, or bzip2 when the matched policy does not have a MarshalUnmarshaler,
+// which are detected automatically.
+func WithPolicyRefiner(f func(res *http.Response, p Policy) Policy) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.policyRefiner = f
+			return nil
+		},
+	}
+}
+
+// WithKeyFinalizer is a disk cache option to set a func that computes the
+// actual storage key for a fetched response from the matched key, such as to
+// store entries by a canonical URL from a response header. The func is called
+// after the response has been fetched and rewritten, and should not read the
+// response body.
+//
+// The final key cannot be recomputed without fetching the response, so the
+// final key is recorded in a sidecar file next to the matched key, and Load,
+// Mod, Evict, and other lookups by the matched key follow the recorded final
+// key. Lookups must therefore always use the matched key: an entry is only
+// found by its matched key after it has been stored through the cache, and
+// the func must be deterministic for a matched key and response, as the
+// recorded final key is replaced each time the response is fetched. Multiple
+// matched keys may share the same final key.
+func WithKeyFinalizer(f func(key string, res *http.Response) string) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.keyFinalizer = f
+			return nil
+		},
+	}
+}
+
+// WithAutoCompression is a disk cache option to choose the marshaler for each
+// fetched response by the response's content type, such as to compress text
+// and JSON, but store images raw. Rules are keyed by content type glob (such
+// as text/* or application/*json), with more specific (longer) globs
+// consulted first. A nil marshaler stores matching responses raw. Responses
+// not matching any rule are stored with the policy's marshaler.
+//
+// Entries stored with a rule's marshaler are prefixed with a short marker
+// line identifying the rule, so that entries are loaded with the correct
+// marshaler. Entries whose rule has since been removed are refetched. Rules
+// cannot use a FlatMarshalUnmarshaler.
+//
+// Auto compression is applied after the policy refiner (see
+// WithPolicyRefiner).
+func WithAutoCompression(rules map[string]MarshalUnmarshaler) Option {
+	return option{
+		cache: func(c *Cache) error {
+			var err error
+			c.codecRules, err = newCodecRules(rules)
+			return err
+		},
+	}
+}
+
+// WithCompressionPassthrough is a disk cache option to store responses whose
+// bodies were already encoded by the upstream (with a Content-Encoding such
+// as gzip) as-is, skipping the policy's marshaler, such as set by
+// WithGzipCompression, as compressing an already compressed body only costs
+// CPU. The response is served with its Content-Encoding header intact.
+//
+// Entries stored as-is are prefixed with a short marker line, so that they
+// are loaded without the policy's unmarshaler. Other responses are stored
+// with the policy's marshaler.
+func WithCompressionPassthrough() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.compressionPassthrough = true
+			return nil
+		},
+	}
+}
+
+// WithWalkConcurrency is a disk cache option to set the maximum number of
+// entries opened and processed in parallel by bulk operations, such as
+// Verify and EvictIdle. Defaults to 1, where entries are processed one at a
+// time. Entries are always closed before being released to the next entry.
+//
+// Export writes a single tarball, and always processes entries one at a
+// time.
+func WithWalkConcurrency(n int) Option {
+	return option{
+		cache: func(c *Cache) error {
+			if n < 1 {
+				return errors.New("walk concurrency must be greater than 0")
+			}
+			c.walkConcurrency = n
+			return nil
+		},
+	}
+}
+
+// WithBackgroundRefresh is a disk cache option to keep the stored entries for
+// the requests fresh, independent of request traffic, by refreshing the
+// requests in a background goroutine started by New. The requests are
+// refreshed immediately, and then every interval. After consecutive
+// failures, the interval is doubled for each failure (up to 32 times the
+// interval), and is reset after the next successful refresh.
+//
+// The background goroutine is stopped by Close. Only applies when passed to
+// New.
+//
+// See Cache.Refresh.
+func WithBackgroundRefresh(interval time.Duration, reqs ...*http.Request) Option {
+	return option{
+		cache: func(c *Cache) error {
+			switch {
+			case interval <= 0:
+				return errors.New("background refresh interval must be greater than 0")
+			case len(reqs) == 0:
+				return errors.New("background refresh requests cannot be empty")
+			case c.refresher != nil && c.refresher.cancel != nil:
+				return errors.New("background refresh already started")
+			}
+			c.refresher = &refresher{interval: interval, reqs: reqs}
+			return nil
+		},
+	}
+}
+
+// WithTeeStreaming is a disk cache option to stream fetched response bodies
+// to the client while they are written to the cache, instead of returning
+// the response once it has been fully stored. Only applies to responses that
+// are stored without body transformers, a marshaler, a response filter, a
+// body validator, or a store predicate, and when there are no response
+// rewriters.
+//
+// The entry is written to a partial cache file, and is only committed to the
+// cache once the client has read the full body. Entries are not committed
+// when the body is closed before being fully read, when an error occurs, or
+// when the cache has been closed or its fs swapped with SwapFs.
+func WithTeeStreaming() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.teeStreaming = true
+			return nil
+		},
+	}
+}
+
+// WithSyncWrites is a disk cache option to sync stored entries to stable
+// storage before returning, so that a stored entry is not lost or corrupted
+// by a crash. Syncing adds significant latency to every write, and is a no-op
+// for fs backends that do not support syncing, such as afero.MemMapFs.
+func WithSyncWrites() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.syncWrites = true
+			return nil
+		},
+	}
+}
+
+// WithConfigVersion is a disk cache option to invalidate entries stored under
+// a different configuration. A hash of the version and the matched policy's
+// header transformers, body transformers (and their priorities), and
+// marshaler is recorded in a sidecar file when storing entries. Entries whose
+// recorded hash differs from the current configuration, or that have no
+// recorded hash (such as entries stored prior to enabling the option), are
+// stale, and are refetched under the current configuration.
+//
+// Transformers are identified by type, name (see Named), and priority, so
+// changes to a transformer's settings are not detected. Change the version
+// to invalidate entries after such changes. The hash is of the matched
+// policy, prior to changes made for the response by a policy refiner, auto
+// compression, or compression passthrough.
+func WithConfigVersion(version string) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.configVersioning, c.configVersion = true, version
+			return nil
+		},
+	}
+}
+
+// WithStoredTimestamp is a disk cache option to record the fetch time of
+// stored entries in a sidecar file, which is preferred over the fs last
+// modified time when determining staleness, such as by Mod and Stale. Useful
+// when the cache fs is backed up or restored with tools that do not preserve
+// last modified times. Entries without a stored fetch time, such as entries
+// stored prior to enabling the option, use the fs last modified time.
+//
+// Reading the fetch time requires reading the sidecar file, even when the
+// index is enabled.
+func WithStoredTimestamp() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.storedTimestamp = true
+			return nil
+		},
+	}
+}
+
+// WithSkipUnchangedWrites is a disk cache option to avoid rewriting stored
+// entries that have not changed when refetched. When the refetched response
+// has the same ETag and headers as the stored entry, or when the buffered
+// response is the same as the stored entry, the stored entry's last modified
+// time is updated in place of rewriting the entry. Responses are compared
+// after header transformers have been applied, ignoring the Date and
+// Content-Length headers, and entries are rewritten when any other header has
+// changed. ETags are compared using the weak comparison function, so a weak
+// ETag (W/"...") matches a strong ETag with the same opaque tag.
+func WithSkipUnchangedWrites() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.skipUnchanged = true
+			return nil
+		},
+	}
+}
+
+// WithMemoryLayer is a disk cache option to keep up to maxEntries recently
+// loaded and stored responses in memory, in a least recently used cache.
+// Responses are kept unmarshaled, and are used in place of reading the fs when
+// the last modified time of the stored entry has not changed. The memory layer
+// is safe for concurrent use.
+func WithMemoryLayer(maxEntries int) Option {
+	return option{
+		cache: func(c *Cache) error {
+			if maxEntries <= 0 {
+				return fmt.Errorf("invalid max entries %d", maxEntries)
+			}
+			c.memory = newMemory(maxEntries)
+			return nil
+		},
+	}
+}
+
+// WithCompressionStats is a disk cache option to track the aggregate sizes of
+// stored responses before and after marshaling, by content type.
+//
+// See Cache.CompressionStats.
+func WithCompressionStats() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.compressionStats = &compressionStats{stats: make(map[string]CompressionStat)}
+			return nil
+		},
+	}
+}
+
+// WithMatchers is a disk cache option to set matchers.
+func WithMatchers(matchers ...Matcher) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.matchers = matchers
+			return nil
+		},
+	}
+}
+
+// WithDefaultMatcher is a disk cache option to set the default matcher.
+func WithDefaultMatcher(method, host, path, key string, opts ...Option) Option {
+	return option{
+		cache: func(c *Cache) error {
+			m, err := NewSimpleMatcher(method, host, path, key, opts...)
+			if err != nil {
+				return err
+			}
+			x := &Cache{noDefault: true}
+			if err := m.apply(x); err != nil {
+				return err
+			}
+			c.matcher = x.matchers[0].(*SimpleMatcher)
+			return nil
+		},
+	}
+}
+
+// WithMatcherPriority is a simple matcher option to set the matcher's
+// priority. Matchers are evaluated in priority order (lowest first), with
+// ties broken by registration order. The default matcher is always evaluated
+// last.
+func WithMatcherPriority(priority int) Option {
+	return option{
+		cache: func(*Cache) error {
+			return errors.New("WithMatcherPriority can only be used with a SimpleMatcher")
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.priority = priority
+			return nil
+		},
+	}
+}
+
+// WithMatcherFs is a disk cache option to set the fs used for storing
+// responses for a SimpleMatcher, overriding the cache fs. Allows responses to
+// be stored on separate fs's, such as for tiered storage.
+//
+// The index and maintenance methods that walk the cache fs (Export, Import,
+// EvictIdle, Verify) only use the cache fs.
+func WithMatcherFs(fs afero.Fs) Option {
+	return option{
+		cache: func(*Cache) error {
+			return errors.New("WithMatcherFs can only be used with a SimpleMatcher")
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.Fs = fs
+			return nil
+		},
+	}
+}
+
+// WithPathBlacklist is a disk cache option to exclude requests with paths
+// matching any of the globs, such as /admin/** or /logout, from being
+// matched. Excluded requests are not cached. In globs, * does not match
+// across path separators, while ** does.
+func WithPathBlacklist(globs ...string) Option {
+	var blacklist []glob.Glob
+	var err error
+	for _, s := range globs {
+		var g glob.Glob
+		if g, err = glob.Compile(s, '/'); err != nil {
+			err = fmt.Errorf("invalid path glob %q: %w", s, err)
+			break
+		}
+		blacklist = append(blacklist, g)
+	}
+	return option{
+		cache: func(c *Cache) error {
+			if err != nil {
+				return err
+			}
+			c.matcher.pathBlacklist = append(c.matcher.pathBlacklist, blacklist...)
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			if err != nil {
 				return err
 			}
-			c.matcher = x.matchers[0].(*SimpleMatcher)
+			m.pathBlacklist = append(m.pathBlacklist, blacklist...)
 			return nil
 		},
 	}
@@ -225,6 +1417,30 @@ func WithHeaderWhitelist(whitelist ...string) Option {
 	}
 }
 
+// WithRedactHeaders is a disk cache option to add a header transformer that
+// replaces the values of any header in the list with "[redacted]", retaining
+// the header names and count.
+func WithRedactHeaders(headers ...string) Option {
+	var pairs []string
+	for _, header := range headers {
+		pairs = append(pairs, "("+regexp.QuoteMeta(header)+`):.*?`, "$1: [redacted]")
+	}
+	headerTransformer, err := NewHeaderTransformer(pairs...)
+	if err != nil {
+		panic(err)
+	}
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.HeaderTransformers = append(c.matcher.policy.HeaderTransformers, headerTransformer)
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.HeaderTransformers = append(m.policy.HeaderTransformers, headerTransformer)
+			return nil
+		},
+	}
+}
+
 // WithHeaderTransform is a disk cache option to add a header transformer that
 // transforms headers matching the provided regexp pairs and replacements.
 func WithHeaderTransform(pairs ...string) Option {
@@ -258,6 +1474,83 @@ func WithBodyTransformers(bodyTransformers ...BodyTransformer) Option {
 	}
 }
 
+// WithBodyTransformFunc is a disk cache option to add a body transformer func
+// with the specified priority.
+func WithBodyTransformFunc(priority TransformPriority, f func(w io.Writer, r io.Reader, urlstr string, code int, contentType string) (bool, error)) Option {
+	t := priorityBodyTransformer{
+		BodyTransformerFunc: f,
+		priority:            priority,
+	}
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.BodyTransformers = append(c.matcher.policy.BodyTransformers, t)
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.BodyTransformers = append(m.policy.BodyTransformers, t)
+			return nil
+		},
+	}
+}
+
+// WithBodyTransformContextFunc is a disk cache option to add a context body
+// transformer func with the transform priority, that is passed the request
+// and response.
+//
+// See ContextBodyTransformer.
+func WithBodyTransformContextFunc(priority TransformPriority, f func(ctx context.Context, w io.Writer, r io.Reader, req *http.Request, res *http.Response) (bool, error)) Option {
+	t := priorityContextBodyTransformer{
+		ContextBodyTransformerFunc: f,
+		priority:                   priority,
+	}
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.BodyTransformers = append(c.matcher.policy.BodyTransformers, t)
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.BodyTransformers = append(m.policy.BodyTransformers, t)
+			return nil
+		},
+	}
+}
+
+// WithTransformTrace is a disk cache option to set a func that is called
+// after each body transformer is applied, with the transformer's name, the
+// number of bytes read and written, and whether the transformer
+// short-circuited the remaining transformers.
+//
+// The name is the transformer's Name when it satisfies the Named interface,
+// otherwise its type.
+func WithTransformTrace(trace func(name string, before, after int, shortCircuit bool)) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.transformTrace = trace
+			return nil
+		},
+	}
+}
+
+// WithMaxTransformMemory is a disk cache option to set the maximum number of
+// bytes of in-flight body data buffered by the body transformer chain, being
+// the combined size of a body transformer's buffered input and its output.
+// Requests for responses exceeding the limit fail with a TransformError
+// wrapping ErrTransformMemory, and the response is not stored.
+//
+// Useful to bound the memory used when transforming large responses, such as
+// large minifiable documents.
+func WithMaxTransformMemory(n int64) Option {
+	return option{
+		cache: func(c *Cache) error {
+			if n <= 0 {
+				return fmt.Errorf("invalid max transform memory %d", n)
+			}
+			c.maxTransformMemory = n
+			return nil
+		},
+	}
+}
+
 // WithMinifier is a disk cache option to add a body transformer that does
 // content minification of HTML, XML, SVG, JavaScript, JSON, and CSS data.
 // Useful for reducing disk storage sizes.
@@ -279,6 +1572,167 @@ func WithMinifier() Option {
 	}
 }
 
+// WithHTMLStrip is a disk cache option to add a body transformer that removes
+// scripts, comments, and styles from HTML content, prior to minification.
+// Removing scripts also removes inline event handler attributes.
+//
+// Use WithBodyTransformers with a HTMLStripper for finer grained control.
+func WithHTMLStrip(removeScripts, removeComments, removeStyles bool) Option {
+	t := HTMLStripper{
+		Priority:            TransformPriorityModify,
+		RemoveScripts:       removeScripts,
+		RemoveComments:      removeComments,
+		RemoveStyles:        removeStyles,
+		RemoveEventHandlers: removeScripts,
+	}
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.BodyTransformers = append(c.matcher.policy.BodyTransformers, t)
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.BodyTransformers = append(m.policy.BodyTransformers, t)
+			return nil
+		},
+	}
+}
+
+// WithImageOptimizer is a disk cache option to add a body transformer that
+// re-encodes JPEG and PNG images, stripping image metadata, and downscaling
+// images larger than the max dimension (when non-zero). Other image formats,
+// such as WebP, are stored unmodified.
+//
+// See ImageTransformer.
+func WithImageOptimizer(maxDimension, quality int) Option {
+	t := ImageTransformer{
+		Priority:     TransformPriorityModify,
+		MaxDimension: maxDimension,
+		Quality:      quality,
+	}
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.BodyTransformers = append(c.matcher.policy.BodyTransformers, t)
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.BodyTransformers = append(m.policy.BodyTransformers, t)
+			return nil
+		},
+	}
+}
+
+// WithJSONCanonical is a disk cache option to add a body transformer that
+// re-encodes JSON content with sorted object keys, prior to minification.
+// When no content types are passed, application/json content is
+// canonicalized.
+//
+// Note: the stored body will not be byte-for-byte identical to the original
+// response.
+func WithJSONCanonical(contentTypes ...string) Option {
+	if len(contentTypes) == 0 {
+		contentTypes = []string{"application/json"}
+	}
+	t := JSONCanonicalizer{
+		Priority:     TransformPriorityModify,
+		ContentTypes: contentTypes,
+	}
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.BodyTransformers = append(c.matcher.policy.BodyTransformers, t)
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.BodyTransformers = append(m.policy.BodyTransformers, t)
+			return nil
+		},
+	}
+}
+
+// WithWhitespaceNormalize is a disk cache option to add a body transformer
+// that normalizes whitespace in text content. When no content types are
+// passed, text/plain and text/csv content is normalized.
+//
+// See WhitespaceNormalizer.
+func WithWhitespaceNormalize(contentTypes ...string) Option {
+	if len(contentTypes) == 0 {
+		contentTypes = []string{"text/plain", "text/csv"}
+	}
+	t := WhitespaceNormalizer{
+		Priority:     TransformPriorityModify,
+		ContentTypes: contentTypes,
+	}
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.BodyTransformers = append(c.matcher.policy.BodyTransformers, t)
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.BodyTransformers = append(m.policy.BodyTransformers, t)
+			return nil
+		},
+	}
+}
+
+// WithNDJSON is a disk cache option to add a body transformer that validates
+// and minifies newline delimited JSON (NDJSON) content line by line.
+// Responses with invalid lines are not stored, and ErrInvalidBody is
+// returned.
+//
+// The transformer has a transform priority just before
+// TransformPriorityMinify, so that it can be used together with WithMinifier.
+//
+// Use WithBodyTransformers with a NDJSONMinifier for finer grained control,
+// such as dropping invalid lines.
+func WithNDJSON() Option {
+	t := NDJSONMinifier{
+		Priority: TransformPriorityMinify - 1,
+		Minify:   true,
+	}
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.BodyTransformers = append(c.matcher.policy.BodyTransformers, t)
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.BodyTransformers = append(m.policy.BodyTransformers, t)
+			return nil
+		},
+	}
+}
+
+// WithURLRewriter is a disk cache option to add a body transformer that
+// rewrites absolute references to the base URL's host in HTML and CSS content
+// to relative references, prior to minification.
+//
+// See URLRewriter.
+func WithURLRewriter(base string, rules ...func(*url.URL) *url.URL) Option {
+	u, err := url.Parse(base)
+	if err == nil && u.Host == "" {
+		err = fmt.Errorf("base url %q has no host", base)
+	}
+	t := URLRewriter{
+		Priority: TransformPriorityModify,
+		Base:     u,
+		Rules:    rules,
+	}
+	return option{
+		cache: func(c *Cache) error {
+			if err != nil {
+				return err
+			}
+			c.matcher.policy.BodyTransformers = append(c.matcher.policy.BodyTransformers, t)
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			if err != nil {
+				return err
+			}
+			m.policy.BodyTransformers = append(m.policy.BodyTransformers, t)
+			return nil
+		},
+	}
+}
+
 // WithTruncator is a disk cache option to add a body transformer that
 // truncates responses based on match criteria.
 func WithTruncator(priority TransformPriority, match func(string, int, string) bool) Option {
@@ -321,6 +1775,8 @@ func WithStatusCodeTruncator(statusCodes ...int) Option {
 
 // WithErrorTruncator is a disk cache option to add a body transformer that
 // truncates responses when the HTTP status code != OK (200).
+//
+// See WithErrorPlaceholder to store a placeholder body instead.
 func WithErrorTruncator() Option {
 	t := Truncator{
 		Priority: TransformPriorityFirst,
@@ -340,6 +1796,47 @@ func WithErrorTruncator() Option {
 	}
 }
 
+// WithErrorPlaceholder is a disk cache option to add a body transformer that
+// replaces the body of responses when the HTTP status code != OK (200) with
+// the placeholder, allowing a stored error to be distinguished from an empty
+// successful response. When contentType is not empty, it replaces the
+// Content-Type header of the stored response.
+//
+// The placeholder is matched in the same way as WithErrorTruncator, and is
+// used in its place. When both are used, the one added first applies, as
+// both short-circuit any remaining body transformers. To store a placeholder
+// for other match criteria, use a Truncator with a Placeholder.
+func WithErrorPlaceholder(body []byte, contentType string) Option {
+	t := Truncator{
+		Priority: TransformPriorityFirst,
+		Match: func(_ string, code int, _ string) bool {
+			return code != http.StatusOK
+		},
+		Placeholder: append([]byte{}, body...),
+	}
+	var h []HeaderTransformer
+	if contentType != "" {
+		h = append(h, HeaderTransformerFunc(func(buf []byte) []byte {
+			if statusCode(buf) == http.StatusOK {
+				return buf
+			}
+			return addHeader(stripContentTypeHeader(buf), "Content-Type", contentType)
+		}))
+	}
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.HeaderTransformers = append(c.matcher.policy.HeaderTransformers, h...)
+			c.matcher.policy.BodyTransformers = append(c.matcher.policy.BodyTransformers, t)
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.HeaderTransformers = append(m.policy.HeaderTransformers, h...)
+			m.policy.BodyTransformers = append(m.policy.BodyTransformers, t)
+			return nil
+		},
+	}
+}
+
 // WithBase64Decoder is a disk cache option to add a body transformer that does
 // base64 decoding of responses for specific content types.
 func WithBase64Decoder(contentTypes ...string) Option {
@@ -372,16 +1869,155 @@ func WithPrefixStripper(prefix []byte, contentTypes ...string) Option {
 	}
 	return option{
 		cache: func(c *Cache) error {
-			c.matcher.policy.BodyTransformers = append(c.matcher.policy.BodyTransformers, t)
+			c.matcher.policy.BodyTransformers = append(c.matcher.policy.BodyTransformers, t)
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.BodyTransformers = append(m.policy.BodyTransformers, t)
+			return nil
+		},
+	}
+}
+
+// WithResponseFilter is a disk cache option to set a response filter that
+// determines whether or not a response is stored. Responses for which the
+// filter returns false are returned, but are not stored.
+//
+// The filter is called after all header and body transformers have been
+// applied, and is passed the response as it would be stored on disk.
+func WithResponseFilter(filter func(*http.Request, *http.Response) bool) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.ResponseFilter = filter
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.ResponseFilter = filter
+			return nil
+		},
+	}
+}
+
+// WithStorePredicate is a disk cache option to set a predicate that is passed
+// the key, the exact bytes about to be written to the fs (after body
+// transformers and marshaling), and the response as it would be stored.
+// Responses are returned, but not stored, when the predicate returns false.
+func WithStorePredicate(predicate func(key string, data []byte, res *http.Response) bool) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.StorePredicate = predicate
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.StorePredicate = predicate
+			return nil
+		},
+	}
+}
+
+// WithCacheableStatusCodes is a disk cache option to set the status codes of
+// responses that are stored. Responses with other status codes are returned,
+// but not stored.
+func WithCacheableStatusCodes(statusCodes ...int) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.CacheableStatusCodes = statusCodes
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.CacheableStatusCodes = statusCodes
+			return nil
+		},
+	}
+}
+
+// WithStoreContentTypes is a disk cache option to set the content type globs
+// (such as text/* or application/json) of responses that are stored.
+// Responses with other content types are returned, but not stored.
+//
+// See WithSkipContentTypes.
+func WithStoreContentTypes(globs ...string) Option {
+	return contentTypesOption("store", globs, func(p *Policy, v []glob.Glob) {
+		p.storeContentTypes = v
+	})
+}
+
+// WithSkipContentTypes is a disk cache option to set the content type globs
+// (such as video/* or image/*) of responses that are not stored, regardless
+// of status code. Responses with the content types are returned, but not
+// stored. Takes precedence over WithStoreContentTypes.
+func WithSkipContentTypes(globs ...string) Option {
+	return contentTypesOption("skip", globs, func(p *Policy, v []glob.Glob) {
+		p.skipContentTypes = v
+	})
+}
+
+// contentTypesOption creates a policy option that compiles the content type
+// globs, and sets them using f.
+func contentTypesOption(name string, globs []string, f func(*Policy, []glob.Glob)) Option {
+	compile := func() ([]glob.Glob, error) {
+		if len(globs) == 0 {
+			return nil, fmt.Errorf("%s content types cannot be empty", name)
+		}
+		var v []glob.Glob
+		for _, s := range globs {
+			g, err := glob.Compile(strings.ToLower(s), '/')
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s content type %q: %w", name, s, err)
+			}
+			v = append(v, g)
+		}
+		return v, nil
+	}
+	return option{
+		cache: func(c *Cache) error {
+			v, err := compile()
+			if err != nil {
+				return err
+			}
+			f(&c.matcher.policy, v)
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			v, err := compile()
+			if err != nil {
+				return err
+			}
+			f(&m.policy, v)
+			return nil
+		},
+	}
+}
+
+// WithBodyValidator is a disk cache option to set a body validator that
+// validates response bodies after body transformers have been applied.
+// Responses with invalid bodies are not stored, and ErrInvalidBody is
+// returned. Use with WithServeStaleOnError to serve the previously cached
+// entry instead.
+func WithBodyValidator(validator func(body []byte, contentType string) bool) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.BodyValidator = validator
 			return nil
 		},
 		matcher: func(m *SimpleMatcher) error {
-			m.policy.BodyTransformers = append(m.policy.BodyTransformers, t)
+			m.policy.BodyValidator = validator
 			return nil
 		},
 	}
 }
 
+// WithValidJSON is a disk cache option to set a body validator that verifies
+// JSON content is valid JSON.
+func WithValidJSON() Option {
+	return WithBodyValidator(func(body []byte, contentType string) bool {
+		if i := strings.Index(contentType, ";"); i != -1 {
+			contentType = contentType[:i]
+		}
+		return !jsonContentTypeRE.MatchString(strings.TrimSpace(contentType)) || json.Valid(body)
+	})
+}
+
 // WithMarshalUnmarshaler is a disk cache option to set a marshaler/unmarshaler.
 func WithMarshalUnmarshaler(marshalUnmarshaler MarshalUnmarshaler) Option {
 	return option{
@@ -396,6 +2032,28 @@ func WithMarshalUnmarshaler(marshalUnmarshaler MarshalUnmarshaler) Option {
 	}
 }
 
+// WithFormat is a disk cache option to set the marshaler/unmarshaler to the
+// entry format registered for the tag with RegisterFormat. Entries are stored
+// with a short format tag line, and entries with other format tags are loaded
+// with their registered format. The marshaler of previously stored (untagged)
+// entries is detected from the entry's leading bytes, for plain, gzip, zlib,
+// and bzip2 entries, with other untagged entries being refetched.
+func WithFormat(tag byte) Option {
+	z := formatMarshalUnmarshaler{tag: tag}
+	return option{
+		cache: func(c *Cache) error {
+			return WithFormat(tag).apply(c.matcher)
+		},
+		matcher: func(m *SimpleMatcher) error {
+			if _, ok := lookupFormat(tag); !ok {
+				return fmt.Errorf("format %#02x not registered", tag)
+			}
+			m.policy.MarshalUnmarshaler = z
+			return nil
+		},
+	}
+}
+
 // WithGzipCompression is a disk cache option to set a gzip marshaler/unmarshaler.
 func WithGzipCompression() Option {
 	z := GzipMarshalUnmarshaler{
@@ -413,6 +2071,26 @@ func WithGzipCompression() Option {
 	}
 }
 
+// WithHeaderGzipCompression is a disk cache option to set a gzip
+// marshaler/unmarshaler that only compresses the header block.
+//
+// See HeaderGzipMarshalUnmarshaler.
+func WithHeaderGzipCompression() Option {
+	z := HeaderGzipMarshalUnmarshaler{
+		Level: gzip.DefaultCompression,
+	}
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.MarshalUnmarshaler = z
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.MarshalUnmarshaler = z
+			return nil
+		},
+	}
+}
+
 // WithZlibCompression is a disk cache option to set a zlib marshaler/unmarshaler.
 func WithZlibCompression() Option {
 	z := ZlibMarshalUnmarshaler{
@@ -448,6 +2126,80 @@ func WithFlatStorage() Option {
 	}
 }
 
+// WithLazyBody is a disk cache option to unmarshal stored entries on demand
+// as loaded responses are read, instead of unmarshaling the entire entry
+// before returning the response. Useful when loaded response bodies are
+// often discarded, as entries stored with a marshaler (such as with
+// WithGzipCompression) are only decompressed as far as they are read.
+// Closing the response body releases the entry's file.
+//
+// As entries are not fully unmarshaled prior to being returned, corrupt
+// entries may only be detected when reading the response body, with the read
+// error wrapping ErrCorruptEntry. Not used with WithLFHeaders or
+// WithMemoryLayer. Marshalers that buffer the entire entry when unmarshaling
+// (such as the flat marshalers) do not benefit.
+func WithLazyBody() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.lazyBody = true
+			return nil
+		},
+	}
+}
+
+// WithFlatKeepHeaders is a disk cache option to keep the named response
+// headers (such as Content-Type and Content-Length) when using flat storage,
+// storing them in a minimal header block prior to the body, and restoring them
+// when loading. Must be used after WithFlatStorage, WithFlatChain,
+// WithFlatGzipCompression, or WithFlatZlibCompression.
+//
+// Changing the kept headers will cause previously stored entries to fail to
+// load.
+func WithFlatKeepHeaders(names ...string) Option {
+	keep := func(z MarshalUnmarshaler) (MarshalUnmarshaler, error) {
+		flat, ok := z.(FlatMarshalUnmarshaler)
+		if !ok {
+			return nil, errors.New("flat keep headers requires flat storage")
+		}
+		flat.Headers = append([]string{}, names...)
+		return flat, nil
+	}
+	return option{
+		cache: func(c *Cache) error {
+			z, err := keep(c.matcher.policy.MarshalUnmarshaler)
+			if err != nil {
+				return err
+			}
+			c.matcher.policy.MarshalUnmarshaler = z
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			z, err := keep(m.policy.MarshalUnmarshaler)
+			if err != nil {
+				return err
+			}
+			m.policy.MarshalUnmarshaler = z
+			return nil
+		},
+	}
+}
+
+// WithWARCStorage is a disk cache option to set a WARC marshaler/unmarshaler,
+// storing responses as WARC response records.
+func WithWARCStorage() Option {
+	z := WARCMarshalUnmarshaler{}
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.MarshalUnmarshaler = z
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.MarshalUnmarshaler = z
+			return nil
+		},
+	}
+}
+
 // WithFlatChain is a disk cache option that marshals/unmarshals responses,
 // removing headers from responses, and chaining marshaling/unmarshaling to a
 // provided marshaler/unmarshaler.
@@ -501,15 +2253,116 @@ func WithTTL(ttl time.Duration) Option {
 	}
 }
 
+// WithMatcherLabel is a disk cache option to set the cache policy label,
+// allowing the policy's TTL to be overridden independently of other policies
+// with WithContextLabelTTL.
+func WithMatcherLabel(label string) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.Label = label
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.Label = label
+			return nil
+		},
+	}
+}
+
+// WithExpireAt is a disk cache option to set an absolute expiry time for the
+// cache policy. Entries last modified prior to the expiry time are stale once
+// the expiry time has passed.
+//
+// When used with a TTL, the earlier of the two expiry times is used.
+func WithExpireAt(expires time.Time) Option {
+	return WithExpireFunc(func(mod time.Time) time.Time {
+		if mod.Before(expires) {
+			return expires
+		}
+		return time.Time{}
+	})
+}
+
+// WithExpireFunc is a disk cache option to set a func that returns the
+// absolute expiry time for an entry based on its last modified time. The func
+// should return a zero time for entries that do not expire.
+//
+// For example, to expire all entries at midnight UTC:
+//
+//	WithExpireFunc(func(mod time.Time) time.Time {
+//		return mod.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+//	})
+//
+// When used with a TTL, the earlier of the two expiry times is used.
+func WithExpireFunc(f func(time.Time) time.Time) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.ExpireFunc = f
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.ExpireFunc = f
+			return nil
+		},
+	}
+}
+
+// WithScheduleTTL is a disk cache option to set a func that returns the TTL
+// for the cache policy based on the current time, allowing freshness to vary
+// by time of day. The func is called each time staleness is determined.
+//
+// For example, to cache for an hour during business hours, and otherwise
+// always refetch:
+//
+//	WithScheduleTTL(func(now time.Time) time.Duration {
+//		if h := now.Hour(); 9 <= h && h < 17 {
+//			return 1 * time.Hour
+//		}
+//		return 1 * time.Nanosecond
+//	})
+//
+// The returned TTL takes precedence over the TTL set by WithTTL, but is
+// overridden by TTLs added to the context with WithContextTTL or
+// WithContextLabelTTL. A zero TTL indicates no expiry.
+func WithScheduleTTL(f func(now time.Time) time.Duration) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.ScheduleTTL = f
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.ScheduleTTL = f
+			return nil
+		},
+	}
+}
+
+// WithStaleFunc is a disk cache option to set a func that determines whether
+// or not an existing entry is stale, in place of the default TTL and expiry
+// comparison. The func is passed the entry's last modified time and the
+// effective TTL (including any context TTL).
+func WithStaleFunc(f func(ctx context.Context, key string, mod time.Time, ttl time.Duration) (bool, error)) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.policy.StaleFunc = f
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.policy.StaleFunc = f
+			return nil
+		},
+	}
+}
+
 // WithIndexPath is a disk cache option to set the index path name.
 func WithIndexPath(indexPath string) Option {
 	return option{
 		cache: func(c *Cache) error {
-			c.matcher.indexPath = indexPath
+			c.matcher.indexPath, c.matcher.defaultIndex = indexPath, false
 			return nil
 		},
 		matcher: func(m *SimpleMatcher) error {
-			m.indexPath = indexPath
+			m.indexPath, m.defaultIndex = indexPath, false
 			return nil
 		},
 	}
@@ -519,11 +2372,58 @@ func WithIndexPath(indexPath string) Option {
 func WithLongPathHandler(longPathHandler func(string) string) Option {
 	return option{
 		cache: func(c *Cache) error {
-			c.matcher.longPathHandler = longPathHandler
+			c.matcher.longPathHandler, c.matcher.defaultLong, c.matcher.maxKeyLength = longPathHandler, false, 0
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.longPathHandler, m.defaultLong, m.maxKeyLength = longPathHandler, false, 0
+			return nil
+		},
+	}
+}
+
+// WithMaxKeyLength is a disk cache option to set a long path handler that
+// bounds keys to n characters, keeping keys readable. Keys longer than n are
+// truncated to the first keepPrefix characters, followed by a ~ and the hex
+// encoded hash of the full key. The prefix is shortened to leave room for the
+// hash, and an error is returned when n cannot hold the hash of the hasher
+// set with WithHasher (65 characters for the default SHA-256 hasher).
+func WithMaxKeyLength(n, keepPrefix int) Option {
+	handler := func(m *SimpleMatcher) func(string) string {
+		return func(key string) string {
+			if len(key) <= n {
+				return key
+			}
+			sum := m.hasher.Sum([]byte(key))
+			i := max(min(keepPrefix, n-1-len(sum)), 0)
+			for i > 0 && !utf8.RuneStart(key[i]) {
+				i--
+			}
+			return key[:i] + "~" + sum
+		}
+	}
+	check := func(h Hasher) error {
+		switch {
+		case keepPrefix < 0:
+			return fmt.Errorf("invalid max key length prefix %d", keepPrefix)
+		case n < h.hexLen()+1:
+			return fmt.Errorf("max key length %d cannot hold hash length %d", n, h.hexLen())
+		}
+		return nil
+	}
+	return option{
+		cache: func(c *Cache) error {
+			if err := check(c.hasher); err != nil {
+				return err
+			}
+			c.matcher.longPathHandler, c.matcher.defaultLong, c.matcher.maxKeyLength = handler(c.matcher), false, n
 			return nil
 		},
 		matcher: func(m *SimpleMatcher) error {
-			m.longPathHandler = longPathHandler
+			if err := check(m.hasher); err != nil {
+				return err
+			}
+			m.longPathHandler, m.defaultLong, m.maxKeyLength = handler(m), false, n
 			return nil
 		},
 	}
@@ -533,11 +2433,11 @@ func WithLongPathHandler(longPathHandler func(string) string) Option {
 func WithQueryEncoder(queryEncoder func(url.Values) string) Option {
 	return option{
 		cache: func(c *Cache) error {
-			c.matcher.queryEncoder = queryEncoder
+			c.matcher.queryEncoder, c.matcher.defaultQuery = queryEncoder, false
 			return nil
 		},
 		matcher: func(m *SimpleMatcher) error {
-			m.queryEncoder = queryEncoder
+			m.queryEncoder, m.defaultQuery = queryEncoder, false
 			return nil
 		},
 	}
@@ -548,7 +2448,13 @@ func WithQueryEncoder(queryEncoder func(url.Values) string) Option {
 //
 // The query string encoder can be limited to only the passed fields.
 func WithQueryPrefix(prefix string, fields ...string) Option {
-	f := func(v url.Values) string {
+	return WithQueryEncoder(queryPrefixEncoder(prefix, fields...))
+}
+
+// queryPrefixEncoder returns a query encoder that adds the prefix to the
+// non-empty and canonical encoding of the passed fields (or all fields).
+func queryPrefixEncoder(prefix string, fields ...string) func(url.Values) string {
+	return func(v url.Values) string {
 		if len(fields) > 0 {
 			for k := range v {
 				if !contains(fields, k) {
@@ -561,13 +2467,230 @@ func WithQueryPrefix(prefix string, fields ...string) Option {
 		}
 		return ""
 	}
+}
+
+// WithIndexStrategy is a disk cache option to set the strategy for entries
+// whose fs name collides with a stored entry or directory, such as /foo being
+// stored as a file, when /foo/bar is later stored (or the reverse). By
+// default, storing a colliding entry returns ErrKeyCollision. With IndexHash,
+// colliding entries are instead stored under a fallback name.
+//
+// The fallback name is not used for entries stored with
+// WithExtensionFromContentType. Some fs's, such as afero.MemMapFs, do not
+// return an error when storing colliding entries.
+func WithIndexStrategy(strategy IndexStrategy) Option {
+	return option{
+		cache: func(c *Cache) error {
+			switch strategy {
+			case IndexError, IndexHash:
+			default:
+				return fmt.Errorf("invalid index strategy %d", strategy)
+			}
+			c.indexStrategy = strategy
+			return nil
+		},
+	}
+}
+
+// WithVersioning is a disk cache option to keep the last n historical
+// versions of each stored entry, such as for auditing changes to an upstream
+// resource over time. The latest version is stored as usual, and each stored
+// entry is also copied to a version sidecar directory, named by the time it
+// was stored. Versions beyond n are removed, oldest first, and entries stored
+// unchanged from the latest version are not copied again.
+//
+// Load, Stale, and the TTL apply only to the latest version. Historical
+// versions never expire, and are removed when the entry is evicted. Use
+// Cache.Versions and Cache.LoadVersion to retrieve historical versions.
+func WithVersioning(n int) Option {
+	return option{
+		cache: func(c *Cache) error {
+			if n < 1 {
+				return errors.New("versions must be greater than 0")
+			}
+			c.versions = n
+			return nil
+		},
+	}
+}
+
+// WithKeyDelimiter is a disk cache option to set the index path, long path,
+// and query prefix markers used in keys by the default matcher, and by
+// matchers created with MatchHost and MatchHostPath, replacing the default
+// ?index, ?long/, and _ markers. As ? is not a valid file name character on
+// Windows, and needs to be quoted in most shells, markers such as @index and
+// @long/ make the cache portable across platforms and tooling.
+//
+// Markers customized with WithIndexPath, WithQueryPrefix, WithQueryEncoder,
+// or WithLongPathHandler are not replaced. Changing the markers changes the
+// keys of stored entries, so a single cache should not mix markers.
+//
+// Only the index path, long path, and query prefix markers are replaced. The
+// ?body=, ?vary=, ?preflight=, and ?sig= key suffixes, the ?collision
+// directory, and sidecar file directories (such as ?atime and ?keys) always
+// contain a ?, so a cache using those features is not fully portable.
+func WithKeyDelimiter(index, long, queryPrefix string) Option {
+	return option{
+		cache: func(c *Cache) error {
+			if index == "" || long == "" {
+				return errors.New("index and long path delimiters cannot be empty")
+			}
+			c.keyDelimiters = &keyDelimiters{index: index, long: long, query: queryPrefix}
+			return nil
+		},
+	}
+}
+
+// WithFragmentInKey is a disk cache option to include the URL fragment in the
+// key, by appending the {{fragment}} token to the key template when not
+// already present. Non-empty fragments are escaped and added to the key with
+// a "#" prefix, and requests with an empty fragment use the key without a
+// fragment.
+//
+// Fragments are never sent to an origin, so this is only useful when the
+// cache is used as a local or archival document cache, such as for
+// single-page apps that encode state in the fragment.
+func WithFragmentInKey() Option {
+	return option{
+		cache: func(c *Cache) error {
+			return WithFragmentInKey().apply(c.matcher)
+		},
+		matcher: func(m *SimpleMatcher) error {
+			if !strings.Contains(m.key, "{{fragment}}") {
+				m.key += "{{fragment}}"
+			}
+			return nil
+		},
+	}
+}
+
+// WithQuerySort is a disk cache option to sort the values of each query field
+// prior to being passed to the query encoder, so that the order of repeated
+// query fields does not change the key.
+//
+// Query values are only used in keys when a query encoder has been set, such
+// as with WithQueryPrefix or WithQueryEncoder.
+func WithQuerySort() Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.querySort = true
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.querySort = true
+			return nil
+		},
+	}
+}
+
+// WithIgnoreQueryParams is a disk cache option to remove the named query
+// fields (such as utm_source or gclid) prior to being passed to the query
+// encoder, so that requests differing only by the named fields share the same
+// key. The request is not modified, and the fields are still sent upstream.
+//
+// Query values are only used in keys when a query encoder has been set, such
+// as with WithQueryPrefix or WithQueryEncoder.
+func WithIgnoreQueryParams(names ...string) Option {
+	return option{
+		cache: func(c *Cache) error {
+			c.matcher.ignoreQuery = append(c.matcher.ignoreQuery, names...)
+			return nil
+		},
+		matcher: func(m *SimpleMatcher) error {
+			m.ignoreQuery = append(m.ignoreQuery, names...)
+			return nil
+		},
+	}
+}
+
+// WithBodyKeyForContentTypes is a disk cache option to include a hash of the
+// request body in the key for requests with one of the content types, such
+// as application/json or application/graphql. The request body is buffered
+// and restored only for requests with a matching content type, and other
+// requests are keyed by URL alone.
+//
+// Use with WithMethod to match POST requests.
+func WithBodyKeyForContentTypes(contentTypes ...string) Option {
+	return option{
+		cache: func(c *Cache) error {
+			return WithBodyKeyForContentTypes(contentTypes...).apply(c.matcher)
+		},
+		matcher: func(m *SimpleMatcher) error {
+			if len(contentTypes) == 0 {
+				return errors.New("body key content types cannot be empty")
+			}
+			m.bodyKeyTypes = contentTypes
+			return nil
+		},
+	}
+}
+
+// WithNormalizedVaryKey is a disk cache option to include a hash of the
+// values of the request headers in the key, such as Accept-Language or
+// Accept. The hash is appended to the key as a fixed length token, keeping
+// paths short for any number of varying headers. The header values for stored
+// entries are recorded in a sidecar file, and can be retrieved with
+// Cache.VaryValues.
+func WithNormalizedVaryKey(headers ...string) Option {
+	return option{
+		cache: func(c *Cache) error {
+			return WithNormalizedVaryKey(headers...).apply(c.matcher)
+		},
+		matcher: func(m *SimpleMatcher) error {
+			if len(headers) == 0 {
+				return errors.New("vary headers cannot be empty")
+			}
+			m.varyHeaders = make([]string, len(headers))
+			for i, k := range headers {
+				m.varyHeaders[i] = http.CanonicalHeaderKey(k)
+			}
+			m.policy.Vary = m.varyHeaders
+			return nil
+		},
+	}
+}
+
+// WithPreflight is a disk cache option to cache CORS preflight responses,
+// matching OPTIONS requests in addition to the matched methods. Keys for
+// OPTIONS requests include a hash of the request's Origin,
+// Access-Control-Request-Method, and Access-Control-Request-Headers, as
+// preflight responses vary by them.
+//
+// The TTL of stored preflight responses with an Access-Control-Max-Age is the
+// max age, in place of the policy's TTL, and a max age of 0 is always stale.
+// The max age is recorded in a sidecar file when storing. TTLs added to the
+// context still take precedence.
+func WithPreflight() Option {
 	return option{
 		cache: func(c *Cache) error {
-			c.matcher.queryEncoder = f
+			return WithPreflight().apply(c.matcher)
+		},
+		matcher: func(m *SimpleMatcher) error {
+			if !m.method.Match("OPTIONS") {
+				if err := WithMethod(m.methodPattern, "OPTIONS").apply(m); err != nil {
+					return err
+				}
+			}
+			m.preflight, m.policy.preflight = true, true
 			return nil
 		},
+	}
+}
+
+// WithSignatureKey is a disk cache option to include the request signature
+// in the key, made of the request method, the normalized request URL, the
+// values of the request headers, and when includeBody is true, a hash of the
+// request body, for exact request matching as used by request recorders.
+// The signature is appended to the key as a fixed length token.
+//
+// See RequestSignature.
+func WithSignatureKey(includeBody bool, headers ...string) Option {
+	return option{
+		cache: func(c *Cache) error {
+			return WithSignatureKey(includeBody, headers...).apply(c.matcher)
+		},
 		matcher: func(m *SimpleMatcher) error {
-			m.queryEncoder = f
+			m.signature, m.sigHeaders, m.sigBody = true, headers, includeBody
 			return nil
 		},
 	}
@@ -602,6 +2725,33 @@ func WithValidatorFunc(f ValidatorFunc) Option {
 	}
 }
 
+// WithMinContentLength is a disk cache option to set the cache policy
+// validator to one that refetches 200 responses with a body shorter than n
+// bytes, such as truncated responses from a misbehaving upstream, for
+// responses with one of the content types (or all responses, when no content
+// types are passed). Short responses are refetched up to 3 times, after which
+// ErrContentTooShort is returned, and the short response is not cached.
+//
+// The body length is determined by the response's Content-Length when
+// present, otherwise up to n bytes of the body are buffered.
+func WithMinContentLength(n int64, contentTypes ...string) Option {
+	return WithValidator(NewRequestValidator(func(req *http.Request, res *http.Response, _ time.Time, _ bool, count int) (Validity, error) {
+		if req.Method == "HEAD" || res.StatusCode != http.StatusOK || !matchContentType(contentTypes, res.Header.Get("Content-Type")) {
+			return Valid, nil
+		}
+		short, err := shortBody(res, n)
+		switch {
+		case err != nil:
+			return Error, err
+		case !short:
+			return Valid, nil
+		case count < minContentLengthRetries:
+			return Retry, nil
+		}
+		return Error, fmt.Errorf("%w: %s", ErrContentTooShort, redactURL(req.URL))
+	}))
+}
+
 // WithContentTypeTTL is a disk cache option to set the cache policy TTL for
 // matching content types.
 func WithContentTypeTTL(ttl time.Duration, contentTypes ...string) Option {
@@ -613,6 +2763,32 @@ func WithContentTypeTTL(ttl time.Duration, contentTypes ...string) Option {
 	})
 }
 
+// WithRetryAfter is a disk cache option to set the cache policy validator to
+// one that retries 429 Too Many Requests responses, and 503 Service
+// Unavailable responses with a Retry-After header, up to max retries, waiting
+// the delay in the Retry-After header (either a number of seconds, or a
+// HTTP-date) before each retry. 429 responses without a valid Retry-After
+// header are retried after 1 second. Waiting stops when the request's context
+// is done. Retried responses are not cached, while the last response is
+// returned (and cached, per the cache policy) when the retries are exhausted.
+// The Retry-After header of responses loaded from the cache is ignored, as the
+// delay is relative to when the response was fetched.
+func WithRetryAfter(maxRetries int) Option {
+	return WithValidator(NewRequestValidator(func(_ *http.Request, res *http.Response, _ time.Time, cached bool, count int) (Validity, error) {
+		if cached || count >= maxRetries {
+			return Valid, nil
+		}
+		d, ok := parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+		switch {
+		case res.StatusCode == http.StatusTooManyRequests && !ok:
+			return Retry, RetryDelay(defaultRetryAfter)
+		case res.StatusCode == http.StatusTooManyRequests, res.StatusCode == http.StatusServiceUnavailable && ok:
+			return Retry, RetryDelay(d)
+		}
+		return Valid, nil
+	}))
+}
+
 // WithRetryStatusCode is a disk cache option to add a validator to the cache
 // policy that retries when the response status is not the expected status.
 func WithRetryStatusCode(retries int, expected ...int) Option {
@@ -0,0 +1,41 @@
+package diskcache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// encodedMagic is the marker line of entries stored with
+// WithCompressionPassthrough, whose bodies were already encoded by the
+// upstream (such as with gzip), and are stored as-is without the policy's
+// marshaler.
+const encodedMagic = "DISKCACHE-ENCODED\n"
+
+// encodedMarshalUnmarshaler stores entries as-is, prefixed with the encoded
+// marker line.
+type encodedMarshalUnmarshaler struct{}
+
+// Marshal satisfies the MarshalUnmarshaler interface.
+func (encodedMarshalUnmarshaler) Marshal(w io.Writer, r io.Reader) error {
+	if _, err := io.WriteString(w, encodedMagic); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, r)
+	return err
+}
+
+// Unmarshal satisfies the MarshalUnmarshaler interface.
+func (encodedMarshalUnmarshaler) Unmarshal(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	switch {
+	case err != nil:
+		return err
+	case line != encodedMagic:
+		return fmt.Errorf("invalid encoded marker %q", strings.TrimSpace(line))
+	}
+	_, err = io.Copy(w, br)
+	return err
+}
@@ -0,0 +1,137 @@
+package diskcache
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"sync"
+)
+
+// compression writer pools, by compression level.
+var (
+	gzipWriters [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+	zlibWriters [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+)
+
+// compression reader pools.
+var (
+	gzipReaders sync.Pool
+	zlibReaders sync.Pool
+)
+
+// defaultBufferPool is the default buffer pool.
+var defaultBufferPool = &sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+// maxPooledBuffer is the maximum capacity of buffers returned to a buffer
+// pool, preventing large responses from being retained.
+const maxPooledBuffer = 1 << 20
+
+// getBuffer returns a reset buffer from the pool.
+func getBuffer(pool *sync.Pool) *bytes.Buffer {
+	if b, ok := pool.Get().(*bytes.Buffer); ok {
+		b.Reset()
+		return b
+	}
+	return new(bytes.Buffer)
+}
+
+// putBuffer returns the buffer to the pool.
+func putBuffer(pool *sync.Pool, b *bytes.Buffer) {
+	if b != nil && b.Cap() <= maxPooledBuffer {
+		pool.Put(b)
+	}
+}
+
+// validLevel returns whether or not the compression level is valid.
+func validLevel(level int) bool {
+	return flate.HuffmanOnly <= level && level <= flate.BestCompression
+}
+
+// getGzipWriter returns a pooled gzip writer for the level, writing to w.
+func getGzipWriter(w io.Writer, level int) (*gzip.Writer, error) {
+	if !validLevel(level) {
+		return gzip.NewWriterLevel(w, level)
+	}
+	if v := gzipWriters[level-flate.HuffmanOnly].Get(); v != nil {
+		wr := v.(*gzip.Writer)
+		wr.Reset(w)
+		return wr, nil
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+// putGzipWriter returns the gzip writer for the level to the pool.
+func putGzipWriter(wr *gzip.Writer, level int) {
+	if validLevel(level) {
+		gzipWriters[level-flate.HuffmanOnly].Put(wr)
+	}
+}
+
+// getGzipReader returns a pooled gzip reader, reading from r.
+func getGzipReader(r io.Reader) (*gzip.Reader, error) {
+	if v := gzipReaders.Get(); v != nil {
+		rd := v.(*gzip.Reader)
+		if err := rd.Reset(r); err != nil {
+			gzipReaders.Put(rd)
+			return nil, err
+		}
+		return rd, nil
+	}
+	return gzip.NewReader(r)
+}
+
+// putGzipReader returns the gzip reader to the pool.
+func putGzipReader(rd *gzip.Reader) {
+	gzipReaders.Put(rd)
+}
+
+// getZlibWriter returns a zlib writer for the level and dictionary, writing
+// to w. Writers are only pooled when there is no dictionary.
+func getZlibWriter(w io.Writer, level int, dict []byte) (*zlib.Writer, error) {
+	if dict != nil || !validLevel(level) {
+		return zlib.NewWriterLevelDict(w, level, dict)
+	}
+	if v := zlibWriters[level-flate.HuffmanOnly].Get(); v != nil {
+		wr := v.(*zlib.Writer)
+		wr.Reset(w)
+		return wr, nil
+	}
+	return zlib.NewWriterLevel(w, level)
+}
+
+// putZlibWriter returns the zlib writer for the level and dictionary to the
+// pool.
+func putZlibWriter(wr *zlib.Writer, level int, dict []byte) {
+	if dict == nil && validLevel(level) {
+		zlibWriters[level-flate.HuffmanOnly].Put(wr)
+	}
+}
+
+// getZlibReader returns a zlib reader for the dictionary, reading from r.
+// Readers are only pooled when there is no dictionary.
+func getZlibReader(r io.Reader, dict []byte) (io.ReadCloser, error) {
+	if dict == nil {
+		if v := zlibReaders.Get(); v != nil {
+			rd := v.(io.ReadCloser)
+			if err := rd.(zlib.Resetter).Reset(r, nil); err != nil {
+				zlibReaders.Put(rd)
+				return nil, err
+			}
+			return rd, nil
+		}
+	}
+	return zlib.NewReaderDict(r, dict)
+}
+
+// putZlibReader returns the zlib reader for the dictionary to the pool.
+func putZlibReader(rd io.ReadCloser, dict []byte) {
+	if dict == nil {
+		zlibReaders.Put(rd)
+	}
+}
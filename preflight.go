@@ -0,0 +1,79 @@
+package diskcache
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// preflightDir is the directory for preflight max age sidecar files.
+const preflightDir = "?preflight"
+
+// preflightName returns the fs name of the preflight max age sidecar file for
+// the fs name.
+func (c *Cache) preflightName(name string) string {
+	root := c.root()
+	return path.Join(root, preflightDir, strings.TrimPrefix(name, root))
+}
+
+// writePreflight writes the preflight max age sidecar file for the fs name.
+func (c *Cache) writePreflight(name, maxAge string, mode os.FileMode) error {
+	sidecar := c.preflightName(name)
+	if err := c.fs.MkdirAll(path.Dir(sidecar), c.dirMode); err != nil {
+		return err
+	}
+	return afero.WriteFile(c.fs, sidecar, []byte(maxAge), mode)
+}
+
+// preflightKey returns the hex encoded hash of the origin and requested
+// method and headers of the CORS preflight request, used in keys for OPTIONS
+// requests. Requested headers are compared case-insensitively, and in any
+// order.
+func preflightKey(h Hasher, req *http.Request) string {
+	var headers []string
+	for _, v := range req.Header.Values("Access-Control-Request-Headers") {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+				headers = append(headers, s)
+			}
+		}
+	}
+	slices.Sort(headers)
+	return h.Sum([]byte(strings.Join([]string{
+		req.Header.Get("Origin"),
+		strings.ToUpper(strings.TrimSpace(req.Header.Get("Access-Control-Request-Method"))),
+		strings.Join(slices.Compact(headers), ","),
+	}, "\n")))
+}
+
+// preflightPolicy returns the policy with its TTL replaced by the
+// Access-Control-Max-Age recorded for the stored preflight response for the
+// key, when the policy caches preflight responses. Entries for other requests
+// do not have a recorded max age.
+func (c *Cache) preflightPolicy(key string, p Policy) Policy {
+	if !p.preflight {
+		return p
+	}
+	name, err := c.lookup(key)
+	if err != nil {
+		return p
+	}
+	buf, err := afero.ReadFile(c.fs, c.preflightName(name))
+	if err != nil {
+		return p
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return p
+	}
+	// a max age of 0 (or less) disables caching, while a zero TTL would
+	// never expire
+	p.TTL, p.ScheduleTTL = max(time.Duration(n)*time.Second, time.Nanosecond), nil
+	return p
+}
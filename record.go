@@ -0,0 +1,97 @@
+package diskcache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// fixtureKey returns the fixture key for the request, made of the lower case
+// request method, the request host, and the request signature (including the
+// request body).
+func fixtureKey(dir string, req *http.Request) (string, error) {
+	sig, err := RequestSignature(req, nil, true)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, strings.ToLower(req.Method), req.URL.Host, sig), nil
+}
+
+// FixtureMatcher is a matcher that matches all requests, using the fixture
+// key of the request in the fixture directory, for replaying fixtures
+// recorded with WithRecordAll.
+//
+// See NewFixtureReplayer.
+type FixtureMatcher struct {
+	// Dir is the fixture directory.
+	Dir string
+}
+
+// Match satisfies the Matcher interface.
+func (m FixtureMatcher) Match(req *http.Request) (string, Policy, error) {
+	key, err := fixtureKey(m.Dir, req)
+	if err != nil {
+		return "", Policy{}, err
+	}
+	return key, Policy{}, nil
+}
+
+// NewFixtureReplayer creates a new disk cache that only replays fixtures
+// recorded in the fixture directory of the fs with WithRecordAll, for use in
+// tests.
+//
+// See NewReplayer.
+func NewFixtureReplayer(fs afero.Fs, dir string, opts ...Option) (*Cache, error) {
+	return NewReplayer(fs, append([]Option{WithMatchers(FixtureMatcher{Dir: dir}), WithNoDefault()}, opts...)...)
+}
+
+// recordRoundTrip executes the round trip for the request, recording the
+// response as a fixture.
+func (c *Cache) recordRoundTrip(req *http.Request) (*http.Response, error) {
+	key, err := fixtureKey(c.recordDir, req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.record(key, req, res); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	return res, nil
+}
+
+// record writes the response to the fixture for the key, restoring the
+// response body.
+func (c *Cache) record(key string, req *http.Request, res *http.Response) error {
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if err := res.Body.Close(); err != nil {
+		return err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	buf, err := httputil.DumpResponse(res, false)
+	if err != nil {
+		return err
+	}
+	buf = stripTransferEncodingHeader(buf)
+	if req.Method == "HEAD" {
+		buf = addHeader(buf, methodHeader, "HEAD")
+	} else {
+		buf = append(stripContentLengthHeader(buf), body...)
+	}
+	c.debug(req.Context(), "record", "method", req.Method, "url", redactURL(req.URL), "key", key)
+	if err := c.fs.MkdirAll(path.Dir(key), c.dirMode); err != nil {
+		return err
+	}
+	return afero.WriteFile(c.fs, key, buf, c.fileMode)
+}
@@ -0,0 +1,104 @@
+package diskcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxRefreshBackoff is the maximum shift of the background refresh interval
+// applied after consecutive failures.
+const maxRefreshBackoff = 5
+
+// refresher is a background refresher.
+type refresher struct {
+	interval time.Duration
+	reqs     []*http.Request
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// start starts the background refresher for the cache.
+func (r *refresher) start(c *Cache) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel, r.done = cancel, make(chan struct{})
+	go func() {
+		defer close(r.done)
+		var failures int
+		for delay := time.Duration(0); ; {
+			t := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+			switch err := c.Refresh(ctx, r.reqs...); {
+			case ctx.Err() != nil:
+				return
+			case err != nil:
+				failures++
+				delay = r.interval << min(failures, maxRefreshBackoff)
+				c.debug(ctx, "refresh error", "error", err, "delay", delay)
+			default:
+				failures, delay = 0, r.interval
+			}
+		}
+	}()
+}
+
+// stop stops the background refresher, waiting for it to exit.
+func (r *refresher) stop() {
+	if r == nil || r.cancel == nil {
+		return
+	}
+	r.cancel()
+	<-r.done
+}
+
+// Refresh fetches and stores the requests, regardless of whether or not the
+// stored entries are stale. Requests are refreshed in order using the
+// context, stopping when the context is canceled. Errors for the requests
+// are joined, and ErrNotMatched is returned for requests not matched by any
+// matcher.
+func (c *Cache) Refresh(ctx context.Context, reqs ...*http.Request) error {
+	if !c.life.acquire() {
+		return ErrClosed
+	}
+	defer c.life.release()
+	var errs []error
+	for _, req := range reqs {
+		if err := ctx.Err(); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		if err := c.refresh(req.Clone(ctx)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// refresh fetches and stores the request.
+func (c *Cache) refresh(req *http.Request) error {
+	key, p, err := c.Match(req)
+	switch {
+	case err != nil:
+		return err
+	case key == "":
+		return fmt.Errorf("%w: %s %s", ErrNotMatched, req.Method, redactURL(req.URL))
+	}
+	if z, ok := ContextPolicy(req.Context()); ok {
+		p = z
+	}
+	c.debug(req.Context(), "refresh", "method", req.Method, "url", redactURL(req.URL), "key", key)
+	res, err := c.execute(key, p, req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, err = io.Copy(io.Discard, res.Body)
+	return err
+}
@@ -0,0 +1,136 @@
+package diskcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// requestDir is the directory for recorded request sidecar files.
+const requestDir = "?request"
+
+// sensitiveHeaders are the request headers that are only recorded when
+// explicitly passed to WithRecordRequest.
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+	"X-Api-Key",
+}
+
+// requestName returns the fs name of the recorded request sidecar file for the
+// fs name.
+func (c *Cache) requestName(name string) string {
+	root := c.root()
+	return path.Join(root, requestDir, strings.TrimPrefix(name, root))
+}
+
+// dumpRequest dumps the request line and headers of the request, without the
+// body. When headers is not empty, only the passed headers are included.
+// Otherwise, all headers other than sensitive headers are included.
+func dumpRequest(req *http.Request, headers []string) ([]byte, error) {
+	header := make(http.Header)
+	for k, v := range req.Header {
+		switch {
+		case len(headers) != 0 && !containsFold(headers, k),
+			len(headers) == 0 && containsFold(sensitiveHeaders, k):
+			continue
+		}
+		header[k] = v
+	}
+	z := *req
+	z.Header, z.Body, z.ContentLength, z.TransferEncoding = header, nil, 0, nil
+	return httputil.DumpRequest(&z, false)
+}
+
+// recordRequest writes the recorded request sidecar file for the fs name.
+func (c *Cache) recordRequest(name string, req *http.Request, mode os.FileMode) error {
+	buf, err := dumpRequest(req, c.recordHeaders)
+	if err != nil {
+		return err
+	}
+	sidecar := c.requestName(name)
+	if err := c.fs.MkdirAll(path.Dir(sidecar), c.dirMode); err != nil {
+		return err
+	}
+	return afero.WriteFile(c.fs, sidecar, buf, mode)
+}
+
+// RecordedRequest returns the request recorded for the key, when recording
+// requests with WithRecordRequest. The returned request does not have a body.
+func (c *Cache) RecordedRequest(key string) (*http.Request, error) {
+	if !c.life.acquire() {
+		return nil, ErrClosed
+	}
+	defer c.life.release()
+	name, err := c.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := afero.ReadFile(c.fs, c.requestName(name))
+	if err != nil {
+		return nil, err
+	}
+	return http.ReadRequest(bufio.NewReader(bytes.NewReader(buf)))
+}
+
+// readStoredRequest reads the request stored with a response using
+// WithStoreRequest from br, returning nil when there is no stored request.
+func readStoredRequest(br *bufio.Reader) (*http.Request, error) {
+	switch buf, err := br.Peek(5); {
+	case err != nil && !errors.Is(err, io.EOF):
+		return nil, err
+	case string(buf) == "HTTP/":
+		return nil, nil
+	}
+	return http.ReadRequest(br)
+}
+
+// LoadRequest unmarshals and loads the request stored with the cached
+// response for the key and cache policy, when storing requests with
+// WithStoreRequest. The returned request does not have a body. Returns
+// ErrNoStoredRequest when the entry does not have a stored request.
+func (c *Cache) LoadRequest(key string, p Policy) (*http.Request, error) {
+	if !c.life.acquire() {
+		return nil, ErrClosed
+	}
+	defer c.life.release()
+	c = c.policyCache(p)
+	name, err := c.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = bufio.NewReader(f)
+	if m := c.unmarshaler(r.(*bufio.Reader), p); m != nil {
+		buf := new(bytes.Buffer)
+		if err := m.Unmarshal(buf, r); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrCorruptEntry, name, err)
+		}
+		r = buf
+	}
+	req, err := readStoredRequest(bufio.NewReader(r))
+	switch {
+	case err != nil:
+		return nil, err
+	case req == nil:
+		return nil, fmt.Errorf("%w: %s", ErrNoStoredRequest, key)
+	}
+	return req, nil
+}
+
+// ErrNoStoredRequest is the no stored request error.
+var ErrNoStoredRequest = errors.New("no stored request")
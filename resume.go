@@ -0,0 +1,231 @@
+package diskcache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// resumeDir is the directory for interrupted downloads.
+const resumeDir = "?resume"
+
+// resumeName returns the fs name of the interrupted download for the fs name.
+func (c *Cache) resumeName(name string) string {
+	root := c.root()
+	return path.Join(root, resumeDir, strings.TrimPrefix(name, root))
+}
+
+// resumeFetch fetches the request using the transport, resuming a previously
+// interrupted download of the key with a range request when possible. The
+// body of resumable responses is recorded as it is read, and is kept when the
+// download is interrupted.
+func (c *Cache) resumeFetch(transport http.RoundTripper, key string, req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" || req.Header.Get("Range") != "" {
+		return transport.RoundTrip(req)
+	}
+	name := c.resumeName(c.storeName(key))
+	// claim the interrupted download, if any
+	tmp := c.tempName(name)
+	if err := c.fs.MkdirAll(path.Dir(tmp), c.dirMode); err != nil {
+		return nil, err
+	}
+	if err := c.fs.Rename(name, tmp); err == nil {
+		switch res, err := c.resume(transport, name, tmp, req); {
+		case err != nil:
+			return nil, err
+		case res != nil:
+			return res, nil
+		}
+	}
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	return c.resumable(name, res), nil
+}
+
+// resume resumes the claimed interrupted download tmp, returning a response
+// whose body is the previously downloaded body followed by the remainder of
+// the body. Returns a nil response when the download cannot be resumed, such
+// as when the resource has changed.
+func (c *Cache) resume(transport http.RoundTripper, name, tmp string, req *http.Request) (*http.Response, error) {
+	f, err := c.fs.OpenFile(tmp, os.O_RDWR, c.fileMode)
+	if err != nil {
+		_ = c.fs.Remove(tmp)
+		return nil, nil
+	}
+	prev, n, offset, err := readPartial(f)
+	validator := ""
+	if err == nil {
+		validator = resumeValidator(prev.Header)
+	}
+	if validator == "" || offset <= 0 {
+		f.Close()
+		_ = c.fs.Remove(tmp)
+		return nil, nil
+	}
+	// request the remainder of the body
+	z := req.Clone(req.Context())
+	z.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	z.Header.Set("If-Range", validator)
+	res, err := transport.RoundTrip(z)
+	if err != nil {
+		// keep the interrupted download for a later attempt
+		f.Close()
+		_ = c.replace(tmp, name)
+		return nil, err
+	}
+	if res.StatusCode != http.StatusPartialContent || !strings.HasPrefix(res.Header.Get("Content-Range"), "bytes "+strconv.FormatInt(offset, 10)+"-") {
+		f.Close()
+		_ = c.fs.Remove(tmp)
+		if res.StatusCode == http.StatusOK {
+			// resource changed, use the full response
+			return c.resumable(name, res), nil
+		}
+		res.Body.Close()
+		return nil, nil
+	}
+	c.debug(req.Context(), "resume", "url", redactURL(req.URL), "offset", offset)
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		res.Body.Close()
+		_ = c.fs.Remove(tmp)
+		return nil, err
+	}
+	prev.Request = req
+	prev.Body = &resumeBody{
+		r:    io.MultiReader(io.NewSectionReader(f, n, offset), io.TeeReader(res.Body, f)),
+		body: res.Body,
+		c:    c,
+		f:    f,
+		name: name,
+		tmp:  tmp,
+	}
+	return prev, nil
+}
+
+// resumable wraps the body of the response when the response can be resumed
+// when interrupted, recording the body to a partial download as it is read.
+// Responses without a strong validator, or that were transparently
+// decompressed by the transport, cannot be resumed.
+func (c *Cache) resumable(name string, res *http.Response) *http.Response {
+	if res.StatusCode != http.StatusOK || res.Uncompressed || res.Header.Get("Accept-Ranges") == "none" || resumeValidator(res.Header) == "" {
+		return res
+	}
+	buf, err := httputil.DumpResponse(res, false)
+	if err != nil {
+		return res
+	}
+	f, tmp, err := c.createTemp(name, c.fileMode)
+	if err != nil {
+		return res
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		_ = c.fs.Remove(tmp)
+		return res
+	}
+	res.Body = &resumeBody{
+		r:    io.TeeReader(res.Body, f),
+		body: res.Body,
+		c:    c,
+		f:    f,
+		name: name,
+		tmp:  tmp,
+	}
+	return res
+}
+
+// readPartial reads the response header of the interrupted download, returning
+// the response, the length of the header, and the length of the downloaded
+// body.
+func readPartial(f afero.File) (*http.Response, int64, int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	r := &countBody{ReadCloser: f}
+	br := bufio.NewReader(r)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, 0, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	n := r.n - int64(br.Buffered())
+	return res, n, fi.Size() - n, nil
+}
+
+// resumeValidator returns the validator for the If-Range header of a resumed
+// download, the strong ETag or the Last-Modified date.
+func resumeValidator(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
+
+// resumeBody wraps a response body, recording the body to a partial download
+// as it is read. The partial download is removed once the body has been fully
+// read, and is kept for resuming when the body is interrupted.
+type resumeBody struct {
+	r    io.Reader
+	body io.Closer
+	c    *Cache
+	f    afero.File
+	name string
+	tmp  string
+	done bool
+}
+
+// Read satisfies the io.Reader interface.
+func (b *resumeBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	switch {
+	case errors.Is(err, io.EOF):
+		b.finish(true)
+	case err != nil:
+		b.finish(false)
+	}
+	return n, err
+}
+
+// Close satisfies the io.Closer interface.
+func (b *resumeBody) Close() error {
+	b.finish(false)
+	return b.body.Close()
+}
+
+// finish removes the partial download when complete, otherwise keeping it for
+// resuming.
+func (b *resumeBody) finish(complete bool) {
+	if b.done {
+		return
+	}
+	b.done = true
+	if complete {
+		b.f.Close()
+		_ = b.c.fs.Remove(b.tmp)
+		return
+	}
+	if err := b.c.sync(b.f); err != nil {
+		b.f.Close()
+		_ = b.c.fs.Remove(b.tmp)
+		return
+	}
+	if err := b.f.Close(); err != nil {
+		_ = b.c.fs.Remove(b.tmp)
+		return
+	}
+	_ = b.c.replace(b.tmp, b.name)
+}
@@ -0,0 +1,51 @@
+package diskcache
+
+import (
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strings"
+)
+
+// RequestSignature returns the hex encoded SHA-256 signature of the request's
+// identity, made of the request method, the request URL normalized with
+// NormalizeDefault and NormalizeQueryOrder without any user info or
+// fragment, the values of the allowed headers, and when includeBody is true,
+// a hash of the request body.
+//
+// Allowed headers are sorted and compared by canonical name, and header
+// values are trimmed of surrounding whitespace, retaining their order. Absent
+// headers and headers with empty values are treated the same. The request
+// body is buffered and restored when read.
+func RequestSignature(req *http.Request, headerAllowlist []string, includeBody bool) (string, error) {
+	return requestSignature(nil, req, headerAllowlist, includeBody)
+}
+
+// requestSignature returns the hex encoded signature of the request's
+// identity using the hasher.
+func requestSignature(h Hasher, req *http.Request, headerAllowlist []string, includeBody bool) (string, error) {
+	u := normalizeURL(req.URL, NormalizeDefault|NormalizeQueryOrder)
+	u.User, u.Fragment, u.RawFragment = nil, "", ""
+	var sb strings.Builder
+	sb.WriteString(strings.ToUpper(req.Method) + "\n" + u.String() + "\n")
+	headers := make([]string, len(headerAllowlist))
+	for i, k := range headerAllowlist {
+		headers[i] = textproto.CanonicalMIMEHeaderKey(k)
+	}
+	slices.Sort(headers)
+	for _, k := range slices.Compact(headers) {
+		values := make([]string, len(req.Header.Values(k)))
+		for i, v := range req.Header.Values(k) {
+			values[i] = strings.TrimSpace(v)
+		}
+		sb.WriteString(strings.ToLower(k) + ": " + strings.Join(values, ", ") + "\n")
+	}
+	if includeBody {
+		hash, err := hashBody(h, req)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString("\n" + hash)
+	}
+	return h.Sum([]byte(sb.String())), nil
+}
@@ -0,0 +1,60 @@
+package diskcache
+
+import (
+	"mime"
+	"sync"
+)
+
+// CompressionStat contains aggregate sizes of stored responses.
+type CompressionStat struct {
+	// Count is the number of stored responses.
+	Count int64
+	// Size is the total size of responses, prior to marshaling.
+	Size int64
+	// StoredSize is the total size of responses stored on disk.
+	StoredSize int64
+}
+
+// Ratio returns the compression ratio (Size / StoredSize).
+func (stat CompressionStat) Ratio() float64 {
+	if stat.StoredSize == 0 {
+		return 0
+	}
+	return float64(stat.Size) / float64(stat.StoredSize)
+}
+
+// compressionStats tracks aggregate compression stats by content type.
+type compressionStats struct {
+	sync.Mutex
+	stats map[string]CompressionStat
+}
+
+// add adds the sizes for the content type.
+func (s *compressionStats) add(contentType string, size, storedSize int64) {
+	if typ, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = typ
+	}
+	s.Lock()
+	defer s.Unlock()
+	stat := s.stats[contentType]
+	stat.Count++
+	stat.Size += size
+	stat.StoredSize += storedSize
+	s.stats[contentType] = stat
+}
+
+// CompressionStats returns the aggregate compression stats of stored
+// responses by content type, when enabled with WithCompressionStats.
+// Responses without a content type are aggregated under the empty string.
+func (c *Cache) CompressionStats() map[string]CompressionStat {
+	if c.compressionStats == nil {
+		return nil
+	}
+	c.compressionStats.Lock()
+	defer c.compressionStats.Unlock()
+	stats := make(map[string]CompressionStat, len(c.compressionStats.stats))
+	for k, v := range c.compressionStats.stats {
+		stats[k] = v
+	}
+	return stats
+}
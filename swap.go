@@ -0,0 +1,43 @@
+package diskcache
+
+import (
+	"errors"
+
+	"github.com/spf13/afero"
+)
+
+// SwapFs atomically switches the cache fs to the fs, such as to promote a
+// cache built in a staging directory. Requests made during the swap wait for
+// the swap to complete, and the swap waits for in-flight requests to finish,
+// so requests use either the old or the new fs, but never a mix. The index
+// (when enabled) is rebuilt from the new fs, and the memory layer is cleared.
+//
+// Response bodies returned prior to the swap remain readable from the old fs.
+// Entries being streamed with WithTeeStreaming that complete after the swap
+// are not committed. The fs of policies with a Fs is not changed, and
+// BasePath returns false after the swap.
+//
+// Other methods of the cache that use the fs, such as Mod, EvictKey, Verify
+// and the FS view, similarly wait for the swap to complete. SwapFs must not be
+// called from within a request to the cache, such as from a validator or
+// transformer, as it would wait on itself, and funcs called during a request
+// should not call methods of the cache, as they would wait on a concurrent
+// swap.
+func (c *Cache) SwapFs(fs afero.Fs) error {
+	if fs == nil {
+		return errors.New("fs cannot be nil")
+	}
+	return c.life.exclusive(func() error {
+		if c.index != nil {
+			if err := c.index.scan(fs, c.root()); err != nil {
+				return err
+			}
+		}
+		c.fs, c.basePath, c.basePathFs = fs, "", nil
+		c.fsGen++
+		if c.memory != nil {
+			c.memory.clear()
+		}
+		return nil
+	})
+}
@@ -0,0 +1,204 @@
+package diskcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/spf13/afero"
+)
+
+// teeDir is the directory for partially streamed entries.
+const teeDir = "?tee"
+
+// teeName returns the fs name of the partially streamed entry for the fs
+// name.
+func (c *Cache) teeName(name string) string {
+	root := c.root()
+	return path.Join(root, teeDir, strings.TrimPrefix(name, root))
+}
+
+// tempSeq is the sequence for uniquely naming partial entries.
+var tempSeq atomic.Uint64
+
+// tempName returns a unique fs name for a partial entry for the fs name.
+func (c *Cache) tempName(name string) string {
+	return c.teeName(name) + "." + strconv.FormatUint(tempSeq.Add(1), 36)
+}
+
+// createTemp creates a uniquely named partial entry for the fs name with the
+// file mode, so that concurrent writes of the same entry do not truncate each
+// other, or the entry being read.
+func (c *Cache) createTemp(name string, mode os.FileMode) (afero.File, string, error) {
+	tmp := c.tempName(name)
+	f, err := c.create(tmp, os.O_RDWR|os.O_EXCL, mode)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, tmp, nil
+}
+
+// replace atomically replaces the fs name with the partial entry tmp.
+func (c *Cache) replace(tmp, name string) error {
+	if err := c.fs.MkdirAll(path.Dir(name), c.dirMode); err != nil {
+		_ = c.fs.Remove(tmp)
+		return c.collisionError(name, err)
+	}
+	if err := c.fs.Rename(tmp, name); err != nil {
+		_ = c.fs.Remove(tmp)
+		return c.collisionError(name, err)
+	}
+	return nil
+}
+
+// storeTee stores the response buf and body using the key, cache policy, and
+// file mode, returning a response whose body streams the response body to the
+// client while it is written to the cache. The entry is only committed once
+// the client has read the full body.
+func (c *Cache) storeTee(key string, p Policy, mode os.FileMode, req *http.Request, contentType string, buf []byte, body io.ReadCloser) (*http.Response, error) {
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf)), req)
+	if err != nil {
+		return nil, err
+	}
+	if c.lfHeaders {
+		buf = lfHeader(buf)
+	}
+	if buf, err = c.prependRequest(buf, req); err != nil {
+		return nil, err
+	}
+	name := c.storeName(key)
+	// open partial cache file
+	f, tmp, err := c.createTemp(name, mode)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		_ = c.fs.Remove(tmp)
+		return nil, err
+	}
+	res.Body = &teeBody{
+		ReadCloser:  body,
+		c:           c,
+		f:           f,
+		key:         key,
+		name:        name,
+		tmp:         tmp,
+		p:           p,
+		mode:        mode,
+		req:         req,
+		contentType: contentType,
+		n:           int64(len(buf)),
+		fs:          c.fs,
+		gen:         c.fsGen,
+	}
+	return res, nil
+}
+
+// teeBody wraps a response body, writing the body to a partial cache file
+// as it is read, and committing the partial cache file to the cache when
+// fully read. Partial cache files are removed when the body is closed before
+// being fully read, or when an error occurs.
+type teeBody struct {
+	io.ReadCloser
+	c           *Cache
+	f           afero.File
+	key         string
+	name        string
+	tmp         string
+	p           Policy
+	mode        os.FileMode
+	req         *http.Request
+	contentType string
+	n           int64
+	fs          afero.Fs
+	gen         int64
+	done        bool
+}
+
+// Read satisfies the io.Reader interface.
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.done {
+		if _, werr := b.f.Write(p[:n]); werr != nil {
+			b.c.debug(b.req.Context(), "tee error", "key", b.key, "error", werr)
+			b.abort()
+		}
+		b.n += int64(n)
+	}
+	switch {
+	case b.done:
+	case errors.Is(err, io.EOF):
+		if cerr := b.commit(); cerr != nil {
+			b.c.debug(b.req.Context(), "tee error", "key", b.key, "error", cerr)
+			b.abort()
+		}
+	case err != nil:
+		b.abort()
+	}
+	return n, err
+}
+
+// Close satisfies the io.Closer interface.
+func (b *teeBody) Close() error {
+	if !b.done {
+		b.c.debug(b.req.Context(), "tee incomplete", "key", b.key)
+		b.abort()
+	}
+	return b.ReadCloser.Close()
+}
+
+// commit commits the partial cache file to the cache. Partial cache files
+// are not committed when the cache is closed, or the cache fs was swapped.
+func (b *teeBody) commit() error {
+	b.done = true
+	if !b.c.life.acquire() {
+		b.f.Close()
+		return ErrClosed
+	}
+	defer b.c.life.release()
+	if b.c.fsGen != b.gen {
+		b.f.Close()
+		return errors.New("cache fs swapped")
+	}
+	if err := b.c.sync(b.f); err != nil {
+		b.f.Close()
+		return err
+	}
+	if err := b.f.Close(); err != nil {
+		return err
+	}
+	if err := b.c.replace(b.tmp, b.name); err != nil {
+		return err
+	}
+	b.c.debug(b.req.Context(), "store", "key", b.key, "name", b.name, "size", b.n)
+	if err := b.c.writeSidecars(b.name, b.key, b.p, b.mode, b.req); err != nil {
+		return err
+	}
+	if b.c.compressionStats != nil {
+		b.c.compressionStats.add(b.contentType, b.n, b.n)
+	}
+	if b.c.index != nil {
+		return b.c.index.update(b.c.fs, b.name)
+	}
+	return nil
+}
+
+// abort removes the partial cache file.
+func (b *teeBody) abort() {
+	if !b.done {
+		b.done = true
+		b.f.Close()
+	}
+	if err := b.fs.Remove(b.tmp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		b.c.debug(b.req.Context(), "tee error", "key", b.key, "error", err)
+	}
+}
@@ -0,0 +1,47 @@
+package diskcache
+
+import (
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// timestampDir is the directory for fetch timestamp sidecar files.
+const timestampDir = "?timestamp"
+
+// timestampName returns the fs name of the fetch timestamp sidecar file for
+// the fs name.
+func (c *Cache) timestampName(name string) string {
+	root := c.root()
+	return path.Join(root, timestampDir, strings.TrimPrefix(name, root))
+}
+
+// writeTimestamp writes the fetch timestamp sidecar file for the fs name, when
+// storing fetch timestamps.
+func (c *Cache) writeTimestamp(name string, t time.Time, mode os.FileMode) error {
+	if !c.storedTimestamp {
+		return nil
+	}
+	sidecar := c.timestampName(name)
+	if err := c.fs.MkdirAll(path.Dir(sidecar), c.dirMode); err != nil {
+		return err
+	}
+	return afero.WriteFile(c.fs, sidecar, []byte(t.UTC().Format(time.RFC3339Nano)), mode)
+}
+
+// readTimestamp reads the fetch timestamp sidecar file for the fs name.
+// Returns false when there is no stored fetch timestamp, or it is invalid.
+func (c *Cache) readTimestamp(name string) (time.Time, bool) {
+	buf, err := afero.ReadFile(c.fs, c.timestampName(name))
+	if err != nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(buf)))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
@@ -1,12 +1,20 @@
 package diskcache
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"net/http"
 	"net/url"
+	"path"
 	"regexp"
 	"strings"
 
@@ -14,9 +22,11 @@ import (
 	"github.com/tdewolff/minify/v2/css"
 	"github.com/tdewolff/minify/v2/html"
 	"github.com/tdewolff/minify/v2/js"
-	"github.com/tdewolff/minify/v2/json"
+	mjson "github.com/tdewolff/minify/v2/json"
 	"github.com/tdewolff/minify/v2/svg"
 	"github.com/tdewolff/minify/v2/xml"
+	"github.com/tdewolff/parse/v2"
+	phtml "github.com/tdewolff/parse/v2/html"
 )
 
 // TransformPriority is the body transform priority.
@@ -87,7 +97,8 @@ func (t *RegexpHeaderTransformer) HeaderTransform(buf []byte) []byte {
 // BodyTransformer is the shared interface for mangling body content prior to
 // storage in the fs.
 type BodyTransformer interface {
-	// TransformPriority returns the order for the transformer.
+	// TransformPriority returns the order for the transformer. Transformers
+	// with the same priority are applied in registration order.
 	TransformPriority() TransformPriority
 	// BodyTransform transforms data read from r to w for the provided URL,
 	// status code, and content type. A return of false prevents further
@@ -95,6 +106,208 @@ type BodyTransformer interface {
 	BodyTransform(w io.Writer, r io.Reader, urlstr string, code int, contentType string) (bool, error)
 }
 
+// Named is the interface for body transformers that provide a name, used when
+// tracing body transforms.
+//
+// See WithTransformTrace.
+type Named interface {
+	// Name returns the name.
+	Name() string
+}
+
+// ResponseRewriter is the shared interface for rewriting responses prior to
+// storage. Unlike header and body transformers, response rewriters are passed
+// the whole response, and can be used to change the status code, or to change
+// headers and body together.
+type ResponseRewriter interface {
+	// Rewrite rewrites the response, returning the original or a new
+	// response, which must not be nil. A response whose body length has
+	// changed should have its ContentLength set to -1.
+	Rewrite(*http.Response) (*http.Response, error)
+}
+
+// ResponseRewriterFunc is a response rewriter func.
+type ResponseRewriterFunc func(*http.Response) (*http.Response, error)
+
+// Rewrite satisfies the ResponseRewriter interface.
+func (f ResponseRewriterFunc) Rewrite(res *http.Response) (*http.Response, error) {
+	return f(res)
+}
+
+// TransformError is a body transform error. TransformErrors satisfy
+// errors.Is for ErrTransform.
+type TransformError struct {
+	// Name is the body transformer name.
+	Name string
+	// URL is the request URL.
+	URL string
+	// Code is the response status code.
+	Code int
+	// ContentType is the response content type.
+	ContentType string
+	// Err is the error returned by the body transformer.
+	Err error
+}
+
+// Error satisfies the error interface.
+func (err *TransformError) Error() string {
+	return fmt.Sprintf("%s: %s (%d %s): %v", err.Name, err.URL, err.Code, err.ContentType, err.Err)
+}
+
+// Unwrap returns the body transformer's error.
+func (err *TransformError) Unwrap() error {
+	return err.Err
+}
+
+// Is returns whether or not target is ErrTransform.
+func (err *TransformError) Is(target error) bool {
+	return target == ErrTransform
+}
+
+// BodyTransformerFunc is a body transformer func, with a transform priority of
+// TransformPriorityModify.
+type BodyTransformerFunc func(w io.Writer, r io.Reader, urlstr string, code int, contentType string) (bool, error)
+
+// TransformPriority satisfies the BodyTransformer interface.
+func (f BodyTransformerFunc) TransformPriority() TransformPriority {
+	return TransformPriorityModify
+}
+
+// BodyTransform satisfies the BodyTransformer interface.
+func (f BodyTransformerFunc) BodyTransform(w io.Writer, r io.Reader, urlstr string, code int, contentType string) (bool, error) {
+	return f(w, r, urlstr, code, contentType)
+}
+
+// ContextBodyTransformer is the interface for body transformers that need the
+// request or response, such as to transform the body based on a request
+// header or a context value. Body transformers satisfying the interface have
+// BodyTransformContext called in place of BodyTransform.
+type ContextBodyTransformer interface {
+	BodyTransformer
+	// BodyTransformContext transforms data read from r to w for the request
+	// and response. The response's body must not be read, and the response's
+	// Content-Type header is the content type after any override. A return
+	// of false prevents further passing the stream to lower priority body
+	// transformers.
+	BodyTransformContext(ctx context.Context, w io.Writer, r io.Reader, req *http.Request, res *http.Response) (bool, error)
+}
+
+// ContextBodyTransformerFunc is a context body transformer func, with a
+// transform priority of TransformPriorityModify.
+type ContextBodyTransformerFunc func(ctx context.Context, w io.Writer, r io.Reader, req *http.Request, res *http.Response) (bool, error)
+
+// TransformPriority satisfies the BodyTransformer interface.
+func (f ContextBodyTransformerFunc) TransformPriority() TransformPriority {
+	return TransformPriorityModify
+}
+
+// BodyTransform satisfies the BodyTransformer interface, calling the func
+// with a GET request for the URL, and a response with the status code and
+// content type.
+func (f ContextBodyTransformerFunc) BodyTransform(w io.Writer, r io.Reader, urlstr string, code int, contentType string) (bool, error) {
+	req, err := http.NewRequest("GET", urlstr, nil)
+	if err != nil {
+		return false, err
+	}
+	res := &http.Response{
+		StatusCode: code,
+		Header:     http.Header{"Content-Type": {contentType}},
+		Request:    req,
+	}
+	return f(req.Context(), w, r, req, res)
+}
+
+// BodyTransformContext satisfies the ContextBodyTransformer interface.
+func (f ContextBodyTransformerFunc) BodyTransformContext(ctx context.Context, w io.Writer, r io.Reader, req *http.Request, res *http.Response) (bool, error) {
+	return f(ctx, w, r, req, res)
+}
+
+// priorityContextBodyTransformer wraps a context body transformer func with
+// a transform priority.
+type priorityContextBodyTransformer struct {
+	ContextBodyTransformerFunc
+	priority TransformPriority
+}
+
+// TransformPriority satisfies the BodyTransformer interface.
+func (t priorityContextBodyTransformer) TransformPriority() TransformPriority {
+	return t.priority
+}
+
+// priorityBodyTransformer wraps a body transformer func with a transform
+// priority.
+type priorityBodyTransformer struct {
+	BodyTransformerFunc
+	priority TransformPriority
+}
+
+// TransformPriority satisfies the BodyTransformer interface.
+func (t priorityBodyTransformer) TransformPriority() TransformPriority {
+	return t.priority
+}
+
+// SizeGated wraps the body transformer, only applying it to bodies with a
+// size between min and max bytes (inclusive). A max of 0 or less indicates no
+// maximum. Bodies outside the range are passed unmodified to the next body
+// transformer.
+func SizeGated(t BodyTransformer, min, max int64) BodyTransformer {
+	return sizeGated{t: t, min: min, max: max}
+}
+
+// sizeGated is a size gated body transformer.
+type sizeGated struct {
+	t        BodyTransformer
+	min, max int64
+}
+
+// TransformPriority satisfies the BodyTransformer interface.
+func (t sizeGated) TransformPriority() TransformPriority {
+	return t.t.TransformPriority()
+}
+
+// BodyTransform satisfies the BodyTransformer interface.
+func (t sizeGated) BodyTransform(w io.Writer, r io.Reader, urlstr string, code int, contentType string) (bool, error) {
+	b, ok, err := t.gate(w, r)
+	if err != nil || !ok {
+		return err == nil, err
+	}
+	return t.t.BodyTransform(w, b, urlstr, code, contentType)
+}
+
+// BodyTransformContext satisfies the ContextBodyTransformer interface.
+func (t sizeGated) BodyTransformContext(ctx context.Context, w io.Writer, r io.Reader, req *http.Request, res *http.Response) (bool, error) {
+	b, ok, err := t.gate(w, r)
+	if err != nil || !ok {
+		return err == nil, err
+	}
+	return bodyTransform(t.t, w, b, req.WithContext(ctx), res, res.Header.Get("Content-Type"))
+}
+
+// gate reads the body from r, returning the body and true when the body is
+// in range. Bodies not in range are copied to w.
+func (t sizeGated) gate(w io.Writer, r io.Reader) (io.Reader, bool, error) {
+	// read up to max+1 bytes to determine whether the body is in range
+	lr := r
+	if t.max > 0 {
+		lr = io.LimitReader(r, t.max+1)
+	}
+	b := new(bytes.Buffer)
+	n, err := io.Copy(b, lr)
+	if err != nil {
+		return nil, false, err
+	}
+	if n < t.min || t.max > 0 && n > t.max {
+		_, err := io.Copy(w, io.MultiReader(b, r))
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+// Name satisfies the Named interface.
+func (t sizeGated) Name() string {
+	return transformerName(t.t)
+}
+
 // Minifier is a body transformer that minifies HTML, XML, SVG, JavaScript,
 // JSON, and CSS content.
 //
@@ -129,7 +342,7 @@ func (t Minifier) BodyTransform(w io.Writer, r io.Reader, urlstr string, code in
 	m.AddFunc("text/css", css.Minify)
 	m.AddFunc("image/svg+xml", svg.Minify)
 	m.AddFuncRegexp(jsContentTypeRE, js.Minify)
-	m.AddFuncRegexp(jsonContentTypeRE, json.Minify)
+	m.AddFuncRegexp(jsonContentTypeRE, mjson.Minify)
 	m.AddFuncRegexp(xmlContentTypeRE, xml.Minify)
 	if contentType == "text/html" {
 		var err error
@@ -149,11 +362,279 @@ var (
 	xmlContentTypeRE  = regexp.MustCompile("[/+]xml$")
 )
 
+// HTMLStripper is a body transformer that strips scripts, comments, styles,
+// and other content from HTML content. Useful for creating reproducible
+// archival snapshots.
+//
+// Malformed HTML that cannot be lexed is passed through unmodified.
+type HTMLStripper struct {
+	Priority TransformPriority
+	// RemoveScripts toggles removing <script> elements.
+	RemoveScripts bool
+	// RemoveComments toggles removing comments.
+	RemoveComments bool
+	// RemoveStyles toggles removing <style> elements.
+	RemoveStyles bool
+	// RemoveNoscript toggles removing <noscript> elements.
+	RemoveNoscript bool
+	// RemoveEventHandlers toggles removing inline event handler (on*)
+	// attributes.
+	RemoveEventHandlers bool
+}
+
+// TransformPriority satisfies the BodyTransformer interface.
+func (t HTMLStripper) TransformPriority() TransformPriority {
+	return t.Priority
+}
+
+// BodyTransform satisfies the BodyTransformer interface.
+func (t HTMLStripper) BodyTransform(w io.Writer, r io.Reader, urlstr string, code int, contentType string) (bool, error) {
+	if !matchContentType([]string{"text/html"}, contentType) {
+		_, err := io.Copy(w, r)
+		return err == nil, err
+	}
+	b := new(bytes.Buffer)
+	if _, err := io.Copy(b, r); err != nil {
+		return false, err
+	}
+	buf, out := b.Bytes(), new(bytes.Buffer)
+	l := phtml.NewLexer(parse.NewInputBytes(buf))
+	// skip is the name of the element being removed, and depth is the
+	// nesting depth of the removed element
+	var skip []byte
+	var depth int
+	// name is the current tag name, and drop toggles dropping the current
+	// tag
+	var name []byte
+	var drop bool
+	for {
+		tt, data := l.Next()
+		switch tt {
+		case phtml.ErrorToken:
+			if !errors.Is(l.Err(), io.EOF) {
+				_, err := w.Write(buf)
+				return err == nil, err
+			}
+			_, err := w.Write(out.Bytes())
+			return err == nil, err
+		case phtml.CommentToken:
+			if skip != nil || t.RemoveComments {
+				continue
+			}
+		case phtml.StartTagToken:
+			name = append(name[:0], l.Text()...)
+			switch {
+			case skip != nil:
+				if bytes.EqualFold(name, skip) {
+					depth++
+				}
+				drop = true
+				continue
+			case t.remove(name):
+				skip, depth, drop = append([]byte(nil), name...), 1, true
+				continue
+			}
+			drop = false
+		case phtml.AttributeToken:
+			if drop || t.RemoveEventHandlers && len(l.AttrKey()) > 2 && bytes.EqualFold(l.AttrKey()[:2], []byte("on")) {
+				continue
+			}
+		case phtml.StartTagVoidToken:
+			if drop {
+				if bytes.EqualFold(name, skip) {
+					if depth--; depth == 0 {
+						skip = nil
+					}
+				}
+				drop = false
+				continue
+			}
+		case phtml.StartTagCloseToken:
+			if drop {
+				drop = false
+				continue
+			}
+		case phtml.EndTagToken:
+			if skip != nil {
+				if bytes.EqualFold(l.Text(), skip) {
+					if depth--; depth == 0 {
+						skip = nil
+					}
+				}
+				continue
+			}
+		default:
+			if skip != nil {
+				continue
+			}
+		}
+		out.Write(data)
+	}
+}
+
+// remove determines if the element should be removed.
+func (t HTMLStripper) remove(name []byte) bool {
+	switch {
+	case t.RemoveScripts && bytes.EqualFold(name, []byte("script")),
+		t.RemoveStyles && bytes.EqualFold(name, []byte("style")),
+		t.RemoveNoscript && bytes.EqualFold(name, []byte("noscript")):
+		return true
+	}
+	return false
+}
+
+// maxImagePixels is the maximum number of pixels of images re-encoded by
+// ImageTransformer.
+const maxImagePixels = 64 << 20
+
+// ImageTransformer is a body transformer that re-encodes JPEG and PNG images,
+// stripping any image metadata (such as EXIF data), and optionally
+// downscaling images.
+//
+// Only JPEG and PNG images are supported. Content that is not a JPEG or PNG
+// image (including WebP and GIF images), that cannot be decoded, or whose
+// dimensions exceed 64 megapixels, is passed through unmodified. Image
+// dimensions are checked prior to decoding the image.
+//
+// Note: decoding and encoding images is CPU intensive.
+type ImageTransformer struct {
+	Priority TransformPriority
+	// MaxDimension is the maximum width or height of images. Images larger
+	// than the max dimension are downscaled, preserving the aspect ratio.
+	MaxDimension int
+	// Quality is the JPEG encoding quality. Uses jpeg.DefaultQuality when 0.
+	Quality int
+}
+
+// TransformPriority satisfies the BodyTransformer interface.
+func (t ImageTransformer) TransformPriority() TransformPriority {
+	return t.Priority
+}
+
+// BodyTransform satisfies the BodyTransformer interface.
+func (t ImageTransformer) BodyTransform(w io.Writer, r io.Reader, urlstr string, code int, contentType string) (bool, error) {
+	if !matchContentType([]string{"image/jpeg", "image/png"}, contentType) {
+		_, err := io.Copy(w, r)
+		return err == nil, err
+	}
+	b := new(bytes.Buffer)
+	if _, err := io.Copy(b, r); err != nil {
+		return false, err
+	}
+	buf := b.Bytes()
+	// guard against decompression bombs
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		_, err := w.Write(buf)
+		return err == nil, err
+	}
+	img, typ, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		_, err := w.Write(buf)
+		return err == nil, err
+	}
+	if t.MaxDimension > 0 {
+		img = downscale(img, t.MaxDimension)
+	}
+	out := new(bytes.Buffer)
+	switch typ {
+	case "jpeg":
+		quality := t.Quality
+		if quality == 0 {
+			quality = jpeg.DefaultQuality
+		}
+		err = jpeg.Encode(out, img, &jpeg.Options{Quality: quality})
+	case "png":
+		err = png.Encode(out, img)
+	default:
+		out.Reset()
+		out.Write(buf)
+	}
+	if err != nil {
+		_, err := w.Write(buf)
+		return err == nil, err
+	}
+	_, err = w.Write(out.Bytes())
+	return err == nil, err
+}
+
+// downscale downscales the image using nearest neighbor sampling, so that
+// neither the width or height exceed dim.
+func downscale(img image.Image, dim int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= dim && h <= dim {
+		return img
+	}
+	nw, nh := dim, dim
+	if w > h {
+		nh = max(h*dim/w, 1)
+	} else {
+		nw = max(w*dim/h, 1)
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, nw, nh))
+	for y := 0; y < nh; y++ {
+		for x := 0; x < nw; x++ {
+			dst.Set(x, y, img.At(b.Min.X+x*w/nw, b.Min.Y+y*h/nh))
+		}
+	}
+	return dst
+}
+
+// JSONCanonicalizer is a body transformer that re-encodes JSON content with
+// sorted object keys, so that equivalent JSON documents are stored
+// identically. Array order is preserved.
+//
+// When ContentTypes is empty, all responses are canonicalized, otherwise only
+// responses with a matching content type are canonicalized.
+//
+// Note: the body is altered, and content that cannot be decoded as JSON is
+// passed through unmodified.
+type JSONCanonicalizer struct {
+	Priority     TransformPriority
+	ContentTypes []string
+}
+
+// TransformPriority satisfies the BodyTransformer interface.
+func (t JSONCanonicalizer) TransformPriority() TransformPriority {
+	return t.Priority
+}
+
+// BodyTransform satisfies the BodyTransformer interface.
+func (t JSONCanonicalizer) BodyTransform(w io.Writer, r io.Reader, urlstr string, code int, contentType string) (bool, error) {
+	if !matchContentType(t.ContentTypes, contentType) {
+		_, err := io.Copy(w, r)
+		return err == nil, err
+	}
+	b := new(bytes.Buffer)
+	dec := json.NewDecoder(io.TeeReader(r, b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		// pass through
+		if _, err := io.Copy(b, r); err != nil {
+			return false, err
+		}
+		_, err := w.Write(b.Bytes())
+		return err == nil, err
+	}
+	out := new(bytes.Buffer)
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return false, err
+	}
+	_, err := w.Write(bytes.TrimSuffix(out.Bytes(), []byte("\n")))
+	return err == nil, err
+}
+
 // Truncator is a body transformer that truncates responses based on match
-// criteria.
+// criteria. When Placeholder is not nil, it is stored in place of the body of
+// truncated responses.
 type Truncator struct {
-	Priority TransformPriority
-	Match    func(string, int, string) bool
+	Priority    TransformPriority
+	Match       func(string, int, string) bool
+	Placeholder []byte
 }
 
 // TransformPriority satisfies the BodyTransformer interface.
@@ -164,6 +645,10 @@ func (t Truncator) TransformPriority() TransformPriority {
 // BodyTransform satisfies the BodyTransformer interface.
 func (t Truncator) BodyTransform(w io.Writer, r io.Reader, urlstr string, code int, contentType string) (bool, error) {
 	if t.Match(urlstr, code, contentType) {
+		if t.Placeholder != nil {
+			_, err := w.Write(t.Placeholder)
+			return false, err
+		}
 		return false, nil
 	}
 	_, err := io.Copy(w, r)
@@ -171,6 +656,10 @@ func (t Truncator) BodyTransform(w io.Writer, r io.Reader, urlstr string, code i
 }
 
 // Base64Decoder is a body transformer that base64 decodes the body.
+//
+// When ContentTypes is empty, all responses are decoded, otherwise only
+// responses with a matching content type are decoded. Responses without a
+// content type never match a non-empty ContentTypes.
 type Base64Decoder struct {
 	Priority     TransformPriority
 	ContentTypes []string
@@ -184,10 +673,7 @@ func (t Base64Decoder) TransformPriority() TransformPriority {
 
 // BodyTransform satisfies the BodyTransformer interface.
 func (t Base64Decoder) BodyTransform(w io.Writer, r io.Reader, urlstr string, code int, contentType string) (bool, error) {
-	if i := strings.Index(contentType, ";"); i != -1 {
-		contentType = contentType[:i]
-	}
-	if len(t.ContentTypes) != 0 && !contains(t.ContentTypes, contentType) {
+	if !matchContentType(t.ContentTypes, contentType) {
 		_, err := io.Copy(w, r)
 		return err == nil, err
 	}
@@ -204,6 +690,10 @@ func (t Base64Decoder) BodyTransform(w io.Writer, r io.Reader, urlstr string, co
 //
 // Useful for munging content that may have had a preventative XSS prefix
 // attached to it, such as some JavaScript or JSON content.
+//
+// When ContentTypes is empty, the prefix is stripped from all responses,
+// otherwise only from responses with a matching content type. Responses
+// without a content type never match a non-empty ContentTypes.
 type PrefixStripper struct {
 	Priority     TransformPriority
 	ContentTypes []string
@@ -217,10 +707,7 @@ func (t PrefixStripper) TransformPriority() TransformPriority {
 
 // BodyTransform satisfies the BodyTransformer interface.
 func (t PrefixStripper) BodyTransform(w io.Writer, r io.Reader, urlstr string, code int, contentType string) (bool, error) {
-	if i := strings.Index(contentType, ";"); i != -1 {
-		contentType = contentType[:i]
-	}
-	if len(t.ContentTypes) != 0 && !contains(t.ContentTypes, contentType) {
+	if !matchContentType(t.ContentTypes, contentType) {
 		_, err := io.Copy(w, r)
 		return err == nil, err
 	}
@@ -235,3 +722,310 @@ func (t PrefixStripper) BodyTransform(w io.Writer, r io.Reader, urlstr string, c
 	_, err := w.Write(buf[len(t.Prefix):])
 	return err == nil, err
 }
+
+// WhitespaceNormalizer is a body transformer that normalizes whitespace in
+// text content, processing the body line by line.
+//
+// The normalization rules are:
+//
+//   - CRLF line endings are converted to LF
+//   - leading and trailing whitespace (spaces, tabs, and CRs) is removed from
+//     each line
+//   - runs of whitespace within a line are collapsed to a single space
+//   - runs of blank lines are collapsed to a single blank line
+//
+// When ContentTypes is empty, all responses are normalized, otherwise only
+// responses with a matching content type are normalized. Responses without a
+// content type never match a non-empty ContentTypes.
+type WhitespaceNormalizer struct {
+	Priority     TransformPriority
+	ContentTypes []string
+}
+
+// TransformPriority satisfies the BodyTransformer interface.
+func (t WhitespaceNormalizer) TransformPriority() TransformPriority {
+	return t.Priority
+}
+
+// BodyTransform satisfies the BodyTransformer interface.
+func (t WhitespaceNormalizer) BodyTransform(w io.Writer, r io.Reader, urlstr string, code int, contentType string) (bool, error) {
+	if !matchContentType(t.ContentTypes, contentType) {
+		_, err := io.Copy(w, r)
+		return err == nil, err
+	}
+	br, bw := bufio.NewReader(r), bufio.NewWriter(w)
+	blank := false
+	for {
+		line, err := br.ReadSlice('\n')
+		switch {
+		case errors.Is(err, bufio.ErrBufferFull):
+			// continue long lines
+			b := append([]byte(nil), line...)
+			for errors.Is(err, bufio.ErrBufferFull) {
+				line, err = br.ReadSlice('\n')
+				b = append(b, line...)
+			}
+			line = b
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return false, err
+		}
+		eol := bytes.HasSuffix(line, lf)
+		fields := bytes.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == '\r' || r == '\n'
+		})
+		switch {
+		case len(fields) != 0:
+			if _, err := bw.Write(bytes.Join(fields, []byte(" "))); err != nil {
+				return false, err
+			}
+			if eol {
+				if err := bw.WriteByte('\n'); err != nil {
+					return false, err
+				}
+			}
+			blank = false
+		case eol && !blank:
+			if err := bw.WriteByte('\n'); err != nil {
+				return false, err
+			}
+			blank = true
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+	return true, bw.Flush()
+}
+
+// NDJSONMinifier is a body transformer that validates and minifies newline
+// delimited JSON (NDJSON) content line by line, as opposed to the Minifier,
+// which treats JSON content as a single document. Blank lines are dropped.
+//
+// Lines that are not valid JSON are dropped when DropInvalid is true,
+// otherwise an error wrapping ErrInvalidBody is returned, and the response is
+// not stored. When ContentTypes is empty, application/x-ndjson,
+// application/ndjson, application/jsonl, and application/x-jsonlines content
+// is processed.
+type NDJSONMinifier struct {
+	Priority     TransformPriority
+	ContentTypes []string
+	// Minify toggles minifying each line. When false, lines are only
+	// validated.
+	Minify bool
+	// DropInvalid toggles dropping invalid lines.
+	DropInvalid bool
+}
+
+// TransformPriority satisfies the BodyTransformer interface.
+func (t NDJSONMinifier) TransformPriority() TransformPriority {
+	return t.Priority
+}
+
+// BodyTransform satisfies the BodyTransformer interface.
+func (t NDJSONMinifier) BodyTransform(w io.Writer, r io.Reader, urlstr string, code int, contentType string) (bool, error) {
+	contentTypes := t.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = []string{"application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines"}
+	}
+	if !matchContentType(contentTypes, contentType) {
+		_, err := io.Copy(w, r)
+		return err == nil, err
+	}
+	br, bw := bufio.NewReader(r), bufio.NewWriter(w)
+	b := new(bytes.Buffer)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return false, err
+		}
+		switch v := bytes.TrimSpace(line); {
+		case len(v) == 0:
+		case !json.Valid(v) && t.DropInvalid:
+		case !json.Valid(v):
+			return false, fmt.Errorf("%w: invalid json on line %d", ErrInvalidBody, n)
+		default:
+			if t.Minify {
+				b.Reset()
+				if err := json.Compact(b, v); err != nil {
+					return false, err
+				}
+				v = b.Bytes()
+			}
+			if _, err := bw.Write(v); err != nil {
+				return false, err
+			}
+			if err := bw.WriteByte('\n'); err != nil {
+				return false, err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+	return true, bw.Flush()
+}
+
+// URLRewriter is a body transformer that rewrites absolute references to the
+// base URL's host in HTML href and src attributes, and in CSS url()
+// references, to references relative to the response URL. Useful for creating
+// self-contained archives for offline browsing.
+//
+// References with a host or a root-relative path are resolved against the
+// response URL, and passed to each of the rules, in order, before being
+// rewritten. A rule can map a reference to a different URL (such as mapping a
+// CDN host to the base host), or return nil to leave the reference
+// unmodified. Only references with the base URL's host and under the base
+// URL's path are rewritten, and only for responses with the base URL's host.
+//
+// Only text/html and text/css content is rewritten. Malformed HTML that cannot
+// be lexed is passed through unmodified.
+type URLRewriter struct {
+	Priority TransformPriority
+	Base     *url.URL
+	Rules    []func(*url.URL) *url.URL
+}
+
+// TransformPriority satisfies the BodyTransformer interface.
+func (t URLRewriter) TransformPriority() TransformPriority {
+	return t.Priority
+}
+
+// BodyTransform satisfies the BodyTransformer interface.
+func (t URLRewriter) BodyTransform(w io.Writer, r io.Reader, urlstr string, code int, contentType string) (bool, error) {
+	html, css := matchContentType([]string{"text/html"}, contentType), matchContentType([]string{"text/css"}, contentType)
+	doc, err := url.Parse(urlstr)
+	if !html && !css || err != nil || t.Base == nil || !strings.EqualFold(doc.Host, t.Base.Host) {
+		_, err := io.Copy(w, r)
+		return err == nil, err
+	}
+	b := new(bytes.Buffer)
+	if _, err := io.Copy(b, r); err != nil {
+		return false, err
+	}
+	buf := b.Bytes()
+	if css {
+		_, err := w.Write(t.rewriteCSS(doc, buf, `"`))
+		return err == nil, err
+	}
+	out := new(bytes.Buffer)
+	l := phtml.NewLexer(parse.NewInputBytes(buf))
+	var style bool
+	for {
+		tt, data := l.Next()
+		switch tt {
+		case phtml.ErrorToken:
+			if !errors.Is(l.Err(), io.EOF) {
+				_, err := w.Write(buf)
+				return err == nil, err
+			}
+			_, err := w.Write(out.Bytes())
+			return err == nil, err
+		case phtml.StartTagToken:
+			style = bytes.EqualFold(l.Text(), []byte("style"))
+		case phtml.EndTagToken:
+			style = false
+		case phtml.TextToken:
+			if style {
+				data = t.rewriteCSS(doc, data, `"`)
+			}
+		case phtml.AttributeToken:
+			key, val := l.AttrKey(), l.AttrVal()
+			switch {
+			case bytes.EqualFold(key, []byte("href")), bytes.EqualFold(key, []byte("src")):
+				if ref, ok := t.rewrite(doc, string(bytes.Trim(val, `"'`))); ok {
+					data = append(append(append([]byte(nil), data[:len(data)-len(val)]...), '"'), append([]byte(ref), '"')...)
+				}
+			case bytes.EqualFold(key, []byte("style")):
+				// quote references with the quote not used by the attribute
+				quote := `'`
+				if bytes.HasPrefix(val, []byte("'")) {
+					quote = `"`
+				}
+				data = append(append([]byte(nil), data[:len(data)-len(val)]...), t.rewriteCSS(doc, val, quote)...)
+			}
+		}
+		out.Write(data)
+	}
+}
+
+// cssURLRE matches CSS url() references.
+var cssURLRE = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^'")\s]*))\s*\)`)
+
+// rewriteCSS rewrites url() references in the CSS content, quoting rewritten
+// references with the quote.
+func (t URLRewriter) rewriteCSS(doc *url.URL, buf []byte, quote string) []byte {
+	return cssURLRE.ReplaceAllFunc(buf, func(b []byte) []byte {
+		m := cssURLRE.FindSubmatch(b)
+		ref, ok := t.rewrite(doc, string(m[1])+string(m[2])+string(m[3]))
+		if !ok {
+			return b
+		}
+		return []byte("url(" + quote + strings.ReplaceAll(ref, "'", "%27") + quote + ")")
+	})
+}
+
+// rewrite returns the reference rewritten relative to the document URL.
+func (t URLRewriter) rewrite(doc *url.URL, ref string) (string, bool) {
+	if ref = strings.TrimSpace(ref); !strings.HasPrefix(ref, "/") && !strings.Contains(ref, "://") {
+		return "", false
+	}
+	u, err := doc.Parse(ref)
+	if err != nil {
+		return "", false
+	}
+	for _, rule := range t.Rules {
+		if u = rule(u); u == nil {
+			return "", false
+		}
+	}
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https",
+		!strings.EqualFold(u.Host, t.Base.Host),
+		!strings.HasPrefix(u.Path, t.Base.Path):
+		return "", false
+	}
+	rel := relativePath(doc.EscapedPath(), u.EscapedPath())
+	if u.RawQuery != "" {
+		rel += "?" + u.RawQuery
+	}
+	if u.Fragment != "" {
+		rel += "#" + u.EscapedFragment()
+	}
+	return strings.ReplaceAll(rel, `"`, "%22"), true
+}
+
+// relativePath returns the path to target relative to the directory of the
+// from path.
+func relativePath(from, target string) string {
+	dir := strings.Split(strings.Trim(path.Dir(from+"x"), "/"), "/")
+	if dir[0] == "" || dir[0] == "." {
+		dir = nil
+	}
+	parts := strings.Split(strings.TrimPrefix(target, "/"), "/")
+	i := 0
+	for ; i < len(dir) && i < len(parts)-1 && dir[i] == parts[i]; i++ {
+	}
+	rel := strings.Repeat("../", len(dir)-i) + strings.Join(parts[i:], "/")
+	if rel == "" {
+		return "./"
+	}
+	return rel
+}
+
+// matchContentType determines if the content type matches any of the content
+// types, ignoring any content type parameters. An empty content types always
+// matches, while an empty content type never matches a non-empty content
+// types.
+func matchContentType(contentTypes []string, contentType string) bool {
+	if len(contentTypes) == 0 {
+		return true
+	}
+	if i := strings.Index(contentType, ";"); i != -1 {
+		contentType = contentType[:i]
+	}
+	if contentType = strings.TrimSpace(contentType); contentType == "" {
+		return false
+	}
+	return contains(contentTypes, contentType)
+}
@@ -2,12 +2,25 @@ package diskcache
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gobwas/glob"
 )
 
 // various byte slices.
 var (
+	lf         = []byte("\n")
+	lflf       = []byte("\n\n")
 	crlf       = []byte("\r\n")
 	crlfcrlf   = []byte("\r\n\r\n")
 	httpHeader = []byte("HTTP/1.1 200 OK\r\n\r\n")
@@ -17,6 +30,7 @@ var (
 var (
 	stripTransferEncodingHeader func([]byte) []byte
 	stripContentLengthHeader    func([]byte) []byte
+	stripContentTypeHeader      func([]byte) []byte
 )
 
 func init() {
@@ -29,6 +43,10 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+	stripContentTypeHeader, err = stripHeaders("Content-Type")
+	if err != nil {
+		panic(err)
+	}
 }
 
 // stripHeaders builds a func that removes matching headers.
@@ -81,27 +99,305 @@ func compileHeaderRegexps(suffix string, headers ...string) ([]*regexp.Regexp, e
 }
 
 // transformAndAppend walks the body transformer chain, applying each
-// successive body transformer.
-func transformAndAppend(buf []byte, r io.Reader, urlstr string, code int, contentType string, stripContentLength bool, bodyTransformers ...BodyTransformer) ([]byte, error) {
-	for _, m := range bodyTransformers {
-		w := new(bytes.Buffer)
-		success, err := m.BodyTransform(w, r, urlstr, code, contentType)
+// successive body transformer to the body read from r for the request and
+// response. When trace is not nil, it is called after each body transformer.
+// Intermediate buffers are retrieved from the pool, and the input buffer of
+// each body transformer is reused as the output buffer of the next. When
+// maxMemory is non-zero, ErrTransformMemory is returned when the combined
+// size of the buffered input and output of a body transformer exceeds it.
+func transformAndAppend(buf []byte, r io.Reader, req *http.Request, res *http.Response, contentType string, stripContentLength bool, pool *sync.Pool, maxMemory int64, trace func(string, int, int, bool), bodyTransformers ...BodyTransformer) ([]byte, error) {
+	if stripContentLength {
+		buf = stripContentLengthHeader(buf)
+	}
+	// read the body to determine its length when tracing
+	n := -1
+	if trace != nil && len(bodyTransformers) != 0 {
+		b, err := io.ReadAll(r)
 		if err != nil {
 			return nil, err
 		}
-		r = bytes.NewReader(w.Bytes())
+		r, n = bytes.NewReader(b), len(b)
+	}
+	var prev, spare *bytes.Buffer
+	defer func() {
+		putBuffer(pool, prev)
+		putBuffer(pool, spare)
+	}()
+	for _, m := range bodyTransformers {
+		w := spare
+		if spare = nil; w == nil {
+			w = getBuffer(pool)
+		}
+		var dst io.Writer = w
+		if maxMemory != 0 {
+			// account for the input already buffered in memory
+			dst = &limitWriter{w: w, n: maxMemory - int64(max(n, 0))}
+		}
+		success, err := bodyTransform(m, dst, r, req, res, contentType)
+		if err != nil {
+			putBuffer(pool, w)
+			return nil, transformError(m, req, res, contentType, err)
+		}
+		if trace != nil {
+			trace(transformerName(m), n, w.Len(), !success)
+		}
+		if prev != nil {
+			prev.Reset()
+		}
+		r, n, prev, spare = bytes.NewReader(w.Bytes()), w.Len(), w, prev
 		if !success {
 			break
 		}
 	}
-	body := new(bytes.Buffer)
-	if _, err := io.Copy(body, r); err != nil {
+	// append the last output directly, avoiding an additional copy
+	if prev != nil {
+		return append(buf, prev.Bytes()...), nil
+	}
+	w := bytes.NewBuffer(buf)
+	if _, err := w.ReadFrom(r); err != nil {
 		return nil, err
 	}
-	if stripContentLength {
-		return append(stripContentLengthHeader(buf), body.Bytes()...), nil
+	return w.Bytes(), nil
+}
+
+// transformError wraps the error returned by the body transformer.
+func transformError(t BodyTransformer, req *http.Request, res *http.Response, contentType string, err error) error {
+	return &TransformError{
+		Name:        transformerName(t),
+		URL:         req.URL.String(),
+		Code:        res.StatusCode,
+		ContentType: contentType,
+		Err:         err,
+	}
+}
+
+// limitWriter wraps a writer, returning ErrTransformMemory when more than n
+// bytes are written.
+type limitWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write satisfies the io.Writer interface.
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if w.n < 0 || int64(len(p)) > w.n {
+		return 0, ErrTransformMemory
+	}
+	n, err := w.w.Write(p)
+	w.n -= int64(n)
+	return n, err
+}
+
+// bodyTransform applies the body transformer, preferring BodyTransformContext
+// when the body transformer is a ContextBodyTransformer.
+func bodyTransform(t BodyTransformer, w io.Writer, r io.Reader, req *http.Request, res *http.Response, contentType string) (bool, error) {
+	if z, ok := t.(ContextBodyTransformer); ok {
+		return z.BodyTransformContext(req.Context(), w, r, req, res)
+	}
+	return t.BodyTransform(w, r, req.URL.String(), res.StatusCode, contentType)
+}
+
+// transformerName returns the name of the body transformer.
+func transformerName(t BodyTransformer) string {
+	switch v := t.(type) {
+	case Named:
+		return v.Name()
+	case priorityBodyTransformer:
+		return fmt.Sprintf("%T", v.BodyTransformerFunc)
+	case priorityContextBodyTransformer:
+		return fmt.Sprintf("%T", v.ContextBodyTransformerFunc)
+	}
+	return fmt.Sprintf("%T", t)
+}
+
+// statusCode returns the status code from the status line in buf. Returns 0
+// when the status line cannot be parsed.
+func statusCode(buf []byte) int {
+	if i := bytes.Index(buf, crlf); i != -1 {
+		buf = buf[:i]
+	}
+	fields := bytes.Fields(buf)
+	if len(fields) < 2 {
+		return 0
+	}
+	code, _ := strconv.Atoi(string(fields[1]))
+	return code
+}
+
+// addHeader adds a header to the end of the header block in buf.
+func addHeader(buf []byte, name, value string) []byte {
+	i := bytes.Index(buf, crlfcrlf)
+	if i == -1 {
+		return buf
+	}
+	return append(append(append([]byte(nil), buf[:i+2]...), name+": "+value+"\r\n"...), buf[i+2:]...)
+}
+
+// headerBoundary returns the position and length of the header/body boundary
+// in buf, accepting either CRLF or LF line endings. Returns -1 when there is
+// no boundary.
+func headerBoundary(buf []byte) (int, int) {
+	i, j := bytes.Index(buf, crlfcrlf), bytes.Index(buf, lflf)
+	switch {
+	case j != -1 && (i == -1 || j < i):
+		return j, len(lflf)
+	case i != -1:
+		return i, len(crlfcrlf)
+	}
+	return -1, 0
+}
+
+// lfHeader converts the header block in buf to LF line endings.
+func lfHeader(buf []byte) []byte {
+	i := bytes.Index(buf, crlfcrlf)
+	if i == -1 {
+		return buf
+	}
+	header := bytes.ReplaceAll(buf[:i], crlf, lf)
+	return append(append(header, lflf...), buf[i+len(crlfcrlf):]...)
+}
+
+// crlfHeader converts the header block in buf to CRLF line endings.
+func crlfHeader(buf []byte) []byte {
+	i, n := headerBoundary(buf)
+	if i == -1 || n == len(crlfcrlf) {
+		return buf
+	}
+	header := bytes.ReplaceAll(buf[:i], lf, crlf)
+	return append(append(header, crlfcrlf...), buf[i+n:]...)
+}
+
+// isVerbatimContentType determines if the content type is a gRPC-Web or
+// Server-Sent Events content type, whose bodies are stored verbatim.
+func isVerbatimContentType(contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	return strings.HasPrefix(contentType, "application/grpc-web") || strings.HasPrefix(contentType, "text/event-stream")
+}
+
+// isEncoded determines if the header has a non-identity Content-Encoding.
+func isEncoded(header http.Header) bool {
+	for _, v := range header.Values("Content-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			if enc = strings.TrimSpace(enc); enc != "" && !strings.EqualFold(enc, "identity") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// preferredExts are the preferred extensions for common content types.
+var preferredExts = map[string]string{
+	"application/javascript": ".js",
+	"application/xml":        ".xml",
+	"image/jpeg":             ".jpg",
+	"image/svg+xml":          ".svg",
+	"text/html":              ".html",
+	"text/javascript":        ".js",
+	"text/plain":             ".txt",
+	"text/xml":               ".xml",
+}
+
+// extByContentType returns the file extension for the content type.
+func extByContentType(contentType string) string {
+	typ, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	if ext, ok := preferredExts[typ]; ok {
+		return ext
 	}
-	return append(buf, body.Bytes()...), nil
+	if exts, err := mime.ExtensionsByType(typ); err == nil && len(exts) != 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// isExt determines if s is a file extension.
+func isExt(s string) bool {
+	return len(s) > 1 && s[0] == '.' && !strings.ContainsAny(s[1:], "./")
+}
+
+// requestCacheControl returns whether or not the request cache control
+// directives in the header prevent storing (no-store) or force revalidation
+// (no-cache, max-age=0).
+func requestCacheControl(header http.Header) (bool, bool) {
+	var noStore, force bool
+	for _, v := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			switch name, value, _ := strings.Cut(strings.TrimSpace(directive), "="); strings.ToLower(name) {
+			case "no-store":
+				noStore = true
+			case "no-cache":
+				force = true
+			case "max-age":
+				force = force || strings.Trim(value, `"`) == "0"
+			}
+		}
+	}
+	if header.Get("Pragma") == "no-cache" && len(header.Values("Cache-Control")) == 0 {
+		force = true
+	}
+	return noStore, force
+}
+
+// safeMethod returns whether or not the request method is safe to cache with
+// the matched policy. GET, HEAD, and OPTIONS requests are safe, as are POST
+// requests keyed by their body.
+func safeMethod(method string, p Policy) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	case "POST":
+		return p.bodyKey
+	}
+	return false
+}
+
+// etagMatch returns whether or not the ETags match using the weak comparison
+// function of RFC 7232, section 2.3.2, where two ETags match when their opaque
+// tags are identical, regardless of either being weak (W/ prefixed).
+func etagMatch(a, b string) bool {
+	a = strings.TrimPrefix(strings.TrimSpace(a), "W/")
+	b = strings.TrimPrefix(strings.TrimSpace(b), "W/")
+	return a != "" && a == b
+}
+
+// sameHeader determines if the headers are the same, ignoring the Date and
+// Content-Length headers and any additional passed headers.
+func sameHeader(a, b http.Header, ignore ...string) bool {
+	a, b = a.Clone(), b.Clone()
+	for _, k := range append([]string{"Date", "Content-Length"}, ignore...) {
+		a.Del(k)
+		b.Del(k)
+	}
+	return maps.EqualFunc(a, b, slices.Equal[[]string])
+}
+
+// acceptsGzip returns whether or not the Accept-Encoding header accepts gzip.
+func acceptsGzip(header http.Header) bool {
+	for _, v := range header.Values("Accept-Encoding") {
+		for _, s := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(s), ";")
+			if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+				continue
+			}
+			if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+				if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL returns the URL without user info, query, or fragment, for
+// logging.
+func redactURL(u *url.URL) string {
+	z := url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}
+	return z.String()
 }
 
 // contains determines if haystack contains needle.
@@ -123,3 +419,23 @@ func containsInt(haystack []int, needle int) bool {
 	}
 	return false
 }
+
+// matchGlobs determines if any of the globs match s.
+func matchGlobs(globs []glob.Glob, s string) bool {
+	for _, g := range globs {
+		if g.Match(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold determines if haystack contains needle, ignoring case.
+func containsFold(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if strings.EqualFold(s, needle) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,7 +1,14 @@
 package diskcache
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,18 +23,37 @@ const (
 )
 
 // Validator is the shared interface for validating responses.
+//
+// Validators may return a RetryDelay error with Retry validity to delay the
+// retry. Fetched responses that are not valid are evicted from the cache.
 type Validator interface {
 	// Validate validates the response based on
 	Validate(*http.Request, *http.Response, time.Time, bool) (Validity, error)
 }
 
+// RetryDelay is the error returned by validators with Retry validity to
+// delay the retry by the duration.
+type RetryDelay time.Duration
+
+// Error satisfies the error interface.
+func (d RetryDelay) Error() string {
+	return "retry after " + time.Duration(d).String()
+}
+
 // ValidatorFunc is a response validator func.
 type ValidatorFunc func(*http.Request, *http.Response, time.Time, bool, int) (Validity, error)
 
 // SimpleValidator is a simple response validator.
+//
+// A SimpleValidator is safe for concurrent use. By default, the count passed
+// to the validator func is the total number of times the validator has been
+// called without error, across all requests, and concurrent calls may be
+// passed the same count. Use NewRequestValidator to create a validator where
+// the count is instead the number of attempts for the current request.
 type SimpleValidator struct {
-	count     int
-	validator ValidatorFunc
+	count      atomic.Int64
+	perRequest bool
+	validator  ValidatorFunc
 }
 
 // NewSimpleValidator creates a simple validator.
@@ -38,12 +64,103 @@ func NewSimpleValidator(validator ValidatorFunc) *SimpleValidator {
 	return v
 }
 
-// Validate satisfies the Validator interface.
+// NewRequestValidator creates a simple validator that passes the number of
+// prior attempts for the current request as the count to the validator func.
+func NewRequestValidator(validator ValidatorFunc) *SimpleValidator {
+	v := &SimpleValidator{
+		perRequest: true,
+		validator:  validator,
+	}
+	return v
+}
+
+// Validate satisfies the Validator interface. The count is only incremented
+// when the validator func does not return an error (other than a RetryDelay).
 func (v *SimpleValidator) Validate(req *http.Request, res *http.Response, mod time.Time, stale bool) (Validity, error) {
-	validity, err := v.validator(req, res, mod, stale, v.count)
-	if err != nil {
+	validity, err := v.validate(req, res, mod, stale, int(v.count.Load()))
+	var delay RetryDelay
+	if err == nil || errors.As(err, &delay) {
+		v.count.Add(1)
+	}
+	return validity, err
+}
+
+// Reset resets the validator's count.
+func (v *SimpleValidator) Reset() {
+	v.count.Store(0)
+}
+
+// validate validates the response using the count.
+func (v *SimpleValidator) validate(req *http.Request, res *http.Response, mod time.Time, stale bool, count int) (Validity, error) {
+	validity, err := v.validator(req, res, mod, stale, count)
+	var delay RetryDelay
+	switch {
+	case validity == Retry && errors.As(err, &delay):
+		return Retry, delay
+	case err != nil:
 		return Error, err
 	}
-	v.count++
 	return validity, nil
 }
+
+// validate validates the response using the validator, passing the request
+// attempt count to per-request simple validators.
+func validate(validator Validator, req *http.Request, res *http.Response, mod time.Time, stale bool, count int) (Validity, error) {
+	if v, ok := validator.(*SimpleValidator); ok && v.perRequest {
+		return v.validate(req, res, mod, stale, count)
+	}
+	return validator.Validate(req, res, mod, stale)
+}
+
+// minContentLengthRetries is the number of times a response shorter than the
+// minimum content length is refetched.
+const minContentLengthRetries = 3
+
+// shortBody determines if the response body is shorter than n bytes, using
+// the response's Content-Length when known, otherwise buffering up to n bytes
+// of the body, which remains readable.
+func shortBody(res *http.Response, n int64) (bool, error) {
+	if res.ContentLength >= 0 {
+		return res.ContentLength < n, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(res.Body, n))
+	res.Body = &fileBody{ReadCloser: io.NopCloser(io.MultiReader(bytes.NewReader(buf), res.Body)), f: res.Body}
+	return int64(len(buf)) < n, err
+}
+
+// defaultRetryAfter is the retry delay for 429 responses without a valid
+// Retry-After header.
+const defaultRetryAfter = 1 * time.Second
+
+// parseRetryAfter parses the Retry-After header value, either a number of
+// seconds, or a HTTP-date, returning the delay from now.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if n < 0 {
+			return 0, false
+		}
+		return time.Duration(n) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return max(0, t.Sub(now)), true
+}
+
+// wait waits for the duration, returning the context's error when the context
+// is done first.
+func wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,74 @@
+package diskcache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// varyDir is the directory for vary sidecar files.
+const varyDir = "?vary"
+
+// varyName returns the fs name of the vary sidecar file for the fs name.
+func (c *Cache) varyName(name string) string {
+	root := c.root()
+	return path.Join(root, varyDir, strings.TrimPrefix(name, root))
+}
+
+// varyValues returns the serialized values of the request headers.
+func varyValues(req *http.Request, headers []string) []byte {
+	h := make(http.Header, len(headers))
+	for _, k := range headers {
+		if v := req.Header.Values(k); len(v) != 0 {
+			h[k] = v
+		}
+	}
+	buf := new(bytes.Buffer)
+	_ = h.Write(buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// varyHash returns the hex encoded hash of the values of the request headers.
+func varyHash(h Hasher, req *http.Request, headers []string) string {
+	return h.Sum(varyValues(req, headers))
+}
+
+// writeVary writes the vary sidecar file for the fs name.
+func (c *Cache) writeVary(name string, req *http.Request, headers []string, mode os.FileMode) error {
+	sidecar := c.varyName(name)
+	if err := c.fs.MkdirAll(path.Dir(sidecar), c.dirMode); err != nil {
+		return err
+	}
+	return afero.WriteFile(c.fs, sidecar, varyValues(req, headers), mode)
+}
+
+// VaryValues returns the values of the varying request headers recorded for
+// the key by a matcher using WithNormalizedVaryKey. Returns fs.ErrNotExist
+// when there are no recorded values for the key.
+func (c *Cache) VaryValues(key string) (http.Header, error) {
+	if !c.life.acquire() {
+		return nil, ErrClosed
+	}
+	defer c.life.release()
+	name, err := c.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := afero.ReadFile(c.fs, c.varyName(name))
+	if err != nil {
+		return nil, err
+	}
+	h, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(buf))).ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrCorruptEntry, c.varyName(name), err)
+	}
+	return http.Header(h), nil
+}
@@ -0,0 +1,123 @@
+package diskcache
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/spf13/afero"
+)
+
+// VerifyReport is the result of verifying the entries in the cache fs.
+type VerifyReport struct {
+	// Count is the number of verified entries.
+	Count int
+	// Bad are the keys of entries that could not be loaded.
+	Bad []string
+	// Removed is the number of removed entries.
+	Removed int
+}
+
+// Verify verifies that every entry in the cache fs can be loaded, returning a
+// report of entries that could not be unmarshaled or parsed. When repair is
+// true, entries that could not be loaded are removed.
+//
+// As an entry's policy cannot be determined without a request, an entry is
+// considered valid when it can be loaded using the policy of any of the
+// cache's simple matchers, or the default policy.
+func (c *Cache) Verify(repair bool) (VerifyReport, error) {
+	if !c.life.acquire() {
+		return VerifyReport{}, ErrClosed
+	}
+	defer c.life.release()
+	names, err := c.entryNames()
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	policies := c.policies()
+	valid := make([]bool, len(names))
+	_ = c.each(names, func(i int, name string) error {
+		valid[i] = c.verify(name, policies)
+		return nil
+	})
+	var report VerifyReport
+	for i, name := range names {
+		report.Count++
+		if valid[i] {
+			continue
+		}
+		report.Bad = append(report.Bad, c.key(name))
+		if repair {
+			if err := c.remove(name); err != nil {
+				return report, err
+			}
+			report.Removed++
+		}
+	}
+	return report, nil
+}
+
+// policies returns the default policy and the policies of the cache's simple
+// matchers.
+func (c *Cache) policies() []Policy {
+	policies := []Policy{c.matcher.policy}
+	for _, m := range c.matchers {
+		if sm, ok := m.(*SimpleMatcher); ok {
+			policies = append(policies, sm.policy)
+		}
+	}
+	return policies
+}
+
+// verify returns true when the fs name can be loaded using any of the
+// policies.
+func (c *Cache) verify(name string, policies []Policy) bool {
+	_, err := c.entryBody(name, policies)
+	return err == nil
+}
+
+// entryBody returns the response body of the stored entry for the fs name,
+// loaded using the first of the policies that can load the entry.
+func (c *Cache) entryBody(name string, policies []Policy) ([]byte, error) {
+	buf, err := afero.ReadFile(c.fs, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range policies {
+		var body []byte
+		if body, err = c.loadEntry(buf, p); err == nil {
+			return body, nil
+		}
+	}
+	return nil, err
+}
+
+// loadEntry unmarshals and parses the stored entry in buf using the policy,
+// returning the response body.
+func (c *Cache) loadEntry(buf []byte, p Policy) ([]byte, error) {
+	if p.MarshalUnmarshaler != nil {
+		w := new(bytes.Buffer)
+		if err := p.MarshalUnmarshaler.Unmarshal(w, bytes.NewReader(buf)); err != nil {
+			return nil, err
+		}
+		buf = w.Bytes()
+	}
+	br := bufio.NewReader(bytes.NewReader(buf))
+	if _, err := readStoredRequest(br); err != nil {
+		return nil, err
+	}
+	if c.lfHeaders {
+		b, err := io.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(bytes.NewReader(crlfHeader(b)))
+	}
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return io.ReadAll(res.Body)
+}
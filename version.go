@@ -0,0 +1,151 @@
+package diskcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// versionDir is the directory for historical version sidecar files.
+const versionDir = "?version"
+
+// versionLayout is the time layout of historical version file names, which
+// sort chronologically.
+const versionLayout = "20060102T150405.000000000Z"
+
+// versionName returns the fs name of the historical version sidecar
+// directory for the fs name.
+func (c *Cache) versionName(name string) string {
+	root := c.root()
+	return path.Join(root, versionDir, strings.TrimPrefix(name, root))
+}
+
+// writeVersion copies the stored entry for the fs name to the historical
+// version sidecar directory, when versioning, removing versions beyond the
+// max versions. Entries unchanged from the latest version are not copied.
+func (c *Cache) writeVersion(name string, mode os.FileMode) error {
+	if c.versions == 0 {
+		return nil
+	}
+	buf, err := afero.ReadFile(c.fs, name)
+	if err != nil {
+		return err
+	}
+	dir := c.versionName(name)
+	names, err := c.versionNames(dir)
+	if err != nil {
+		return err
+	}
+	if len(names) != 0 {
+		if prev, err := afero.ReadFile(c.fs, path.Join(dir, names[len(names)-1])); err == nil && bytes.Equal(prev, buf) {
+			return nil
+		}
+	}
+	if err := c.fs.MkdirAll(dir, c.dirMode); err != nil {
+		return err
+	}
+	if err := afero.WriteFile(c.fs, path.Join(dir, time.Now().UTC().Format(versionLayout)), buf, mode); err != nil {
+		return err
+	}
+	for i := 0; i < len(names)+1-c.versions; i++ {
+		if err := c.fs.Remove(path.Join(dir, names[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// versionNames returns the sorted historical version file names in the
+// directory.
+func (c *Cache) versionNames(dir string) ([]string, error) {
+	entries, err := afero.ReadDir(c.fs, dir)
+	switch {
+	case err != nil && errors.Is(err, fs.ErrNotExist):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	var names []string
+	for _, fi := range entries {
+		if _, err := time.Parse(versionLayout, fi.Name()); err == nil && fi.Mode().IsRegular() {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+// Versions returns the times of the stored historical versions for the key,
+// oldest first, when versioning with WithVersioning.
+func (c *Cache) Versions(key string) ([]time.Time, error) {
+	if !c.life.acquire() {
+		return nil, ErrClosed
+	}
+	defer c.life.release()
+	name, err := c.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	names, err := c.versionNames(c.versionName(name))
+	if err != nil {
+		return nil, err
+	}
+	var v []time.Time
+	for _, s := range names {
+		t, _ := time.Parse(versionLayout, s)
+		v = append(v, t)
+	}
+	return v, nil
+}
+
+// LoadVersion loads the historical version of the entry for the key that was
+// stored at, or most recently before, the time, when versioning with
+// WithVersioning. Returns fs.ErrNotExist when there is no such version.
+//
+// As the matched policy for a key is not known, versions are unmarshaled
+// using the default policy's MarshalUnmarshaler.
+func (c *Cache) LoadVersion(key string, at time.Time) (*http.Response, error) {
+	if !c.life.acquire() {
+		return nil, ErrClosed
+	}
+	defer c.life.release()
+	name, err := c.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	dir := c.versionName(name)
+	names, err := c.versionNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	var version string
+	for _, s := range names {
+		if t, _ := time.Parse(versionLayout, s); t.After(at) {
+			break
+		}
+		version = s
+	}
+	if version == "" {
+		return nil, &fs.PathError{Op: "open", Path: key, Err: fs.ErrNotExist}
+	}
+	r, err := c.read(path.Join(dir, version), c.matcher.policy)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.ReadResponse(bufio.NewReader(r), nil)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("%w: %s: %w", ErrCorruptEntry, path.Join(dir, version), err)
+	}
+	res.Body = &fileBody{ReadCloser: res.Body, f: r}
+	res.Header.Del(methodHeader)
+	return res, nil
+}
@@ -0,0 +1,74 @@
+package diskcache
+
+import (
+	"errors"
+	"io/fs"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// entryNames returns the fs names of all stored entries, skipping sidecar
+// files.
+func (c *Cache) entryNames() ([]string, error) {
+	root := c.root()
+	var names []string
+	err := afero.Walk(c.fs, root, func(name string, fi fs.FileInfo, err error) error {
+		switch {
+		case err != nil && name == root && errors.Is(err, fs.ErrNotExist):
+			return nil
+		case err != nil:
+			return err
+		case fi.IsDir() && c.sidecarDir(name):
+			return fs.SkipDir
+		case fi.Mode().IsRegular():
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// each calls f for each of the fs names, processing at most the walk
+// concurrency names in parallel. Returns the first error returned by f, after
+// which no more names are processed.
+func (c *Cache) each(names []string, f func(i int, name string) error) error {
+	if c.walkConcurrency <= 1 {
+		for i, name := range names {
+			if err := f(i, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var first error
+	sem := make(chan struct{}, c.walkConcurrency)
+	for i, name := range names {
+		sem <- struct{}{}
+		mu.Lock()
+		err := first
+		mu.Unlock()
+		if err != nil {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := f(i, name); err != nil {
+				mu.Lock()
+				if first == nil {
+					first = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return first
+}